@@ -0,0 +1,66 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jafarsirojov/APM-core/pkg/core"
+)
+
+func TestRun(t *testing.T) {
+	file, err := ioutil.TempFile("", "reconcile-*.db")
+	if err != nil {
+		t.Fatalf("can't create db file: %v", err)
+	}
+	_ = file.Close()
+	defer os.Remove(file.Name())
+
+	db, err := sql.Open("sqlite3", file.Name())
+	if err != nil {
+		t.Fatalf("can't open db: %v", err)
+	}
+	defer db.Close()
+	err = core.Init(db)
+	if err != nil {
+		t.Fatalf("can't init db: %v", err)
+	}
+	err = core.AddUser("Vasya", "vasya", "secret", "A132323", 9001, db)
+	if err != nil {
+		t.Fatalf("can't add user: %v", err)
+	}
+	err = core.SetCardSecretKey([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("can't set card secret key: %v", err)
+	}
+	err = core.AddCard("AlifMobi", 200, 1, db)
+	if err != nil {
+		t.Fatalf("can't add card: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-driver", "sqlite3", "-dsn", file.Name()}, &stdout, &stderr)
+	if code != 0 || stdout.String() != "balances agree with the operations log\n" {
+		t.Errorf("run not match: %d, %q, %q", code, stdout.String(), stderr.String())
+	}
+
+	_, err = db.Exec(`UPDATE cards SET balance = 250 WHERE id = 1`)
+	if err != nil {
+		t.Fatalf("can't change card balance: %v", err)
+	}
+	stdout.Reset()
+	code = run([]string{"-driver", "sqlite3", "-dsn", file.Name()}, &stdout, &stderr)
+	if code != 1 || stdout.String() != "card 1: balance 250, logged 200\n" {
+		t.Errorf("run not match: %d, %q, %q", code, stdout.String(), stderr.String())
+	}
+
+	code = run([]string{"-driver", "unknown"}, &stdout, &stderr)
+	if code != 2 {
+		t.Errorf("run with unknown driver not match: %d", code)
+	}
+}
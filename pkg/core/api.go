@@ -1,25 +1,25 @@
 package core
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"io/ioutil"
-	"log"
-	"strconv"
 	"time"
 )
 
 var ErrInvalidPass = errors.New("invalid password")
-
-var onlineUserID int
-
-var idCardForTransferRecipient int64
-
-const tempNumberCard = 20216000000000000
+var ErrUserBlocked = errors.New("user blocked by manager")
+var ErrInvalidAmount = errors.New("invalid amount")
+var ErrInsufficientFunds = errors.New("insufficient funds")
+var ErrCardNotFound = errors.New("card not found")
+var ErrRecipientNotFound = errors.New("recipient not found")
+var ErrRecipientHasNoCard = errors.New("recipient has no card")
+var ErrSameCard = errors.New("sender and recipient card are the same")
+var ErrServiceNotFound = errors.New("service not found")
 
 type QueryError struct {
 	Query string
@@ -35,31 +35,47 @@ type DbTxError struct {
 	RollbackErr error
 }
 
+type Session struct {
+	UserId int64
+	Login  string
+}
+
 type Atm struct {
-	Id      int64
-	Name    string
-	Address string
+	Id        int64
+	Name      string
+	Address   string
+	Latitude  float64
+	Longitude float64
+	Status    AtmStatus
 }
 
 type Service struct {
-	Id      int64
-	Name    string
-	Balance int64
+	Id          int64
+	Name        string
+	Balance     int64
+	Category    ServiceCategory
+	Description string
+	Active      bool
+	MinAmount   int64
+	MaxAmount   int64
 }
 
 type Card struct {
 	Id         int64
 	Name       string
 	Balance    int64
-	User_id    int64
-	NumberCard int
+	User_id     int64
+	NumberCard  string
+	Status      CardStatus
+	ExpiryMonth int
+	ExpiryYear  int
 }
 
 type User struct {
 	Id             int64
 	Name           string
 	Login string
-	Password string
+	Password string `json:"-" xml:"-"`
 	PassportSeries string
 	NumberPhone    int
 	HideShow       int
@@ -81,11 +97,14 @@ type UserShow struct {
 
 type OperationsLogging struct {
 	Id              int64
-	Name            string
-	Time            string
+	Name            OperationType
+	Time            time.Time
 	RecipientSender string
 	Balance         int
 	User_id         int
+	Atm_id          int64
+	Card_id         int64
+	Reference       string
 }
 
 func (receiver *QueryError) Unwrap() error {
@@ -93,7 +112,7 @@ func (receiver *QueryError) Unwrap() error {
 }
 
 func (receiver *QueryError) Error() string {
-	return fmt.Sprintf("can't execute query %s: %s", loginManagerSQL, receiver.Err.Error())
+	return fmt.Sprintf("can't execute query %s: %s", receiver.Query, receiver.Err.Error())
 }
 
 func queryError(query string, err error) *QueryError {
@@ -112,30 +131,33 @@ func dbError(err error) *DbError {
 	return &DbError{Err: err}
 }
 
-func Init(db *sql.DB) (err error) {
-	ddls := []string{managerDDL, usersDDL, cardsDDL, atmDDL, servicesDDL, sumTransferUsersDDL, operationsLoggingDDL}
-	for _, ddl := range ddls {
-		_, err = db.Exec(ddl)
-		if err != nil {
-			return err
-		}
-	}
+func (receiver *DbTxError) Error() string {
+	return fmt.Sprintf("can't handle tx operation: %v, rollback: %v", receiver.Err, receiver.RollbackErr)
+}
 
-	initialData := []string{managerInitialData, sumTransferUsersDDLInitialData}
-	for _, datum := range initialData {
-		_, err = db.Exec(datum)
-		if err != nil {
-			return err
-		}
-	}
+func (receiver *DbTxError) Unwrap() error {
+	return receiver.Err
+}
 
-	return nil
+func dbTxError(err error, rollbackErr error) *DbTxError {
+	return &DbTxError{Err: err, RollbackErr: rollbackErr}
 }
 
-func LoginManager(login, password string, db *sql.DB) (bool, error) {
+// InitContext brings the schema up to the latest migration, see MigrateContext. Databases
+// created before migrations existed are adopted: the initial migration only
+// creates what is missing.
+func InitContext(ctx context.Context, db *sql.DB) (err error) {
+	return MigrateContext(ctx, db, LatestMigrationVersion())
+}
+
+func Init(db *sql.DB) (err error) {
+	return InitContext(context.Background(), db)
+}
+
+func LoginManagerContext(ctx context.Context, login, password string, db *sql.DB) (bool, error) {
 	var dbLogin, dbPassword string
 
-	err := db.QueryRow(
+	err := db.QueryRowContext(ctx,
 		loginManagerSQL,
 		login).Scan(&dbLogin, &dbPassword)
 
@@ -146,41 +168,70 @@ func LoginManager(login, password string, db *sql.DB) (bool, error) {
 
 		return false, queryError(loginManagerSQL, err)
 	}
+	if dbPassword == "" {
+		return false, ErrManagerPasswordNotSet
+	}
 
-	if dbPassword != password {
+	ok, rehash := checkPassword(dbPassword, password)
+	if !ok {
 		return false, ErrInvalidPass
 	}
+	if rehash {
+		err = SetManagerPasswordContext(ctx, dbLogin, password, db)
+		if err != nil {
+			return false, err
+		}
+	}
 
 	return true, nil
 }
 
-func LoginUsers(login, password string, db *sql.DB) (bool, error) {
+func LoginManager(login, password string, db *sql.DB) (bool, error) {
+	return LoginManagerContext(context.Background(), login, password, db)
+}
+
+func LoginUsersContext(ctx context.Context, login, password string, db *sql.DB) (Session, bool, error) {
+	var dbUserId int64
 	var dbLogin, dbPassword string
 	var dbHideShow int
 
-	err := db.QueryRow(
+	err := db.QueryRowContext(ctx,
 		loginUsersSQL,
-		login).Scan(&onlineUserID, &dbLogin, &dbPassword, &dbHideShow)
+		login).Scan(&dbUserId, &dbLogin, &dbPassword, &dbHideShow)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, nil
+			return Session{}, false, nil
 		}
-		return false, queryError(loginUsersSQL, err)
+		return Session{}, false, queryError(loginUsersSQL, err)
+	}
+
+	ok, rehash := checkPassword(dbPassword, password)
+	if !ok {
+		return Session{}, false, ErrInvalidPass
 	}
 	if dbHideShow == 4 {
-		fmt.Println("У вас нет доступа!!!\n Вы заблокированы менеджером!!! ")
-		return false, nil
+		return Session{}, false, ErrUserBlocked
 	}
-
-	if dbPassword != password {
-		return false, ErrInvalidPass
+	if rehash {
+		err = SetUserPasswordContext(ctx, dbUserId, password, db)
+		if err != nil {
+			return Session{}, false, err
+		}
 	}
 
-	return true, nil
+	return Session{UserId: dbUserId, Login: dbLogin}, true, nil
+}
+
+func LoginUsers(login, password string, db *sql.DB) (Session, bool, error) {
+	return LoginUsersContext(context.Background(), login, password, db)
 }
 
-func AddAtm(atmName string, atmAddress string, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func AddAtmContext(ctx context.Context, atmName string, atmAddress string, latitude, longitude float64, db *sql.DB) (err error) {
+	if !validCoordinates(latitude, longitude) {
+		return ErrInvalidCoordinates
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -192,11 +243,13 @@ func AddAtm(atmName string, atmAddress string, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		insertAtmSQL,
 
-		sql.Named("name", atmName),
-		sql.Named("address", atmAddress),
+		atmName,
+		atmAddress,
+		latitude,
+		longitude,
 	)
 	if err != nil {
 		return err
@@ -205,8 +258,12 @@ func AddAtm(atmName string, atmAddress string, db *sql.DB) (err error) {
 	return nil
 }
 
-func GetAllAtms(db *sql.DB) (atms []Atm, err error) {
-	rows, err := db.Query(getAllAtmsSQL)
+func AddAtm(atmName string, atmAddress string, latitude, longitude float64, db *sql.DB) (err error) {
+	return AddAtmContext(context.Background(), atmName, atmAddress, latitude, longitude, db)
+}
+
+func GetAllAtmsContext(ctx context.Context, db *sql.DB) (atms []Atm, err error) {
+	rows, err := db.QueryContext(ctx, getAllAtmsSQL)
 	if err != nil {
 		return nil, queryError(getAllAtmsSQL, err)
 	}
@@ -218,7 +275,7 @@ func GetAllAtms(db *sql.DB) (atms []Atm, err error) {
 
 	for rows.Next() {
 		atm := Atm{}
-		err = rows.Scan(&atm.Id, &atm.Name, &atm.Address)
+		err = rows.Scan(&atm.Id, &atm.Name, &atm.Address, &atm.Latitude, &atm.Longitude, &atm.Status)
 		if err != nil {
 			return nil, dbError(err)
 		}
@@ -231,8 +288,12 @@ func GetAllAtms(db *sql.DB) (atms []Atm, err error) {
 	return atms, nil
 }
 
-func AddService(serviceName string, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func GetAllAtms(db *sql.DB) (atms []Atm, err error) {
+	return GetAllAtmsContext(context.Background(), db)
+}
+
+func AddServiceContext(ctx context.Context, serviceName string, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -244,11 +305,11 @@ func AddService(serviceName string, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		insertServiceSQL,
 
-		sql.Named("name", serviceName),
-		sql.Named("balance", 0),
+		serviceName,
+		0,
 	)
 	if err != nil {
 		return err
@@ -257,8 +318,14 @@ func AddService(serviceName string, db *sql.DB) (err error) {
 	return nil
 }
 
-func GetAllServices(db *sql.DB) (services []Service, err error) {
-	rows, err := db.Query(getAllServicesSQL)
+func AddService(serviceName string, db *sql.DB) (err error) {
+	return AddServiceContext(context.Background(), serviceName, db)
+}
+
+// GetAllServicesContext returns the services of the catalog that pass the
+// filter.
+func GetAllServicesContext(ctx context.Context, filter ServiceFilter, db *sql.DB) (services []Service, err error) {
+	rows, err := db.QueryContext(ctx, getAllServicesSQL, filter.Category, filter.ActiveOnly)
 	if err != nil {
 		return nil, queryError(getAllServicesSQL, err)
 	}
@@ -270,7 +337,7 @@ func GetAllServices(db *sql.DB) (services []Service, err error) {
 
 	for rows.Next() {
 		service := Service{}
-		err = rows.Scan(&service.Id, &service.Name, &service.Balance)
+		err = rows.Scan(&service.Id, &service.Name, &service.Balance, &service.Category, &service.Description, &service.Active, &service.MinAmount, &service.MaxAmount)
 		if err != nil {
 			return nil, dbError(err)
 		}
@@ -283,42 +350,21 @@ func GetAllServices(db *sql.DB) (services []Service, err error) {
 	return services, nil
 }
 
-func AddCard(cardName string, cardBalance int64, cardUser_id int64, db *sql.DB) (err error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
-	var cardNumberCard string
-	selectDescIdFromCard := 0
-	var numberCard int
-	_ = tx.QueryRow(selectDescIdFromCardSQL).Scan(&selectDescIdFromCard)
-	numberCard = tempNumberCard + selectDescIdFromCard + 1
-	cardNumberCard = strconv.Itoa(numberCard)
-
-	_, err = tx.Exec(
-		insertCardSQL,
-
-		sql.Named("name", cardName),
-		sql.Named("balance", cardBalance),
-		sql.Named("user_id", cardUser_id),
-		sql.Named("numberCard", cardNumberCard),
-	)
-	if err != nil {
-		return err
-	}
+func GetAllServices(filter ServiceFilter, db *sql.DB) (services []Service, err error) {
+	return GetAllServicesContext(context.Background(), filter, db)
+}
 
-	return nil
+func AddCardContext(ctx context.Context, cardName string, cardBalance int64, cardUser_id int64, db *sql.DB) (err error) {
+	_, err = IssueCardContext(ctx, cardName, cardBalance, cardUser_id, db)
+	return err
 }
 
-func GetAllCards(db *sql.DB) (cards []Card, err error) {
-	rows, err := db.Query(getAllCardsSQL)
+func AddCard(cardName string, cardBalance int64, cardUser_id int64, db *sql.DB) (err error) {
+	return AddCardContext(context.Background(), cardName, cardBalance, cardUser_id, db)
+}
+
+func GetAllCardsContext(ctx context.Context, db *sql.DB) (cards []Card, err error) {
+	rows, err := db.QueryContext(ctx, getAllCardsSQL)
 	if err != nil {
 		return nil, queryError(getAllCardsSQL, err)
 	}
@@ -330,7 +376,7 @@ func GetAllCards(db *sql.DB) (cards []Card, err error) {
 
 	for rows.Next() {
 		card := Card{}
-		err = rows.Scan(&card.Id, &card.Name, &card.Balance, &card.User_id, &card.NumberCard)
+		err = rows.Scan(&card.Id, &card.Name, &card.Balance, &card.User_id, &card.NumberCard, &card.Status, &card.ExpiryMonth, &card.ExpiryYear)
 		if err != nil {
 			return nil, dbError(err)
 		}
@@ -343,8 +389,12 @@ func GetAllCards(db *sql.DB) (cards []Card, err error) {
 	return cards, nil
 }
 
-func AddUser(userName string, userLogin string, userPassword string, userPassportSeries string, userPhoneNumber int, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func GetAllCards(db *sql.DB) (cards []Card, err error) {
+	return GetAllCardsContext(context.Background(), db)
+}
+
+func AddUserContext(ctx context.Context, userName string, userLogin string, userPassword string, userPassportSeries string, userPhoneNumber int, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -357,16 +407,20 @@ func AddUser(userName string, userLogin string, userPassword string, userPasspor
 	}()
 
 	userHideShow := 3
+	passwordHash, err := hashPassword(userPassword)
+	if err != nil {
+		return err
+	}
 
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		insertUserSQL,
 
-		sql.Named("name", userName),
-		sql.Named("login", userLogin),
-		sql.Named("password", userPassword),
-		sql.Named("passportSeries", userPassportSeries),
-		sql.Named("phoneNumber", userPhoneNumber),
-		sql.Named("hideShow", userHideShow),
+		userName,
+		userLogin,
+		passwordHash,
+		userPassportSeries,
+		userPhoneNumber,
+		userHideShow,
 	)
 	if err != nil {
 		return err
@@ -375,8 +429,12 @@ func AddUser(userName string, userLogin string, userPassword string, userPasspor
 	return nil
 }
 
-func GetAllUsers(db *sql.DB) (users []User, err error) {
-	rows, err := db.Query(getAllUsersSQL)
+func AddUser(userName string, userLogin string, userPassword string, userPassportSeries string, userPhoneNumber int, db *sql.DB) (err error) {
+	return AddUserContext(context.Background(), userName, userLogin, userPassword, userPassportSeries, userPhoneNumber, db)
+}
+
+func GetAllUsersContext(ctx context.Context, db *sql.DB) (users []User, err error) {
+	rows, err := db.QueryContext(ctx, getAllUsersSQL)
 	if err != nil {
 		return nil, queryError(getAllUsersSQL, err)
 	}
@@ -401,8 +459,12 @@ func GetAllUsers(db *sql.DB) (users []User, err error) {
 	return users, nil
 }
 
-func GetUserCards(db *sql.DB) (cards []Card, err error) {
-	rows, err := db.Query(getUserCardsSQL, onlineUserID)
+func GetAllUsers(db *sql.DB) (users []User, err error) {
+	return GetAllUsersContext(context.Background(), db)
+}
+
+func (receiver Session) GetUserCardsContext(ctx context.Context, db *sql.DB) (cards []Card, err error) {
+	rows, err := db.QueryContext(ctx, getUserCardsSQL, receiver.UserId)
 	if err != nil {
 		return nil, queryError(getUserCardsSQL, err)
 	}
@@ -414,7 +476,7 @@ func GetUserCards(db *sql.DB) (cards []Card, err error) {
 
 	for rows.Next() {
 		card := Card{}
-		err = rows.Scan(&card.Id, &card.Name, &card.Balance, &card.NumberCard)
+		err = rows.Scan(&card.Id, &card.Name, &card.Balance, &card.NumberCard, &card.Status, &card.ExpiryMonth, &card.ExpiryYear)
 		if err != nil {
 			return nil, dbError(err)
 		}
@@ -426,38 +488,35 @@ func GetUserCards(db *sql.DB) (cards []Card, err error) {
 	return cards, err
 }
 
-func TransferMoneyForPhoneNumber(phoneNumber int, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func (receiver Session) GetUserCards(db *sql.DB) (cards []Card, err error) {
+	return receiver.GetUserCardsContext(context.Background(), db)
+}
+
+// SetDefaultCardContext makes the active card idCard the card transfers and payments use
+// when no card is given, and the card money sent by phone or login goes to.
+func (receiver Session) SetDefaultCardContext(ctx context.Context, idCard int64, db *sql.DB) error {
+	result, err := db.ExecContext(ctx, updateDefaultCardUserSQL, idCard, receiver.UserId)
 	if err != nil {
-		return err
+		return queryError(updateDefaultCardUserSQL, err)
 	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		err = tx.Commit()
-	}()
-	var userIdRecipient int
-	err = tx.QueryRow(selectIdUserPhoneNumberSQL, phoneNumber).Scan(&userIdRecipient)
+	affected, err := result.RowsAffected()
 	if err != nil {
-		fmt.Println("Клиент с такой номера не зарегистрирован!!!")
-		return err
+		return dbError(err)
 	}
-
-	err = tx.QueryRow(selectIdCardForTransferPhoneNumberSQL, userIdRecipient).Scan(&idCardForTransferRecipient)
-	if err != nil {
-		fmt.Println("У клиент нет счёта!!!")
-		return err
+	if affected == 0 {
+		return ErrCardNotFound
 	}
-
 	return nil
 }
 
-func TransferMoneyCardNumber(countNumber string, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func (receiver Session) SetDefaultCard(idCard int64, db *sql.DB) error {
+	return receiver.SetDefaultCardContext(context.Background(), idCard, db)
+}
+
+func (receiver Session) DefaultCardContext(ctx context.Context, db *sql.DB) (idCard int64, err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, dbError(err)
 	}
 	defer func() {
 		if err != nil {
@@ -467,18 +526,17 @@ func TransferMoneyCardNumber(countNumber string, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
-	err = tx.QueryRow(selectIdCardForTransferCountNumberSQL, countNumber).Scan(&idCardForTransferRecipient)
-	if err != nil {
-		fmt.Println("Введен неверный номер счёта!!!")
-		return err
-	}
-	return err
+	return defaultCardId(ctx, tx, receiver.UserId)
 }
 
-func TransferMoney(currency int, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func (receiver Session) DefaultCard(db *sql.DB) (idCard int64, err error) {
+	return receiver.DefaultCardContext(context.Background(), db)
+}
+
+func TransferMoneyForPhoneNumberContext(ctx context.Context, phoneNumber int, db *sql.DB) (idCardRecipient int64, err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer func() {
 		if err != nil {
@@ -487,122 +545,121 @@ func TransferMoney(currency int, db *sql.DB) (err error) {
 		}
 		err = tx.Commit()
 	}()
-
-	var currencySenderLast int
-	err = tx.QueryRow(selectBalanceToCardSenderSQL, onlineUserID).Scan(&currencySenderLast)
+	var userIdRecipient int
+	err = tx.QueryRowContext(ctx, selectIdUserPhoneNumberSQL, phoneNumber).Scan(&userIdRecipient)
 	if err != nil {
-		return err
-	}
-	if currencySenderLast < currency {
-		fmt.Println("У вас нет таких денег в счету!!!")
-		return nil
+		if err == sql.ErrNoRows {
+			return 0, ErrRecipientNotFound
+		}
+		return 0, queryError(selectIdUserPhoneNumberSQL, err)
 	}
 
-	var currencySenderFirst int
-	currencySenderFirst = currencySenderLast - currency
-
-	_, err = tx.Exec(
-		updateBalanceToCardSenderSQL, currencySenderFirst, onlineUserID,
-	)
+	idCardRecipient, err = defaultCardId(ctx, tx, int64(userIdRecipient))
+	if err == ErrCardNotFound {
+		return 0, ErrRecipientHasNoCard
+	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	var currencyRecipientLast int
-	err = tx.QueryRow(selectBalanceToCardRecipientSQL, idCardForTransferRecipient).Scan(&currencyRecipientLast)
-	var currencyRecipientFirst int
-	currencyRecipientFirst = currencyRecipientLast + currency
+	return idCardRecipient, nil
+}
 
-	_, err = tx.Exec(
-		updateBalanceToCardRecipientSQL, currencyRecipientFirst, idCardForTransferRecipient,
-	)
-	if err != nil {
-		return err
-	}
-	var sumTransferUsers int
-	err = tx.QueryRow(selectBalanceSumTransferUsers).Scan(&sumTransferUsers)
-	if err != nil {
-		return err
-	}
+func TransferMoneyForPhoneNumber(phoneNumber int, db *sql.DB) (idCardRecipient int64, err error) {
+	return TransferMoneyForPhoneNumberContext(context.Background(), phoneNumber, db)
+}
 
-	var numberCard string
-	err = tx.QueryRow(selectNumberCardToIdCardSQL, idCardForTransferRecipient).Scan(&numberCard)
-	if err != nil {
-		log.Fatalf("can't operationLogging, select number card for id card: %s", err)
-	}
-	t := time.Now().String()
-	_, err = tx.Exec(insertOperationsLoggingSQL, "translatedToSend", t, numberCard, -currency, onlineUserID)
-	if err != nil {
-		log.Fatalf("can't operationLogging %s", err)
-	}
-	//------------
-	var idUserGet int
-	err = tx.QueryRow(selectUser_idWhereIdCardSQL, idCardForTransferRecipient).Scan(&idUserGet)
-	if err != nil {
-		log.Fatalf("can't operationLogging, select number card for id card: %s", err)
-	}
-	err = tx.QueryRow(selectNumberCardFromUser_idCardSQL, onlineUserID).Scan(&numberCard)
-	if err != nil {
-		log.Fatalf("can't operationLogging, select number card for id card: %s", err)
+func TransferMoneyCardNumberContext(ctx context.Context, countNumber string, db *sql.DB) (idCardRecipient int64, err error) {
+	if !ValidCardNumber(countNumber) {
+		return 0, ErrInvalidCardNumber
 	}
-	_, err = tx.Exec(insertOperationsLoggingSQL, "translatedToGet", t, numberCard, currency, idUserGet)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatalf("can't operationLogging %s", err)
+		return 0, err
 	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
 
-	sumTransferUsers = sumTransferUsers + currency
-	_, err = tx.Exec(updateBalanceSumTransferUsersSQL, sumTransferUsers)
+	err = tx.QueryRowContext(ctx, selectIdCardForTransferCountNumberSQL, countNumber).Scan(&idCardRecipient)
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return 0, ErrRecipientNotFound
+		}
+		return 0, queryError(selectIdCardForTransferCountNumberSQL, err)
 	}
-	return nil
+	return idCardRecipient, nil
 }
 
-func TransferServices(currency int, name string, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func TransferMoneyCardNumber(countNumber string, db *sql.DB) (idCardRecipient int64, err error) {
+	return TransferMoneyCardNumberContext(context.Background(), countNumber, db)
+}
+
+// TransferMoneyContext moves currency from the session user's card
+// idCardSender, or from the default card when it is 0, to idCardRecipient.
+func (receiver Session) TransferMoneyContext(ctx context.Context, idCardSender int64, idCardRecipient int64, currency int, db *sql.DB) (err error) {
+	if currency <= 0 {
+		return ErrInvalidAmount
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 	defer func() {
 		if err != nil {
-			_ = tx.Rollback()
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
 			return
 		}
 		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
 	}()
-	var currencyUser int
-	err = tx.QueryRow(selectBalanceToCardSenderSQL, onlineUserID).Scan(&currencyUser)
+
+	sender, err := selectSenderCard(ctx, tx, receiver.UserId, idCardSender)
 	if err != nil {
 		return err
 	}
-	currencyUser = currencyUser - currency
-	_, err = tx.Exec(
-		updateBalanceToCardSenderSQL, currencyUser, onlineUserID,
-	)
-	if err != nil {
-		return err
+	if sender.balance <= int64(currency) {
+		return ErrInsufficientFunds
 	}
-
-	var currencyService int
-	err = tx.QueryRow(selectBalanceOnServiceSQL, name).Scan(&currencyService)
+	recipient, err := selectRecipientCard(ctx, tx, idCardRecipient)
 	if err != nil {
 		return err
 	}
-	currencyService = currencyService + currency
-	_, err = tx.Exec(
-		updateBalanceServiceSQL, currencyService, name,
-	)
-	t := time.Now().String()
-
-	_,err = tx.Exec(insertOperationsLoggingSQL,"payToService",t,name,-currency,onlineUserID)
-	if err != nil {
-		return err
+	if recipient.id == sender.id {
+		return ErrSameCard
 	}
-	return nil
+
+	_, err = moveBetweenCards(ctx, tx, DialectOf(db), sender, recipient, int64(currency))
+	return err
 }
 
-func UserHideManager(userId int, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func (receiver Session) TransferMoney(idCardSender int64, idCardRecipient int64, currency int, db *sql.DB) (err error) {
+	return receiver.TransferMoneyContext(context.Background(), idCardSender, idCardRecipient, currency, db)
+}
+
+// TransferServicesContext pays currency to the service name from the session
+// user's card idCardSender, or from the default card when it is 0. Services
+// with payment fields must be paid with PayServiceContext.
+func (receiver Session) TransferServicesContext(ctx context.Context, idCardSender int64, currency int, name string, db *sql.DB) (err error) {
+	_, err = receiver.PayServiceContext(ctx, idCardSender, int64(currency), name, nil, db)
+	return err
+}
+
+func (receiver Session) TransferServices(idCardSender int64, currency int, name string, db *sql.DB) (err error) {
+	return receiver.TransferServicesContext(context.Background(), idCardSender, currency, name, db)
+}
+
+func UserHideManagerContext(ctx context.Context, userId int, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -614,7 +671,7 @@ func UserHideManager(userId int, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		updateHideShowUser, 4, userId,
 	)
 
@@ -625,8 +682,12 @@ func UserHideManager(userId int, db *sql.DB) (err error) {
 	return nil
 }
 
-func UserShowManager(userId int, db *sql.DB) (err error) {
-	tx, err := db.Begin()
+func UserHideManager(userId int, db *sql.DB) (err error) {
+	return UserHideManagerContext(context.Background(), userId, db)
+}
+
+func UserShowManagerContext(ctx context.Context, userId int, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -638,7 +699,7 @@ func UserShowManager(userId int, db *sql.DB) (err error) {
 		err = tx.Commit()
 	}()
 
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		updateHideShowUser, 3, userId,
 	)
 
@@ -649,10 +710,14 @@ func UserShowManager(userId int, db *sql.DB) (err error) {
 	return nil
 }
 
-func GetHideUsers(db *sql.DB) (users []UserHide, err error) {
-	rows, err := db.Query(getHideUserSQL, 4)
+func UserShowManager(userId int, db *sql.DB) (err error) {
+	return UserShowManagerContext(context.Background(), userId, db)
+}
+
+func GetHideUsersContext(ctx context.Context, db *sql.DB) (users []UserHide, err error) {
+	rows, err := db.QueryContext(ctx, getHideUserSQL, 4)
 	if err != nil {
-		return nil, nil
+		return nil, queryError(getHideUserSQL, err)
 	}
 	defer func() {
 		if innerErr := rows.Close(); innerErr != nil {
@@ -674,10 +739,14 @@ func GetHideUsers(db *sql.DB) (users []UserHide, err error) {
 	return users, nil
 }
 
-func GetShowUsers(db *sql.DB) (users []UserShow, err error) {
-	rows, err := db.Query(getHideUserSQL, 3)
+func GetHideUsers(db *sql.DB) (users []UserHide, err error) {
+	return GetHideUsersContext(context.Background(), db)
+}
+
+func GetShowUsersContext(ctx context.Context, db *sql.DB) (users []UserShow, err error) {
+	rows, err := db.QueryContext(ctx, getHideUserSQL, 3)
 	if err != nil {
-		return nil, nil
+		return nil, queryError(getHideUserSQL, err)
 	}
 	defer func() {
 		if innerErr := rows.Close(); innerErr != nil {
@@ -699,8 +768,12 @@ func GetShowUsers(db *sql.DB) (users []UserShow, err error) {
 	return users, nil
 }
 
-func SearchUserByPhoneNumber(phoneNumber int, db *sql.DB) (users []User, err error) {
-	rows, err := db.Query(
+func GetShowUsers(db *sql.DB) (users []UserShow, err error) {
+	return GetShowUsersContext(context.Background(), db)
+}
+
+func SearchUserByPhoneNumberContext(ctx context.Context, phoneNumber int, db *sql.DB) (users []User, err error) {
+	rows, err := db.QueryContext(ctx,
 		searchUserForPhoneNumberSQL, phoneNumber,
 	)
 	if err != nil {
@@ -726,28 +799,48 @@ func SearchUserByPhoneNumber(phoneNumber int, db *sql.DB) (users []User, err err
 	return users, nil
 }
 
-func StaticCountUsers(db *sql.DB) (count int) {
-	db.QueryRow(staticCountUserSQL).Scan(&count)
+func SearchUserByPhoneNumber(phoneNumber int, db *sql.DB) (users []User, err error) {
+	return SearchUserByPhoneNumberContext(context.Background(), phoneNumber, db)
+}
+
+func StaticCountUsersContext(ctx context.Context, db *sql.DB) (count int) {
+	db.QueryRowContext(ctx, staticCountUserSQL).Scan(&count)
 	return count
 }
 
+func StaticCountUsers(db *sql.DB) (count int) {
+	return StaticCountUsersContext(context.Background(), db)
+}
+
+func StaticSumBalanceUsersContext(ctx context.Context, db *sql.DB) (sum int) {
+	db.QueryRowContext(ctx, staticSumBalanceUsersSQL).Scan(&sum)
+	return sum
+}
+
 func StaticSumBalanceUsers(db *sql.DB) (sum int) {
-	db.QueryRow(staticSumBalanceUsersSQL).Scan(&sum)
+	return StaticSumBalanceUsersContext(context.Background(), db)
+}
+
+func StaticBalanceOfServicesContext(ctx context.Context, db *sql.DB) (sum int) {
+	db.QueryRowContext(ctx, staticBalanceOfServicesSQL).Scan(&sum)
 	return sum
 }
 
 func StaticBalanceOfServices(db *sql.DB) (sum int) {
-	db.QueryRow(staticBalanceOfServicesSQL).Scan(&sum)
+	return StaticBalanceOfServicesContext(context.Background(), db)
+}
+
+func StaticBalanceSumTransferContext(ctx context.Context, db *sql.DB) (sum int) {
+	db.QueryRowContext(ctx, selectBalanceSumTransferUsers).Scan(&sum)
 	return sum
 }
 
 func StaticBalanceSumTransfer(db *sql.DB) (sum int) {
-	db.QueryRow(selectBalanceSumTransferUsers).Scan(&sum)
-	return sum
+	return StaticBalanceSumTransferContext(context.Background(), db)
 }
 
-func ViewOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error) {
-	rows, err := db.Query(getOperationsLoggingUserSQL, onlineUserID)
+func (receiver Session) ViewOperationsLoggingContext(ctx context.Context, db *sql.DB) (opLogs []OperationsLogging, err error) {
+	rows, err := db.QueryContext(ctx, getOperationsLoggingUserSQL, receiver.UserId)
 	if err != nil {
 		return nil, queryError(getOperationsLoggingUserSQL, err)
 	}
@@ -758,10 +851,9 @@ func ViewOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error) {
 	}()
 
 	for rows.Next() {
-		opLog := OperationsLogging{}
-		err = rows.Scan(&opLog.Id, &opLog.Name, &opLog.Time, &opLog.RecipientSender, &opLog.Balance)
+		opLog, err := scanOperation(rows)
 		if err != nil {
-			return nil, dbError(err)
+			return nil, err
 		}
 		opLogs = append(opLogs, opLog)
 	}
@@ -771,8 +863,12 @@ func ViewOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error) {
 	return opLogs, err
 }
 
-func ViewOperationsLoggingToSearch(idUser int, db *sql.DB) (opLogs []OperationsLogging, err error) {
-	rows, err := db.Query(getOperationsLoggingUserSQL, idUser)
+func (receiver Session) ViewOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error) {
+	return receiver.ViewOperationsLoggingContext(context.Background(), db)
+}
+
+func ViewOperationsLoggingToSearchContext(ctx context.Context, idUser int, db *sql.DB) (opLogs []OperationsLogging, err error) {
+	rows, err := db.QueryContext(ctx, getOperationsLoggingUserSQL, idUser)
 	if err != nil {
 		return nil, queryError(getOperationsLoggingUserSQL, err)
 	}
@@ -783,10 +879,9 @@ func ViewOperationsLoggingToSearch(idUser int, db *sql.DB) (opLogs []OperationsL
 	}()
 
 	for rows.Next() {
-		opLog := OperationsLogging{}
-		err = rows.Scan(&opLog.Id, &opLog.Name, &opLog.Time, &opLog.RecipientSender, &opLog.Balance)
+		opLog, err := scanOperation(rows)
 		if err != nil {
-			return nil, dbError(err)
+			return nil, err
 		}
 		opLogs = append(opLogs, opLog)
 	}
@@ -796,8 +891,12 @@ func ViewOperationsLoggingToSearch(idUser int, db *sql.DB) (opLogs []OperationsL
 	return opLogs, err
 }
 
-func ViewAllOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error) {
-	rows, err := db.Query(getAllOperationsLoggingUserSQL)
+func ViewOperationsLoggingToSearch(idUser int, db *sql.DB) (opLogs []OperationsLogging, err error) {
+	return ViewOperationsLoggingToSearchContext(context.Background(), idUser, db)
+}
+
+func ViewAllOperationsLoggingContext(ctx context.Context, db *sql.DB) (opLogs []OperationsLogging, err error) {
+	rows, err := db.QueryContext(ctx, getAllOperationsLoggingUserSQL)
 	if err != nil {
 		return nil, queryError(getAllOperationsLoggingUserSQL, err)
 	}
@@ -808,10 +907,9 @@ func ViewAllOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error
 	}()
 
 	for rows.Next() {
-		opLog := OperationsLogging{}
-		err = rows.Scan(&opLog.Id, &opLog.Name, &opLog.Time, &opLog.RecipientSender, &opLog.Balance)
+		opLog, err := scanOperation(rows)
 		if err != nil {
-			return nil, dbError(err)
+			return nil, err
 		}
 		opLogs = append(opLogs, opLog)
 	}
@@ -821,34 +919,50 @@ func ViewAllOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error
 	return opLogs, err
 }
 
+func ViewAllOperationsLogging(db *sql.DB) (opLogs []OperationsLogging, err error) {
+	return ViewAllOperationsLoggingContext(context.Background(), db)
+}
+
 
 //--------------------------------
 
-func ExportClientsToJSON(db *sql.DB) error {
-	return ExportToFile(db, getAllUsersSQL, "clients.json",
+func ExportClientsToJSONContext(ctx context.Context, db *sql.DB) error {
+	return ExportToFileContext(ctx, db, exportClientsSQL, "clients.json",
 		mapRowToClient, json.Marshal, mapInterfaceSliceToClients)
 }
-func ExportAtmsToJSON(db *sql.DB) error {
-	return ExportToFile(db, getAllAtmsSQL, "atms.json",
+func ExportClientsToJSON(db *sql.DB) error {
+	return ExportClientsToJSONContext(context.Background(), db)
+}
+func ExportAtmsToJSONContext(ctx context.Context, db *sql.DB) error {
+	return ExportToFileContext(ctx, db, getAllAtmsSQL, "atms.json",
 		mapRowToAtm, json.Marshal,
 		mapInterfaceSliceToAtms)
 }
+func ExportAtmsToJSON(db *sql.DB) error {
+	return ExportAtmsToJSONContext(context.Background(), db)
+}
 
 //XML
 
-func ExportClientsToXML(db *sql.DB) error {
-	return ExportToFile(db, getAllUsersSQL, "clients.xml",
+func ExportClientsToXMLContext(ctx context.Context, db *sql.DB) error {
+	return ExportToFileContext(ctx, db, exportClientsSQL, "clients.xml",
 		mapRowToClient, xml.Marshal, mapInterfaceSliceToClients)
 }
-func ExportAtmsToXML(db *sql.DB) error {
-	return ExportToFile(db, getAllAtmsSQL, "atms.xml",
+func ExportClientsToXML(db *sql.DB) error {
+	return ExportClientsToXMLContext(context.Background(), db)
+}
+func ExportAtmsToXMLContext(ctx context.Context, db *sql.DB) error {
+	return ExportToFileContext(ctx, db, getAllAtmsSQL, "atms.xml",
 		mapRowToAtm, xml.Marshal,
 		mapInterfaceSliceToAtms)
 }
+func ExportAtmsToXML(db *sql.DB) error {
+	return ExportAtmsToXMLContext(context.Background(), db)
+}
 
 func mapRowToClient(rows *sql.Rows) (interface{}, error) {
 	user := User{}
-	err := rows.Scan(&user.Id, &user.Login, &user.Password, &user.Name, &user.NumberPhone, &user.HideShow)
+	err := rows.Scan(&user.Id, &user.Login, &user.Name, &user.PassportSeries, &user.NumberPhone, &user.HideShow)
 	if err != nil {
 		return nil, err
 	}
@@ -856,7 +970,7 @@ func mapRowToClient(rows *sql.Rows) (interface{}, error) {
 }
 func mapRowToAtm(rows *sql.Rows) (interface{}, error) {
 	atm := Atm{}
-	err := rows.Scan(&atm.Id,&atm.Name, &atm.Address)
+	err := rows.Scan(&atm.Id,&atm.Name, &atm.Address, &atm.Latitude, &atm.Longitude, &atm.Status)
 	if err != nil {
 		return nil, err
 	}
@@ -881,8 +995,9 @@ func mapInterfaceSliceToAtms(ifaces []interface{}) interface{} {
 	atmsExport := AtmsExport{Atms: atms}
 	return atmsExport
 }
-func ImportClientsFromJSON(db *sql.DB) error {
-	return ImportFromFile(
+func ImportClientsFromJSONContext(ctx context.Context, db *sql.DB) error {
+	return ImportFromFileContext(
+		ctx,
 		db,
 		"clients.json",
 		func(data []byte) ([]interface{}, error) {
@@ -891,8 +1006,12 @@ func ImportClientsFromJSON(db *sql.DB) error {
 		insertClientToDB,
 	)
 }
-func ImportAtmsFromJSON(db *sql.DB) error {
-	return ImportFromFile(
+func ImportClientsFromJSON(db *sql.DB) error {
+	return ImportClientsFromJSONContext(context.Background(), db)
+}
+func ImportAtmsFromJSONContext(ctx context.Context, db *sql.DB) error {
+	return ImportFromFileContext(
+		ctx,
 		db,
 		"atms.json",
 		func(data []byte) ([]interface{}, error) {
@@ -901,8 +1020,12 @@ func ImportAtmsFromJSON(db *sql.DB) error {
 		insertAtmToDB,
 	)
 }
-func ImportClientsFromXML(db *sql.DB) error {
-	return ImportFromFile(
+func ImportAtmsFromJSON(db *sql.DB) error {
+	return ImportAtmsFromJSONContext(context.Background(), db)
+}
+func ImportClientsFromXMLContext(ctx context.Context, db *sql.DB) error {
+	return ImportFromFileContext(
+		ctx,
 		db,
 		"clients.xml",
 		func(data []byte) ([]interface{}, error) {
@@ -911,8 +1034,12 @@ func ImportClientsFromXML(db *sql.DB) error {
 		insertClientToDB,
 	)
 }
-func ImportAtmsFromXML(db *sql.DB) error {
-	return ImportFromFile(
+func ImportClientsFromXML(db *sql.DB) error {
+	return ImportClientsFromXMLContext(context.Background(), db)
+}
+func ImportAtmsFromXMLContext(ctx context.Context, db *sql.DB) error {
+	return ImportFromFileContext(
+		ctx,
 		db,
 		"atms.xml",
 		func(data []byte) ([]interface{}, error) {
@@ -921,6 +1048,9 @@ func ImportAtmsFromXML(db *sql.DB) error {
 		insertAtmToDB,
 	)
 }
+func ImportAtmsFromXML(db *sql.DB) error {
+	return ImportAtmsFromXMLContext(context.Background(), db)
+}
 func mapBytesToClients(data []byte, unmarshal func([]byte, interface{}) error,) ([]interface{}, error) {
 	clientsExport := ClientsExport{}
 	err := unmarshal(data, &clientsExport)
@@ -933,19 +1063,21 @@ func mapBytesToClients(data []byte, unmarshal func([]byte, interface{}) error,)
 	}
 	return ifaces, nil
 }
-func insertClientToDB(iface interface{}, db *sql.DB) error {
+// insertClientToDB stores imported clients without password: exports never
+// carry password material, so the manager sets one with SetUserPassword.
+func insertClientToDB(ctx context.Context, tx *sql.Tx, iface interface{}) error {
 	client := iface.(User)
-	_, err := db.Exec(
+	_, err := tx.ExecContext(ctx,
 		insertUserSQL,
-		sql.Named("name", client.Name),
-		sql.Named("login", client.Login),
-		sql.Named("password", client.Password),
-		sql.Named("passportSeries", client.PassportSeries),
-		sql.Named("phoneNumber", client.NumberPhone),
-		sql.Named("hideShow", client.HideShow),
+		client.Name,
+		client.Login,
+		"",
+		client.PassportSeries,
+		client.NumberPhone,
+		client.HideShow,
 	)
 	if err != nil {
-		return err
+		return queryError(insertUserSQL, err)
 	}
 	return nil
 }
@@ -967,16 +1099,17 @@ func mapBytesToAtms(data []byte, unmarshal func([]byte, interface{}) error,
 	}
 	return ifaces, nil
 }
-func insertAtmToDB(iface interface{}, db *sql.DB) error {
+func insertAtmToDB(ctx context.Context, tx *sql.Tx, iface interface{}) error {
 	atm := iface.(Atm)
-	_, err := db.Exec(
+	_, err := tx.ExecContext(ctx,
 		insertAtmSQL,
-		sql.Named("id", atm.Id),
-		sql.Named("name", atm.Name),
-		sql.Named("address", atm.Address),
+		atm.Name,
+		atm.Address,
+		atm.Latitude,
+		atm.Longitude,
 	)
 	if err != nil {
-		return err
+		return queryError(insertAtmSQL, err)
 	}
 	return nil
 }
@@ -985,31 +1118,46 @@ type MapperRowTo func(rows *sql.Rows) (interface{}, error)
 type MapperInterfaceSliceTo func([]interface{}) interface{}
 type Marshaller func(interface{}) ([]byte, error)
 
-func ExportToFile(
+// ExportToFileContext writes nothing when ctx is done before all rows are
+// read: a cancelled export never leaves a partial file behind.
+func ExportToFileContext(
+	ctx context.Context,
 	db *sql.DB,
 	getDataFromDbSQL string,
 	filename string,
 	mapRow MapperRowTo,
 	marshal Marshaller,
-	mapDataSlice MapperInterfaceSliceTo) error {
+	mapDataSlice MapperInterfaceSliceTo) (err error) {
 
-	rows, err := db.Query(getDataFromDbSQL)
+	rows, err := db.QueryContext(ctx, getDataFromDbSQL)
 	if err != nil {
-		return err
+		return queryError(getDataFromDbSQL, err)
 	}
 	defer func() {
-		err = rows.Close()
+		if innerErr := rows.Close(); innerErr != nil && err == nil {
+			err = dbError(innerErr)
+		}
 	}()
 	var dataSlice []interface{}
 	for rows.Next() {
 		dataElement, err := mapRow(rows)
 		if err != nil {
-			return err
+			return dbError(err)
 		}
 		dataSlice = append(dataSlice, dataElement)
 	}
+	if rows.Err() != nil {
+		return dbError(rows.Err())
+	}
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
 	exportData := mapDataSlice(dataSlice)
 	data, err := marshal(exportData)
+	if err != nil {
+		return err
+	}
 	err = ioutil.WriteFile(filename, data, 0666)
 	if err != nil {
 		return err
@@ -1017,27 +1165,75 @@ func ExportToFile(
 	return nil
 }
 
+func ExportToFile(
+	db *sql.DB,
+	getDataFromDbSQL string,
+	filename string,
+	mapRow MapperRowTo,
+	marshal Marshaller,
+	mapDataSlice MapperInterfaceSliceTo) error {
+	return ExportToFileContext(context.Background(), db, getDataFromDbSQL, filename, mapRow, marshal, mapDataSlice)
+}
+
 
 type MapperBytesTo func([]byte) ([]interface{}, error)
+type InserterTo func(ctx context.Context, tx *sql.Tx, iface interface{}) error
 
-func ImportFromFile(
+// ImportFromFileContext inserts all items in one transaction: an error or
+// ctx cancellation in the middle of the file leaves the database unchanged.
+func ImportFromFileContext(
+	ctx context.Context,
 	db *sql.DB,
 	filename string,
 	mapBytes MapperBytesTo,
-	insertToDB func(interface{}, *sql.DB) error,
-) error {
+	insertToDB InserterTo,
+) (err error) {
 	itemsData, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
 
 	sliceData, err := mapBytes(itemsData)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			// ErrTxDone: database/sql has already rolled back on cancellation.
+			if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
 
 	for _, datum := range sliceData {
-		err = insertToDB(datum, db)
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		err = insertToDB(ctx, tx, datum)
 		if err != nil {
 			return err
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+func ImportFromFile(
+	db *sql.DB,
+	filename string,
+	mapBytes MapperBytesTo,
+	insertToDB InserterTo,
+) error {
+	return ImportFromFileContext(context.Background(), db, filename, mapBytes, insertToDB)
+}
@@ -1,9 +1,17 @@
+//go:build cgo
+// +build cgo
+
 package core
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -137,7 +145,7 @@ func TestLoginUsers_QueryError(t *testing.T) {
 		}
 	}()
 
-	_, err = LoginUsers("", "", db)
+	_, _, err = LoginUsers("", "", db)
 	// errors.Is vs errors.As
 	var typedErr *QueryError
 	if ok := errors.As(err, &typedErr); !ok {
@@ -173,7 +181,7 @@ func TestLoginUsers_NoSuchLoginForEmptyDb(t *testing.T) {
 		t.Errorf("can't execute query: %v", err)
 	}
 
-	result, err := LoginUsers("", "", db)
+	_, result, err := LoginUsers("", "", db)
 	if err != nil {
 		t.Errorf("can't execute Login: %v", err)
 	}
@@ -215,7 +223,7 @@ func TestLoginUsers_LoginOk(t *testing.T) {
 		t.Errorf("can't execute Login: %v", err)
 	}
 
-	result, err := LoginUsers("vasya", "secret", db)
+	session, result, err := LoginUsers("vasya", "secret", db)
 	if err != nil {
 		t.Errorf("can't execute Login: %v", err)
 	}
@@ -223,6 +231,9 @@ func TestLoginUsers_LoginOk(t *testing.T) {
 	if result != true {
 		t.Error("Login result not true for existing account")
 	}
+	if session.UserId != 1 || session.Login != "vasya" {
+		t.Errorf("Login session not match existing account: %v", session)
+	}
 }
 
 func TestLoginUsers_LoginNotOkForInvalidPassword(t *testing.T) {
@@ -256,12 +267,144 @@ func TestLoginUsers_LoginNotOkForInvalidPassword(t *testing.T) {
 		t.Errorf("can't execute Login: %v", err)
 	}
 
-	_, err = LoginUsers("vasya", "password", db)
+	_, _, err = LoginUsers("vasya", "password", db)
+	if !errors.Is(err, ErrInvalidPass) {
+		t.Errorf("Not ErrInvalidPass error for invalid pass: %v", err)
+	}
+}
+
+func TestLoginUsers_RehashPlaintextPassword(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Errorf("can't open db: %v", err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("can't close db: %v", err)
+		}
+	}()
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS users
+(
+    id      INTEGER PRIMARY KEY AUTOINCREMENT,
+    name    TEXT    NOT NULL,
+    login   TEXT    NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+	passportSeries TEXT NOT NULL UNIQUE,
+	phoneNumber INTEGER NOT NULL,
+	hideShow INTEGER NOT NULL
+);`)
+	if err != nil {
+		t.Errorf("can't execute Login: %v", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO users( name, login, password, passportSeries, phoneNumber, hideShow) VALUES ('Vasya','vasya', 'secret','A132323',9001,3)`)
+	if err != nil {
+		t.Errorf("can't execute Login: %v", err)
+	}
+
+	_, result, err := LoginUsers("vasya", "secret", db)
+	if err != nil || result != true {
+		t.Errorf("can't login with plaintext password: %v", err)
+	}
+
+	var dbPassword string
+	err = db.QueryRow(`SELECT password FROM users WHERE login = 'vasya'`).Scan(&dbPassword)
+	if err != nil {
+		t.Errorf("can't select password: %v", err)
+	}
+	if dbPassword == "secret" || !isPasswordHash(dbPassword) {
+		t.Errorf("plaintext password not rehashed on login: %v", dbPassword)
+	}
+
+	_, result, err = LoginUsers("vasya", "secret", db)
+	if err != nil || result != true {
+		t.Errorf("can't login with rehashed password: %v", err)
+	}
+	_, _, err = LoginUsers("vasya", "password", db)
 	if !errors.Is(err, ErrInvalidPass) {
 		t.Errorf("Not ErrInvalidPass error for invalid pass: %v", err)
 	}
 }
 
+func TestLoginUsers_EmptyPasswordNeverMatch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Errorf("can't open db: %v", err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("can't close db: %v", err)
+		}
+	}()
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS users
+(
+    id      INTEGER PRIMARY KEY AUTOINCREMENT,
+    name    TEXT    NOT NULL,
+    login   TEXT    NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+	passportSeries TEXT NOT NULL UNIQUE,
+	phoneNumber INTEGER NOT NULL,
+	hideShow INTEGER NOT NULL
+);`)
+	if err != nil {
+		t.Errorf("can't execute Login: %v", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO users( name, login, password, passportSeries, phoneNumber, hideShow) VALUES ('Vasya','vasya', '','A132323',9001,3)`)
+	if err != nil {
+		t.Errorf("can't execute Login: %v", err)
+	}
+
+	_, _, err = LoginUsers("vasya", "", db)
+	if !errors.Is(err, ErrInvalidPass) {
+		t.Errorf("Not ErrInvalidPass error for account without password: %v", err)
+	}
+}
+
+func TestLoginUsers_Blocked(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Errorf("can't open db: %v", err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("can't close db: %v", err)
+		}
+	}()
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS users
+(
+    id      INTEGER PRIMARY KEY AUTOINCREMENT,
+    name    TEXT    NOT NULL,
+    login   TEXT    NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+	passportSeries TEXT NOT NULL UNIQUE,
+	phoneNumber INTEGER NOT NULL,
+	hideShow INTEGER NOT NULL
+);`)
+	if err != nil {
+		t.Errorf("can't execute Login: %v", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO users( name, login, password, passportSeries, phoneNumber, hideShow) VALUES ('Vasya','vasya', 'secret','A132323',9001,4)`)
+	if err != nil {
+		t.Errorf("can't execute Login: %v", err)
+	}
+
+	_, result, err := LoginUsers("vasya", "secret", db)
+	if !errors.Is(err, ErrUserBlocked) {
+		t.Errorf("Not ErrUserBlocked error for blocked user: %v", err)
+	}
+	if result != false {
+		t.Error("Login result not false for blocked user")
+	}
+}
+
 func TestAddAtm_NoBd(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -272,7 +415,7 @@ func TestAddAtm_NoBd(t *testing.T) {
 			t.Errorf("can't close db: %v", err)
 		}
 	}()
-	err = AddAtm("T1", "rudaki 65", db)
+	err = AddAtm("T1", "rudaki 65", 38.5737, 68.7738, db)
 	if err == nil {
 		t.Errorf("can't execute add atm: %v", err)
 	}
@@ -294,10 +437,13 @@ func TestAddAtm_HasBd(t *testing.T) {
 	(
 		id      INTEGER PRIMARY KEY AUTOINCREMENT,
 		name    TEXT    NOT NULL UNIQUE,
-		address TEXT NOT NULL
+		address TEXT NOT NULL,
+		latitude REAL,
+		longitude REAL,
+		status TEXT NOT NULL DEFAULT 'online'
 	);`)
 
-	err = AddAtm("T1", "rudaki 65", db)
+	err = AddAtm("T1", "rudaki 65", 38.5737, 68.7738, db)
 	if err != nil {
 		t.Errorf("can't execute add atm: %v", err)
 	}
@@ -336,7 +482,10 @@ func TestGetAllAtms_HasDbError(t *testing.T) {
 	(
 		id      INTEGER PRIMARY KEY AUTOINCREMENT,
 		name    TEXT    NOT NULL UNIQUE,
-		address TEXT NOT NULL
+		address TEXT NOT NULL,
+		latitude REAL,
+		longitude REAL,
+		status TEXT NOT NULL DEFAULT 'online'
 	);`)
 
 	atms, err := GetAllAtms(db)
@@ -364,7 +513,10 @@ func TestGetAllAtms_HasDb(t *testing.T) {
 	(
 		id      INTEGER PRIMARY KEY AUTOINCREMENT,
 		name    TEXT    NOT NULL UNIQUE,
-		address TEXT NOT NULL
+		address TEXT NOT NULL,
+		latitude REAL,
+		longitude REAL,
+		status TEXT NOT NULL DEFAULT 'online'
 	);`)
 	if err != nil {
 		t.Errorf("can't creat atm to get all atm: %v", err)
@@ -442,7 +594,7 @@ func TestGetAllServices_NoDb(t *testing.T) {
 		}
 	}()
 
-	_, err = GetAllServices(db)
+	_, err = GetAllServices(ServiceFilter{}, db)
 	if err == nil {
 		t.Errorf("can't get all atm: %v", err)
 	}
@@ -492,7 +644,12 @@ func TestGetAllServices_HasDb(t *testing.T) {
 (
    id      INTEGER PRIMARY KEY AUTOINCREMENT,
    name    TEXT    NOT NULL,
-   balance INTEGER NOT NULL 
+   balance INTEGER NOT NULL,
+   category TEXT NOT NULL DEFAULT 'other',
+   description TEXT NOT NULL DEFAULT '',
+   active INTEGER NOT NULL DEFAULT 1,
+   minAmount INTEGER NOT NULL DEFAULT 0,
+   maxAmount INTEGER NOT NULL DEFAULT 0
 );`)
 	if err != nil {
 		t.Errorf("can't creat atm to get all atm: %v", err)
@@ -507,7 +664,7 @@ func TestGetAllServices_HasDb(t *testing.T) {
 	if err != nil {
 		t.Errorf("can't get all services, add atm: %v", err)
 	}
-	services, err := GetAllServices(db)
+	services, err := GetAllServices(ServiceFilter{}, db)
 	if err != nil {
 		t.Errorf("can't get all seervices: %v", err)
 	}
@@ -551,11 +708,21 @@ func TestAddCard_HasDb(t *testing.T) {
    numberCard TEXT NOT NULL,
    name    TEXT    NOT NULL,
    balance INTEGER NOT NULL CHECK ( balance > 0 ),
-   user_id INTEGER REFERENCES users(id)
+   user_id INTEGER REFERENCES users(id),
+   expiryMonth INTEGER NOT NULL DEFAULT 0,
+   expiryYear INTEGER NOT NULL DEFAULT 0,
+   cvv TEXT NOT NULL DEFAULT '',
+   status TEXT NOT NULL DEFAULT 'active'
 );`)
 	if err != nil {
 		t.Errorf("can't add card: %v", err)
 	}
+	for _, ddl := range []string{ledgerJournalDDL, ledgerPostingsDDL} {
+		_, err = db.Exec(ddl)
+		if err != nil {
+			t.Errorf("can't create ledger: %v", err)
+		}
+	}
 
 	err = AddCard("AlifMobi", 100, 1, db)
 	if err != nil {
@@ -563,6 +730,22 @@ func TestAddCard_HasDb(t *testing.T) {
 	}
 }
 
+func TestAddCard_CardNumber(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		err := AddCard("AlifMobi", 100, 3, db)
+		if err != nil {
+			t.Errorf("can't add card: %v", err)
+		}
+		idCard, err := TransferMoneyCardNumber("2021600000000032", db)
+		if err != nil || idCard != 3 {
+			t.Errorf("added card not found by generated number: %v, %v", idCard, err)
+		}
+	})
+}
+
 func TestGetAllCards_NoDb(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -574,7 +757,7 @@ func TestGetAllCards_NoDb(t *testing.T) {
 		}
 	}()
 
-	services, err := GetAllServices(db)
+	services, err := GetAllServices(ServiceFilter{}, db)
 
 	if err == nil {
 		t.Errorf("can't get all cards: %v", err)
@@ -602,7 +785,11 @@ func TestGetAllCards_HasDbError(t *testing.T) {
    numberCard TEXT NOT NULL,
    name    TEXT    NOT NULL,
    balance INTEGER NOT NULL CHECK ( balance > 0 ),
-   user_id INTEGER REFERENCES users(id)
+   user_id INTEGER REFERENCES users(id),
+   expiryMonth INTEGER NOT NULL DEFAULT 0,
+   expiryYear INTEGER NOT NULL DEFAULT 0,
+   cvv TEXT NOT NULL DEFAULT '',
+   status TEXT NOT NULL DEFAULT 'active'
 );`)
 
 	cards, err := GetAllCards(db)
@@ -631,18 +818,22 @@ func TestGetAllCards_HasDb(t *testing.T) {
    numberCard TEXT NOT NULL,
    name    TEXT    NOT NULL,
    balance INTEGER NOT NULL CHECK ( balance > 0 ),
-   user_id INTEGER REFERENCES users(id)
+   user_id INTEGER REFERENCES users(id),
+   expiryMonth INTEGER NOT NULL DEFAULT 0,
+   expiryYear INTEGER NOT NULL DEFAULT 0,
+   cvv TEXT NOT NULL DEFAULT '',
+   status TEXT NOT NULL DEFAULT 'active'
 );`)
 	if err != nil {
 		t.Errorf("can't creat atm to get all atm: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,1,"20216000000000001")`)
+	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,1,"2021600000000016")`)
 	if err != nil {
 		t.Errorf("can't get all card, add card: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (2,"AlifMobi",400,2,"20216000000000002")`)
+	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (2,"AlifMobi",400,2,"2021600000000024")`)
 	if err != nil {
 		t.Errorf("can't get all card, add card: %v", err)
 	}
@@ -704,6 +895,47 @@ func TestAddUser_HasDb(t *testing.T) {
 	}
 }
 
+func TestAddUser_HashPassword(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Errorf("can't open db: %v", err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("can't close db: %v", err)
+		}
+	}()
+
+	err = Init(db)
+	if err != nil {
+		t.Errorf("can't init db: %v", err)
+	}
+
+	err = AddUser("User1", "user1", "secret", "A242342", 9002, db)
+	if err != nil {
+		t.Errorf("can't add user: %v", err)
+	}
+
+	var dbPassword string
+	err = db.QueryRow(`SELECT password FROM users WHERE login = 'user1'`).Scan(&dbPassword)
+	if err != nil {
+		t.Errorf("can't select password: %v", err)
+	}
+	if !isPasswordHash(dbPassword) {
+		t.Errorf("password stored without hash: %v", dbPassword)
+	}
+
+	_, result, err := LoginUsers("user1", "secret", db)
+	if err != nil || result != true {
+		t.Errorf("can't login added user: %v", err)
+	}
+
+	_, err = LoginManager("admin", seededManagerPassword, db)
+	if !errors.Is(err, ErrManagerPasswordNotSet) {
+		t.Errorf("Not ErrManagerPasswordNotSet error for seeded manager: %v", err)
+	}
+}
+
 func TestGetAllUsers_NoDb(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -811,7 +1043,7 @@ func TestGetUserCards_NoDb(t *testing.T) {
 		}
 	}()
 
-	cards, err := GetUserCards(db)
+	cards, err := Session{UserId: 1}.GetUserCards(db)
 	if err == nil {
 		t.Errorf("can't get card user: %v", err)
 	}
@@ -838,13 +1070,17 @@ func TestGetUserCards_HasDbError(t *testing.T) {
    numberCard TEXT NOT NULL,
    name    TEXT    NOT NULL,
    balance INTEGER NOT NULL CHECK ( balance > 0 ),
-   user_id INTEGER REFERENCES users(id)
+   user_id INTEGER REFERENCES users(id),
+   expiryMonth INTEGER NOT NULL DEFAULT 0,
+   expiryYear INTEGER NOT NULL DEFAULT 0,
+   cvv TEXT NOT NULL DEFAULT '',
+   status TEXT NOT NULL DEFAULT 'active'
 );`)
 	if err != nil {
 		t.Errorf("can't creat table user, get user cards: %v", err)
 	}
 
-	users, err := GetUserCards(db)
+	users, err := Session{UserId: 1}.GetUserCards(db)
 	if err != nil {
 		t.Errorf("can't get user cards: %v", err)
 	}
@@ -888,22 +1124,26 @@ func TestGetUserCards_HasDb(t *testing.T) {
    numberCard TEXT NOT NULL,
    name    TEXT    NOT NULL,
    balance INTEGER NOT NULL CHECK ( balance > 0 ),
-   user_id INTEGER REFERENCES users(id)
+   user_id INTEGER REFERENCES users(id),
+   expiryMonth INTEGER NOT NULL DEFAULT 0,
+   expiryYear INTEGER NOT NULL DEFAULT 0,
+   cvv TEXT NOT NULL DEFAULT '',
+   status TEXT NOT NULL DEFAULT 'active'
 );`)
 	if err != nil {
 		t.Errorf("can't creat table user, get user cards: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,0,"20216000000000001")`)
+	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,0,"2021600000000016")`)
 	if err != nil {
 		t.Errorf("can't get user cards, add card: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (2,"AlifMobi",400,1,"20216000000000002")`)
+	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (2,"AlifMobi",400,1,"2021600000000024")`)
 	if err != nil {
 		t.Errorf("can't get user cards, add card: %v", err)
 	}
-	cards, err := GetUserCards(db)
+	cards, err := Session{UserId: 1}.GetUserCards(db)
 	if err != nil {
 		t.Errorf("can't get user cards: %v", err)
 	}
@@ -913,6 +1153,64 @@ func TestGetUserCards_HasDb(t *testing.T) {
 	}
 }
 
+func TestGetUserCards_SessionsSeeOnlyOwnCards(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Errorf("can't open db: %v", err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("can't close db: %v", err)
+		}
+	}()
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cards
+(
+   id      INTEGER PRIMARY KEY AUTOINCREMENT,
+   numberCard TEXT NOT NULL,
+   name    TEXT    NOT NULL,
+   balance INTEGER NOT NULL CHECK ( balance > 0 ),
+   user_id INTEGER REFERENCES users(id),
+   expiryMonth INTEGER NOT NULL DEFAULT 0,
+   expiryYear INTEGER NOT NULL DEFAULT 0,
+   cvv TEXT NOT NULL DEFAULT '',
+   status TEXT NOT NULL DEFAULT 'active'
+);`)
+	if err != nil {
+		t.Errorf("can't creat table cards, get user cards: %v", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,1,"2021600000000016")`)
+	if err != nil {
+		t.Errorf("can't get user cards, add card: %v", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (2,"AlifMobi",400,2,"2021600000000024")`)
+	if err != nil {
+		t.Errorf("can't get user cards, add card: %v", err)
+	}
+
+	vasya := Session{UserId: 1, Login: "vasya"}
+	petya := Session{UserId: 2, Login: "petya"}
+
+	vasyaCards, err := vasya.GetUserCards(db)
+	if err != nil {
+		t.Errorf("can't get user cards: %v", err)
+	}
+	petyaCards, err := petya.GetUserCards(db)
+	if err != nil {
+		t.Errorf("can't get user cards: %v", err)
+	}
+
+	if len(vasyaCards) != 1 || vasyaCards[0].Id != 1 {
+		t.Errorf("session got foreign cards: %v", vasyaCards)
+	}
+	if len(petyaCards) != 1 || petyaCards[0].Id != 2 {
+		t.Errorf("session got foreign cards: %v", petyaCards)
+	}
+}
+
 func TestTransferMoneyForPhoneNumber_NoDb(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -924,7 +1222,7 @@ func TestTransferMoneyForPhoneNumber_NoDb(t *testing.T) {
 		}
 	}()
 
-	err = TransferMoneyForPhoneNumber(9001, db)
+	_, err = TransferMoneyForPhoneNumber(9001, db)
 	if err == nil {
 		t.Errorf("can't search id cards for number phone: %v", err)
 	}
@@ -949,7 +1247,8 @@ func TestTransferMoneyForPhoneNumber_HasDb(t *testing.T) {
     password TEXT NOT NULL,
 	passportSeries TEXT NOT NULL UNIQUE,
 	phoneNumber INTEGER NOT NULL,
-	hideShow INTEGER NOT NULL
+	hideShow INTEGER NOT NULL,
+	defaultCard_id INTEGER REFERENCES cards(id)
 );`)
 	if err != nil {
 		t.Errorf("can't create table users, add user: %v", err)
@@ -966,18 +1265,55 @@ func TestTransferMoneyForPhoneNumber_HasDb(t *testing.T) {
    numberCard TEXT NOT NULL,
    name    TEXT    NOT NULL,
    balance INTEGER NOT NULL CHECK ( balance > 0 ),
-   user_id INTEGER REFERENCES users(id)
+   user_id INTEGER REFERENCES users(id),
+   expiryMonth INTEGER NOT NULL DEFAULT 0,
+   expiryYear INTEGER NOT NULL DEFAULT 0,
+   cvv TEXT NOT NULL DEFAULT '',
+   status TEXT NOT NULL DEFAULT 'active'
 );`)
+	for _, ddl := range []string{ledgerJournalDDL, ledgerPostingsDDL} {
+		_, err = db.Exec(ddl)
+		if err != nil {
+			t.Errorf("can't create ledger: %v", err)
+		}
+	}
 
 	err = AddCard("AlifMobi", 100, 1, db)
 	if err != nil {
 		t.Errorf("can't add card: %v", err)
 	}
 
-	err = TransferMoneyForPhoneNumber(9001, db)
+	idCardRecipient, err := TransferMoneyForPhoneNumber(9001, db)
 	if err != nil {
 		t.Errorf("can't search id cards for number phone: %v", err)
 	}
+	if idCardRecipient != 1 {
+		t.Errorf("recipient card not match for number phone: %v", idCardRecipient)
+	}
+}
+
+func TestTransferMoneyForPhoneNumber_Errors(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		_, err := TransferMoneyForPhoneNumber(9999, db)
+		if !errors.Is(err, ErrRecipientNotFound) {
+			t.Errorf("Not ErrRecipientNotFound error for unknown phone: %v", err)
+		}
+		_, err = TransferMoneyForPhoneNumber(9003, db)
+		if !errors.Is(err, ErrRecipientHasNoCard) {
+			t.Errorf("Not ErrRecipientHasNoCard error for user without card: %v", err)
+		}
+		_, err = TransferMoneyCardNumber("2021600000000099", db)
+		if !errors.Is(err, ErrRecipientNotFound) {
+			t.Errorf("Not ErrRecipientNotFound error for unknown card: %v", err)
+		}
+		_, err = TransferMoneyCardNumber("1", db)
+		if !errors.Is(err, ErrInvalidCardNumber) {
+			t.Errorf("Not ErrInvalidCardNumber error for invalid card number: %v", err)
+		}
+	})
 }
 
 func TestTransferMoneyCardNumber_NoDb(t *testing.T) {
@@ -991,7 +1327,7 @@ func TestTransferMoneyCardNumber_NoDb(t *testing.T) {
 		}
 	}()
 
-	err = TransferMoneyCardNumber("20216000000000001", db)
+	_, err = TransferMoneyCardNumber("2021600000000016", db)
 	if err == nil {
 		t.Errorf("can't search id cards for number phone: %v", err)
 	}
@@ -1013,21 +1349,28 @@ func TestTransferMoneyCardNumber_HasDbError(t *testing.T) {
 		numberCard TEXT NOT NULL,
 		name    TEXT    NOT NULL,
 		balance INTEGER NOT NULL CHECK ( balance > 0 ),
-		user_id INTEGER NOT NULL 
-	);`)
+		user_id INTEGER NOT NULL,
+		expiryMonth INTEGER NOT NULL DEFAULT 0,
+		expiryYear INTEGER NOT NULL DEFAULT 0,
+		cvv TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'active'
+);`)
 
 	if err != nil {
 		t.Errorf("can't creat table cards for number card: %v", err)
 	}
-	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,0,"20216000000000001")`)
+	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,0,"2021600000000016")`)
 	if err != nil {
 		t.Errorf("can't get all card, add card: %v", err)
 	}
 
-	err = TransferMoneyCardNumber("20216000000000001", db)
+	idCardRecipient, err := TransferMoneyCardNumber("2021600000000016", db)
 	if err != nil {
 		t.Errorf("can't search id cards for number card: %v", err)
 	}
+	if idCardRecipient != 1 {
+		t.Errorf("recipient card not match for number card: %v", idCardRecipient)
+	}
 }
 
 func TestTransferMoney_NoDb(t *testing.T) {
@@ -1041,64 +1384,161 @@ func TestTransferMoney_NoDb(t *testing.T) {
 		}
 	}()
 
-	err = TransferMoney(100, db)
+	err = Session{UserId: 1}.TransferMoney(1, 2, 100, db)
 	if err == nil {
 		t.Errorf("can't trancfer money: %v", err)
 	}
 
 }
 
-//func TestTransferMoney_HasDb(t *testing.T) {
-//	db, err := sql.Open("sqlite3", ":memory:")
-//	if err != nil {
-//		t.Errorf("can't open db: %v", err)
-//	}
-//	defer func() {
-//		if err := db.Close(); err != nil {
-//			t.Errorf("can't close db: %v", err)
-//		}
-//	}()
-//
-//	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sumTransferUsers
-//(
-//    id      INTEGER PRIMARY KEY AUTOINCREMENT,
-//    balance INTEGER NOT NULL
-//);`)
-//	if err != nil {
-//		t.Errorf("can't trancfer money: %v", err)
-//	}
-//	_, err = db.Exec(`INSERT INTO sumTransferUsers(id,balance)
-//VALUES (1,0)
-//       ON CONFLICT DO NOTHING;`)
-//	if err != nil {
-//		t.Errorf("can't trancfer money: %v", err)
-//	}
-//
-//	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cards
-//(
-//   id      INTEGER PRIMARY KEY AUTOINCREMENT,
-//   numberCard TEXT NOT NULL,
-//   name    TEXT    NOT NULL,
-//   balance INTEGER NOT NULL CHECK ( balance > 0 ),
-//   user_id INTEGER REFERENCES users(id)
-//);`)
-//	if err != nil {
-//		t.Errorf("can't creat atm to get all atm: %v", err)
-//	}
-//
-//	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (1,"AlifMobi",200,0,"20216000000000001")`)
-//	if err != nil {
-//		t.Errorf("can't get all card, add card: %v", err)
-//	}
-//
-//	_, err = db.Exec(`INSERT INTO cards(id,name, balance, user_id, numberCard) VALUES (2,"AlifMobi",400,1,"20216000000000002")`)
-//	if err != nil {
-//		t.Errorf("can't get all card, add card: %v", err)
-//	}
-//
-//	err = TransferMoney(100, db)
-//	if err != nil {
-//		t.Errorf("can't trancfer money: %v", err)
-//	}
-//
-//}
+func TestTransferMoney_InsufficientFunds(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		err := Session{UserId: 1}.TransferMoney(1, 2, 500, db)
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("Not ErrInsufficientFunds error for transfer: %v", err)
+		}
+		err = Session{UserId: 1}.TransferMoney(1, 2, 200, db)
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("Not ErrInsufficientFunds error for transfer of the whole balance: %v", err)
+		}
+		if cardBalance(t, db, 1) != 200 || cardBalance(t, db, 2) != 400 {
+			t.Error("card balances changed on rejected transfer")
+		}
+
+		err = Session{UserId: 3}.TransferMoney(0, 2, 50, db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for user without card: %v", err)
+		}
+	})
+}
+
+func TestTransferMoney_HasDb(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		err := Session{UserId: 1}.TransferMoney(1, 2, 100, db)
+		if err != nil {
+			t.Errorf("can't trancfer money: %v", err)
+		}
+		if cardBalance(t, db, 1) != 100 || cardBalance(t, db, 2) != 500 {
+			t.Error("card balances not updated on transfer")
+		}
+		if StaticBalanceSumTransfer(db) != 100 {
+			t.Error("sumTransferUsers not updated on transfer")
+		}
+	})
+}
+
+func TestTransferMoney_LogFailureRollback(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		failOperationsLogging(t, db)
+
+		err := Session{UserId: 1}.TransferMoney(1, 2, 100, db)
+		var typedErr *QueryError
+		if ok := errors.As(err, &typedErr); !ok {
+			t.Errorf("error not maptch QueryError: %v", err)
+		}
+		if cardBalance(t, db, 1) != 200 || cardBalance(t, db, 2) != 400 {
+			t.Error("card balances changed on failed operations logging")
+		}
+		if StaticBalanceSumTransfer(db) != 0 {
+			t.Error("sumTransferUsers changed on failed operations logging")
+		}
+	})
+}
+
+func TestAddAtmContext_Canceled(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := AddAtmContext(ctx, "T1", "rudaki 65", 38.5737, 68.7738, db)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Not context.Canceled error for canceled add atm: %v", err)
+		}
+		atms, err := GetAllAtms(db)
+		if err != nil || len(atms) != 0 {
+			t.Errorf("atm added with canceled context: %v, %v", atms, err)
+		}
+	})
+}
+
+func TestExportToFileContext_Canceled(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		dir, err := ioutil.TempDir("", "apm-core")
+		if err != nil {
+			t.Fatalf("can't create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "clients.json")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		mapRow := func(rows *sql.Rows) (interface{}, error) {
+			cancel()
+			return mapRowToClient(rows)
+		}
+		err = ExportToFileContext(ctx, db, exportClientsSQL, filename, mapRow, json.Marshal, mapInterfaceSliceToClients)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Not context.Canceled error for canceled export: %v", err)
+		}
+		_, err = os.Stat(filename)
+		if !os.IsNotExist(err) {
+			t.Errorf("file written by canceled export: %v", err)
+		}
+	})
+}
+
+func TestImportFromFileContext_CanceledRollback(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		dir, err := ioutil.TempDir("", "apm-core")
+		if err != nil {
+			t.Fatalf("can't create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "atms.json")
+		err = ioutil.WriteFile(filename, []byte(`{"Atms":[{"Name":"T1","Address":"rudaki 65"},{"Name":"T2","Address":"rudaki 66"}]}`), 0666)
+		if err != nil {
+			t.Fatalf("can't write import file: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		insertToDB := func(ctx context.Context, tx *sql.Tx, iface interface{}) error {
+			err := insertAtmToDB(ctx, tx, iface)
+			cancel()
+			return err
+		}
+		mapBytes := func(data []byte) ([]interface{}, error) {
+			return mapBytesToAtms(data, json.Unmarshal)
+		}
+		err = ImportFromFileContext(ctx, db, filename, mapBytes, insertToDB)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Not context.Canceled error for canceled import: %v", err)
+		}
+		atms, err := GetAllAtms(db)
+		if err != nil || len(atms) != 0 {
+			t.Errorf("canceled import not rolled back: %v, %v", atms, err)
+		}
+
+		err = ImportFromFile(db, filename, mapBytes, insertAtmToDB)
+		if err != nil {
+			t.Errorf("can't import atms: %v", err)
+		}
+		atms, err = GetAllAtms(db)
+		if err != nil || len(atms) != 2 {
+			t.Errorf("imported atms not match: %v, %v", atms, err)
+		}
+	})
+}
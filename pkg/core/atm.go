@@ -0,0 +1,426 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrAtmNotFound = errors.New("atm not found")
+var ErrInvalidDenomination = errors.New("invalid denomination")
+var ErrAmountNotInDenominations = errors.New("amount can't be made of the atm denominations")
+var ErrOperationNotFound = errors.New("operation not found")
+var ErrOperationReversed = errors.New("operation already reversed")
+
+type AtmOperationResult struct {
+	CardBalance int64
+	OperationId int64
+	Notes       []Cassette
+}
+
+// SetAtmDenominationsContext replaces the banknotes the ATM accepts and pays
+// out. Cassettes of the denominations kept keep their notes; the ones
+// dropped must be empty.
+func SetAtmDenominationsContext(ctx context.Context, atmId int64, denominations []int64, db *sql.DB) (err error) {
+	denominations, err = normalizeDenominations(denominations)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	_, err = selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return err
+	}
+	cassettes, err := selectCassettes(ctx, tx, atmId)
+	if err != nil {
+		return err
+	}
+	for _, cassette := range cassettes {
+		if denominationIn(cassette.Denomination, denominations) {
+			continue
+		}
+		if cassette.Notes > 0 {
+			return ErrCassetteNotEmpty
+		}
+		_, err = tx.ExecContext(ctx, deleteAtmDenominationSQL, atmId, cassette.Denomination)
+		if err != nil {
+			return queryError(deleteAtmDenominationSQL, err)
+		}
+	}
+	for _, denomination := range denominations {
+		_, err = tx.ExecContext(ctx, insertAtmCassetteSQL, atmId, denomination)
+		if err != nil {
+			return queryError(insertAtmCassetteSQL, err)
+		}
+	}
+	return nil
+}
+
+func SetAtmDenominations(atmId int64, denominations []int64, db *sql.DB) error {
+	return SetAtmDenominationsContext(context.Background(), atmId, denominations, db)
+}
+
+// AtmDenominationsContext returns the denominations of the ATM, largest
+// first.
+func AtmDenominationsContext(ctx context.Context, atmId int64, db *sql.DB) ([]int64, error) {
+	cassettes, err := AtmCassettesContext(ctx, atmId, db)
+	if err != nil {
+		return nil, err
+	}
+	return denominationsOf(cassettes), nil
+}
+
+func AtmDenominations(atmId int64, db *sql.DB) ([]int64, error) {
+	return AtmDenominationsContext(context.Background(), atmId, db)
+}
+
+// WithdrawContext pays amount out of the ATM from the session user's card
+// idCard, or from the default card when it is 0. The ATM must be
+// operational, see AtmOperationalContext. The amount must be made of the ATM
+// denominations and is dispensed with the fewest notes the cassettes hold.
+func (receiver Session) WithdrawContext(ctx context.Context, atmId int64, idCard int64, amount int64, db *sql.DB) (AtmOperationResult, error) {
+	return atmOperation(ctx, receiver, atmId, idCard, amount, true, db)
+}
+
+func (receiver Session) Withdraw(atmId int64, idCard int64, amount int64, db *sql.DB) (AtmOperationResult, error) {
+	return receiver.WithdrawContext(context.Background(), atmId, idCard, amount, db)
+}
+
+// DepositContext puts the banknotes of amount on the card like
+// WithdrawContext takes them; the notes go into the cassettes.
+func (receiver Session) DepositContext(ctx context.Context, atmId int64, idCard int64, amount int64, db *sql.DB) (AtmOperationResult, error) {
+	return atmOperation(ctx, receiver, atmId, idCard, amount, false, db)
+}
+
+func (receiver Session) Deposit(atmId int64, idCard int64, amount int64, db *sql.DB) (AtmOperationResult, error) {
+	return receiver.DepositContext(context.Background(), atmId, idCard, amount, db)
+}
+
+// atmOperation changes the card balance and the cassettes by amount and logs
+// it with the ATM in one transaction.
+func atmOperation(ctx context.Context, session Session, atmId int64, idCard int64, amount int64, withdraw bool, db *sql.DB) (result AtmOperationResult, err error) {
+	if amount <= 0 {
+		return result, ErrInvalidAmount
+	}
+	change, name := amount, OperationAtmDeposit
+	if withdraw {
+		change, name = -amount, OperationAtmWithdraw
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			result = AtmOperationResult{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			result = AtmOperationResult{}
+		}
+	}()
+
+	atm, err := selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return result, err
+	}
+	err = checkAtmOperational(ctx, tx, atm, time.Now())
+	if err != nil {
+		return result, err
+	}
+	cassettes, err := selectCassettes(ctx, tx, atmId)
+	if err != nil {
+		return result, err
+	}
+	if !payableIn(denominationsOf(cassettes), amount) {
+		return result, ErrAmountNotInDenominations
+	}
+
+	card, err := selectSenderCard(ctx, tx, session.UserId, idCard)
+	if err != nil {
+		return result, err
+	}
+	if card.balance+change <= 0 {
+		return result, ErrInsufficientFunds
+	}
+	sign := int64(1)
+	if withdraw {
+		var ok bool
+		result.Notes, ok = noteMix(cassettes, amount)
+		if !ok {
+			return result, ErrNotEnoughCash
+		}
+		sign = -1
+	} else {
+		result.Notes = depositMix(denominationsOf(cassettes), amount)
+	}
+	_, err = tx.ExecContext(ctx, addBalanceToCardSQL, change, card.id)
+	if err != nil {
+		return result, queryError(addBalanceToCardSQL, err)
+	}
+	err = addCassetteNotes(ctx, tx, atmId, result.Notes, sign)
+	if err != nil {
+		return result, err
+	}
+
+	result.OperationId, err = logAtmOperation(ctx, tx, DialectOf(db), name, time.Now(), atm, change, session.UserId, card.id)
+	if err != nil {
+		return result, err
+	}
+	if withdraw {
+		for _, cassette := range result.Notes {
+			_, err = tx.ExecContext(ctx, insertAtmWithdrawalNotesSQL, result.OperationId, cassette.Denomination, cassette.Notes)
+			if err != nil {
+				return result, queryError(insertAtmWithdrawalNotesSQL, err)
+			}
+		}
+	}
+	err = postJournal(ctx, tx, DialectOf(db), result.OperationId, string(name),
+		Posting{Account: CardAccount(card.id), Amount: -change},
+		Posting{Account: AtmAccount(atm.Id), Amount: change},
+	)
+	if err != nil {
+		return result, err
+	}
+	result.CardBalance = card.balance + change
+	return result, nil
+}
+
+// ReverseAtmWithdrawalContext puts the amount of the ATM withdrawal
+// operationId back on its card, for an ATM that couldn't dispense the notes.
+// atmId, idCard and amount must match the withdrawal. The notes the
+// withdrawal took go back into the cassettes, as the ATM retracts them;
+// withdrawals from before notes were recorded give none back. The card is
+// credited whatever its status.
+func ReverseAtmWithdrawalContext(ctx context.Context, atmId int64, operationId int64, idCard int64, amount int64, db *sql.DB) (result AtmOperationResult, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			result = AtmOperationResult{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			result = AtmOperationResult{}
+		}
+	}()
+
+	var name OperationType
+	var userId, withdrawalAtmId, cardId, balance int64
+	err = tx.QueryRowContext(ctx, selectAtmOperationSQL, operationId).Scan(&name, &userId, &withdrawalAtmId, &cardId, &balance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return result, ErrOperationNotFound
+		}
+		return result, queryError(selectAtmOperationSQL, err)
+	}
+	if name != OperationAtmWithdraw || withdrawalAtmId != atmId || cardId != idCard || -balance != amount {
+		return result, ErrOperationNotFound
+	}
+	var reversals int
+	err = tx.QueryRowContext(ctx, countAtmReversalSQL, operationId).Scan(&reversals)
+	if err != nil {
+		return result, queryError(countAtmReversalSQL, err)
+	}
+	if reversals > 0 {
+		return result, ErrOperationReversed
+	}
+
+	atm, err := selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return result, err
+	}
+	notes, err := selectWithdrawalNotes(ctx, tx, operationId)
+	if err != nil {
+		return result, err
+	}
+	err = addCassetteNotes(ctx, tx, atm.Id, notes, 1)
+	if err != nil {
+		return result, err
+	}
+	_, err = tx.ExecContext(ctx, addBalanceToCardSQL, amount, cardId)
+	if err != nil {
+		return result, queryError(addBalanceToCardSQL, err)
+	}
+	err = tx.QueryRowContext(ctx, selectBalanceToCardRecipientSQL, cardId).Scan(&result.CardBalance)
+	if err != nil {
+		return result, queryError(selectBalanceToCardRecipientSQL, err)
+	}
+	result.OperationId, err = logAtmOperation(ctx, tx, DialectOf(db), OperationAtmReversal, time.Now(), atm, amount, userId, cardId)
+	if err != nil {
+		return result, err
+	}
+	err = postJournal(ctx, tx, DialectOf(db), result.OperationId, string(OperationAtmReversal),
+		Posting{Account: AtmAccount(atm.Id), Amount: amount},
+		Posting{Account: CardAccount(cardId), Amount: -amount},
+	)
+	if err != nil {
+		return result, err
+	}
+	_, err = tx.ExecContext(ctx, insertAtmReversalSQL, operationId, result.OperationId)
+	if err != nil {
+		return result, queryError(insertAtmReversalSQL, err)
+	}
+	return result, nil
+}
+
+func ReverseAtmWithdrawal(atmId int64, operationId int64, idCard int64, amount int64, db *sql.DB) (AtmOperationResult, error) {
+	return ReverseAtmWithdrawalContext(context.Background(), atmId, operationId, idCard, amount, db)
+}
+
+func selectWithdrawalNotes(ctx context.Context, tx *sql.Tx, operationId int64) (notes []Cassette, err error) {
+	rows, err := tx.QueryContext(ctx, getAtmWithdrawalNotesSQL, operationId)
+	if err != nil {
+		return nil, queryError(getAtmWithdrawalNotesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			notes, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		cassette := Cassette{}
+		err = rows.Scan(&cassette.Denomination, &cassette.Notes)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		notes = append(notes, cassette)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return notes, nil
+}
+
+func selectAtm(ctx context.Context, tx *sql.Tx, atmId int64) (atm Atm, err error) {
+	err = tx.QueryRowContext(ctx, selectAtmSQL, atmId).Scan(&atm.Id, &atm.Name, &atm.Address, &atm.Latitude, &atm.Longitude, &atm.Status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return atm, ErrAtmNotFound
+		}
+		return atm, queryError(selectAtmSQL, err)
+	}
+	return atm, nil
+}
+
+// logAtmOperation logs an operation at the ATM; the ATM name stands in
+// recipientSender where transfers have the other card.
+func logAtmOperation(ctx context.Context, tx *sql.Tx, dialect Dialect, name OperationType, t time.Time, atm Atm, balance int64, userId int64, cardId int64) (int64, error) {
+	return insertOperation(ctx, tx, dialect, insertAtmOperationsLoggingSQL, name, formatTimestamp(t), atm.Name, balance, userId, atm.Id, cardId)
+}
+
+// normalizeDenominations sorts denominations largest first without
+// duplicates.
+func normalizeDenominations(denominations []int64) ([]int64, error) {
+	normalized := make([]int64, 0, len(denominations))
+	for _, denomination := range denominations {
+		if denomination <= 0 {
+			return nil, ErrInvalidDenomination
+		}
+		normalized = append(normalized, denomination)
+	}
+	sort.Slice(normalized, func(i, j int) bool { return normalized[i] > normalized[j] })
+
+	unique := normalized[:0]
+	for i, denomination := range normalized {
+		if i == 0 || denomination != normalized[i-1] {
+			unique = append(unique, denomination)
+		}
+	}
+	return unique, nil
+}
+
+// payableIn reports whether amount is a sum of banknotes of denominations,
+// any number of each.
+func payableIn(denominations []int64, amount int64) bool {
+	if len(denominations) == 0 || amount <= 0 {
+		return false
+	}
+	divisor := denominations[0]
+	for _, denomination := range denominations[1:] {
+		divisor = gcd(divisor, denomination)
+	}
+	if amount%divisor != 0 {
+		return false
+	}
+
+	// With the common divisor taken out, every sum from
+	// (smallest-1)*(largest-1) on can be paid (Schur's bound), so only
+	// smaller ones need to be searched.
+	notes := make([]int64, len(denominations))
+	smallest, largest := denominations[0]/divisor, denominations[0]/divisor
+	for i, denomination := range denominations {
+		notes[i] = denomination / divisor
+		if notes[i] < smallest {
+			smallest = notes[i]
+		}
+		if notes[i] > largest {
+			largest = notes[i]
+		}
+	}
+	target := amount / divisor
+	if target >= (smallest-1)*(largest-1) {
+		return true
+	}
+
+	payable := make([]bool, target+1)
+	payable[0] = true
+	for sum := int64(1); sum <= target; sum++ {
+		for _, note := range notes {
+			if note <= sum && payable[sum-note] {
+				payable[sum] = true
+				break
+			}
+		}
+	}
+	return payable[target]
+}
+
+func denominationIn(denomination int64, denominations []int64) bool {
+	for _, d := range denominations {
+		if d == denomination {
+			return true
+		}
+	}
+	return false
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,350 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPayableIn(t *testing.T) {
+	tests := []struct {
+		denominations []int64
+		amount        int64
+		want          bool
+	}{
+		{[]int64{100, 50, 20}, 70, true},
+		{[]int64{100, 50, 20}, 30, false},
+		{[]int64{100, 50, 20}, 110, true},
+		{[]int64{100, 50, 20}, 15, false},
+		{[]int64{100, 50, 20}, 1000000, true},
+		{[]int64{50, 20}, 60, true},
+		{[]int64{50, 20}, 10, false},
+		{[]int64{500}, 1500, true},
+		{[]int64{500}, 1200, false},
+		{nil, 100, false},
+		{[]int64{100}, 0, false},
+	}
+	for _, test := range tests {
+		got := payableIn(test.denominations, test.amount)
+		if got != test.want {
+			t.Errorf("payableIn(%v, %d) = %v, want %v", test.denominations, test.amount, got, test.want)
+		}
+	}
+}
+
+func TestAtmDenominations(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		err := AddAtm("T1", "rudaki 65", 38.5737, 68.7738, db)
+		if err != nil {
+			t.Fatalf("can't add atm: %v", err)
+		}
+
+		err = SetAtmDenominations(1, []int64{20, 100, 50, 20}, db)
+		if err != nil {
+			t.Errorf("can't set denominations: %v", err)
+		}
+		denominations, err := AtmDenominations(1, db)
+		if err != nil || !reflect.DeepEqual(denominations, []int64{100, 50, 20}) {
+			t.Errorf("denominations not match: %v, %v", denominations, err)
+		}
+		err = SetAtmDenominations(1, []int64{100, 0}, db)
+		if !errors.Is(err, ErrInvalidDenomination) {
+			t.Errorf("Not ErrInvalidDenomination error: %v", err)
+		}
+		err = SetAtmDenominations(9, []int64{100}, db)
+		if !errors.Is(err, ErrAtmNotFound) {
+			t.Errorf("Not ErrAtmNotFound error: %v", err)
+		}
+	})
+}
+
+func TestWithdrawDeposit(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		err := AddAtm("T1", "rudaki 65", 38.5737, 68.7738, db)
+		if err != nil {
+			t.Fatalf("can't add atm: %v", err)
+		}
+		vasya := Session{UserId: 1}
+
+		_, err = vasya.Withdraw(1, 1, 50, db)
+		if !errors.Is(err, ErrAmountNotInDenominations) {
+			t.Errorf("Not ErrAmountNotInDenominations error for atm without denominations: %v", err)
+		}
+		err = SetAtmDenominations(1, []int64{50, 20}, db)
+		if err != nil {
+			t.Fatalf("can't set denominations: %v", err)
+		}
+		err = ReplenishAtm(1, []Cassette{{Denomination: 50, Notes: 10}, {Denomination: 20, Notes: 10}}, db)
+		if err != nil {
+			t.Fatalf("can't replenish atm: %v", err)
+		}
+
+		result, err := vasya.Withdraw(1, 1, 60, db)
+		if err != nil || result.CardBalance != 140 || result.OperationId == 0 || !reflect.DeepEqual(result.Notes, []Cassette{{Denomination: 20, Notes: 3}}) {
+			t.Errorf("can't withdraw: %v, %v", result, err)
+		}
+		result, err = vasya.Deposit(1, 0, 120, db)
+		if err != nil || result.CardBalance != 260 || !reflect.DeepEqual(result.Notes, []Cassette{{Denomination: 50, Notes: 2}, {Denomination: 20, Notes: 1}}) {
+			t.Errorf("can't deposit: %v, %v", result, err)
+		}
+		if balance := cardBalance(t, db, 1); balance != 260 {
+			t.Errorf("card balance not match: %d", balance)
+		}
+
+		_, err = vasya.Withdraw(1, 1, 30, db)
+		if !errors.Is(err, ErrAmountNotInDenominations) {
+			t.Errorf("Not ErrAmountNotInDenominations error: %v", err)
+		}
+		_, err = vasya.Withdraw(1, 1, 1000, db)
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("Not ErrInsufficientFunds error: %v", err)
+		}
+		_, err = vasya.Withdraw(1, 1, 260, db)
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("Not ErrInsufficientFunds error for the whole balance: %v", err)
+		}
+		_, err = vasya.Deposit(1, 1, -100, db)
+		if !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("Not ErrInvalidAmount error: %v", err)
+		}
+		_, err = vasya.Withdraw(1, 2, 50, db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for foreign card: %v", err)
+		}
+		_, err = vasya.Withdraw(9, 1, 50, db)
+		if !errors.Is(err, ErrAtmNotFound) {
+			t.Errorf("Not ErrAtmNotFound error: %v", err)
+		}
+		err = BlockCard(1, db)
+		if err != nil {
+			t.Fatalf("can't block card: %v", err)
+		}
+		_, err = vasya.Deposit(1, 1, 50, db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("Not ErrCardNotActive error for blocked card: %v", err)
+		}
+		if balance := cardBalance(t, db, 1); balance != 260 {
+			t.Errorf("card balance changed by failed operations: %d", balance)
+		}
+
+		opLogs, err := vasya.ViewOperationsLogging(db)
+		want := []OperationsLogging{
+			{Id: 2, Name: "atmWithdraw", RecipientSender: "T1", Balance: -60, Atm_id: 1, Card_id: 1},
+			{Id: 3, Name: "atmDeposit", RecipientSender: "T1", Balance: 120, Atm_id: 1, Card_id: 1},
+		}
+		if err != nil || len(opLogs) != len(want) {
+			t.Fatalf("operations logging not match: %v, %v", opLogs, err)
+		}
+		for i := range want {
+			if opLogs[i].Time.IsZero() || opLogs[i].Time.Location() != time.UTC {
+				t.Errorf("operation %d time not UTC: %v", i, opLogs[i].Time)
+			}
+			opLogs[i].Time = time.Time{}
+			if opLogs[i] != want[i] {
+				t.Errorf("operation %d not match: %v, want %v", i, opLogs[i], want[i])
+			}
+		}
+	})
+}
+
+func TestReverseAtmWithdrawal(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openAtmDb(t, driver)
+		defer closeDb()
+		vasya := Session{UserId: 1}
+
+		withdrawal, err := vasya.Withdraw(1, 1, 120, db)
+		if err != nil {
+			t.Fatalf("can't withdraw: %v", err)
+		}
+		deposit, err := vasya.Deposit(1, 1, 50, db)
+		if err != nil {
+			t.Fatalf("can't deposit: %v", err)
+		}
+
+		_, err = ReverseAtmWithdrawal(2, withdrawal.OperationId, 1, 120, db)
+		if !errors.Is(err, ErrOperationNotFound) {
+			t.Errorf("Not ErrOperationNotFound error for other atm: %v", err)
+		}
+		_, err = ReverseAtmWithdrawal(1, withdrawal.OperationId, 2, 120, db)
+		if !errors.Is(err, ErrOperationNotFound) {
+			t.Errorf("Not ErrOperationNotFound error for other card: %v", err)
+		}
+		_, err = ReverseAtmWithdrawal(1, withdrawal.OperationId, 1, 100, db)
+		if !errors.Is(err, ErrOperationNotFound) {
+			t.Errorf("Not ErrOperationNotFound error for other amount: %v", err)
+		}
+		_, err = ReverseAtmWithdrawal(1, deposit.OperationId, 1, 50, db)
+		if !errors.Is(err, ErrOperationNotFound) {
+			t.Errorf("Not ErrOperationNotFound error for deposit: %v", err)
+		}
+		_, err = ReverseAtmWithdrawal(1, 99, 1, 120, db)
+		if !errors.Is(err, ErrOperationNotFound) {
+			t.Errorf("Not ErrOperationNotFound error for unknown operation: %v", err)
+		}
+
+		err = BlockCard(1, db)
+		if err != nil {
+			t.Fatalf("can't block card: %v", err)
+		}
+		reversal, err := ReverseAtmWithdrawal(1, withdrawal.OperationId, 1, 120, db)
+		if err != nil {
+			t.Fatalf("can't reverse withdrawal: %v", err)
+		}
+		if reversal.CardBalance != 250 || reversal.OperationId != deposit.OperationId+1 {
+			t.Errorf("reversal not match: %+v", reversal)
+		}
+		if balance := cardBalance(t, db, 1); balance != 250 {
+			t.Errorf("card balance not match: %d", balance)
+		}
+		_, err = ReverseAtmWithdrawal(1, withdrawal.OperationId, 1, 120, db)
+		if !errors.Is(err, ErrOperationReversed) {
+			t.Errorf("Not ErrOperationReversed error: %v", err)
+		}
+
+		cassettes, err := AtmCassettes(1, db)
+		want := []Cassette{{Denomination: 50, Notes: 11}, {Denomination: 20, Notes: 10}}
+		if err != nil || !reflect.DeepEqual(cassettes, want) {
+			t.Errorf("cassettes not match: %v, want %v: %v", cassettes, want, err)
+		}
+		opLogs, err := vasya.ViewOperationsLogging(db)
+		if err != nil || len(opLogs) != 3 {
+			t.Fatalf("operations logging not match: %v, %v", opLogs, err)
+		}
+		opLogs[2].Time = time.Time{}
+		if opLog := (OperationsLogging{Id: reversal.OperationId, Name: "atmReversal", RecipientSender: "T1", Balance: 120, Atm_id: 1, Card_id: 1}); opLogs[2] != opLog {
+			t.Errorf("reversal log not match: %v, want %v", opLogs[2], opLog)
+		}
+	})
+}
+
+func TestNoteMix(t *testing.T) {
+	tests := []struct {
+		cassettes []Cassette
+		amount    int64
+		want      []Cassette
+		ok        bool
+	}{
+		{[]Cassette{{100, 5}, {50, 5}, {20, 5}}, 160, []Cassette{{100, 1}, {20, 3}}, true},
+		{[]Cassette{{100, 0}, {50, 5}, {20, 5}}, 160, []Cassette{{50, 2}, {20, 3}}, true},
+		{[]Cassette{{100, 5}, {50, 1}, {20, 1}}, 60, nil, false},
+		{[]Cassette{{50, 2}, {20, 5}}, 60, []Cassette{{20, 3}}, true},
+		{[]Cassette{{50, 2}, {20, 5}}, 200, []Cassette{{50, 2}, {20, 5}}, true},
+		{[]Cassette{{50, 2}, {20, 5}}, 220, nil, false},
+		{[]Cassette{{25, 4}, {10, 10}, {1, 3}}, 30, []Cassette{{10, 3}}, true},
+		{[]Cassette{{5000, 1000000}, {1, 3}}, 5000*999999 + 2, []Cassette{{5000, 999999}, {1, 2}}, true},
+		{[]Cassette{{5000, 1000000}, {4999, 1000000}}, 5000*999000 + 4999, []Cassette{{5000, 999000}, {4999, 1}}, true},
+		{[]Cassette{{5000, 1000000}, {1, 3}}, 5000*999999 + 4, nil, false},
+		{nil, 100, nil, false},
+	}
+	for _, test := range tests {
+		got, ok := noteMix(test.cassettes, test.amount)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("noteMix(%v, %d) = %v, %v, want %v, %v", test.cassettes, test.amount, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestDepositMix(t *testing.T) {
+	for _, amount := range []int64{20, 70, 110, 980, 123450} {
+		var sum int64
+		for _, cassette := range depositMix([]int64{100, 50, 20}, amount) {
+			sum += cassette.Denomination * cassette.Notes
+		}
+		if sum != amount {
+			t.Errorf("depositMix of %d sums to %d", amount, sum)
+		}
+	}
+}
+
+func TestAtmCassettes(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		for _, atm := range []Atm{{Name: "T1", Address: "rudaki 65", Latitude: 38.5737, Longitude: 68.7738}, {Name: "T2", Address: "somoni 77", Latitude: 38.5812, Longitude: 68.7712}} {
+			err := AddAtm(atm.Name, atm.Address, atm.Latitude, atm.Longitude, db)
+			if err != nil {
+				t.Fatalf("can't add atm: %v", err)
+			}
+		}
+		err := SetAtmDenominations(1, []int64{100, 50}, db)
+		if err != nil {
+			t.Fatalf("can't set denominations: %v", err)
+		}
+
+		err = ReplenishAtm(1, []Cassette{{Denomination: 100, Notes: 10}, {Denomination: 50, Notes: 4}}, db)
+		if err != nil {
+			t.Errorf("can't replenish atm: %v", err)
+		}
+		err = ReplenishAtm(1, []Cassette{{Denomination: 20, Notes: 10}}, db)
+		if !errors.Is(err, ErrInvalidDenomination) {
+			t.Errorf("Not ErrInvalidDenomination error: %v", err)
+		}
+		err = ReplenishAtm(1, []Cassette{{Denomination: 100, Notes: -1}}, db)
+		if !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("Not ErrInvalidAmount error: %v", err)
+		}
+		err = ReplenishAtm(9, []Cassette{{Denomination: 100, Notes: 1}}, db)
+		if !errors.Is(err, ErrAtmNotFound) {
+			t.Errorf("Not ErrAtmNotFound error: %v", err)
+		}
+
+		err = SetAtmDenominations(1, []int64{100, 20}, db)
+		if !errors.Is(err, ErrCassetteNotEmpty) {
+			t.Errorf("Not ErrCassetteNotEmpty error: %v", err)
+		}
+		err = SetAtmDenominations(1, []int64{100, 50, 20}, db)
+		if err != nil {
+			t.Errorf("can't add denomination: %v", err)
+		}
+		cassettes, err := AtmCassettes(1, db)
+		want := []Cassette{{Denomination: 100, Notes: 10}, {Denomination: 50, Notes: 4}, {Denomination: 20, Notes: 0}}
+		if err != nil || !reflect.DeepEqual(cassettes, want) {
+			t.Errorf("cassettes not match: %v, %v", cassettes, err)
+		}
+
+		lowCash, err := LowCashAtms(1500, db)
+		want2 := []AtmCash{
+			{Atm: Atm{Id: 2, Name: "T2", Address: "somoni 77", Latitude: 38.5812, Longitude: 68.7712, Status: AtmOnline}, Cash: 0},
+			{Atm: Atm{Id: 1, Name: "T1", Address: "rudaki 65", Latitude: 38.5737, Longitude: 68.7738, Status: AtmOnline}, Cash: 1200},
+		}
+		if err != nil || !reflect.DeepEqual(lowCash, want2) {
+			t.Errorf("low cash atms not match: %v, %v", lowCash, err)
+		}
+		lowCash, err = LowCashAtms(1000, db)
+		if err != nil || len(lowCash) != 1 || lowCash[0].Atm.Id != 2 {
+			t.Errorf("low cash atms not match: %v, %v", lowCash, err)
+		}
+
+		_, err = Session{UserId: 2}.Withdraw(1, 2, 250, db)
+		if err != nil {
+			t.Errorf("can't withdraw: %v", err)
+		}
+		_, err = Session{UserId: 2}.Withdraw(1, 2, 20, db)
+		if !errors.Is(err, ErrNotEnoughCash) {
+			t.Errorf("Not ErrNotEnoughCash error for empty cassette: %v", err)
+		}
+
+		collected, err := CollectAtm(1, db)
+		if err != nil || !reflect.DeepEqual(collected, []Cassette{{Denomination: 100, Notes: 8}, {Denomination: 50, Notes: 3}}) {
+			t.Errorf("collected not match: %v, %v", collected, err)
+		}
+		cassettes, err = AtmCassettes(1, db)
+		if err != nil || cassettes[0].Notes != 0 || cassettes[1].Notes != 0 {
+			t.Errorf("cassettes not empty after collect: %v, %v", cassettes, err)
+		}
+
+		opLogs, err := ViewAllOperationsLogging(db)
+		if err != nil || len(opLogs) != 3 || opLogs[0].Name != "atmReplenish" || opLogs[0].Balance != 1200 || opLogs[2].Name != "atmCollect" || opLogs[2].Balance != -950 || opLogs[2].Atm_id != 1 {
+			t.Errorf("operations logging not match: %v, %v", opLogs, err)
+		}
+	})
+}
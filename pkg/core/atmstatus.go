@@ -0,0 +1,387 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrInvalidAtmStatus = errors.New("invalid atm status")
+var ErrInvalidWorkingHours = errors.New("invalid working hours")
+var ErrInvalidMaintenanceWindow = errors.New("invalid maintenance window")
+var ErrAtmNotOperational = errors.New("atm not operational")
+
+type AtmStatus string
+
+const (
+	AtmOnline       AtmStatus = "online"
+	AtmOffline      AtmStatus = "offline"
+	AtmOutOfService AtmStatus = "out_of_service"
+	AtmMaintenance  AtmStatus = "maintenance"
+)
+
+// WorkingHours is when the ATM works on Weekday, in minutes since midnight
+// of the server's local time, Closes excluded. An ATM without working hours
+// works around the clock; one with hours is closed on the days it has none.
+type WorkingHours struct {
+	Weekday time.Weekday
+	Opens   int
+	Closes  int
+}
+
+type MaintenanceWindow struct {
+	Id       int64
+	StartsAt time.Time
+	EndsAt   time.Time
+}
+
+type AtmStatusChange struct {
+	From      AtmStatus
+	To        AtmStatus
+	Reason    string
+	ChangedAt time.Time
+}
+
+func validAtmStatus(status AtmStatus) bool {
+	switch status {
+	case AtmOnline, AtmOffline, AtmOutOfService, AtmMaintenance:
+		return true
+	}
+	return false
+}
+
+// SetAtmStatusContext changes the status of the ATM and records the change
+// in its status history; setting the current status changes nothing.
+func SetAtmStatusContext(ctx context.Context, atmId int64, status AtmStatus, reason string, db *sql.DB) (err error) {
+	if !validAtmStatus(status) {
+		return ErrInvalidAtmStatus
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	atm, err := selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return err
+	}
+	if atm.Status == status {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, updateStatusAtmSQL, status, atmId)
+	if err != nil {
+		return queryError(updateStatusAtmSQL, err)
+	}
+	_, err = tx.ExecContext(ctx, insertAtmStatusHistorySQL, atmId, atm.Status, status, reason, formatTimestamp(time.Now()))
+	if err != nil {
+		return queryError(insertAtmStatusHistorySQL, err)
+	}
+	return nil
+}
+
+func SetAtmStatus(atmId int64, status AtmStatus, reason string, db *sql.DB) error {
+	return SetAtmStatusContext(context.Background(), atmId, status, reason, db)
+}
+
+// AtmStatusHistoryContext returns the status changes of the ATM, oldest
+// first.
+func AtmStatusHistoryContext(ctx context.Context, atmId int64, db *sql.DB) (changes []AtmStatusChange, err error) {
+	rows, err := db.QueryContext(ctx, getAtmStatusHistorySQL, atmId)
+	if err != nil {
+		return nil, queryError(getAtmStatusHistorySQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			changes, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		change := AtmStatusChange{}
+		var changedAt string
+		err = rows.Scan(&change.From, &change.To, &change.Reason, &changedAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		change.ChangedAt, err = parseTimestamp(changedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return changes, nil
+}
+
+func AtmStatusHistory(atmId int64, db *sql.DB) ([]AtmStatusChange, error) {
+	return AtmStatusHistoryContext(context.Background(), atmId, db)
+}
+
+// SetAtmWorkingHoursContext replaces the weekly working hours of the ATM; no
+// hours make it work around the clock.
+func SetAtmWorkingHoursContext(ctx context.Context, atmId int64, hours []WorkingHours, db *sql.DB) (err error) {
+	err = checkWorkingHours(hours)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	_, err = selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, deleteAtmWorkingHoursSQL, atmId)
+	if err != nil {
+		return queryError(deleteAtmWorkingHoursSQL, err)
+	}
+	for _, day := range hours {
+		_, err = tx.ExecContext(ctx, insertAtmWorkingHoursSQL, atmId, int(day.Weekday), day.Opens, day.Closes)
+		if err != nil {
+			return queryError(insertAtmWorkingHoursSQL, err)
+		}
+	}
+	return nil
+}
+
+func SetAtmWorkingHours(atmId int64, hours []WorkingHours, db *sql.DB) error {
+	return SetAtmWorkingHoursContext(context.Background(), atmId, hours, db)
+}
+
+func AtmWorkingHoursContext(ctx context.Context, atmId int64, db *sql.DB) (hours []WorkingHours, err error) {
+	rows, err := db.QueryContext(ctx, getAtmWorkingHoursSQL, atmId)
+	if err != nil {
+		return nil, queryError(getAtmWorkingHoursSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			hours, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		day := WorkingHours{}
+		err = rows.Scan(&day.Weekday, &day.Opens, &day.Closes)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		hours = append(hours, day)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return hours, nil
+}
+
+func AtmWorkingHours(atmId int64, db *sql.DB) ([]WorkingHours, error) {
+	return AtmWorkingHoursContext(context.Background(), atmId, db)
+}
+
+// ScheduleAtmMaintenanceContext plans a maintenance of the ATM from startsAt
+// until endsAt, during which it refuses operations whatever its status.
+func ScheduleAtmMaintenanceContext(ctx context.Context, atmId int64, startsAt, endsAt time.Time, db *sql.DB) (id int64, err error) {
+	if !startsAt.Before(endsAt) {
+		return 0, ErrInvalidMaintenanceWindow
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			id = 0
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			id = 0
+		}
+	}()
+
+	_, err = selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return 0, err
+	}
+	return DialectOf(db).insertId(ctx, tx, insertAtmMaintenanceSQL, atmId, formatTimestamp(startsAt), formatTimestamp(endsAt))
+}
+
+func ScheduleAtmMaintenance(atmId int64, startsAt, endsAt time.Time, db *sql.DB) (int64, error) {
+	return ScheduleAtmMaintenanceContext(context.Background(), atmId, startsAt, endsAt, db)
+}
+
+// AtmMaintenanceWindowsContext returns the maintenance windows of the ATM
+// that haven't ended at the given time, earliest first.
+func AtmMaintenanceWindowsContext(ctx context.Context, atmId int64, at time.Time, db *sql.DB) (windows []MaintenanceWindow, err error) {
+	rows, err := db.QueryContext(ctx, getAtmMaintenanceSQL, atmId, formatTimestamp(at))
+	if err != nil {
+		return nil, queryError(getAtmMaintenanceSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			windows, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		window := MaintenanceWindow{}
+		var startsAt, endsAt string
+		err = rows.Scan(&window.Id, &startsAt, &endsAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		window.StartsAt, err = parseTimestamp(startsAt)
+		if err != nil {
+			return nil, err
+		}
+		window.EndsAt, err = parseTimestamp(endsAt)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return windows, nil
+}
+
+func AtmMaintenanceWindows(atmId int64, at time.Time, db *sql.DB) ([]MaintenanceWindow, error) {
+	return AtmMaintenanceWindowsContext(context.Background(), atmId, at, db)
+}
+
+// AtmOperationalContext returns ErrAtmNotOperational unless the ATM is
+// online, within its working hours and out of maintenance at the given time.
+func AtmOperationalContext(ctx context.Context, atmId int64, at time.Time, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	atm, err := selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return err
+	}
+	return checkAtmOperational(ctx, tx, atm, at)
+}
+
+func AtmOperational(atmId int64, at time.Time, db *sql.DB) error {
+	return AtmOperationalContext(context.Background(), atmId, at, db)
+}
+
+func checkAtmOperational(ctx context.Context, tx *sql.Tx, atm Atm, at time.Time) error {
+	if atm.Status != AtmOnline {
+		return ErrAtmNotOperational
+	}
+
+	rows, err := tx.QueryContext(ctx, getAtmWorkingHoursSQL, atm.Id)
+	if err != nil {
+		return queryError(getAtmWorkingHoursSQL, err)
+	}
+	var hours []WorkingHours
+	for rows.Next() {
+		day := WorkingHours{}
+		err = rows.Scan(&day.Weekday, &day.Opens, &day.Closes)
+		if err != nil {
+			_ = rows.Close()
+			return dbError(err)
+		}
+		hours = append(hours, day)
+	}
+	if rows.Err() != nil {
+		_ = rows.Close()
+		return dbError(rows.Err())
+	}
+	err = rows.Close()
+	if err != nil {
+		return dbError(err)
+	}
+	if !openAt(hours, at) {
+		return ErrAtmNotOperational
+	}
+
+	var maintenance int
+	err = tx.QueryRowContext(ctx, countAtmMaintenanceAtSQL, atm.Id, formatTimestamp(at)).Scan(&maintenance)
+	if err != nil {
+		return queryError(countAtmMaintenanceAtSQL, err)
+	}
+	if maintenance > 0 {
+		return ErrAtmNotOperational
+	}
+	return nil
+}
+
+func openAt(hours []WorkingHours, at time.Time) bool {
+	if len(hours) == 0 {
+		return true
+	}
+	minute := at.Hour()*60 + at.Minute()
+	for _, day := range hours {
+		if day.Weekday == at.Weekday() && day.Opens <= minute && minute < day.Closes {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWorkingHours accepts at most one interval a day within the day.
+func checkWorkingHours(hours []WorkingHours) error {
+	var seen [7]bool
+	for _, day := range hours {
+		if day.Weekday < time.Sunday || day.Weekday > time.Saturday || seen[day.Weekday] {
+			return ErrInvalidWorkingHours
+		}
+		if day.Opens < 0 || day.Closes > 24*60 || day.Opens >= day.Closes {
+			return ErrInvalidWorkingHours
+		}
+		seen[day.Weekday] = true
+	}
+	return nil
+}
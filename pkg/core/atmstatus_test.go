@@ -0,0 +1,213 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenAt(t *testing.T) {
+	monday := time.Date(2020, 3, 2, 9, 30, 0, 0, time.Local)
+	hours := []WorkingHours{{Weekday: time.Monday, Opens: 9 * 60, Closes: 18 * 60}}
+	tests := []struct {
+		name  string
+		hours []WorkingHours
+		at    time.Time
+		want  bool
+	}{
+		{"no hours", nil, monday, true},
+		{"open", hours, monday, true},
+		{"opens", hours, monday.Add(-30 * time.Minute), true},
+		{"before opening", hours, monday.Add(-31 * time.Minute), false},
+		{"closes", hours, monday.Add(8*time.Hour + 30*time.Minute), false},
+		{"other day", hours, monday.AddDate(0, 0, 1), false},
+	}
+	for _, test := range tests {
+		if got := openAt(test.hours, test.at); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func openAtmDb(t *testing.T, driver string) (db *sql.DB, closeDb func()) {
+	db, closeDb = openTransferDb(t, driver)
+	err := AddAtm("T1", "rudaki 65", 38.5737, 68.7738, db)
+	if err != nil {
+		closeDb()
+		t.Fatalf("can't add atm: %v", err)
+	}
+	err = SetAtmDenominations(1, []int64{50, 20}, db)
+	if err != nil {
+		closeDb()
+		t.Fatalf("can't set denominations: %v", err)
+	}
+	err = ReplenishAtm(1, []Cassette{{Denomination: 50, Notes: 10}, {Denomination: 20, Notes: 10}}, db)
+	if err != nil {
+		closeDb()
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+	return db, closeDb
+}
+
+func TestAtmStatus(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openAtmDb(t, driver)
+		defer closeDb()
+		vasya := Session{UserId: 1}
+
+		err := SetAtmStatus(1, AtmOffline, "no network", db)
+		if err != nil {
+			t.Errorf("can't set atm status: %v", err)
+		}
+		_, err = vasya.Withdraw(1, 1, 50, db)
+		if !errors.Is(err, ErrAtmNotOperational) {
+			t.Errorf("Not ErrAtmNotOperational error for offline atm: %v", err)
+		}
+		_, err = vasya.Deposit(1, 1, 50, db)
+		if !errors.Is(err, ErrAtmNotOperational) {
+			t.Errorf("Not ErrAtmNotOperational error for offline atm: %v", err)
+		}
+		found, err := FindNearestAtms(38.5737, 68.7738, 1, 0, AtmFilter{Status: AtmOnline}, db)
+		if err != nil || len(found) != 0 {
+			t.Errorf("found offline atm: %v, %v", found, err)
+		}
+		found, err = FindNearestAtms(38.5737, 68.7738, 1, 0, AtmFilter{Status: AtmOffline}, db)
+		if err != nil || len(found) != 1 || found[0].Atm.Status != AtmOffline {
+			t.Errorf("offline atm not found: %v, %v", found, err)
+		}
+
+		err = SetAtmStatus(1, AtmOffline, "still no network", db)
+		if err != nil {
+			t.Errorf("can't set same atm status: %v", err)
+		}
+		err = SetAtmStatus(1, AtmOnline, "", db)
+		if err != nil {
+			t.Errorf("can't set atm status: %v", err)
+		}
+		_, err = vasya.Withdraw(1, 1, 50, db)
+		if err != nil {
+			t.Errorf("can't withdraw from online atm: %v", err)
+		}
+
+		history, err := AtmStatusHistory(1, db)
+		if err != nil || len(history) != 2 {
+			t.Fatalf("status history not match: %v, %v", history, err)
+		}
+		if history[0].From != AtmOnline || history[0].To != AtmOffline || history[0].Reason != "no network" || history[1].To != AtmOnline {
+			t.Errorf("status history not match: %v", history)
+		}
+		if since := time.Since(history[0].ChangedAt); since < -time.Second || since > time.Minute {
+			t.Errorf("status change time not match: %v", history[0].ChangedAt)
+		}
+
+		err = SetAtmStatus(1, "broken", "", db)
+		if !errors.Is(err, ErrInvalidAtmStatus) {
+			t.Errorf("Not ErrInvalidAtmStatus error: %v", err)
+		}
+		err = SetAtmStatus(9, AtmOffline, "", db)
+		if !errors.Is(err, ErrAtmNotFound) {
+			t.Errorf("Not ErrAtmNotFound error: %v", err)
+		}
+	})
+}
+
+func TestAtmWorkingHours(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openAtmDb(t, driver)
+		defer closeDb()
+		vasya := Session{UserId: 1}
+		tomorrow := time.Now().AddDate(0, 0, 1).Weekday()
+
+		err := SetAtmWorkingHours(1, []WorkingHours{{Weekday: tomorrow, Opens: 0, Closes: 24 * 60}}, db)
+		if err != nil {
+			t.Errorf("can't set working hours: %v", err)
+		}
+		_, err = vasya.Withdraw(1, 1, 50, db)
+		if !errors.Is(err, ErrAtmNotOperational) {
+			t.Errorf("Not ErrAtmNotOperational error for closed atm: %v", err)
+		}
+
+		var hours []WorkingHours
+		for day := time.Saturday; day >= time.Sunday; day-- {
+			hours = append(hours, WorkingHours{Weekday: day, Opens: 0, Closes: 24 * 60})
+		}
+		err = SetAtmWorkingHours(1, hours, db)
+		if err != nil {
+			t.Errorf("can't set working hours: %v", err)
+		}
+		_, err = vasya.Withdraw(1, 1, 50, db)
+		if err != nil {
+			t.Errorf("can't withdraw from open atm: %v", err)
+		}
+		got, err := AtmWorkingHours(1, db)
+		if err != nil || len(got) != 7 || got[0].Weekday != time.Sunday || got[6] != hours[0] {
+			t.Errorf("working hours not match: %v, %v", got, err)
+		}
+
+		invalid := [][]WorkingHours{
+			{{Weekday: time.Monday, Opens: 18 * 60, Closes: 9 * 60}},
+			{{Weekday: time.Monday, Opens: 0, Closes: 25 * 60}},
+			{{Weekday: 7, Opens: 0, Closes: 60}},
+			{{Weekday: time.Monday, Opens: 0, Closes: 60}, {Weekday: time.Monday, Opens: 120, Closes: 180}},
+		}
+		for _, hours := range invalid {
+			err = SetAtmWorkingHours(1, hours, db)
+			if !errors.Is(err, ErrInvalidWorkingHours) {
+				t.Errorf("Not ErrInvalidWorkingHours error for %v: %v", hours, err)
+			}
+		}
+		err = SetAtmWorkingHours(1, nil, db)
+		if err != nil {
+			t.Errorf("can't clear working hours: %v", err)
+		}
+		err = AtmOperational(1, time.Now().AddDate(0, 0, 3), db)
+		if err != nil {
+			t.Errorf("atm without working hours not operational: %v", err)
+		}
+	})
+}
+
+func TestAtmMaintenance(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openAtmDb(t, driver)
+		defer closeDb()
+		now := time.Now()
+
+		id, err := ScheduleAtmMaintenance(1, now.Add(-time.Hour), now.Add(time.Hour), db)
+		if err != nil || id != 1 {
+			t.Errorf("can't schedule maintenance: %v, %v", id, err)
+		}
+		_, err = Session{UserId: 1}.Withdraw(1, 1, 50, db)
+		if !errors.Is(err, ErrAtmNotOperational) {
+			t.Errorf("Not ErrAtmNotOperational error during maintenance: %v", err)
+		}
+		err = AtmOperational(1, now.Add(2*time.Hour), db)
+		if err != nil {
+			t.Errorf("atm not operational after maintenance: %v", err)
+		}
+
+		_, err = ScheduleAtmMaintenance(1, now.Add(24*time.Hour), now.Add(26*time.Hour), db)
+		if err != nil {
+			t.Errorf("can't schedule maintenance: %v", err)
+		}
+		windows, err := AtmMaintenanceWindows(1, now.Add(2*time.Hour), db)
+		want := []MaintenanceWindow{{Id: 2, StartsAt: now.Add(24 * time.Hour).UTC().Truncate(time.Millisecond), EndsAt: now.Add(26 * time.Hour).UTC().Truncate(time.Millisecond)}}
+		if err != nil || !reflect.DeepEqual(windows, want) {
+			t.Errorf("maintenance windows not match: %v, want %v: %v", windows, want, err)
+		}
+
+		_, err = ScheduleAtmMaintenance(1, now, now, db)
+		if !errors.Is(err, ErrInvalidMaintenanceWindow) {
+			t.Errorf("Not ErrInvalidMaintenanceWindow error: %v", err)
+		}
+		_, err = ScheduleAtmMaintenance(9, now, now.Add(time.Hour), db)
+		if !errors.Is(err, ErrAtmNotFound) {
+			t.Errorf("Not ErrAtmNotFound error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,430 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var ErrCardNotActive = errors.New("card not active")
+var ErrCardExpired = errors.New("card expired")
+var ErrInvalidCardStatus = errors.New("card status doesn't allow operation")
+var ErrInvalidCVV = errors.New("invalid CVV")
+var ErrCVVAttemptsExceeded = errors.New("CVV attempts exceeded, card blocked")
+
+type CardStatus string
+
+const (
+	CardActive  CardStatus = "active"
+	CardBlocked CardStatus = "blocked"
+	CardExpired CardStatus = "expired"
+	CardClosed  CardStatus = "closed"
+)
+
+// Why a blocked card was blocked: ResetPINAttempts lifts PIN blocks only,
+// UnblockCard any of them.
+const (
+	blockedByManager = "manager"
+	blockedByPIN     = "pin"
+	blockedByCVV     = "cvv"
+)
+
+// maxCVVAttempts wrong CVVs in a row block the card until a manager
+// unblocks it.
+const maxCVVAttempts = 3
+
+// cardValidityYears is how long an issued card is valid; it expires at the
+// end of its issue month that many years later.
+const cardValidityYears = 4
+
+// IssuedCard is returned once on issue: the CVV is stored hashed, see
+// SetCardSecretKey, and can't be read back.
+type IssuedCard struct {
+	Id          int64
+	NumberCard  string
+	ExpiryMonth int
+	ExpiryYear  int
+	CVV         string
+}
+
+func cardExpiry(issued time.Time) (month int, year int) {
+	return int(issued.Month()), issued.Year() + cardValidityYears
+}
+
+// cardPastExpiry reports whether at the card valid through month/year has
+// expired. Cards without expiry never do.
+func cardPastExpiry(month, year int, at time.Time) bool {
+	if year == 0 {
+		return false
+	}
+	return year < at.Year() || year == at.Year() && month < int(at.Month())
+}
+
+// checkCardUsable refuses cards transfers and payments can't use.
+func checkCardUsable(status CardStatus, month, year int) error {
+	if status == CardExpired || cardPastExpiry(month, year, time.Now()) {
+		return ErrCardExpired
+	}
+	if status != CardActive {
+		return ErrCardNotActive
+	}
+	return nil
+}
+
+// CheckCardUsable refuses the cards expired, by status or past their
+// expiry, and the cards not active.
+func CheckCardUsable(card Card) error {
+	return checkCardUsable(card.Status, card.ExpiryMonth, card.ExpiryYear)
+}
+
+func newCVV() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%03d", n.Int64()), nil
+}
+
+// pendingCardNumber is a unique placeholder numberCard for a card inserted
+// before its id, and so its number, is known.
+func pendingCardNumber() (string, error) {
+	pending := make([]byte, 8)
+	_, err := rand.Read(pending)
+	if err != nil {
+		return "", err
+	}
+	return "pending-" + hex.EncodeToString(pending), nil
+}
+
+// IssueCardContext adds a card with a new number, expiry and CVV. Cards
+// are issued with a positive balance.
+func IssueCardContext(ctx context.Context, cardName string, cardBalance int64, cardUser_id int64, db *sql.DB) (card IssuedCard, err error) {
+	if cardBalance <= 0 {
+		return card, ErrInvalidAmount
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return card, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			card = IssuedCard{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			card = IssuedCard{}
+		}
+	}()
+
+	pendingNumber, err := pendingCardNumber()
+	if err != nil {
+		return card, err
+	}
+	card.ExpiryMonth, card.ExpiryYear = cardExpiry(time.Now())
+	card.CVV, err = newCVV()
+	if err != nil {
+		return card, err
+	}
+
+	card.Id, err = DialectOf(db).insertId(ctx, tx,
+		insertCardSQL,
+
+		cardName,
+		cardBalance,
+		cardUser_id,
+		pendingNumber,
+		card.ExpiryMonth,
+		card.ExpiryYear,
+	)
+	if err != nil {
+		return card, err
+	}
+	// The number comes from the inserted id, so concurrent issues never
+	// derive the same one; the CVV hash is keyed by the id too.
+	card.NumberCard, err = newCardNumber(CardBIN(), card.Id)
+	if err != nil {
+		return card, err
+	}
+	cvvHash, err := hashCardSecret(cardSecretCVV, card.Id, card.CVV)
+	if err != nil {
+		return card, err
+	}
+	_, err = tx.ExecContext(ctx, updateIssuedCardSQL, card.NumberCard, cvvHash, card.Id)
+	if err != nil {
+		return card, queryError(updateIssuedCardSQL, err)
+	}
+	err = postJournal(ctx, tx, DialectOf(db), 0, string(OperationIssueCard),
+		Posting{Account: OpeningAccount, Amount: cardBalance},
+		Posting{Account: CardAccount(card.Id), Amount: -cardBalance},
+	)
+	if err != nil {
+		return card, err
+	}
+	return card, nil
+}
+
+func IssueCard(cardName string, cardBalance int64, cardUser_id int64, db *sql.DB) (IssuedCard, error) {
+	return IssueCardContext(context.Background(), cardName, cardBalance, cardUser_id, db)
+}
+
+// CardByNumberContext returns the card with the number.
+func CardByNumberContext(ctx context.Context, numberCard string, db *sql.DB) (card Card, err error) {
+	err = db.QueryRowContext(ctx, selectCardByNumberSQL, numberCard).Scan(&card.Id, &card.Name, &card.Balance, &card.User_id, &card.NumberCard, &card.Status, &card.ExpiryMonth, &card.ExpiryYear)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Card{}, ErrCardNotFound
+		}
+		return Card{}, queryError(selectCardByNumberSQL, err)
+	}
+	return card, nil
+}
+
+func CardByNumber(numberCard string, db *sql.DB) (Card, error) {
+	return CardByNumberContext(context.Background(), numberCard, db)
+}
+
+// VerifyCVVContext checks cvv against the active card. Wrong CVVs are
+// counted and logged even though an error is returned; the
+// maxCVVAttempts-th in a row blocks the card and returns
+// ErrCVVAttemptsExceeded.
+func VerifyCVVContext(ctx context.Context, idCard int64, cvv string, db *sql.DB) (err error) {
+	var cvvErr error
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			return
+		}
+		err = cvvErr
+	}()
+
+	cvvErr, err = checkCVV(ctx, tx, DialectOf(db), idCard, cvv)
+	return err
+}
+
+func VerifyCVV(idCard int64, cvv string, db *sql.DB) error {
+	return VerifyCVVContext(context.Background(), idCard, cvv, db)
+}
+
+// checkCVV returns the outcome of the attempt in cvvErr apart from err, as
+// checkPIN does.
+func checkCVV(ctx context.Context, tx *sql.Tx, dialect Dialect, idCard int64, cvv string) (cvvErr error, err error) {
+	var stored string
+	var attempts int
+	var status CardStatus
+	var numberCard string
+	var userId int64
+	err = tx.QueryRowContext(ctx, selectCVVCardSQL, idCard).Scan(&stored, &attempts, &status, &numberCard, &userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrCardNotFound
+		}
+		return nil, queryError(selectCVVCardSQL, err)
+	}
+	if status != CardActive {
+		return nil, ErrCardNotActive
+	}
+
+	ok, rehash, err := checkCardSecret(stored, cardSecretCVV, idCard, cvv)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if rehash {
+			stored, err = hashCardSecret(cardSecretCVV, idCard, cvv)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rehash || attempts > 0 {
+			_, err = tx.ExecContext(ctx, updateCVVCardSQL, stored, idCard)
+			if err != nil {
+				return nil, queryError(updateCVVCardSQL, err)
+			}
+		}
+		return nil, nil
+	}
+
+	attempts, err = incrementCardAttempts(ctx, tx, incrementCVVAttemptsCardSQL, selectCVVAttemptsCardSQL, idCard)
+	if err != nil {
+		return nil, err
+	}
+	name := OperationCVVVerifyFailed
+	cvvErr = ErrInvalidCVV
+	if attempts >= maxCVVAttempts {
+		name = OperationCVVBlocked
+		cvvErr = ErrCVVAttemptsExceeded
+		_, err = tx.ExecContext(ctx, blockCardSQL, CardBlocked, blockedByCVV, idCard)
+		if err != nil {
+			return nil, queryError(blockCardSQL, err)
+		}
+	}
+	_, err = logOperation(ctx, tx, dialect, name, time.Now(), numberCard, 0, userId)
+	if err != nil {
+		return nil, err
+	}
+	return cvvErr, nil
+}
+
+// incrementCardAttempts counts a wrong CVV or PIN with incrementSQL in the
+// database rather than from the value read before the check: the UPDATE
+// locks the card until the transaction ends, so concurrent wrong attempts
+// are all counted and the count read back with selectSQL is the one this
+// attempt reached. A card blocked meanwhile is no longer counted and
+// returns ErrCardNotActive.
+func incrementCardAttempts(ctx context.Context, tx *sql.Tx, incrementSQL, selectSQL string, idCard int64) (attempts int, err error) {
+	res, err := tx.ExecContext(ctx, incrementSQL, idCard, CardActive)
+	if err != nil {
+		return 0, queryError(incrementSQL, err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return 0, dbError(err)
+	}
+	if updated == 0 {
+		return 0, ErrCardNotActive
+	}
+	err = tx.QueryRowContext(ctx, selectSQL, idCard).Scan(&attempts)
+	if err != nil {
+		return 0, queryError(selectSQL, err)
+	}
+	return attempts, nil
+}
+
+// BlockCardContext blocks the card for a manager; ResetPINAttempts doesn't
+// lift it, even when the card was blocked for wrong PINs before.
+func BlockCardContext(ctx context.Context, idCard int64, db *sql.DB) error {
+	return setCardStatus(ctx, idCard, CardBlocked, []CardStatus{CardActive, CardBlocked}, db)
+}
+
+func BlockCard(idCard int64, db *sql.DB) error {
+	return BlockCardContext(context.Background(), idCard, db)
+}
+
+// UnblockCardContext makes the card active again, whatever blocked it, and
+// clears its counts of wrong PINs and CVVs.
+func UnblockCardContext(ctx context.Context, idCard int64, db *sql.DB) error {
+	return setCardStatus(ctx, idCard, CardActive, []CardStatus{CardBlocked, CardActive}, db)
+}
+
+func UnblockCard(idCard int64, db *sql.DB) error {
+	return UnblockCardContext(context.Background(), idCard, db)
+}
+
+// CloseCardContext closes the card for good; it stops being the default
+// card of its owner.
+func CloseCardContext(ctx context.Context, idCard int64, db *sql.DB) error {
+	return setCardStatus(ctx, idCard, CardClosed, []CardStatus{CardActive, CardBlocked, CardExpired}, db)
+}
+
+func CloseCard(idCard int64, db *sql.DB) error {
+	return CloseCardContext(context.Background(), idCard, db)
+}
+
+// ExpireCardsContext marks the active and blocked cards past their expiry
+// as expired and returns how many were marked.
+func ExpireCardsContext(ctx context.Context, db *sql.DB) (int64, error) {
+	month, year := int(time.Now().Month()), time.Now().Year()
+	result, err := db.ExecContext(ctx, expireCardsSQL, CardExpired, year, month, CardActive, CardBlocked)
+	if err != nil {
+		return 0, queryError(expireCardsSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return count, nil
+}
+
+func ExpireCards(db *sql.DB) (int64, error) {
+	return ExpireCardsContext(context.Background(), db)
+}
+
+func setCardStatus(ctx context.Context, idCard int64, status CardStatus, from []CardStatus, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	var current CardStatus
+	var month, year int
+	err = tx.QueryRowContext(ctx, selectStatusCardSQL, idCard).Scan(&current, &month, &year)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrCardNotFound
+		}
+		return queryError(selectStatusCardSQL, err)
+	}
+	if status == CardActive && cardPastExpiry(month, year, time.Now()) {
+		return ErrCardExpired
+	}
+	if !cardStatusIn(current, from) {
+		return ErrInvalidCardStatus
+	}
+
+	if status == CardBlocked {
+		_, err = tx.ExecContext(ctx, blockCardSQL, status, blockedByManager, idCard)
+		if err != nil {
+			return queryError(blockCardSQL, err)
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, updateStatusCardSQL, status, idCard)
+		if err != nil {
+			return queryError(updateStatusCardSQL, err)
+		}
+	}
+	if status == CardActive {
+		_, err = tx.ExecContext(ctx, resetAttemptsCardSQL, idCard)
+		if err != nil {
+			return queryError(resetAttemptsCardSQL, err)
+		}
+	}
+	if status == CardClosed {
+		_, err = tx.ExecContext(ctx, resetDefaultCardUserSQL, idCard)
+		if err != nil {
+			return queryError(resetDefaultCardUserSQL, err)
+		}
+	}
+	return nil
+}
+
+func cardStatusIn(status CardStatus, statuses []CardStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIssueCard(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		card, err := IssueCard("AlifMobi", 100, 3, db)
+		if err != nil {
+			t.Errorf("can't issue card: %v", err)
+		}
+		month, year := cardExpiry(time.Now())
+		if card.Id != 3 || !ValidCardNumber(card.NumberCard) || card.ExpiryMonth != month || card.ExpiryYear != year || len(card.CVV) != 3 {
+			t.Errorf("issued card not match: %v", card)
+		}
+		cards, err := Session{UserId: 3}.GetUserCards(db)
+		if err != nil || len(cards) != 1 || cards[0].Status != CardActive || cards[0].ExpiryYear != year {
+			t.Errorf("user cards not match: %v, %v", cards, err)
+		}
+
+		err = VerifyCVV(card.Id, card.CVV, db)
+		if err != nil {
+			t.Errorf("can't verify CVV: %v", err)
+		}
+		err = VerifyCVV(card.Id, "1000", db)
+		if !errors.Is(err, ErrInvalidCVV) {
+			t.Errorf("Not ErrInvalidCVV error for wrong CVV: %v", err)
+		}
+		err = VerifyCVV(1, "000", db)
+		if !errors.Is(err, ErrInvalidCVV) {
+			t.Errorf("Not ErrInvalidCVV error for card without CVV: %v", err)
+		}
+		err = VerifyCVV(9, card.CVV, db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for unknown card: %v", err)
+		}
+	})
+}
+
+func TestVerifyCVV_Legacy(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		legacy, err := hashPassword("123")
+		if err != nil {
+			t.Fatalf("can't hash CVV: %v", err)
+		}
+		_, err = db.Exec(`UPDATE cards SET cvv = $1 WHERE id = 1`, legacy)
+		if err != nil {
+			t.Fatalf("can't set CVV: %v", err)
+		}
+		err = VerifyCVV(1, "123", db)
+		if err != nil {
+			t.Errorf("can't verify legacy CVV: %v", err)
+		}
+		var stored string
+		err = db.QueryRow(`SELECT cvv FROM cards WHERE id = 1`).Scan(&stored)
+		want, hashErr := hashCardSecret(cardSecretCVV, 1, "123")
+		if err != nil || hashErr != nil || stored != want {
+			t.Errorf("legacy CVV not rehashed with the key: %s, %v, %v", stored, err, hashErr)
+		}
+		err = VerifyCVV(1, "123", db)
+		if err != nil {
+			t.Errorf("can't verify rehashed CVV: %v", err)
+		}
+	})
+}
+
+func TestIssueCard_Concurrent(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		cards := make([]IssuedCard, 10)
+		var wg sync.WaitGroup
+		for i := range cards {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				cards[i], err = IssueCard("AlifMobi", 100, 3, db)
+				if err != nil {
+					t.Errorf("can't issue card: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		numbers := make(map[string]bool)
+		for _, card := range cards {
+			want, err := newCardNumber(CardBIN(), card.Id)
+			if err != nil || card.NumberCard != want || numbers[card.NumberCard] {
+				t.Errorf("card number not match id %d: %v", card.Id, card.NumberCard)
+			}
+			numbers[card.NumberCard] = true
+		}
+		userCards, err := Session{UserId: 3}.GetUserCards(db)
+		if err != nil || len(userCards) != len(cards) {
+			t.Errorf("issued cards not match: %v, %v", userCards, err)
+		}
+	})
+}
+
+func TestCardStatus(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		ctx := context.Background()
+		vasya, petya := Session{UserId: 1}, Session{UserId: 2}
+
+		err := BlockCard(1, db)
+		if err != nil {
+			t.Errorf("can't block card: %v", err)
+		}
+		_, err = vasya.Transfer(ctx, 1, RecipientByLogin("petya"), 50, db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("Not ErrCardNotActive error for transfer from blocked card: %v", err)
+		}
+		_, err = petya.Transfer(ctx, 2, RecipientByNumberCard("2021600000000016"), 50, db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("Not ErrCardNotActive error for transfer to blocked card: %v", err)
+		}
+		err = vasya.TransferServices(1, 50, "Internet", db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("Not ErrCardNotActive error for payment from blocked card: %v", err)
+		}
+
+		err = UnblockCard(1, db)
+		if err != nil {
+			t.Errorf("can't unblock card: %v", err)
+		}
+		_, err = vasya.Transfer(ctx, 1, RecipientByLogin("petya"), 50, db)
+		if err != nil {
+			t.Errorf("can't transfer from unblocked card: %v", err)
+		}
+
+		err = vasya.SetDefaultCard(1, db)
+		if err != nil {
+			t.Errorf("can't set default card: %v", err)
+		}
+		err = CloseCard(1, db)
+		if err != nil {
+			t.Errorf("can't close card: %v", err)
+		}
+		_, err = vasya.DefaultCard(db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("closed card still default: %v", err)
+		}
+		err = vasya.TransferMoney(1, 2, 50, db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("Not ErrCardNotActive error for transfer from closed card: %v", err)
+		}
+		for _, change := range []func(int64, *sql.DB) error{BlockCard, UnblockCard, CloseCard} {
+			err = change(1, db)
+			if !errors.Is(err, ErrInvalidCardStatus) {
+				t.Errorf("Not ErrInvalidCardStatus error for closed card: %v", err)
+			}
+		}
+		err = BlockCard(9, db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for unknown card: %v", err)
+		}
+	})
+}
+
+func TestCardStatus_Expired(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		lastYear := time.Now().Year() - 1
+		_, err := db.Exec(`UPDATE cards SET expiryMonth = 12, expiryYear = $1 WHERE id = 1`, lastYear)
+		if err != nil {
+			t.Fatalf("can't update card expiry: %v", err)
+		}
+
+		err = Session{UserId: 1}.TransferMoney(1, 2, 50, db)
+		if !errors.Is(err, ErrCardExpired) {
+			t.Errorf("Not ErrCardExpired error for transfer from expired card: %v", err)
+		}
+		err = Session{UserId: 2}.TransferMoney(2, 1, 50, db)
+		if !errors.Is(err, ErrCardExpired) {
+			t.Errorf("Not ErrCardExpired error for transfer to expired card: %v", err)
+		}
+
+		count, err := ExpireCards(db)
+		if err != nil || count != 1 {
+			t.Errorf("expired cards not match: %v, %v", count, err)
+		}
+		cards, err := GetAllCards(db)
+		if err != nil || cards[0].Status != CardExpired || cards[1].Status != CardActive {
+			t.Errorf("card statuses not match: %v, %v", cards, err)
+		}
+		err = UnblockCard(1, db)
+		if !errors.Is(err, ErrCardExpired) {
+			t.Errorf("Not ErrCardExpired error for unblocking expired card: %v", err)
+		}
+		err = CloseCard(1, db)
+		if err != nil {
+			t.Errorf("can't close expired card: %v", err)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidCardNumber = errors.New("invalid card number")
+var ErrInvalidBIN = errors.New("invalid BIN")
+
+// cardNumberLength is the length of the generated PANs; other issuers' PANs
+// are 12 to 19 digits, see ValidCardNumber.
+const cardNumberLength = 16
+
+const defaultCardBIN = "202160"
+
+var cardBINMu sync.RWMutex
+var cardBIN = defaultCardBIN
+
+// SetCardBIN sets the issuer prefix of the card numbers AddCard generates.
+// Cards already issued keep their numbers.
+func SetCardBIN(bin string) error {
+	if len(bin) < 6 || len(bin) > 8 || !isDigits(bin) {
+		return ErrInvalidBIN
+	}
+	cardBINMu.Lock()
+	defer cardBINMu.Unlock()
+	cardBIN = bin
+	return nil
+}
+
+func CardBIN() string {
+	cardBINMu.RLock()
+	defer cardBINMu.RUnlock()
+	return cardBIN
+}
+
+// newCardNumber builds the PAN of the sequence-th card of bin: the sequence
+// is zero padded between the BIN and the Luhn check digit.
+func newCardNumber(bin string, sequence int64) (string, error) {
+	width := cardNumberLength - len(bin) - 1
+	account := strconv.FormatInt(sequence, 10)
+	if sequence <= 0 || len(account) > width {
+		return "", fmt.Errorf("card sequence %d out of range for BIN %s", sequence, bin)
+	}
+	payload := bin + strings.Repeat("0", width-len(account)) + account
+	return payload + string(luhnCheckDigit(payload)), nil
+}
+
+// ValidCardNumber reports whether number is a PAN: 12 to 19 digits with a
+// valid Luhn check digit.
+func ValidCardNumber(number string) bool {
+	if len(number) < 12 || len(number) > 19 || !isDigits(number) {
+		return false
+	}
+	return luhnCheckDigit(number[:len(number)-1]) == number[len(number)-1]
+}
+
+func luhnCheckDigit(payload string) byte {
+	sum := 0
+	double := true
+	for i := len(payload) - 1; i >= 0; i-- {
+		digit := int(payload[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
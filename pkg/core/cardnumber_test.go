@@ -0,0 +1,56 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidCardNumber(t *testing.T) {
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{"4111111111111111", true},
+		{"2021600000000016", true},
+		{"2021600000000017", false},
+		{"20216000000000001", false},
+		{"202160000000001a", false},
+		{"", false},
+		{"0", false},
+	}
+	for _, test := range tests {
+		if got := ValidCardNumber(test.number); got != test.valid {
+			t.Errorf("ValidCardNumber(%q) = %v, want %v", test.number, got, test.valid)
+		}
+	}
+}
+
+func TestNewCardNumber(t *testing.T) {
+	for _, bin := range []string{"202160", "4000001", "51000002"} {
+		number, err := newCardNumber(bin, 42)
+		if err != nil {
+			t.Errorf("can't generate card number for %s: %v", bin, err)
+		}
+		if len(number) != cardNumberLength || number[:len(bin)] != bin || !ValidCardNumber(number) {
+			t.Errorf("card number not match for %s: %s", bin, number)
+		}
+	}
+	_, err := newCardNumber("202160", 1000000000)
+	if err == nil {
+		t.Error("card number generated for sequence out of range")
+	}
+}
+
+func TestSetCardBIN(t *testing.T) {
+	defer func() {
+		_ = SetCardBIN(defaultCardBIN)
+	}()
+	for _, bin := range []string{"", "12345", "123456789", "12345a"} {
+		if err := SetCardBIN(bin); !errors.Is(err, ErrInvalidBIN) {
+			t.Errorf("Not ErrInvalidBIN error for %q: %v", bin, err)
+		}
+	}
+	if err := SetCardBIN("4000001"); err != nil || CardBIN() != "4000001" {
+		t.Errorf("can't set card BIN: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrCardSecretKeyNotSet = errors.New("card secret key not set")
+var ErrInvalidCardSecretKey = errors.New("card secret key must be at least 32 bytes")
+
+// The kinds of card secrets, hashed apart so that a CVV hash never matches
+// a PIN.
+const (
+	cardSecretCVV = "cvv"
+	cardSecretPIN = "pin"
+)
+
+const minCardSecretKeyLength = 32
+
+var cardSecretKeyMu sync.RWMutex
+var cardSecretKey []byte
+
+// SetCardSecretKey sets the key CVVs and PINs are hashed with. They have so
+// few values that any unkeyed hash is found by trying them all, so the key
+// must be kept out of the database. CVVs and PINs hashed with another key
+// no longer match.
+func SetCardSecretKey(key []byte) error {
+	if len(key) < minCardSecretKeyLength {
+		return ErrInvalidCardSecretKey
+	}
+	cardSecretKeyMu.Lock()
+	defer cardSecretKeyMu.Unlock()
+	cardSecretKey = append([]byte(nil), key...)
+	return nil
+}
+
+// hashCardSecret is the hex HMAC-SHA256 under the card secret key of the
+// secret of kind of the card idCard.
+func hashCardSecret(kind string, idCard int64, secret string) (string, error) {
+	cardSecretKeyMu.RLock()
+	defer cardSecretKeyMu.RUnlock()
+	if cardSecretKey == nil {
+		return "", ErrCardSecretKeyNotSet
+	}
+	mac := hmac.New(sha256.New, cardSecretKey)
+	mac.Write([]byte(kind + "|" + strconv.FormatInt(idCard, 10) + "|" + secret))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// checkCardSecret compares secret with the stored hash. Secrets hashed with
+// bcrypt before the key still match; they are reported with rehash so the
+// caller can replace them with a keyed hash. An empty stored value never
+// matches.
+func checkCardSecret(stored, kind string, idCard int64, secret string) (ok bool, rehash bool, err error) {
+	if stored == "" {
+		return false, false, nil
+	}
+	if isPasswordHash(stored) {
+		ok = bcrypt.CompareHashAndPassword([]byte(stored), []byte(secret)) == nil
+		return ok, ok, nil
+	}
+	hash, err := hashCardSecret(kind, idCard, secret)
+	if err != nil {
+		return false, false, err
+	}
+	return hmac.Equal([]byte(stored), []byte(hash)), false, nil
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+var testCardSecretKey = []byte("0123456789abcdef0123456789abcdef")
+
+func init() {
+	if err := SetCardSecretKey(testCardSecretKey); err != nil {
+		panic(err)
+	}
+}
+
+func TestCardSecret(t *testing.T) {
+	hash, err := hashCardSecret(cardSecretCVV, 1, "123")
+	if err != nil {
+		t.Fatalf("can't hash card secret: %v", err)
+	}
+	tests := []struct {
+		name   string
+		kind   string
+		idCard int64
+		secret string
+		ok     bool
+	}{
+		{"same", cardSecretCVV, 1, "123", true},
+		{"wrong secret", cardSecretCVV, 1, "124", false},
+		{"other card", cardSecretCVV, 2, "123", false},
+		{"other kind", cardSecretPIN, 1, "123", false},
+	}
+	for _, test := range tests {
+		ok, rehash, err := checkCardSecret(hash, test.kind, test.idCard, test.secret)
+		if err != nil || ok != test.ok || rehash {
+			t.Errorf("%s: got %v, %v, %v", test.name, ok, rehash, err)
+		}
+	}
+
+	legacy, err := hashPassword("123")
+	if err != nil {
+		t.Fatalf("can't hash password: %v", err)
+	}
+	ok, rehash, err := checkCardSecret(legacy, cardSecretCVV, 1, "123")
+	if err != nil || !ok || !rehash {
+		t.Errorf("legacy hash not matched for rehash: %v, %v, %v", ok, rehash, err)
+	}
+	ok, _, err = checkCardSecret("", cardSecretCVV, 1, "")
+	if err != nil || ok {
+		t.Errorf("empty hash matched: %v", err)
+	}
+
+	err = SetCardSecretKey([]byte("short"))
+	if !errors.Is(err, ErrInvalidCardSecretKey) {
+		t.Errorf("Not ErrInvalidCardSecretKey error: %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+var ErrNotEnoughCash = errors.New("atm hasn't the notes to pay the amount")
+var ErrCassetteNotEmpty = errors.New("cassette not empty")
+
+// Cassette holds the notes of one denomination of an ATM.
+type Cassette struct {
+	Denomination int64
+	Notes        int64
+}
+
+type AtmCash struct {
+	Atm  Atm
+	Cash int64
+}
+
+// AtmCassettesContext returns the cassettes of the ATM, largest denomination
+// first.
+func AtmCassettesContext(ctx context.Context, atmId int64, db *sql.DB) (cassettes []Cassette, err error) {
+	rows, err := db.QueryContext(ctx, getAtmCassettesSQL, atmId)
+	if err != nil {
+		return nil, queryError(getAtmCassettesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			cassettes, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		cassette := Cassette{}
+		err = rows.Scan(&cassette.Denomination, &cassette.Notes)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		cassettes = append(cassettes, cassette)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return cassettes, nil
+}
+
+func AtmCassettes(atmId int64, db *sql.DB) ([]Cassette, error) {
+	return AtmCassettesContext(context.Background(), atmId, db)
+}
+
+// ReplenishAtmContext loads notes into the cassettes of their denominations.
+func ReplenishAtmContext(ctx context.Context, atmId int64, notes []Cassette, db *sql.DB) (err error) {
+	var total int64
+	for _, cassette := range notes {
+		if cassette.Notes <= 0 {
+			return ErrInvalidAmount
+		}
+		total += cassette.Denomination * cassette.Notes
+	}
+	if total == 0 {
+		return ErrInvalidAmount
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	atm, err := selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return err
+	}
+	cassettes, err := selectCassettes(ctx, tx, atmId)
+	if err != nil {
+		return err
+	}
+	for _, cassette := range notes {
+		if !hasDenomination(cassettes, cassette.Denomination) {
+			return ErrInvalidDenomination
+		}
+	}
+	err = addCassetteNotes(ctx, tx, atmId, notes, 1)
+	if err != nil {
+		return err
+	}
+	_, err = logAtmCashOperation(ctx, tx, DialectOf(db), OperationAtmReplenish, time.Now(), atm, total)
+	return err
+}
+
+func ReplenishAtm(atmId int64, notes []Cassette, db *sql.DB) error {
+	return ReplenishAtmContext(context.Background(), atmId, notes, db)
+}
+
+// CollectAtmContext empties the cassettes of the ATM and returns the notes
+// taken out.
+func CollectAtmContext(ctx context.Context, atmId int64, db *sql.DB) (collected []Cassette, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			collected = nil
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			collected = nil
+		}
+	}()
+
+	atm, err := selectAtm(ctx, tx, atmId)
+	if err != nil {
+		return nil, err
+	}
+	cassettes, err := selectCassettes(ctx, tx, atmId)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, cassette := range cassettes {
+		if cassette.Notes > 0 {
+			collected = append(collected, cassette)
+			total += cassette.Denomination * cassette.Notes
+		}
+	}
+	err = addCassetteNotes(ctx, tx, atmId, collected, -1)
+	if err != nil {
+		return nil, err
+	}
+	_, err = logAtmCashOperation(ctx, tx, DialectOf(db), OperationAtmCollect, time.Now(), atm, -total)
+	if err != nil {
+		return nil, err
+	}
+	return collected, nil
+}
+
+func CollectAtm(atmId int64, db *sql.DB) ([]Cassette, error) {
+	return CollectAtmContext(context.Background(), atmId, db)
+}
+
+// LowCashAtmsContext reports the ATMs holding less cash than threshold,
+// ATMs without cassettes included.
+func LowCashAtmsContext(ctx context.Context, threshold int64, db *sql.DB) (atms []AtmCash, err error) {
+	rows, err := db.QueryContext(ctx, getLowCashAtmsSQL, threshold)
+	if err != nil {
+		return nil, queryError(getLowCashAtmsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			atms, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		atm := AtmCash{}
+		err = rows.Scan(&atm.Atm.Id, &atm.Atm.Name, &atm.Atm.Address, &atm.Atm.Latitude, &atm.Atm.Longitude, &atm.Atm.Status, &atm.Cash)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		atms = append(atms, atm)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return atms, nil
+}
+
+func LowCashAtms(threshold int64, db *sql.DB) ([]AtmCash, error) {
+	return LowCashAtmsContext(context.Background(), threshold, db)
+}
+
+func selectCassettes(ctx context.Context, tx *sql.Tx, atmId int64) (cassettes []Cassette, err error) {
+	rows, err := tx.QueryContext(ctx, getAtmCassettesSQL, atmId)
+	if err != nil {
+		return nil, queryError(getAtmCassettesSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			cassettes, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		cassette := Cassette{}
+		err = rows.Scan(&cassette.Denomination, &cassette.Notes)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		cassettes = append(cassettes, cassette)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return cassettes, nil
+}
+
+// addCassetteNotes adds sign times the notes to the cassettes; the CHECK on
+// notes refuses to take out more than a cassette holds.
+func addCassetteNotes(ctx context.Context, tx *sql.Tx, atmId int64, notes []Cassette, sign int64) error {
+	for _, cassette := range notes {
+		_, err := tx.ExecContext(ctx, addNotesAtmCassetteSQL, sign*cassette.Notes, atmId, cassette.Denomination)
+		if err != nil {
+			return queryError(addNotesAtmCassetteSQL, err)
+		}
+	}
+	return nil
+}
+
+// logAtmCashOperation logs a manager operation on the cash of the ATM; it
+// belongs to no user.
+func logAtmCashOperation(ctx context.Context, tx *sql.Tx, dialect Dialect, name OperationType, t time.Time, atm Atm, balance int64) (int64, error) {
+	return insertOperation(ctx, tx, dialect, insertAtmCashOperationsLoggingSQL, name, formatTimestamp(t), atm.Name, balance, atm.Id)
+}
+
+func denominationsOf(cassettes []Cassette) []int64 {
+	denominations := make([]int64, len(cassettes))
+	for i, cassette := range cassettes {
+		denominations[i] = cassette.Denomination
+	}
+	return denominations
+}
+
+func hasDenomination(cassettes []Cassette, denomination int64) bool {
+	for _, cassette := range cassettes {
+		if cassette.Denomination == denomination {
+			return true
+		}
+	}
+	return false
+}
+
+// maxNoteMixSteps bounds the note counts noteMix tries, so that its work
+// doesn't grow with the amount or the notes held.
+const maxNoteMixSteps = 1 << 16
+
+// noteMix pays amount with the fewest notes the cassettes hold. It fills
+// the cassettes greedily from the largest denomination and backtracks to
+// fewer notes of one, only as many as keep the rest payable by the smaller
+// ones, when the rest can't be paid or may be paid with fewer notes. Past
+// maxNoteMixSteps it keeps the fewest notes found so far.
+func noteMix(cassettes []Cassette, amount int64) ([]Cassette, bool) {
+	var order []int
+	for i, cassette := range cassettes {
+		if cassette.Notes > 0 && cassette.Denomination > 0 {
+			order = append(order, i)
+		}
+	}
+	if amount <= 0 || len(order) == 0 {
+		return nil, false
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return cassettes[order[i]].Denomination > cassettes[order[j]].Denomination
+	})
+	// divisors and totals of the cassettes from each one in order on.
+	divisors := make([]int64, len(order)+1)
+	totals := make([]int64, len(order)+1)
+	for k := len(order) - 1; k >= 0; k-- {
+		cassette := cassettes[order[k]]
+		divisors[k] = gcd(divisors[k+1], cassette.Denomination)
+		totals[k] = totals[k+1] + cassette.Denomination*cassette.Notes
+	}
+
+	counts := make([]int64, len(cassettes))
+	var best []int64
+	fewest := int64(math.MaxInt64)
+	steps := 0
+	var fill func(k int, rest, notes int64)
+	fill = func(k int, rest, notes int64) {
+		if rest == 0 {
+			if notes < fewest {
+				fewest = notes
+				best = append(best[:0], counts...)
+			}
+			return
+		}
+		if k == len(order) || rest%divisors[k] != 0 || rest > totals[k] {
+			return
+		}
+		i := order[k]
+		denomination := cassettes[i].Denomination
+		most := rest / denomination
+		if most > cassettes[i].Notes {
+			most = cassettes[i].Notes
+		}
+		if k+1 == len(order) {
+			if most*denomination == rest && notes+most < fewest {
+				counts[i] = most
+				fill(k+1, 0, notes+most)
+				counts[i] = 0
+			}
+			return
+		}
+		// Dropping one note of the denomination changes the rest modulo
+		// the smaller ones by denomination, so only every step-th count
+		// leaves a payable rest.
+		next := divisors[k+1]
+		step := next / gcd(next, denomination)
+		for most >= 0 && (rest-most*denomination)%next != 0 {
+			most--
+		}
+		// The notes of the rest are at least as many as of the next
+		// denomination alone, a bound that only grows with fewer notes of
+		// this one.
+		nextDenomination := cassettes[order[k+1]].Denomination
+		for count := most; count >= 0 && steps < maxNoteMixSteps; count -= step {
+			steps++
+			left := rest - count*denomination
+			if notes+count+(left+nextDenomination-1)/nextDenomination >= fewest {
+				break
+			}
+			counts[i] = count
+			fill(k+1, left, notes+count)
+		}
+		counts[i] = 0
+	}
+	fill(0, amount, 0)
+	if best == nil {
+		return nil, false
+	}
+
+	var mix []Cassette
+	for i, count := range best {
+		if count > 0 {
+			mix = append(mix, Cassette{Denomination: cassettes[i].Denomination, Notes: count})
+		}
+	}
+	return mix, true
+}
+
+// depositMix splits a deposit the denominations can pay into notes. The
+// notes of the largest denomination beyond the point where every sum can be
+// paid (see payableIn) are counted up front to keep the search small.
+func depositMix(denominations []int64, amount int64) []Cassette {
+	var divisor, smallest, largest int64
+	for _, denomination := range denominations {
+		divisor = gcd(divisor, denomination)
+		if smallest == 0 || denomination < smallest {
+			smallest = denomination
+		}
+		if denomination > largest {
+			largest = denomination
+		}
+	}
+	var upFront int64
+	if bound := (smallest/divisor - 1) * (largest/divisor - 1) * divisor; amount > bound+largest {
+		upFront = (amount - bound) / largest
+	}
+
+	cassettes := make([]Cassette, len(denominations))
+	for i, denomination := range denominations {
+		cassettes[i] = Cassette{Denomination: denomination, Notes: (amount - upFront*largest) / denomination}
+	}
+	mix, _ := noteMix(cassettes, amount-upFront*largest)
+	if upFront == 0 {
+		return mix
+	}
+	for i := range mix {
+		if mix[i].Denomination == largest {
+			mix[i].Notes += upFront
+			return mix
+		}
+	}
+	return append([]Cassette{{Denomination: largest, Notes: upFront}}, mix...)
+}
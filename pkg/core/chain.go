@@ -0,0 +1,413 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+var ErrOperationsChainBroken = errors.New("operations chain broken")
+var ErrInvalidCheckpoint = errors.New("invalid checkpoint signature")
+
+// ChainReport is the state of the hash chain over the operations log: every
+// operation holds the hash of its contents and of the operation before it.
+type ChainReport struct {
+	Operations int64
+	// Head is the hash of the last operation verified.
+	Head string
+	// BrokenAt is the first operation whose hash or link doesn't match, 0
+	// for an intact chain.
+	BrokenAt int64
+}
+
+func (receiver ChainReport) Intact() bool {
+	return receiver.BrokenAt == 0
+}
+
+// OperationsCheckpoint is a signed statement that the log held the chain
+// ending with Hash at OperationId. Exported out of the database, it catches
+// rewrites of the whole chain and removed trailing operations.
+type OperationsCheckpoint struct {
+	OperationId int64  `json:"operationId"`
+	Hash        string `json:"hash"`
+	Time        string `json:"time"`
+	Signature   []byte `json:"signature"`
+}
+
+func (receiver OperationsCheckpoint) message() []byte {
+	return []byte(strconv.FormatInt(receiver.OperationId, 10) + "|" + receiver.Hash + "|" + receiver.Time)
+}
+
+func operationHash(opLog OperationsLogging, prevHash string) string {
+	return chainHash(opLog, formatTimestamp(opLog.Time), prevHash)
+}
+
+// chainHash is the hex SHA-256 of the operation contents, with its time as
+// stored, and prevHash. Strings are quoted so that no two operations hash
+// the same text.
+func chainHash(opLog OperationsLogging, t string, prevHash string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%q|%q|%q|%d|%d|%d|%d|%q|%s",
+		opLog.Id, opLog.Name, t, opLog.RecipientSender, opLog.Balance,
+		opLog.User_id, opLog.Atm_id, opLog.Card_id, opLog.Reference, prevHash)))
+	return hex.EncodeToString(sum[:])
+}
+
+// insertOperation inserts a row of the operations log with query and chains
+// it to the row before it.
+func insertOperation(ctx context.Context, tx *sql.Tx, dialect Dialect, query string, args ...interface{}) (int64, error) {
+	if dialect == Postgres {
+		_, err := tx.ExecContext(ctx, lockOperationsChainPostgresSQL)
+		if err != nil {
+			return 0, queryError(lockOperationsChainPostgresSQL, err)
+		}
+	}
+	id, err := dialect.insertId(ctx, tx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	var prevHash string
+	err = tx.QueryRowContext(ctx, selectPrevHashOperationSQL, id).Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, queryError(selectPrevHashOperationSQL, err)
+	}
+	opLog := OperationsLogging{}
+	var t string
+	err = tx.QueryRowContext(ctx, selectChainOperationSQL, id).Scan(&opLog.Id, &opLog.Name, &t, &opLog.RecipientSender, &opLog.Balance,
+		&opLog.User_id, &opLog.Atm_id, &opLog.Card_id, &opLog.Reference)
+	if err != nil {
+		return 0, queryError(selectChainOperationSQL, err)
+	}
+	_, err = tx.ExecContext(ctx, updateHashOperationSQL, chainHash(opLog, t, prevHash), prevHash, id)
+	if err != nil {
+		return 0, queryError(updateHashOperationSQL, err)
+	}
+	return id, nil
+}
+
+type chainedOperation struct {
+	opLog OperationsLogging
+	// time is the time of the operation as stored.
+	time     string
+	hash     string
+	prevHash string
+}
+
+func selectChainedOperations(ctx context.Context, tx *sql.Tx) (operations []chainedOperation, err error) {
+	rows, err := tx.QueryContext(ctx, selectChainOperationsSQL)
+	if err != nil {
+		return nil, queryError(selectChainOperationsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			operations, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		operation := chainedOperation{}
+		opLog := &operation.opLog
+		err = rows.Scan(&opLog.Id, &opLog.Name, &operation.time, &opLog.RecipientSender, &opLog.Balance,
+			&opLog.User_id, &opLog.Atm_id, &opLog.Card_id, &opLog.Reference, &operation.hash, &operation.prevHash)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		operations = append(operations, operation)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return operations, nil
+}
+
+// chainOperations hashes the operations logged before the chain, oldest
+// first.
+func chainOperations(ctx context.Context, tx *sql.Tx) error {
+	operations, err := selectChainedOperations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	prevHash := ""
+	for _, operation := range operations {
+		hash := chainHash(operation.opLog, operation.time, prevHash)
+		_, err = tx.ExecContext(ctx, updateHashOperationSQL, hash, prevHash, operation.opLog.Id)
+		if err != nil {
+			return queryError(updateHashOperationSQL, err)
+		}
+		prevHash = hash
+	}
+	return nil
+}
+
+func verifyChain(operations []chainedOperation) (report ChainReport) {
+	for _, operation := range operations {
+		if operation.prevHash != report.Head || operation.hash != chainHash(operation.opLog, operation.time, report.Head) {
+			report.BrokenAt = operation.opLog.Id
+			return report
+		}
+		report.Operations++
+		report.Head = operation.hash
+	}
+	return report
+}
+
+// walkChain verifies the operations after the operation afterId, whose
+// hash is head, one row at a time, and calls visit with each operation
+// verified. The report counts the operations after afterId.
+func walkChain(ctx context.Context, tx *sql.Tx, afterId int64, head string, visit func(operation chainedOperation)) (report ChainReport, err error) {
+	rows, err := tx.QueryContext(ctx, selectChainOperationsAfterSQL, afterId)
+	if err != nil {
+		return report, queryError(selectChainOperationsAfterSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			report, err = ChainReport{}, dbError(innerErr)
+		}
+	}()
+
+	report.Head = head
+	for rows.Next() {
+		operation := chainedOperation{}
+		opLog := &operation.opLog
+		err = rows.Scan(&opLog.Id, &opLog.Name, &operation.time, &opLog.RecipientSender, &opLog.Balance,
+			&opLog.User_id, &opLog.Atm_id, &opLog.Card_id, &opLog.Reference, &operation.hash, &operation.prevHash)
+		if err != nil {
+			return ChainReport{}, dbError(err)
+		}
+		if operation.prevHash != report.Head || operation.hash != chainHash(operation.opLog, operation.time, report.Head) {
+			report.BrokenAt = opLog.Id
+			return report, nil
+		}
+		report.Operations++
+		report.Head = operation.hash
+		if visit != nil {
+			visit(operation)
+		}
+	}
+	if rows.Err() != nil {
+		return ChainReport{}, dbError(rows.Err())
+	}
+	return report, nil
+}
+
+// walkChainOf runs walkChain in a transaction of db, so that it reads one
+// state of the log. A checkpoint to start after must still be in the log
+// with its hash.
+func walkChainOf(ctx context.Context, after OperationsCheckpoint, visit func(operation chainedOperation), db *sql.DB) (report ChainReport, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			report = ChainReport{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			report = ChainReport{}
+		}
+	}()
+
+	if after.OperationId != 0 {
+		var hash string
+		err = tx.QueryRowContext(ctx, selectHashOperationSQL, after.OperationId).Scan(&hash)
+		if err != nil && err != sql.ErrNoRows {
+			return report, queryError(selectHashOperationSQL, err)
+		}
+		if hash != after.Hash {
+			return report, fmt.Errorf("operation %d: %w", after.OperationId, ErrOperationsChainBroken)
+		}
+	}
+	return walkChain(ctx, tx, after.OperationId, after.Hash, visit)
+}
+
+// VerifyOperationsChainContext checks the operations log against its hash
+// chain and reports the first operation edited, or following one removed.
+func VerifyOperationsChainContext(ctx context.Context, db *sql.DB) (ChainReport, error) {
+	return walkChainOf(ctx, OperationsCheckpoint{}, nil, db)
+}
+
+func VerifyOperationsChain(db *sql.DB) (ChainReport, error) {
+	return VerifyOperationsChainContext(context.Background(), db)
+}
+
+// CheckpointOperationsContext signs the head of the operations chain with
+// key. A broken chain isn't signed.
+func CheckpointOperationsContext(ctx context.Context, key ed25519.PrivateKey, db *sql.DB) (OperationsCheckpoint, error) {
+	return checkpointOperations(ctx, key, OperationsCheckpoint{}, db)
+}
+
+func CheckpointOperations(key ed25519.PrivateKey, db *sql.DB) (OperationsCheckpoint, error) {
+	return CheckpointOperationsContext(context.Background(), key, db)
+}
+
+// CheckpointOperationsAfterContext signs the head of the operations chain
+// with key, verifying only the operations logged after the previous
+// checkpoint, signed with key too. The operations before are left to
+// VerifyOperationsChain.
+func CheckpointOperationsAfterContext(ctx context.Context, key ed25519.PrivateKey, previous OperationsCheckpoint, db *sql.DB) (OperationsCheckpoint, error) {
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), previous.message(), previous.Signature) {
+		return OperationsCheckpoint{}, ErrInvalidCheckpoint
+	}
+	return checkpointOperations(ctx, key, previous, db)
+}
+
+func CheckpointOperationsAfter(key ed25519.PrivateKey, previous OperationsCheckpoint, db *sql.DB) (OperationsCheckpoint, error) {
+	return CheckpointOperationsAfterContext(context.Background(), key, previous, db)
+}
+
+func checkpointOperations(ctx context.Context, key ed25519.PrivateKey, after OperationsCheckpoint, db *sql.DB) (checkpoint OperationsCheckpoint, err error) {
+	checkpoint.OperationId = after.OperationId
+	report, err := walkChainOf(ctx, after, func(operation chainedOperation) {
+		checkpoint.OperationId = operation.opLog.Id
+	}, db)
+	if err != nil {
+		return OperationsCheckpoint{}, err
+	}
+	if !report.Intact() {
+		return OperationsCheckpoint{}, fmt.Errorf("operation %d: %w", report.BrokenAt, ErrOperationsChainBroken)
+	}
+	checkpoint.Hash = report.Head
+	checkpoint.Time = formatTimestamp(time.Now())
+	checkpoint.Signature = ed25519.Sign(key, checkpoint.message())
+	return checkpoint, nil
+}
+
+// VerifyOperationsCheckpointContext checks the signature of the checkpoint
+// and that the intact chain still passes through it. Checkpoints taken
+// before the operation times migration converted legacy times don't verify
+// after it; see convertOperationTimes.
+func VerifyOperationsCheckpointContext(ctx context.Context, checkpoint OperationsCheckpoint, publicKey ed25519.PublicKey, db *sql.DB) error {
+	if !ed25519.Verify(publicKey, checkpoint.message(), checkpoint.Signature) {
+		return ErrInvalidCheckpoint
+	}
+	passed := checkpoint.OperationId == 0
+	report, err := walkChainOf(ctx, OperationsCheckpoint{}, func(operation chainedOperation) {
+		if operation.opLog.Id == checkpoint.OperationId && operation.hash == checkpoint.Hash {
+			passed = true
+		}
+	}, db)
+	if err != nil {
+		return err
+	}
+	if !report.Intact() {
+		return fmt.Errorf("operation %d: %w", report.BrokenAt, ErrOperationsChainBroken)
+	}
+	if !passed {
+		return fmt.Errorf("operation %d: %w", checkpoint.OperationId, ErrOperationsChainBroken)
+	}
+	return nil
+}
+
+func VerifyOperationsCheckpoint(checkpoint OperationsCheckpoint, publicKey ed25519.PublicKey, db *sql.DB) error {
+	return VerifyOperationsCheckpointContext(context.Background(), checkpoint, publicKey, db)
+}
+
+// AppendOperationsCheckpoint adds the checkpoint to the file at path, one
+// JSON object per line.
+func AppendOperationsCheckpoint(path string, checkpoint OperationsCheckpoint) (err error) {
+	line, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// ReadOperationsCheckpoints returns the checkpoints of the file at path,
+// oldest first.
+func ReadOperationsCheckpoints(path string) (checkpoints []OperationsCheckpoint, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		checkpoint := OperationsCheckpoint{}
+		err = json.Unmarshal(scanner.Bytes(), &checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	return checkpoints, nil
+}
+
+// ExportOperationsCheckpointsContext appends a checkpoint to the file at
+// path now and then every interval, until ctx is done or a checkpoint
+// fails. Each checkpoint verifies the operations logged after the one
+// before, starting from the last of the file.
+func ExportOperationsCheckpointsContext(ctx context.Context, path string, key ed25519.PrivateKey, interval time.Duration, db *sql.DB) error {
+	previous, err := lastOperationsCheckpoint(path)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var checkpoint OperationsCheckpoint
+		if previous == nil {
+			checkpoint, err = CheckpointOperationsContext(ctx, key, db)
+		} else {
+			checkpoint, err = CheckpointOperationsAfterContext(ctx, key, *previous, db)
+		}
+		if err != nil {
+			return err
+		}
+		err = AppendOperationsCheckpoint(path, checkpoint)
+		if err != nil {
+			return err
+		}
+		previous = &checkpoint
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// lastOperationsCheckpoint is the last checkpoint of the file at path, nil
+// without file or checkpoints.
+func lastOperationsCheckpoint(path string) (*OperationsCheckpoint, error) {
+	checkpoints, err := ReadOperationsCheckpoints(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil || len(checkpoints) == 0 {
+		return nil, err
+	}
+	return &checkpoints[len(checkpoints)-1], nil
+}
@@ -0,0 +1,273 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOperationsChain(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		vasya := Session{UserId: 1, Login: "vasya"}
+		for i := 0; i < 3; i++ {
+			_, err := vasya.Transfer(context.Background(), 1, RecipientByLogin("petya"), 10, db)
+			if err != nil {
+				t.Fatalf("can't transfer: %v", err)
+			}
+		}
+		report, err := VerifyOperationsChain(db)
+		if err != nil || !report.Intact() || report.Operations != 6 || report.Head == "" {
+			t.Fatalf("chain not intact: %+v, %v", report, err)
+		}
+
+		_, err = db.Exec(`UPDATE operationsLogging SET balance = -1 WHERE id = 3`)
+		if err != nil {
+			t.Fatalf("can't edit operation: %v", err)
+		}
+		report, err = VerifyOperationsChain(db)
+		if err != nil || report.BrokenAt != 3 || report.Operations != 2 {
+			t.Errorf("edited operation not found: %+v, %v", report, err)
+		}
+		_, err = db.Exec(`UPDATE operationsLogging SET balance = -10 WHERE id = 3`)
+		if err != nil {
+			t.Fatalf("can't edit operation: %v", err)
+		}
+
+		_, err = db.Exec(`DELETE FROM operationsLogging WHERE id = 4`)
+		if err != nil {
+			t.Fatalf("can't delete operation: %v", err)
+		}
+		report, err = VerifyOperationsChain(db)
+		if err != nil || report.BrokenAt != 5 {
+			t.Errorf("removed operation not found: %+v, %v", report, err)
+		}
+	})
+}
+
+func TestOperationsChain_Migration(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openLedgerDb(t, driver)
+		defer closeDb()
+
+		err := Migrate(db, 13)
+		if err != nil {
+			t.Fatalf("can't migrate db: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			_, err = db.Exec(`INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES ('translatedToSend', '2020-06-01 15:04:05.123456789 +0500 +05 m=+0.012345678', '2021600000000024', -25, 1)`)
+			if err != nil {
+				t.Fatalf("can't log operation: %v", err)
+			}
+		}
+		err = Init(db)
+		if err != nil {
+			t.Fatalf("can't init db: %v", err)
+		}
+		_, err = Session{UserId: 1}.Transfer(context.Background(), 1, RecipientByLogin("petya"), 10, db)
+		if err != nil {
+			t.Fatalf("can't transfer: %v", err)
+		}
+
+		report, err := VerifyOperationsChain(db)
+		if err != nil || !report.Intact() || report.Operations != 4 {
+			t.Errorf("chain not intact: %+v, %v", report, err)
+		}
+	})
+}
+
+func TestOperationsCheckpoint(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		dir, err := ioutil.TempDir("", "checkpoints")
+		if err != nil {
+			t.Fatalf("can't create dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "checkpoints.jsonl")
+		publicKey, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("can't generate key: %v", err)
+		}
+
+		vasya := Session{UserId: 1, Login: "vasya"}
+		var checkpoints []OperationsCheckpoint
+		for i := 0; i < 2; i++ {
+			_, err = vasya.Transfer(context.Background(), 1, RecipientByLogin("petya"), 10, db)
+			if err != nil {
+				t.Fatalf("can't transfer: %v", err)
+			}
+			checkpoint, err := CheckpointOperations(key, db)
+			if err != nil {
+				t.Fatalf("can't checkpoint: %v", err)
+			}
+			err = AppendOperationsCheckpoint(path, checkpoint)
+			if err != nil {
+				t.Fatalf("can't export checkpoint: %v", err)
+			}
+			checkpoints = append(checkpoints, checkpoint)
+		}
+
+		read, err := ReadOperationsCheckpoints(path)
+		if err != nil || !reflect.DeepEqual(read, checkpoints) {
+			t.Fatalf("checkpoints not match: %v, %v", read, err)
+		}
+		if read[1].OperationId != 4 {
+			t.Errorf("checkpoint operation not match: %d", read[1].OperationId)
+		}
+		for _, checkpoint := range read {
+			err = VerifyOperationsCheckpoint(checkpoint, publicKey, db)
+			if err != nil {
+				t.Errorf("can't verify checkpoint %d: %v", checkpoint.OperationId, err)
+			}
+		}
+
+		forged := read[0]
+		forged.OperationId = 3
+		err = VerifyOperationsCheckpoint(forged, publicKey, db)
+		if !errors.Is(err, ErrInvalidCheckpoint) {
+			t.Errorf("Not ErrInvalidCheckpoint error: %v", err)
+		}
+
+		_, err = db.Exec(`DELETE FROM operationsLogging WHERE id IN (3, 4)`)
+		if err != nil {
+			t.Fatalf("can't delete operations: %v", err)
+		}
+		err = VerifyOperationsCheckpoint(read[0], publicKey, db)
+		if err != nil {
+			t.Errorf("can't verify checkpoint before removed operations: %v", err)
+		}
+		err = VerifyOperationsCheckpoint(read[1], publicKey, db)
+		if !errors.Is(err, ErrOperationsChainBroken) {
+			t.Errorf("Not ErrOperationsChainBroken error: %v", err)
+		}
+	})
+}
+
+func TestOperationsCheckpointAfter(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		publicKey, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("can't generate key: %v", err)
+		}
+
+		vasya := Session{UserId: 1, Login: "vasya"}
+		_, err = vasya.Transfer(context.Background(), 1, RecipientByLogin("petya"), 10, db)
+		if err != nil {
+			t.Fatalf("can't transfer: %v", err)
+		}
+		first, err := CheckpointOperations(key, db)
+		if err != nil {
+			t.Fatalf("can't checkpoint: %v", err)
+		}
+		same, err := CheckpointOperationsAfter(key, first, db)
+		if err != nil || same.OperationId != first.OperationId || same.Hash != first.Hash {
+			t.Errorf("checkpoint without operations moved: %+v, %v", same, err)
+		}
+
+		_, err = vasya.Transfer(context.Background(), 1, RecipientByLogin("petya"), 10, db)
+		if err != nil {
+			t.Fatalf("can't transfer: %v", err)
+		}
+		second, err := CheckpointOperationsAfter(key, first, db)
+		if err != nil || second.OperationId != 4 {
+			t.Fatalf("can't checkpoint after: %+v, %v", second, err)
+		}
+		err = VerifyOperationsCheckpoint(second, publicKey, db)
+		if err != nil {
+			t.Errorf("can't verify checkpoint: %v", err)
+		}
+
+		_, otherKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("can't generate key: %v", err)
+		}
+		_, err = CheckpointOperationsAfter(otherKey, first, db)
+		if !errors.Is(err, ErrInvalidCheckpoint) {
+			t.Errorf("Not ErrInvalidCheckpoint error: %v", err)
+		}
+
+		_, err = db.Exec(`UPDATE operationsLogging SET balance = -1 WHERE id = 4`)
+		if err != nil {
+			t.Fatalf("can't edit operation: %v", err)
+		}
+		_, err = CheckpointOperationsAfter(key, first, db)
+		if !errors.Is(err, ErrOperationsChainBroken) {
+			t.Errorf("Not ErrOperationsChainBroken error: %v", err)
+		}
+
+		_, err = db.Exec(`DELETE FROM operationsLogging WHERE id = 2`)
+		if err != nil {
+			t.Fatalf("can't delete operation: %v", err)
+		}
+		_, err = CheckpointOperationsAfter(key, first, db)
+		if !errors.Is(err, ErrOperationsChainBroken) {
+			t.Errorf("removed checkpoint operation not found: %v", err)
+		}
+	})
+}
+
+func TestExportOperationsCheckpoints(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		dir, err := ioutil.TempDir("", "checkpoints")
+		if err != nil {
+			t.Fatalf("can't create dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "checkpoints.jsonl")
+		publicKey, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("can't generate key: %v", err)
+		}
+
+		vasya := Session{UserId: 1, Login: "vasya"}
+		for i := 0; i < 2; i++ {
+			_, err = vasya.Transfer(context.Background(), 1, RecipientByLogin("petya"), 10, db)
+			if err != nil {
+				t.Fatalf("can't transfer: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			err = ExportOperationsCheckpointsContext(ctx, path, key, time.Hour, db)
+			cancel()
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Not context.DeadlineExceeded error: %v", err)
+			}
+		}
+
+		read, err := ReadOperationsCheckpoints(path)
+		if err != nil || len(read) != 2 || read[1].OperationId != 4 {
+			t.Fatalf("checkpoints not exported: %+v, %v", read, err)
+		}
+		for _, checkpoint := range read {
+			err = VerifyOperationsCheckpoint(checkpoint, publicKey, db)
+			if err != nil {
+				t.Errorf("can't verify checkpoint %d: %v", checkpoint.OperationId, err)
+			}
+		}
+
+		_, err = db.Exec(`UPDATE operationsLogging SET hash = 'forged' WHERE id = 4`)
+		if err != nil {
+			t.Fatalf("can't edit operation: %v", err)
+		}
+		err = ExportOperationsCheckpointsContext(context.Background(), path, key, time.Hour, db)
+		if !errors.Is(err, ErrOperationsChainBroken) {
+			t.Errorf("Not ErrOperationsChainBroken error: %v", err)
+		}
+	})
+}
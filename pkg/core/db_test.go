@@ -0,0 +1,52 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// testDrivers lists the databases the fixtures run against; postgres skips
+// itself without APM_CORE_POSTGRES_DSN.
+var testDrivers = []string{"sqlite3", "postgres"}
+
+func forEachDriver(t *testing.T, test func(t *testing.T, driver string)) {
+	for _, driver := range testDrivers {
+		driver := driver
+		t.Run(driver, func(t *testing.T) {
+			test(t, driver)
+		})
+	}
+}
+
+func openTestDb(t *testing.T, driver string) (db *sql.DB, closeDb func()) {
+	if driver == "postgres" {
+		return openPostgres(t)
+	}
+	db, err := sql.Open(driver, ":memory:")
+	if err != nil {
+		t.Fatalf("can't open db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	return db, func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("can't close db: %v", err)
+		}
+	}
+}
+
+// resetSequences moves Postgres id sequences past rows inserted with
+// explicit ids, as SQLite does by itself.
+func resetSequences(t *testing.T, db *sql.DB, tables ...string) {
+	if DialectOf(db) != Postgres {
+		return
+	}
+	for _, table := range tables {
+		_, err := db.Exec(`SELECT setval(pg_get_serial_sequence('` + table + `', 'id'), (SELECT max(id) FROM ` + table + `))`)
+		if err != nil {
+			t.Fatalf("can't reset %s sequence: %v", table, err)
+		}
+	}
+}
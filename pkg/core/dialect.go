@@ -0,0 +1,61 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Dialect is the SQL flavour of the database behind *sql.DB. Queries in
+// sql.go use $N placeholders understood by both dialects; only DDL and
+// reading generated ids differ.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// DialectOf picks the dialect by the driver db was opened with: lib/pq
+// ("postgres") is Postgres, everything else is SQLite.
+func DialectOf(db *sql.DB) Dialect {
+	if _, ok := db.Driver().(*pq.Driver); ok {
+		return Postgres
+	}
+	return SQLite
+}
+
+func (receiver Dialect) String() string {
+	switch receiver {
+	case Postgres:
+		return "postgres"
+	default:
+		return "sqlite3"
+	}
+}
+
+// insertId executes an INSERT and returns the id of the new row. Postgres
+// drivers do not implement LastInsertId, so there the id is read back with
+// RETURNING.
+func (receiver Dialect) insertId(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (id int64, err error) {
+	if receiver == Postgres {
+		returning := strings.TrimSuffix(strings.TrimSpace(query), ";") + " RETURNING id"
+		err = tx.QueryRowContext(ctx, returning, args...).Scan(&id)
+		if err != nil {
+			return 0, queryError(query, err)
+		}
+		return id, nil
+	}
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, queryError(query, err)
+	}
+	id, err = res.LastInsertId()
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return id, nil
+}
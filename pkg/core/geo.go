@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"sort"
+)
+
+var ErrInvalidCoordinates = errors.New("invalid coordinates")
+var ErrInvalidRadius = errors.New("invalid radius")
+
+const earthRadiusKm = 6371.0
+
+// AtmFilter narrows FindNearestAtms; the zero value keeps every ATM.
+type AtmFilter struct {
+	Status  AtmStatus
+	MinCash int64
+}
+
+type NearestAtm struct {
+	Atm        Atm
+	DistanceKm float64
+	Cash       int64
+}
+
+func validCoordinates(latitude, longitude float64) bool {
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// haversineKm is the great-circle distance between two points.
+func haversineKm(latitude1, longitude1, latitude2, longitude2 float64) float64 {
+	phi1, phi2 := latitude1*math.Pi/180, latitude2*math.Pi/180
+	dPhi := phi2 - phi1
+	dLambda := (longitude2 - longitude1) * math.Pi / 180
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// FindNearestAtmsContext returns up to limit ATMs within radiusKm of the
+// point, nearest first; limit 0 returns all of them. ATMs added before they
+// had coordinates are never found. The database only narrows the ATMs down
+// to the latitudes in range, the distance is computed here.
+func FindNearestAtmsContext(ctx context.Context, latitude, longitude, radiusKm float64, limit int, filter AtmFilter, db *sql.DB) (atms []NearestAtm, err error) {
+	if !validCoordinates(latitude, longitude) {
+		return nil, ErrInvalidCoordinates
+	}
+	if radiusKm <= 0 || math.IsNaN(radiusKm) {
+		return nil, ErrInvalidRadius
+	}
+
+	degrees := radiusKm / earthRadiusKm * 180 / math.Pi
+	rows, err := db.QueryContext(ctx, getAtmsInLatitudeSQL, latitude-degrees, latitude+degrees, filter.Status, filter.MinCash)
+	if err != nil {
+		return nil, queryError(getAtmsInLatitudeSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			atms, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		atm := NearestAtm{}
+		err = rows.Scan(&atm.Atm.Id, &atm.Atm.Name, &atm.Atm.Address, &atm.Atm.Latitude, &atm.Atm.Longitude, &atm.Atm.Status, &atm.Cash)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		atm.DistanceKm = haversineKm(latitude, longitude, atm.Atm.Latitude, atm.Atm.Longitude)
+		if atm.DistanceKm <= radiusKm {
+			atms = append(atms, atm)
+		}
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return nearestFirst(atms, limit), nil
+}
+
+func FindNearestAtms(latitude, longitude, radiusKm float64, limit int, filter AtmFilter, db *sql.DB) ([]NearestAtm, error) {
+	return FindNearestAtmsContext(context.Background(), latitude, longitude, radiusKm, limit, filter, db)
+}
+
+// nearestFirst sorts atms by distance, ties by id, and keeps limit of them.
+func nearestFirst(atms []NearestAtm, limit int) []NearestAtm {
+	sort.Slice(atms, func(i, j int) bool {
+		if atms[i].DistanceKm != atms[j].DistanceKm {
+			return atms[i].DistanceKm < atms[j].DistanceKm
+		}
+		return atms[i].Atm.Id < atms[j].Atm.Id
+	})
+	if limit > 0 && len(atms) > limit {
+		atms = atms[:limit]
+	}
+	return atms
+}
@@ -0,0 +1,101 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestHaversineKm(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"same point", 38.5737, 68.7738, 38.5737, 68.7738, 0},
+		{"London Paris", 51.5074, -0.1278, 48.8566, 2.3522, 343.56},
+		{"across antimeridian", 0, 179.5, 0, -179.5, 111.19},
+		{"pole to pole", 90, 0, -90, 0, 20015.09},
+	}
+	for _, test := range tests {
+		got := haversineKm(test.lat1, test.lon1, test.lat2, test.lon2)
+		if math.Abs(got-test.want) > 0.5 {
+			t.Errorf("%s: got %.2f km, want %.2f km", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFindNearestAtms(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		atms := []Atm{
+			{Name: "T1", Address: "rudaki 65", Latitude: 38.5737, Longitude: 68.7738},
+			{Name: "T2", Address: "somoni 77", Latitude: 38.5812, Longitude: 68.7712},
+			{Name: "T3", Address: "airport", Latitude: 38.5433, Longitude: 68.8250},
+			{Name: "K1", Address: "khujand", Latitude: 40.2826, Longitude: 69.6222},
+		}
+		for _, atm := range atms {
+			err := AddAtm(atm.Name, atm.Address, atm.Latitude, atm.Longitude, db)
+			if err != nil {
+				t.Fatalf("can't add atm: %v", err)
+			}
+		}
+		_, err := db.Exec(`INSERT INTO atm(name, address) VALUES ('L1', 'legacy')`)
+		if err != nil {
+			t.Fatalf("can't add atm without location: %v", err)
+		}
+		err = SetAtmDenominations(2, []int64{100}, db)
+		if err != nil {
+			t.Fatalf("can't set denominations: %v", err)
+		}
+		err = ReplenishAtm(2, []Cassette{{Denomination: 100, Notes: 10}}, db)
+		if err != nil {
+			t.Fatalf("can't replenish atm: %v", err)
+		}
+
+		found, err := FindNearestAtms(38.5760, 68.7730, 10, 0, AtmFilter{}, db)
+		if err != nil || len(found) != 3 || found[0].Atm.Name != "T1" || found[1].Atm.Name != "T2" || found[2].Atm.Name != "T3" {
+			t.Fatalf("nearest atms not match: %v, %v", found, err)
+		}
+		if found[0].DistanceKm > found[1].DistanceKm || found[1].DistanceKm > found[2].DistanceKm || found[2].DistanceKm > 10 {
+			t.Errorf("nearest atms not ordered by distance: %v", found)
+		}
+		if found[1].Cash != 1000 || found[1].Atm.Latitude != 38.5812 {
+			t.Errorf("nearest atm not match: %v", found[1])
+		}
+
+		found, err = FindNearestAtms(38.5760, 68.7730, 10, 2, AtmFilter{}, db)
+		if err != nil || len(found) != 2 || found[1].Atm.Name != "T2" {
+			t.Errorf("limited nearest atms not match: %v, %v", found, err)
+		}
+		found, err = FindNearestAtms(38.5760, 68.7730, 500, 0, AtmFilter{MinCash: 500}, db)
+		if err != nil || len(found) != 1 || found[0].Atm.Name != "T2" {
+			t.Errorf("nearest atms with cash not match: %v, %v", found, err)
+		}
+		found, err = FindNearestAtms(38.5760, 68.7730, 500, 0, AtmFilter{}, db)
+		if err != nil || len(found) != 4 || found[3].Atm.Name != "K1" {
+			t.Errorf("nearest atms in wide radius not match: %v, %v", found, err)
+		}
+		found, err = FindNearestAtms(0, 0, 100, 0, AtmFilter{}, db)
+		if err != nil || len(found) != 0 {
+			t.Errorf("found atms far away: %v, %v", found, err)
+		}
+
+		_, err = FindNearestAtms(91, 0, 10, 0, AtmFilter{}, db)
+		if !errors.Is(err, ErrInvalidCoordinates) {
+			t.Errorf("Not ErrInvalidCoordinates error: %v", err)
+		}
+		_, err = FindNearestAtms(38.5760, 68.7730, 0, 0, AtmFilter{}, db)
+		if !errors.Is(err, ErrInvalidRadius) {
+			t.Errorf("Not ErrInvalidRadius error: %v", err)
+		}
+		err = AddAtm("X1", "nowhere", 38.5, 181, db)
+		if !errors.Is(err, ErrInvalidCoordinates) {
+			t.Errorf("Not ErrInvalidCoordinates error for new atm: %v", err)
+		}
+	})
+}
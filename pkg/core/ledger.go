@@ -0,0 +1,245 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrUnbalancedJournal = errors.New("journal debits and credits differ")
+
+// Ledger accounts besides the cards and services.
+const (
+	// ClearingTransfersAccount is debited and credited with every transfer
+	// between cards; its debits add up to sumTransferUsers.
+	ClearingTransfersAccount = "clearing:transfers"
+	// OpeningAccount balances the money cards are issued with and the
+	// balances kept before the ledger.
+	OpeningAccount = "equity:opening"
+)
+
+func CardAccount(idCard int64) string {
+	return "card:" + strconv.FormatInt(idCard, 10)
+}
+
+func ServiceAccount(idService int64) string {
+	return "service:" + strconv.FormatInt(idService, 10)
+}
+
+// AtmAccount is the cash the ATM paid out to cards less what it took in.
+func AtmAccount(idAtm int64) string {
+	return "atm:" + strconv.FormatInt(idAtm, 10)
+}
+
+// Posting is one side of a journal: a positive amount debits the account,
+// a negative one credits it.
+type Posting struct {
+	Account string
+	Amount  int64
+}
+
+// LedgerMismatch is an account whose balance kept with its card, service
+// or sumTransferUsers differs from the ledger.
+type LedgerMismatch struct {
+	Account string
+	Balance int64
+	Ledger  int64
+}
+
+type LedgerReport struct {
+	UnbalancedJournals []int64
+	Mismatches         []LedgerMismatch
+}
+
+func (receiver LedgerReport) Balanced() bool {
+	return len(receiver.UnbalancedJournals) == 0 && len(receiver.Mismatches) == 0
+}
+
+func checkPostings(postings []Posting) error {
+	var sum int64
+	for _, posting := range postings {
+		if posting.Amount == 0 {
+			return ErrUnbalancedJournal
+		}
+		sum += posting.Amount
+	}
+	if sum != 0 {
+		return ErrUnbalancedJournal
+	}
+	return nil
+}
+
+// postJournal records a money movement in the ledger. operationId is the
+// logged operation it belongs to, 0 for none.
+func postJournal(ctx context.Context, tx *sql.Tx, dialect Dialect, operationId int64, name string, postings ...Posting) error {
+	err := checkPostings(postings)
+	if err != nil {
+		return err
+	}
+	operation := sql.NullInt64{Int64: operationId, Valid: operationId != 0}
+	journalId, err := dialect.insertId(ctx, tx, insertLedgerJournalSQL, operation, name, formatTimestamp(time.Now()))
+	if err != nil {
+		return err
+	}
+	for _, posting := range postings {
+		_, err = tx.ExecContext(ctx, insertLedgerPostingSQL, journalId, posting.Account, posting.Amount)
+		if err != nil {
+			return queryError(insertLedgerPostingSQL, err)
+		}
+	}
+	return nil
+}
+
+// transferPostings move amount from card to card through the clearing
+// account.
+func transferPostings(senderId, recipientId int64, amount int64) []Posting {
+	return []Posting{
+		{Account: CardAccount(senderId), Amount: amount},
+		{Account: ClearingTransfersAccount, Amount: -amount},
+		{Account: ClearingTransfersAccount, Amount: amount},
+		{Account: CardAccount(recipientId), Amount: -amount},
+	}
+}
+
+// LedgerBalanceContext is the credit balance of the account, credits less
+// debits: for cards and services the money they hold.
+func LedgerBalanceContext(ctx context.Context, account string, db *sql.DB) (int64, error) {
+	var sum int64
+	err := db.QueryRowContext(ctx, selectLedgerBalanceSQL, account).Scan(&sum)
+	if err != nil {
+		return 0, queryError(selectLedgerBalanceSQL, err)
+	}
+	return -sum, nil
+}
+
+func LedgerBalance(account string, db *sql.DB) (int64, error) {
+	return LedgerBalanceContext(context.Background(), account, db)
+}
+
+// VerifyLedgerContext checks that every journal balances and that the card
+// and service balances and sumTransferUsers agree with the ledger.
+func VerifyLedgerContext(ctx context.Context, db *sql.DB) (report LedgerReport, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			report = LedgerReport{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			report = LedgerReport{}
+		}
+	}()
+
+	report.UnbalancedJournals, err = selectUnbalancedJournals(ctx, tx)
+	if err != nil {
+		return report, err
+	}
+	cards, err := selectLedgerMismatches(ctx, tx, selectCardLedgerMismatchSQL, CardAccount)
+	if err != nil {
+		return report, err
+	}
+	services, err := selectLedgerMismatches(ctx, tx, selectServiceLedgerMismatchSQL, ServiceAccount)
+	if err != nil {
+		return report, err
+	}
+	report.Mismatches = append(cards, services...)
+
+	var transfers, cleared int64
+	err = tx.QueryRowContext(ctx, selectTransfersLedgerSQL).Scan(&transfers, &cleared)
+	if err != nil {
+		return report, queryError(selectTransfersLedgerSQL, err)
+	}
+	if transfers != cleared {
+		report.Mismatches = append(report.Mismatches, LedgerMismatch{Account: ClearingTransfersAccount, Balance: transfers, Ledger: cleared})
+	}
+	return report, nil
+}
+
+func VerifyLedger(db *sql.DB) (LedgerReport, error) {
+	return VerifyLedgerContext(context.Background(), db)
+}
+
+func selectUnbalancedJournals(ctx context.Context, tx *sql.Tx) (ids []int64, err error) {
+	rows, err := tx.QueryContext(ctx, selectUnbalancedJournalsSQL)
+	if err != nil {
+		return nil, queryError(selectUnbalancedJournalsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			ids, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		ids = append(ids, id)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return ids, nil
+}
+
+func selectLedgerMismatches(ctx context.Context, tx *sql.Tx, query string, account func(int64) string) (mismatches []LedgerMismatch, err error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			mismatches, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		var id int64
+		mismatch := LedgerMismatch{}
+		err = rows.Scan(&id, &mismatch.Balance, &mismatch.Ledger)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		mismatch.Account = account(id)
+		mismatches = append(mismatches, mismatch)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return mismatches, nil
+}
+
+// openLedger posts the balances kept before the ledger in one opening
+// journal.
+func openLedger(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, insertLedgerJournalSQL, nil, string(OperationLedgerOpening), formatTimestamp(time.Now()))
+	if err != nil {
+		return queryError(insertLedgerJournalSQL, err)
+	}
+	for _, query := range []string{
+		insertOpeningCardPostingsSQL,
+		insertOpeningServicePostingsSQL,
+		insertOpeningTransfersDebitSQL,
+		insertOpeningTransfersCreditSQL,
+		insertOpeningEquityPostingSQL,
+		deleteEmptyOpeningJournalSQL,
+	} {
+		_, err = tx.ExecContext(ctx, query)
+		if err != nil {
+			return queryError(query, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+// openLedgerDb holds the transfer fixture and a service with balances kept
+// before the ledger, which its migration opens.
+func openLedgerDb(t *testing.T, driver string) (db *sql.DB, closeDb func()) {
+	db, closeDb = openTestDb(t, driver)
+	err := Migrate(db, 12)
+	if err != nil {
+		closeDb()
+		t.Fatalf("can't migrate db: %v", err)
+	}
+	for _, query := range []string{
+		`INSERT INTO users(id, name, login, password, passportSeries, phoneNumber, hideShow) VALUES (1,'Vasya','vasya','secret','A132323',9001,3)`,
+		`INSERT INTO users(id, name, login, password, passportSeries, phoneNumber, hideShow) VALUES (2,'Petya','petya','secret','A000009',9002,3)`,
+		`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (1,'AlifMobi',200,1,'2021600000000016')`,
+		`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (2,'AlifMobi',400,2,'2021600000000024')`,
+		`INSERT INTO services(id, name, balance) VALUES (1,'Internet',30)`,
+		`UPDATE sumTransferUsers SET balance = 50`,
+	} {
+		_, err = db.Exec(query)
+		if err != nil {
+			closeDb()
+			t.Fatalf("can't add fixture: %v", err)
+		}
+	}
+	resetSequences(t, db, "users", "cards", "services")
+	err = Init(db)
+	if err != nil {
+		closeDb()
+		t.Fatalf("can't init db: %v", err)
+	}
+	return db, closeDb
+}
+
+func checkLedgerBalances(t *testing.T, db *sql.DB, want map[string]int64) {
+	t.Helper()
+	for account, balance := range want {
+		got, err := LedgerBalance(account, db)
+		if err != nil || got != balance {
+			t.Errorf("%s: got %d, want %d: %v", account, got, balance, err)
+		}
+	}
+}
+
+func TestLedger(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openLedgerDb(t, driver)
+		defer closeDb()
+
+		report, err := VerifyLedger(db)
+		if err != nil || !report.Balanced() {
+			t.Fatalf("opened ledger not balanced: %+v, %v", report, err)
+		}
+		checkLedgerBalances(t, db, map[string]int64{
+			CardAccount(1):           200,
+			CardAccount(2):           400,
+			ServiceAccount(1):        30,
+			ClearingTransfersAccount: 0,
+			OpeningAccount:           -630,
+		})
+
+		vasya := Session{UserId: 1, Login: "vasya"}
+		_, err = vasya.Transfer(context.Background(), 1, RecipientByLogin("petya"), 50, db)
+		if err != nil {
+			t.Fatalf("can't transfer: %v", err)
+		}
+		_, err = vasya.PayService(1, 20, "Internet", nil, db)
+		if err != nil {
+			t.Fatalf("can't pay service: %v", err)
+		}
+		issued, err := IssueCard("AlifMobi", 70, 2, db)
+		if err != nil {
+			t.Fatalf("can't issue card: %v", err)
+		}
+
+		report, err = VerifyLedger(db)
+		if err != nil || !report.Balanced() {
+			t.Errorf("ledger not balanced: %+v, %v", report, err)
+		}
+		checkLedgerBalances(t, db, map[string]int64{
+			CardAccount(1):           130,
+			CardAccount(2):           450,
+			CardAccount(issued.Id):   70,
+			ServiceAccount(1):        50,
+			ClearingTransfersAccount: 0,
+			OpeningAccount:           -700,
+		})
+
+		_, err = db.Exec(`UPDATE cards SET balance = balance + 5 WHERE id = 1`)
+		if err != nil {
+			t.Fatalf("can't change card balance: %v", err)
+		}
+		_, err = db.Exec(`UPDATE sumTransferUsers SET balance = balance + 1`)
+		if err != nil {
+			t.Fatalf("can't change transfers sum: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO ledgerJournal(id, name, time) VALUES (100, 'broken', '')`)
+		if err != nil {
+			t.Fatalf("can't add journal: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO ledgerPostings(journal_id, account, amount) VALUES (100, 'service:1', -1)`)
+		if err != nil {
+			t.Fatalf("can't add posting: %v", err)
+		}
+
+		report, err = VerifyLedger(db)
+		if err != nil {
+			t.Fatalf("can't verify ledger: %v", err)
+		}
+		want := LedgerReport{
+			UnbalancedJournals: []int64{100},
+			Mismatches: []LedgerMismatch{
+				{Account: CardAccount(1), Balance: 135, Ledger: 130},
+				{Account: ServiceAccount(1), Balance: 50, Ledger: 51},
+				{Account: ClearingTransfersAccount, Balance: 101, Ledger: 100},
+			},
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("report not match: %+v, want %+v", report, want)
+		}
+	})
+}
+
+func TestPostJournal_Unbalanced(t *testing.T) {
+	for _, postings := range [][]Posting{
+		{{Account: CardAccount(1), Amount: 10}},
+		{{Account: CardAccount(1), Amount: 10}, {Account: CardAccount(2), Amount: -9}},
+		{{Account: CardAccount(1), Amount: 0}, {Account: CardAccount(2), Amount: 0}},
+	} {
+		if err := checkPostings(postings); err != ErrUnbalancedJournal {
+			t.Errorf("%v: not ErrUnbalancedJournal error: %v", postings, err)
+		}
+	}
+	if err := checkPostings(transferPostings(1, 2, 10)); err != nil {
+		t.Errorf("transfer postings not balanced: %v", err)
+	}
+}
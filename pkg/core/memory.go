@@ -0,0 +1,1446 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is a Store without database: it follows the behaviour of the
+// SQL implementation, including the table constraints, and is meant for
+// tests and for running the higher layers without sqlite3.
+type MemoryStore struct {
+	mu               sync.Mutex
+	managers         []memoryManager
+	users            []User
+	cards            []Card
+	atms             []Atm
+	services         []Service
+	operations       []OperationsLogging
+	sumTransferUsers int
+	defaultCards     map[int64]int64
+	cvvs             map[int64]string
+	cvvAttempts      map[int64]int
+	blockReasons     map[int64]string
+	pins             map[int64]string
+	pinAttempts      map[int64]int
+	cassettes        map[int64][]Cassette
+	workingHours     map[int64][]WorkingHours
+	maintenance      []memoryMaintenance
+	statusHistory    map[int64][]AtmStatusChange
+	reversals        map[int64]int64
+	withdrawalNotes  map[int64][]Cassette
+	servicePayments  map[int64]int64
+	serviceFields    map[int64][]ServiceField
+	journals         []memoryJournal
+}
+
+type memoryMaintenance struct {
+	atmId  int64
+	window MaintenanceWindow
+}
+
+type memoryJournal struct {
+	id          int64
+	operationId int64
+	name        string
+	postings    []Posting
+}
+
+type memoryManager struct {
+	name     string
+	login    string
+	password string
+}
+
+// NewMemoryStore returns a store holding the same initial data as Init.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		managers:        []memoryManager{{name: "IBank", login: "admin"}},
+		defaultCards:    make(map[int64]int64),
+		cvvs:            make(map[int64]string),
+		cvvAttempts:     make(map[int64]int),
+		blockReasons:    make(map[int64]string),
+		pins:            make(map[int64]string),
+		pinAttempts:     make(map[int64]int),
+		cassettes:       make(map[int64][]Cassette),
+		workingHours:    make(map[int64][]WorkingHours),
+		statusHistory:   make(map[int64][]AtmStatusChange),
+		reversals:       make(map[int64]int64),
+		withdrawalNotes: make(map[int64][]Cassette),
+		servicePayments: make(map[int64]int64),
+		serviceFields:   make(map[int64][]ServiceField),
+	}
+}
+
+func uniqueError(column string) error {
+	return fmt.Errorf("UNIQUE constraint failed: %s", column)
+}
+
+func (receiver *MemoryStore) LoginManager(ctx context.Context, login, password string) (bool, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for i := range receiver.managers {
+		manager := &receiver.managers[i]
+		if manager.login != login {
+			continue
+		}
+		if manager.password == "" {
+			return false, ErrManagerPasswordNotSet
+		}
+		ok, rehash := checkPassword(manager.password, password)
+		if !ok {
+			return false, ErrInvalidPass
+		}
+		if rehash {
+			hash, err := hashPassword(password)
+			if err != nil {
+				return false, err
+			}
+			manager.password = hash
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (receiver *MemoryStore) LoginUsers(ctx context.Context, login, password string) (Session, bool, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	user := receiver.userByLogin(login)
+	if user == nil {
+		return Session{}, false, nil
+	}
+	ok, rehash := checkPassword(user.Password, password)
+	if !ok {
+		return Session{}, false, ErrInvalidPass
+	}
+	if user.HideShow == 4 {
+		return Session{}, false, ErrUserBlocked
+	}
+	if rehash {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return Session{}, false, err
+		}
+		user.Password = hash
+	}
+	return Session{UserId: user.Id, Login: user.Login}, true, nil
+}
+
+func (receiver *MemoryStore) AddUser(ctx context.Context, name, login, password, passportSeries string, phoneNumber int) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, user := range receiver.users {
+		if user.Login == login {
+			return uniqueError("users.login")
+		}
+		if user.PassportSeries == passportSeries {
+			return uniqueError("users.passportSeries")
+		}
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	receiver.users = append(receiver.users, User{
+		Id:             int64(len(receiver.users) + 1),
+		Name:           name,
+		Login:          login,
+		Password:       hash,
+		PassportSeries: passportSeries,
+		NumberPhone:    phoneNumber,
+		HideShow:       3,
+	})
+	return nil
+}
+
+func (receiver *MemoryStore) GetAllUsers(ctx context.Context) (users []User, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, user := range receiver.users {
+		users = append(users, User{Id: user.Id, Name: user.Name, PassportSeries: user.PassportSeries, NumberPhone: user.NumberPhone})
+	}
+	return users, nil
+}
+
+func (receiver *MemoryStore) SetManagerPassword(ctx context.Context, login, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for i := range receiver.managers {
+		if receiver.managers[i].login == login {
+			receiver.managers[i].password = hash
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) SetUserPassword(ctx context.Context, userId int64, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if user := receiver.userById(userId); user != nil {
+		user.Password = hash
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) UserHideManager(ctx context.Context, userId int) error {
+	return receiver.setHideShow(int64(userId), 4)
+}
+
+func (receiver *MemoryStore) UserShowManager(ctx context.Context, userId int) error {
+	return receiver.setHideShow(int64(userId), 3)
+}
+
+func (receiver *MemoryStore) setHideShow(userId int64, hideShow int) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	if user := receiver.userById(userId); user != nil {
+		user.HideShow = hideShow
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) GetHideUsers(ctx context.Context) (users []UserHide, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, user := range receiver.users {
+		if user.HideShow == 4 {
+			users = append(users, UserHide{Id: user.Id, Name: user.Name, PassportSeries: user.PassportSeries, NumberPhone: user.NumberPhone})
+		}
+	}
+	return users, nil
+}
+
+func (receiver *MemoryStore) GetShowUsers(ctx context.Context) (users []UserShow, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, user := range receiver.users {
+		if user.HideShow == 3 {
+			users = append(users, UserShow{Id: user.Id, Name: user.Name, PassportSeries: user.PassportSeries, NumberPhone: user.NumberPhone})
+		}
+	}
+	return users, nil
+}
+
+func (receiver *MemoryStore) SearchUserByPhoneNumber(ctx context.Context, phoneNumber int) (users []User, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, user := range receiver.users {
+		if user.NumberPhone == phoneNumber {
+			users = append(users, User{Id: user.Id, Name: user.Name, PassportSeries: user.PassportSeries, NumberPhone: user.NumberPhone})
+		}
+	}
+	return users, nil
+}
+
+func (receiver *MemoryStore) AddCard(ctx context.Context, name string, balance int64, userId int64) error {
+	_, err := receiver.IssueCard(ctx, name, balance, userId)
+	return err
+}
+
+func (receiver *MemoryStore) IssueCard(ctx context.Context, name string, balance int64, userId int64) (card IssuedCard, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	if balance <= 0 {
+		return card, ErrInvalidAmount
+	}
+	card.Id = int64(len(receiver.cards) + 1)
+	card.NumberCard, err = newCardNumber(CardBIN(), card.Id)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	for _, existing := range receiver.cards {
+		if existing.NumberCard == card.NumberCard {
+			return IssuedCard{}, uniqueError("cards.numberCard")
+		}
+	}
+	card.ExpiryMonth, card.ExpiryYear = cardExpiry(time.Now())
+	card.CVV, err = newCVV()
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	cvvHash, err := hashCardSecret(cardSecretCVV, card.Id, card.CVV)
+	if err != nil {
+		return IssuedCard{}, err
+	}
+	receiver.cards = append(receiver.cards, Card{
+		Id:          card.Id,
+		Name:        name,
+		Balance:     balance,
+		User_id:     userId,
+		NumberCard:  card.NumberCard,
+		Status:      CardActive,
+		ExpiryMonth: card.ExpiryMonth,
+		ExpiryYear:  card.ExpiryYear,
+	})
+	receiver.cvvs[card.Id] = cvvHash
+	receiver.postJournal(0, string(OperationIssueCard),
+		Posting{Account: OpeningAccount, Amount: balance},
+		Posting{Account: CardAccount(card.Id), Amount: -balance},
+	)
+	return card, nil
+}
+
+func (receiver *MemoryStore) VerifyCVV(ctx context.Context, idCard int64, cvv string) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card := receiver.cardById(idCard)
+	if card == nil {
+		return ErrCardNotFound
+	}
+	if card.Status != CardActive {
+		return ErrCardNotActive
+	}
+	ok, _, err := checkCardSecret(receiver.cvvs[idCard], cardSecretCVV, idCard, cvv)
+	if err != nil {
+		return err
+	}
+	if ok {
+		receiver.cvvAttempts[idCard] = 0
+		return nil
+	}
+	receiver.cvvAttempts[idCard]++
+	if receiver.cvvAttempts[idCard] >= maxCVVAttempts {
+		card.Status = CardBlocked
+		receiver.blockReasons[idCard] = blockedByCVV
+		receiver.logOperation(OperationCVVBlocked, time.Now(), card.NumberCard, 0, card.User_id)
+		return ErrCVVAttemptsExceeded
+	}
+	receiver.logOperation(OperationCVVVerifyFailed, time.Now(), card.NumberCard, 0, card.User_id)
+	return ErrInvalidCVV
+}
+
+func (receiver *MemoryStore) BlockCard(ctx context.Context, idCard int64) error {
+	return receiver.setCardStatus(idCard, CardBlocked, []CardStatus{CardActive, CardBlocked})
+}
+
+func (receiver *MemoryStore) UnblockCard(ctx context.Context, idCard int64) error {
+	return receiver.setCardStatus(idCard, CardActive, []CardStatus{CardBlocked, CardActive})
+}
+
+func (receiver *MemoryStore) CloseCard(ctx context.Context, idCard int64) error {
+	return receiver.setCardStatus(idCard, CardClosed, []CardStatus{CardActive, CardBlocked, CardExpired})
+}
+
+func (receiver *MemoryStore) setCardStatus(idCard int64, status CardStatus, from []CardStatus) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card := receiver.cardById(idCard)
+	if card == nil {
+		return ErrCardNotFound
+	}
+	if status == CardActive && cardPastExpiry(card.ExpiryMonth, card.ExpiryYear, time.Now()) {
+		return ErrCardExpired
+	}
+	if !cardStatusIn(card.Status, from) {
+		return ErrInvalidCardStatus
+	}
+	card.Status = status
+	if status == CardBlocked {
+		receiver.blockReasons[idCard] = blockedByManager
+	}
+	if status == CardActive {
+		receiver.pinAttempts[idCard] = 0
+		receiver.cvvAttempts[idCard] = 0
+		delete(receiver.blockReasons, idCard)
+	}
+	if status == CardClosed {
+		for userId, defaultCard := range receiver.defaultCards {
+			if defaultCard == idCard {
+				delete(receiver.defaultCards, userId)
+			}
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) ExpireCards(ctx context.Context) (count int64, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for i := range receiver.cards {
+		card := &receiver.cards[i]
+		if (card.Status == CardActive || card.Status == CardBlocked) && cardPastExpiry(card.ExpiryMonth, card.ExpiryYear, time.Now()) {
+			card.Status = CardExpired
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (receiver *MemoryStore) SetPIN(ctx context.Context, session Session, idCard int64, pin string) error {
+	if !validPINFormat(pin) {
+		return ErrInvalidPINFormat
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card := receiver.cardById(idCard)
+	if card == nil || card.User_id != session.UserId {
+		return ErrCardNotFound
+	}
+	if card.Status != CardActive {
+		return ErrCardNotActive
+	}
+	if receiver.pins[idCard] != "" {
+		return ErrPINAlreadySet
+	}
+	return receiver.updatePIN(card, pin, OperationPINSet)
+}
+
+func (receiver *MemoryStore) ChangePIN(ctx context.Context, idCard int64, oldPIN, newPIN string) error {
+	if !validPINFormat(newPIN) {
+		return ErrInvalidPINFormat
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card, err := receiver.checkPIN(idCard, oldPIN)
+	if err != nil {
+		return err
+	}
+	return receiver.updatePIN(card, newPIN, OperationPINChanged)
+}
+
+func (receiver *MemoryStore) VerifyPIN(ctx context.Context, idCard int64, pin string) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	_, err := receiver.checkPIN(idCard, pin)
+	return err
+}
+
+func (receiver *MemoryStore) ResetPINAttempts(ctx context.Context, idCard int64) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card := receiver.cardById(idCard)
+	if card == nil {
+		return ErrCardNotFound
+	}
+	if card.Status == CardBlocked && receiver.blockReasons[idCard] == blockedByPIN {
+		card.Status = CardActive
+		delete(receiver.blockReasons, idCard)
+	}
+	receiver.pinAttempts[idCard] = 0
+	receiver.logOperation(OperationPINAttemptsReset, time.Now(), card.NumberCard, 0, card.User_id)
+	return nil
+}
+
+func (receiver *MemoryStore) checkPIN(idCard int64, pin string) (*Card, error) {
+	card := receiver.cardById(idCard)
+	if card == nil {
+		return nil, ErrCardNotFound
+	}
+	if card.Status != CardActive {
+		return nil, ErrCardNotActive
+	}
+	pinHash := receiver.pins[idCard]
+	if pinHash == "" {
+		return nil, ErrPINNotSet
+	}
+	ok, _, err := checkCardSecret(pinHash, cardSecretPIN, idCard, pin)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		receiver.pinAttempts[idCard] = 0
+		return card, nil
+	}
+
+	receiver.pinAttempts[idCard]++
+	if receiver.pinAttempts[idCard] >= maxPINAttempts {
+		card.Status = CardBlocked
+		receiver.blockReasons[idCard] = blockedByPIN
+		receiver.logOperation(OperationPINBlocked, time.Now(), card.NumberCard, 0, card.User_id)
+		return nil, ErrPINAttemptsExceeded
+	}
+	receiver.logOperation(OperationPINVerifyFailed, time.Now(), card.NumberCard, 0, card.User_id)
+	return nil, ErrWrongPIN
+}
+
+func (receiver *MemoryStore) updatePIN(card *Card, pin string, name OperationType) error {
+	pinHash, err := hashCardSecret(cardSecretPIN, card.Id, pin)
+	if err != nil {
+		return err
+	}
+	receiver.pins[card.Id] = pinHash
+	receiver.pinAttempts[card.Id] = 0
+	receiver.logOperation(name, time.Now(), card.NumberCard, 0, card.User_id)
+	return nil
+}
+
+func (receiver *MemoryStore) GetAllCards(ctx context.Context) (cards []Card, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return append(cards, receiver.cards...), nil
+}
+
+func (receiver *MemoryStore) CardByNumber(ctx context.Context, numberCard string) (Card, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, card := range receiver.cards {
+		if card.NumberCard == numberCard {
+			return card, nil
+		}
+	}
+	return Card{}, ErrCardNotFound
+}
+
+func (receiver *MemoryStore) GetUserCards(ctx context.Context, session Session) (cards []Card, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, card := range receiver.cards {
+		if card.User_id == session.UserId {
+			card.User_id = 0
+			cards = append(cards, card)
+		}
+	}
+	return cards, nil
+}
+
+func (receiver *MemoryStore) SetDefaultCard(ctx context.Context, session Session, idCard int64) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card := receiver.cardById(idCard)
+	if card == nil || card.User_id != session.UserId || card.Status != CardActive {
+		return ErrCardNotFound
+	}
+	receiver.defaultCards[session.UserId] = idCard
+	return nil
+}
+
+func (receiver *MemoryStore) DefaultCard(ctx context.Context, session Session) (int64, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card := receiver.defaultCard(session.UserId)
+	if card == nil {
+		return 0, ErrCardNotFound
+	}
+	return card.Id, nil
+}
+
+func (receiver *MemoryStore) AddAtm(ctx context.Context, name, address string, latitude, longitude float64) error {
+	if !validCoordinates(latitude, longitude) {
+		return ErrInvalidCoordinates
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, atm := range receiver.atms {
+		if atm.Name == name {
+			return uniqueError("atm.name")
+		}
+	}
+	receiver.atms = append(receiver.atms, Atm{Id: int64(len(receiver.atms) + 1), Name: name, Address: address, Latitude: latitude, Longitude: longitude, Status: AtmOnline})
+	return nil
+}
+
+func (receiver *MemoryStore) GetAllAtms(ctx context.Context) (atms []Atm, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return append(atms, receiver.atms...), nil
+}
+
+func (receiver *MemoryStore) SetAtmDenominations(ctx context.Context, atmId int64, denominations []int64) error {
+	denominations, err := normalizeDenominations(denominations)
+	if err != nil {
+		return err
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	if receiver.atmById(atmId) == nil {
+		return ErrAtmNotFound
+	}
+	cassettes := make([]Cassette, len(denominations))
+	for i, denomination := range denominations {
+		cassettes[i].Denomination = denomination
+	}
+	for _, cassette := range receiver.cassettes[atmId] {
+		for i := range cassettes {
+			if cassettes[i].Denomination == cassette.Denomination {
+				cassettes[i].Notes = cassette.Notes
+			}
+		}
+		if cassette.Notes > 0 && !denominationIn(cassette.Denomination, denominations) {
+			return ErrCassetteNotEmpty
+		}
+	}
+	receiver.cassettes[atmId] = cassettes
+	return nil
+}
+
+func (receiver *MemoryStore) AtmDenominations(ctx context.Context, atmId int64) ([]int64, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return denominationsOf(receiver.cassettes[atmId]), nil
+}
+
+func (receiver *MemoryStore) AtmCassettes(ctx context.Context, atmId int64) (cassettes []Cassette, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return append(cassettes, receiver.cassettes[atmId]...), nil
+}
+
+func (receiver *MemoryStore) ReplenishAtm(ctx context.Context, atmId int64, notes []Cassette) error {
+	var total int64
+	for _, cassette := range notes {
+		if cassette.Notes <= 0 {
+			return ErrInvalidAmount
+		}
+		total += cassette.Denomination * cassette.Notes
+	}
+	if total == 0 {
+		return ErrInvalidAmount
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	atm := receiver.atmById(atmId)
+	if atm == nil {
+		return ErrAtmNotFound
+	}
+	for _, cassette := range notes {
+		if !hasDenomination(receiver.cassettes[atmId], cassette.Denomination) {
+			return ErrInvalidDenomination
+		}
+	}
+	receiver.addCassetteNotes(atmId, notes, 1)
+	receiver.logAtmOperation(OperationAtmReplenish, atm, total, 0, 0)
+	return nil
+}
+
+func (receiver *MemoryStore) CollectAtm(ctx context.Context, atmId int64) (collected []Cassette, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	atm := receiver.atmById(atmId)
+	if atm == nil {
+		return nil, ErrAtmNotFound
+	}
+	var total int64
+	for _, cassette := range receiver.cassettes[atmId] {
+		if cassette.Notes > 0 {
+			collected = append(collected, cassette)
+			total += cassette.Denomination * cassette.Notes
+		}
+	}
+	receiver.addCassetteNotes(atmId, collected, -1)
+	receiver.logAtmOperation(OperationAtmCollect, atm, -total, 0, 0)
+	return collected, nil
+}
+
+func (receiver *MemoryStore) LowCashAtms(ctx context.Context, threshold int64) (atms []AtmCash, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, atm := range receiver.atms {
+		var cash int64
+		for _, cassette := range receiver.cassettes[atm.Id] {
+			cash += cassette.Denomination * cassette.Notes
+		}
+		if cash < threshold {
+			atms = append(atms, AtmCash{Atm: atm, Cash: cash})
+		}
+	}
+	sort.SliceStable(atms, func(i, j int) bool { return atms[i].Cash < atms[j].Cash })
+	return atms, nil
+}
+
+func (receiver *MemoryStore) FindNearestAtms(ctx context.Context, latitude, longitude, radiusKm float64, limit int, filter AtmFilter) (atms []NearestAtm, err error) {
+	if !validCoordinates(latitude, longitude) {
+		return nil, ErrInvalidCoordinates
+	}
+	if radiusKm <= 0 || math.IsNaN(radiusKm) {
+		return nil, ErrInvalidRadius
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, atm := range receiver.atms {
+		var cash int64
+		for _, cassette := range receiver.cassettes[atm.Id] {
+			cash += cassette.Denomination * cassette.Notes
+		}
+		if filter.Status != "" && atm.Status != filter.Status {
+			continue
+		}
+		distance := haversineKm(latitude, longitude, atm.Latitude, atm.Longitude)
+		if distance <= radiusKm && cash >= filter.MinCash {
+			atms = append(atms, NearestAtm{Atm: atm, DistanceKm: distance, Cash: cash})
+		}
+	}
+	return nearestFirst(atms, limit), nil
+}
+
+func (receiver *MemoryStore) SetAtmStatus(ctx context.Context, atmId int64, status AtmStatus, reason string) error {
+	if !validAtmStatus(status) {
+		return ErrInvalidAtmStatus
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	atm := receiver.atmById(atmId)
+	if atm == nil {
+		return ErrAtmNotFound
+	}
+	if atm.Status == status {
+		return nil
+	}
+	change := AtmStatusChange{From: atm.Status, To: status, Reason: reason, ChangedAt: time.Now().UTC().Truncate(time.Second)}
+	receiver.statusHistory[atmId] = append(receiver.statusHistory[atmId], change)
+	atm.Status = status
+	return nil
+}
+
+func (receiver *MemoryStore) AtmStatusHistory(ctx context.Context, atmId int64) (changes []AtmStatusChange, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return append(changes, receiver.statusHistory[atmId]...), nil
+}
+
+func (receiver *MemoryStore) SetAtmWorkingHours(ctx context.Context, atmId int64, hours []WorkingHours) error {
+	err := checkWorkingHours(hours)
+	if err != nil {
+		return err
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	if receiver.atmById(atmId) == nil {
+		return ErrAtmNotFound
+	}
+	hours = append([]WorkingHours(nil), hours...)
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Weekday < hours[j].Weekday })
+	receiver.workingHours[atmId] = hours
+	return nil
+}
+
+func (receiver *MemoryStore) AtmWorkingHours(ctx context.Context, atmId int64) (hours []WorkingHours, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return append(hours, receiver.workingHours[atmId]...), nil
+}
+
+func (receiver *MemoryStore) ScheduleAtmMaintenance(ctx context.Context, atmId int64, startsAt, endsAt time.Time) (int64, error) {
+	if !startsAt.Before(endsAt) {
+		return 0, ErrInvalidMaintenanceWindow
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	if receiver.atmById(atmId) == nil {
+		return 0, ErrAtmNotFound
+	}
+	window := MaintenanceWindow{
+		Id:       int64(len(receiver.maintenance) + 1),
+		StartsAt: startsAt.UTC().Truncate(time.Second),
+		EndsAt:   endsAt.UTC().Truncate(time.Second),
+	}
+	receiver.maintenance = append(receiver.maintenance, memoryMaintenance{atmId: atmId, window: window})
+	return window.Id, nil
+}
+
+func (receiver *MemoryStore) AtmMaintenanceWindows(ctx context.Context, atmId int64, at time.Time) (windows []MaintenanceWindow, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	at = at.Truncate(time.Second)
+	for _, maintenance := range receiver.maintenance {
+		if maintenance.atmId == atmId && maintenance.window.EndsAt.After(at) {
+			windows = append(windows, maintenance.window)
+		}
+	}
+	sort.SliceStable(windows, func(i, j int) bool { return windows[i].StartsAt.Before(windows[j].StartsAt) })
+	return windows, nil
+}
+
+func (receiver *MemoryStore) AtmOperational(ctx context.Context, atmId int64, at time.Time) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	atm := receiver.atmById(atmId)
+	if atm == nil {
+		return ErrAtmNotFound
+	}
+	return receiver.checkAtmOperational(atm, at)
+}
+
+func (receiver *MemoryStore) checkAtmOperational(atm *Atm, at time.Time) error {
+	if atm.Status != AtmOnline || !openAt(receiver.workingHours[atm.Id], at) {
+		return ErrAtmNotOperational
+	}
+	at = at.Truncate(time.Second)
+	for _, maintenance := range receiver.maintenance {
+		window := maintenance.window
+		if maintenance.atmId == atm.Id && !window.StartsAt.After(at) && window.EndsAt.After(at) {
+			return ErrAtmNotOperational
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) addCassetteNotes(atmId int64, notes []Cassette, sign int64) {
+	cassettes := receiver.cassettes[atmId]
+	for _, cassette := range notes {
+		for i := range cassettes {
+			if cassettes[i].Denomination == cassette.Denomination {
+				cassettes[i].Notes += sign * cassette.Notes
+			}
+		}
+	}
+}
+
+func (receiver *MemoryStore) AddService(ctx context.Context, name string) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	receiver.services = append(receiver.services, Service{Id: int64(len(receiver.services) + 1), Name: name, Category: ServiceOther, Active: true})
+	return nil
+}
+
+func (receiver *MemoryStore) GetAllServices(ctx context.Context, filter ServiceFilter) (services []Service, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, service := range receiver.services {
+		if (filter.Category == "" || service.Category == filter.Category) && (!filter.ActiveOnly || service.Active) {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+func (receiver *MemoryStore) UpdateService(ctx context.Context, service Service) error {
+	err := checkService(service)
+	if err != nil {
+		return err
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	stored := receiver.serviceById(service.Id)
+	if stored == nil {
+		return ErrServiceNotFound
+	}
+	service.Balance = stored.Balance
+	*stored = service
+	return nil
+}
+
+func (receiver *MemoryStore) DeactivateService(ctx context.Context, id int64) error {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	service := receiver.serviceById(id)
+	if service == nil {
+		return ErrServiceNotFound
+	}
+	service.Active = false
+	return nil
+}
+
+func (receiver *MemoryStore) Transfer(ctx context.Context, session Session, fromCardId int64, to RecipientRef, amount int64) (result TransferResult, err error) {
+	if amount <= 0 {
+		return result, ErrInvalidAmount
+	}
+	err = to.check()
+	if err != nil {
+		return result, err
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	sender := receiver.senderCard(session.UserId, fromCardId)
+	if sender == nil {
+		return result, ErrCardNotFound
+	}
+	err = checkCardUsable(sender.Status, sender.ExpiryMonth, sender.ExpiryYear)
+	if err != nil {
+		return result, err
+	}
+	if sender.Balance <= amount {
+		return result, ErrInsufficientFunds
+	}
+	recipient, err := receiver.recipientCard(to)
+	if err != nil {
+		return result, err
+	}
+	if recipient.Id == sender.Id {
+		return result, ErrSameCard
+	}
+	err = checkCardUsable(recipient.Status, recipient.ExpiryMonth, recipient.ExpiryYear)
+	if err != nil {
+		return result, err
+	}
+
+	sender.Balance -= amount
+	recipient.Balance += amount
+	t := time.Now()
+	result.SenderOperationId = receiver.logOperation(OperationTransferSend, t, recipient.NumberCard, -amount, session.UserId)
+	result.RecipientOperationId = receiver.logOperation(OperationTransferGet, t, sender.NumberCard, amount, recipient.User_id)
+	receiver.operations[result.SenderOperationId-1].Card_id = sender.Id
+	receiver.operations[result.RecipientOperationId-1].Card_id = recipient.Id
+	receiver.sumTransferUsers += int(amount)
+	receiver.postJournal(result.SenderOperationId, string(OperationTransfer), transferPostings(sender.Id, recipient.Id, amount)...)
+
+	result.RecipientCardId = recipient.Id
+	result.SenderBalance = sender.Balance
+	result.RecipientBalance = recipient.Balance
+	return result, nil
+}
+
+func (receiver *MemoryStore) SetServiceFields(ctx context.Context, name string, fields []ServiceField) error {
+	err := checkServiceFields(fields)
+	if err != nil {
+		return err
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	service := receiver.serviceByName(name)
+	if service == nil {
+		return ErrServiceNotFound
+	}
+	receiver.serviceFields[service.Id] = append([]ServiceField(nil), fields...)
+	return nil
+}
+
+func (receiver *MemoryStore) ServiceFields(ctx context.Context, name string) (fields []ServiceField, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	service := receiver.serviceByName(name)
+	if service == nil {
+		return nil, ErrServiceNotFound
+	}
+	return append(fields, receiver.serviceFields[service.Id]...), nil
+}
+
+func (receiver *MemoryStore) TransferServices(ctx context.Context, session Session, fromCardId int64, currency int, name string) error {
+	_, err := receiver.PayService(ctx, session, fromCardId, int64(currency), name, nil)
+	return err
+}
+
+func (receiver *MemoryStore) PayService(ctx context.Context, session Session, fromCardId int64, amount int64, name string, values map[string]string) (result PaymentResult, err error) {
+	if amount <= 0 {
+		return result, ErrInvalidAmount
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	card := receiver.senderCard(session.UserId, fromCardId)
+	if card == nil {
+		return result, ErrCardNotFound
+	}
+	err = checkCardUsable(card.Status, card.ExpiryMonth, card.ExpiryYear)
+	if err != nil {
+		return result, err
+	}
+	service := receiver.serviceByName(name)
+	if service == nil {
+		return result, ErrServiceNotFound
+	}
+	err = checkServiceAmount(*service, amount)
+	if err != nil {
+		return result, err
+	}
+	result.Reference, err = paymentReference(receiver.serviceFields[service.Id], values)
+	if err != nil {
+		return PaymentResult{}, err
+	}
+	if card.Balance <= amount {
+		return PaymentResult{}, ErrInsufficientFunds
+	}
+
+	card.Balance -= amount
+	service.Balance += amount
+	result.OperationId = receiver.logOperation(OperationPayService, time.Now(), name, -amount, session.UserId)
+	receiver.operations[result.OperationId-1].Card_id = card.Id
+	receiver.operations[result.OperationId-1].Reference = result.Reference
+	receiver.servicePayments[result.OperationId] = service.Id
+	receiver.postJournal(result.OperationId, string(OperationPayService),
+		Posting{Account: CardAccount(card.Id), Amount: amount},
+		Posting{Account: ServiceAccount(service.Id), Amount: -amount},
+	)
+	result.CardBalance = card.Balance
+	return result, nil
+}
+
+func (receiver *MemoryStore) Withdraw(ctx context.Context, session Session, atmId int64, idCard int64, amount int64) (AtmOperationResult, error) {
+	return receiver.atmOperation(session, atmId, idCard, amount, true)
+}
+
+func (receiver *MemoryStore) Deposit(ctx context.Context, session Session, atmId int64, idCard int64, amount int64) (AtmOperationResult, error) {
+	return receiver.atmOperation(session, atmId, idCard, amount, false)
+}
+
+func (receiver *MemoryStore) atmOperation(session Session, atmId int64, idCard int64, amount int64, withdraw bool) (result AtmOperationResult, err error) {
+	if amount <= 0 {
+		return result, ErrInvalidAmount
+	}
+	change, name := amount, OperationAtmDeposit
+	if withdraw {
+		change, name = -amount, OperationAtmWithdraw
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	atm := receiver.atmById(atmId)
+	if atm == nil {
+		return result, ErrAtmNotFound
+	}
+	err = receiver.checkAtmOperational(atm, time.Now())
+	if err != nil {
+		return result, err
+	}
+	cassettes := receiver.cassettes[atmId]
+	if !payableIn(denominationsOf(cassettes), amount) {
+		return result, ErrAmountNotInDenominations
+	}
+	card := receiver.senderCard(session.UserId, idCard)
+	if card == nil {
+		return result, ErrCardNotFound
+	}
+	err = checkCardUsable(card.Status, card.ExpiryMonth, card.ExpiryYear)
+	if err != nil {
+		return result, err
+	}
+	if card.Balance+change <= 0 {
+		return result, ErrInsufficientFunds
+	}
+	sign := int64(1)
+	if withdraw {
+		var ok bool
+		result.Notes, ok = noteMix(cassettes, amount)
+		if !ok {
+			return result, ErrNotEnoughCash
+		}
+		sign = -1
+	} else {
+		result.Notes = depositMix(denominationsOf(cassettes), amount)
+	}
+
+	card.Balance += change
+	receiver.addCassetteNotes(atmId, result.Notes, sign)
+	result.OperationId = receiver.logAtmOperation(name, atm, change, session.UserId, card.Id)
+	if withdraw {
+		receiver.withdrawalNotes[result.OperationId] = result.Notes
+	}
+	receiver.postJournal(result.OperationId, string(name),
+		Posting{Account: CardAccount(card.Id), Amount: -change},
+		Posting{Account: AtmAccount(atm.Id), Amount: change},
+	)
+	result.CardBalance = card.Balance
+	return result, nil
+}
+
+func (receiver *MemoryStore) ReverseAtmWithdrawal(ctx context.Context, atmId int64, operationId int64, idCard int64, amount int64) (result AtmOperationResult, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	if operationId <= 0 || operationId > int64(len(receiver.operations)) {
+		return result, ErrOperationNotFound
+	}
+	withdrawal := receiver.operations[operationId-1]
+	if withdrawal.Name != OperationAtmWithdraw || withdrawal.Atm_id != atmId || withdrawal.Card_id != idCard || int64(-withdrawal.Balance) != amount {
+		return result, ErrOperationNotFound
+	}
+	if _, ok := receiver.reversals[operationId]; ok {
+		return result, ErrOperationReversed
+	}
+	atm := receiver.atmById(withdrawal.Atm_id)
+	card := receiver.cardById(idCard)
+	if atm == nil || card == nil {
+		return result, ErrOperationNotFound
+	}
+
+	receiver.addCassetteNotes(atm.Id, receiver.withdrawalNotes[operationId], 1)
+	card.Balance += amount
+	result.OperationId = receiver.logAtmOperation(OperationAtmReversal, atm, amount, int64(withdrawal.User_id), card.Id)
+	receiver.reversals[operationId] = result.OperationId
+	receiver.postJournal(result.OperationId, string(OperationAtmReversal),
+		Posting{Account: AtmAccount(atm.Id), Amount: amount},
+		Posting{Account: CardAccount(card.Id), Amount: -amount},
+	)
+	result.CardBalance = card.Balance
+	return result, nil
+}
+
+func (receiver *MemoryStore) ViewOperationsLogging(ctx context.Context, session Session) ([]OperationsLogging, error) {
+	return receiver.ViewOperationsLoggingToSearch(ctx, int(session.UserId))
+}
+
+func (receiver *MemoryStore) ViewOperationsLoggingToSearch(ctx context.Context, idUser int) (opLogs []OperationsLogging, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, opLog := range receiver.operations {
+		if opLog.User_id == idUser {
+			opLog.User_id = 0
+			opLogs = append(opLogs, opLog)
+		}
+	}
+	return opLogs, nil
+}
+
+func (receiver *MemoryStore) ViewAllOperationsLogging(ctx context.Context) (opLogs []OperationsLogging, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, opLog := range receiver.operations {
+		opLog.User_id = 0
+		opLogs = append(opLogs, opLog)
+	}
+	return opLogs, nil
+}
+
+func (receiver *MemoryStore) QueryOperations(ctx context.Context, filter OperationsFilter) (OperationsPage, error) {
+	limit, err := checkOperationsFilter(filter)
+	if err != nil {
+		return OperationsPage{}, err
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	var opLogs []OperationsLogging
+	for i := len(receiver.operations) - 1; i >= 0 && len(opLogs) <= limit; i-- {
+		if filter.matches(receiver.operations[i]) {
+			opLogs = append(opLogs, receiver.operations[i])
+		}
+	}
+	return operationsPage(opLogs, limit), nil
+}
+
+// VerifyOperationsChain hashes the log the way the database chains it; a
+// log in process memory can't be edited behind the store, so the chain is
+// always intact.
+func (receiver *MemoryStore) VerifyOperationsChain(ctx context.Context) (report ChainReport, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, opLog := range receiver.operations {
+		report.Head = operationHash(opLog, report.Head)
+		report.Operations++
+	}
+	return report, nil
+}
+
+func (receiver *MemoryStore) StaticCountUsers(ctx context.Context) (int, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return len(receiver.users), nil
+}
+
+func (receiver *MemoryStore) StaticSumBalanceUsers(ctx context.Context) (sum int, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, card := range receiver.cards {
+		sum += int(card.Balance)
+	}
+	return sum, nil
+}
+
+func (receiver *MemoryStore) StaticBalanceOfServices(ctx context.Context) (sum int, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	for _, service := range receiver.services {
+		sum += int(service.Balance)
+	}
+	return sum, nil
+}
+
+func (receiver *MemoryStore) StaticBalanceSumTransfer(ctx context.Context) (int, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return receiver.sumTransferUsers, nil
+}
+
+func (receiver *MemoryStore) LedgerBalance(ctx context.Context, account string) (int64, error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	return receiver.ledgerBalance(account), nil
+}
+
+func (receiver *MemoryStore) VerifyLedger(ctx context.Context) (report LedgerReport, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	var cleared int64
+	for _, journal := range receiver.journals {
+		if checkPostings(journal.postings) != nil {
+			report.UnbalancedJournals = append(report.UnbalancedJournals, journal.id)
+		}
+		for _, posting := range journal.postings {
+			if posting.Account == ClearingTransfersAccount && posting.Amount > 0 {
+				cleared += posting.Amount
+			}
+		}
+	}
+	for _, card := range receiver.cards {
+		if ledger := receiver.ledgerBalance(CardAccount(card.Id)); ledger != card.Balance {
+			report.Mismatches = append(report.Mismatches, LedgerMismatch{Account: CardAccount(card.Id), Balance: card.Balance, Ledger: ledger})
+		}
+	}
+	for _, service := range receiver.services {
+		if ledger := receiver.ledgerBalance(ServiceAccount(service.Id)); ledger != service.Balance {
+			report.Mismatches = append(report.Mismatches, LedgerMismatch{Account: ServiceAccount(service.Id), Balance: service.Balance, Ledger: ledger})
+		}
+	}
+	if int64(receiver.sumTransferUsers) != cleared {
+		report.Mismatches = append(report.Mismatches, LedgerMismatch{Account: ClearingTransfersAccount, Balance: int64(receiver.sumTransferUsers), Ledger: cleared})
+	}
+	return report, nil
+}
+
+func (receiver *MemoryStore) Reconcile(ctx context.Context) (report ReconcileReport, err error) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	opening := make(map[string]int64)
+	var since int64
+	for _, journal := range receiver.journals {
+		if journal.operationId != 0 {
+			if since == 0 || journal.operationId < since {
+				since = journal.operationId
+			}
+			continue
+		}
+		for _, posting := range journal.postings {
+			opening[posting.Account] -= posting.Amount
+		}
+	}
+	cards := make(map[int64]int64)
+	services := make(map[int64]int64)
+	for _, opLog := range receiver.operations {
+		if opLog.Name == OperationTransferSend {
+			report.TransfersLogged -= int64(opLog.Balance)
+		}
+		if since == 0 || opLog.Id < since {
+			continue
+		}
+		if opLog.Card_id != 0 {
+			cards[opLog.Card_id] += int64(opLog.Balance)
+		}
+		if serviceId, ok := receiver.servicePayments[opLog.Id]; ok {
+			services[serviceId] -= int64(opLog.Balance)
+		}
+	}
+	for _, card := range receiver.cards {
+		if logged := opening[CardAccount(card.Id)] + cards[card.Id]; logged != card.Balance {
+			report.Cards = append(report.Cards, Divergence{Id: card.Id, Balance: card.Balance, Logged: logged})
+		}
+	}
+	for _, service := range receiver.services {
+		if logged := opening[ServiceAccount(service.Id)] + services[service.Id]; logged != service.Balance {
+			report.Services = append(report.Services, Divergence{Id: service.Id, Balance: service.Balance, Logged: logged})
+		}
+	}
+	report.SumTransferUsers = int64(receiver.sumTransferUsers)
+	return report, nil
+}
+
+// postJournal takes postings built balanced by the callers.
+func (receiver *MemoryStore) postJournal(operationId int64, name string, postings ...Posting) {
+	receiver.journals = append(receiver.journals, memoryJournal{
+		id:          int64(len(receiver.journals) + 1),
+		operationId: operationId,
+		name:        name,
+		postings:    postings,
+	})
+}
+
+func (receiver *MemoryStore) ledgerBalance(account string) (balance int64) {
+	for _, journal := range receiver.journals {
+		for _, posting := range journal.postings {
+			if posting.Account == account {
+				balance -= posting.Amount
+			}
+		}
+	}
+	return balance
+}
+
+func (receiver *MemoryStore) userByLogin(login string) *User {
+	for i := range receiver.users {
+		if receiver.users[i].Login == login {
+			return &receiver.users[i]
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) userById(id int64) *User {
+	for i := range receiver.users {
+		if receiver.users[i].Id == id {
+			return &receiver.users[i]
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) atmById(id int64) *Atm {
+	for i := range receiver.atms {
+		if receiver.atms[i].Id == id {
+			return &receiver.atms[i]
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) serviceById(id int64) *Service {
+	for i := range receiver.services {
+		if receiver.services[i].Id == id {
+			return &receiver.services[i]
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) serviceByName(name string) *Service {
+	for i := range receiver.services {
+		if receiver.services[i].Name == name {
+			return &receiver.services[i]
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) cardById(id int64) *Card {
+	for i := range receiver.cards {
+		if receiver.cards[i].Id == id {
+			return &receiver.cards[i]
+		}
+	}
+	return nil
+}
+
+// senderCard is the card idCard of userId, 0 stands for the default card.
+func (receiver *MemoryStore) senderCard(userId int64, idCard int64) *Card {
+	if idCard == 0 {
+		return receiver.defaultCard(userId)
+	}
+	card := receiver.cardById(idCard)
+	if card == nil || card.User_id != userId {
+		return nil
+	}
+	return card
+}
+
+func (receiver *MemoryStore) defaultCard(userId int64) *Card {
+	if idCard, ok := receiver.defaultCards[userId]; ok {
+		return receiver.cardById(idCard)
+	}
+	return receiver.firstUserCard(userId)
+}
+
+// firstUserCard is the first active card of the user.
+func (receiver *MemoryStore) firstUserCard(userId int64) *Card {
+	for i := range receiver.cards {
+		if receiver.cards[i].User_id == userId && receiver.cards[i].Status == CardActive {
+			return &receiver.cards[i]
+		}
+	}
+	return nil
+}
+
+func (receiver *MemoryStore) recipientCard(to RecipientRef) (*Card, error) {
+	if to.NumberCard != "" {
+		if !ValidCardNumber(to.NumberCard) {
+			return nil, ErrInvalidCardNumber
+		}
+		for i := range receiver.cards {
+			if receiver.cards[i].NumberCard == to.NumberCard {
+				return &receiver.cards[i], nil
+			}
+		}
+		return nil, ErrRecipientNotFound
+	}
+
+	var user *User
+	switch {
+	case to.PhoneNumber != 0:
+		for i := range receiver.users {
+			if receiver.users[i].NumberPhone == to.PhoneNumber {
+				user = &receiver.users[i]
+				break
+			}
+		}
+	case to.Login != "":
+		user = receiver.userByLogin(to.Login)
+	}
+	if user == nil {
+		return nil, ErrRecipientNotFound
+	}
+
+	card := receiver.defaultCard(user.Id)
+	if card == nil {
+		return nil, ErrRecipientHasNoCard
+	}
+	return card, nil
+}
+
+func (receiver *MemoryStore) logAtmOperation(name OperationType, atm *Atm, balance int64, userId int64, cardId int64) int64 {
+	id := receiver.logOperation(name, time.Now(), atm.Name, balance, userId)
+	receiver.operations[id-1].Atm_id = atm.Id
+	receiver.operations[id-1].Card_id = cardId
+	return id
+}
+
+func (receiver *MemoryStore) logOperation(name OperationType, t time.Time, recipientSender string, balance int64, userId int64) int64 {
+	id := int64(len(receiver.operations) + 1)
+	receiver.operations = append(receiver.operations, OperationsLogging{
+		Id:              id,
+		Name:            name,
+		Time:            operationTime(t),
+		RecipientSender: recipientSender,
+		Balance:         int(balance),
+		User_id:         int(userId),
+	})
+	return id
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrUnknownMigration = errors.New("unknown migration version")
+var ErrIrreversibleMigration = errors.New("migration can't be reverted")
+
+// migration is one schema step. Statements are kept per dialect; a
+// migration without down statements can't be reverted. apply runs after the
+// up statements for data changes that SQL alone can't express.
+type migration struct {
+	version int
+	name    string
+	up      map[Dialect][]string
+	apply   func(ctx context.Context, tx *sql.Tx) error
+	down    map[Dialect][]string
+}
+
+type MigrationState struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt string
+}
+
+type MigrationError struct {
+	Version int
+	Name    string
+	Err     error
+}
+
+func (receiver *MigrationError) Error() string {
+	return fmt.Sprintf("can't migrate %d %s: %v", receiver.Version, receiver.Name, receiver.Err)
+}
+
+func (receiver *MigrationError) Unwrap() error {
+	return receiver.Err
+}
+
+// LatestMigrationVersion is the version Init migrates to.
+func LatestMigrationVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrateContext applies or reverts migrations until the schema is at
+// targetVersion; 0 reverts everything. Every migration runs in its own
+// transaction together with its schema_migrations row.
+func MigrateContext(ctx context.Context, db *sql.DB, targetVersion int) error {
+	if targetVersion < 0 || targetVersion > LatestMigrationVersion() {
+		return ErrUnknownMigration
+	}
+	dialect := DialectOf(db)
+
+	_, err := db.ExecContext(ctx, schemaMigrationsDDL)
+	if err != nil {
+		return queryError(schemaMigrationsDDL, err)
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version > targetVersion {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		err = runMigration(ctx, db, dialect, m, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= targetVersion {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if _, ok := m.down[dialect]; !ok {
+			return &MigrationError{Version: m.version, Name: m.name, Err: ErrIrreversibleMigration}
+		}
+		err = runMigration(ctx, db, dialect, m, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Migrate(db *sql.DB, targetVersion int) error {
+	return MigrateContext(context.Background(), db, targetVersion)
+}
+
+// MigrationStatusContext lists every known migration and whether db has it.
+func MigrationStatusContext(ctx context.Context, db *sql.DB) (states []MigrationState, err error) {
+	_, err = db.ExecContext(ctx, schemaMigrationsDDL)
+	if err != nil {
+		return nil, queryError(schemaMigrationsDDL, err)
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.version]
+		states = append(states, MigrationState{Version: m.version, Name: m.name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return states, nil
+}
+
+func MigrationStatus(db *sql.DB) ([]MigrationState, error) {
+	return MigrationStatusContext(context.Background(), db)
+}
+
+func appliedMigrations(ctx context.Context, db *sql.DB) (applied map[int]string, err error) {
+	rows, err := db.QueryContext(ctx, getSchemaMigrationsSQL)
+	if err != nil {
+		return nil, queryError(getSchemaMigrationsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			applied, err = nil, dbError(innerErr)
+		}
+	}()
+
+	applied = make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		applied[version] = appliedAt
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return applied, nil
+}
+
+// runMigration applies (up) or reverts one migration. Another process may
+// have done it since appliedMigrations was read, so the state is checked
+// again inside the transaction.
+func runMigration(ctx context.Context, db *sql.DB, dialect Dialect, m migration, up bool) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			err = &MigrationError{Version: m.version, Name: m.name, Err: err}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = &MigrationError{Version: m.version, Name: m.name, Err: dbError(err)}
+		}
+	}()
+
+	if dialect == Postgres {
+		_, err = tx.ExecContext(ctx, lockSchemaMigrationsPostgresSQL)
+		if err != nil {
+			return queryError(lockSchemaMigrationsPostgresSQL, err)
+		}
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx, countSchemaMigrationSQL, m.version).Scan(&count)
+	if err != nil {
+		return queryError(countSchemaMigrationSQL, err)
+	}
+	if (count > 0) == up {
+		return nil
+	}
+
+	statements := m.down[dialect]
+	if up {
+		statements = m.up[dialect]
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return queryError(statement, err)
+		}
+	}
+
+	if up {
+		if m.apply != nil {
+			err = m.apply(ctx, tx)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, insertSchemaMigrationSQL, m.version, m.name, formatTimestamp(time.Now()))
+		if err != nil {
+			return queryError(insertSchemaMigrationSQL, err)
+		}
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, deleteSchemaMigrationSQL, m.version)
+	if err != nil {
+		return queryError(deleteSchemaMigrationSQL, err)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrations_Ordered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %s has version %d, want %d", m.name, m.version, i+1)
+		}
+		for _, dialect := range []Dialect{SQLite, Postgres} {
+			if len(m.up[dialect]) == 0 {
+				t.Errorf("migration %d has no %v statements", m.version, dialect)
+			}
+		}
+	}
+}
+
+func TestMigrate_UpDown(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTestDb(t, driver)
+		defer closeDb()
+
+		err := Init(db)
+		if err != nil {
+			t.Errorf("can't init db: %v", err)
+		}
+		states, err := MigrationStatus(db)
+		if err != nil {
+			t.Errorf("can't get migration status: %v", err)
+		}
+		if len(states) != len(migrations) {
+			t.Errorf("migration status not match: %v", states)
+		}
+		for _, state := range states {
+			if !state.Applied || state.AppliedAt == "" {
+				t.Errorf("migration not applied by Init: %v", state)
+			}
+		}
+
+		err = Init(db)
+		if err != nil {
+			t.Errorf("can't init db twice: %v", err)
+		}
+
+		err = Migrate(db, 0)
+		if err != nil {
+			t.Errorf("can't revert migrations: %v", err)
+		}
+		states, err = MigrationStatus(db)
+		if err != nil {
+			t.Errorf("can't get migration status: %v", err)
+		}
+		for _, state := range states {
+			if state.Applied {
+				t.Errorf("migration not reverted: %v", state)
+			}
+		}
+		_, err = GetAllUsers(db)
+		if err == nil {
+			t.Error("users table left after reverting all migrations")
+		}
+
+		err = Migrate(db, LatestMigrationVersion()+1)
+		if !errors.Is(err, ErrUnknownMigration) {
+			t.Errorf("Not ErrUnknownMigration error for unknown version: %v", err)
+		}
+	})
+}
+
+func TestInit_AdoptExistingDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Errorf("can't open db: %v", err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("can't close db: %v", err)
+		}
+	}()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS users
+(
+    id      INTEGER PRIMARY KEY AUTOINCREMENT,
+    name    TEXT    NOT NULL,
+    login   TEXT    NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+	passportSeries TEXT NOT NULL UNIQUE,
+	phoneNumber INTEGER NOT NULL,
+	hideShow INTEGER NOT NULL
+);`)
+	if err != nil {
+		t.Errorf("can't create users: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO users( name, login, password, passportSeries, phoneNumber, hideShow) VALUES ('Vasya','vasya', 'secret','A132323',9001,3)`)
+	if err != nil {
+		t.Errorf("can't add user: %v", err)
+	}
+
+	err = Init(db)
+	if err != nil {
+		t.Errorf("can't init existing db: %v", err)
+	}
+	users, err := GetAllUsers(db)
+	if err != nil || len(users) != 1 {
+		t.Errorf("existing users lost on init: %v, %v", users, err)
+	}
+}
+
+func TestMigrate_RevokeSeededManagerPassword(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		seeded, err := hashPassword(seededManagerPassword)
+		if err != nil {
+			t.Fatalf("can't hash password: %v", err)
+		}
+		for _, stored := range []string{seededManagerPassword, initialManagerPasswordHash, seeded} {
+			db, closeDb := openTestDb(t, driver)
+
+			err = Migrate(db, 16)
+			if err != nil {
+				t.Fatalf("can't migrate db: %v", err)
+			}
+			_, err = db.Exec(`UPDATE manager SET password = $1 WHERE login = 'admin'`, stored)
+			if err != nil {
+				t.Fatalf("can't set manager password: %v", err)
+			}
+			_, err = db.Exec(`INSERT INTO manager(name, login, password) VALUES ('Audit', 'audit', $1)`, seededManagerPassword+"!")
+			if err != nil {
+				t.Fatalf("can't add manager: %v", err)
+			}
+			err = Init(db)
+			if err != nil {
+				t.Fatalf("can't init db: %v", err)
+			}
+
+			_, err = LoginManager("admin", seededManagerPassword, db)
+			if !errors.Is(err, ErrManagerPasswordNotSet) {
+				t.Errorf("seeded password %q not revoked: %v", stored, err)
+			}
+			ok, err := LoginManager("audit", seededManagerPassword+"!", db)
+			if err != nil || !ok {
+				t.Errorf("other manager password revoked: %v", err)
+			}
+			err = SetManagerPassword("admin", "9Lp-manager", db)
+			if err != nil {
+				t.Errorf("can't set manager password: %v", err)
+			}
+			ok, err = LoginManager("admin", "9Lp-manager", db)
+			if err != nil || !ok {
+				t.Errorf("can't login manager with new password: %v", err)
+			}
+
+			closeDb()
+		}
+	})
+}
+
+func TestMigrate_RenumberLegacyCards(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTestDb(t, driver)
+		defer closeDb()
+
+		err := Migrate(db, 1)
+		if err != nil {
+			t.Errorf("can't migrate to initial schema: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO users(id, name, login, password, passportSeries, phoneNumber, hideShow) VALUES (1,'Vasya','vasya','secret','A132323',9001,3)`)
+		if err != nil {
+			t.Errorf("can't add user: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (1,'AlifMobi',200,1,'20216000000000001')`)
+		if err != nil {
+			t.Errorf("can't add card: %v", err)
+		}
+
+		err = Init(db)
+		if err != nil {
+			t.Errorf("can't init db: %v", err)
+		}
+		cards, err := GetAllCards(db)
+		if err != nil || len(cards) != 1 {
+			t.Errorf("can't get cards: %v, %v", cards, err)
+		}
+		if cards[0].NumberCard != "2021600000000016" {
+			t.Errorf("legacy card not renumbered: %v", cards[0].NumberCard)
+		}
+
+		_, err = db.Exec(`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (2,'AlifMobi',200,1,'2021600000000016')`)
+		if err == nil {
+			t.Error("duplicate card number accepted")
+		}
+	})
+}
+
+func TestMigrate_LegacyBlockReasons(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTestDb(t, driver)
+		defer closeDb()
+
+		err := Migrate(db, 20)
+		if err != nil {
+			t.Fatalf("can't migrate db: %v", err)
+		}
+		for _, query := range []string{
+			`INSERT INTO users(id, name, login, password, passportSeries, phoneNumber, hideShow) VALUES (1,'Vasya','vasya','secret','A132323',9001,3)`,
+			`INSERT INTO cards(id, name, balance, user_id, numberCard, status, pinAttempts) VALUES (1,'AlifMobi',200,1,'2021600000000016','blocked',3)`,
+			`INSERT INTO cards(id, name, balance, user_id, numberCard, status, pinAttempts) VALUES (2,'AlifMobi',200,1,'2021600000000024','blocked',0)`,
+		} {
+			_, err = db.Exec(query)
+			if err != nil {
+				t.Fatalf("can't add fixture: %v", err)
+			}
+		}
+		resetSequences(t, db, "users", "cards")
+		err = Init(db)
+		if err != nil {
+			t.Fatalf("can't init db: %v", err)
+		}
+
+		for _, idCard := range []int64{1, 2} {
+			err = ResetPINAttempts(idCard, db)
+			if err != nil {
+				t.Errorf("can't reset PIN attempts: %v", err)
+			}
+		}
+		cards, err := GetAllCards(db)
+		if err != nil || len(cards) != 2 || cards[0].Status != CardActive || cards[1].Status != CardBlocked {
+			t.Errorf("legacy blocks not told apart: %v, %v", cards, err)
+		}
+	})
+}
+
+func TestMigrate_DownKeepsData(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		err := Migrate(db, 2)
+		if err != nil {
+			t.Errorf("can't revert to version 2: %v", err)
+		}
+		users, err := GetAllUsers(db)
+		if err != nil || len(users) != 3 {
+			t.Errorf("users lost on revert: %v, %v", users, err)
+		}
+		err = Init(db)
+		if err != nil {
+			t.Errorf("can't migrate again: %v", err)
+		}
+		idCard, err := Session{UserId: 1}.DefaultCard(db)
+		if err != nil || idCard != 1 {
+			t.Errorf("default card not match after migrate again: %v, %v", idCard, err)
+		}
+	})
+}
+
+func TestMigrate_OperationTimes(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openLedgerDb(t, driver)
+		defer closeDb()
+
+		err := Migrate(db, 13)
+		if err != nil {
+			t.Fatalf("can't migrate db: %v", err)
+		}
+		for _, legacy := range []string{
+			"2020-06-01 15:04:05.123456789 +0500 +05 m=+0.012345678",
+			"2020-06-02 10:00:00 +0000 UTC",
+			"yesterday",
+		} {
+			_, err = db.Exec(`INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES ('translatedToSend', $1, '2021600000000024', -25, 1)`, legacy)
+			if err != nil {
+				t.Fatalf("can't log operation: %v", err)
+			}
+		}
+		err = Init(db)
+		if !errors.Is(err, ErrInvalidOperationTime) || !strings.Contains(err.Error(), "operation 3:") {
+			t.Fatalf("Not ErrInvalidOperationTime error for operation 3: %v", err)
+		}
+		err = Migrate(db, 13)
+		if err != nil {
+			t.Fatalf("can't revert migration: %v", err)
+		}
+		_, err = db.Exec(`UPDATE operationsLogging SET time = '2020-06-03 00:00:00 +0000 UTC' WHERE id = 3`)
+		if err != nil {
+			t.Fatalf("can't correct operation time: %v", err)
+		}
+		err = Init(db)
+		if err != nil {
+			t.Fatalf("can't init db: %v", err)
+		}
+
+		opLogs, err := ViewAllOperationsLogging(db)
+		if err != nil || len(opLogs) != 3 {
+			t.Fatalf("operations logging not match: %v, %v", opLogs, err)
+		}
+		for i, want := range []time.Time{
+			time.Date(2020, 6, 1, 10, 4, 5, 123000000, time.UTC),
+			time.Date(2020, 6, 2, 10, 0, 0, 0, time.UTC),
+			time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC),
+		} {
+			if !opLogs[i].Time.Equal(want) || opLogs[i].Name != OperationTransferSend {
+				t.Errorf("operation %d not converted: %v, want time %v", i, opLogs[i], want)
+			}
+		}
+		report, err := VerifyOperationsChain(db)
+		if err != nil || !report.Intact() || report.Operations != 3 {
+			t.Errorf("chain not intact after conversion: %+v, %v", report, err)
+		}
+
+		err = Migrate(db, 14)
+		if err != nil {
+			t.Fatalf("can't revert migration: %v", err)
+		}
+		_, err = db.Exec(`UPDATE operationsLogging SET balance = -1 WHERE id = 2`)
+		if err != nil {
+			t.Fatalf("can't edit operation: %v", err)
+		}
+		err = Init(db)
+		if !errors.Is(err, ErrOperationsChainBroken) {
+			t.Errorf("Not ErrOperationsChainBroken error: %v", err)
+		}
+	})
+}
+
+func TestMigrate_LinkLegacyServicePayments(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openLedgerDb(t, driver)
+		defer closeDb()
+
+		err := Migrate(db, 18)
+		if err != nil {
+			t.Fatalf("can't migrate db: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO services(name, balance) VALUES ('Internet', 0)`)
+		if err != nil {
+			t.Fatalf("can't add service with the same name: %v", err)
+		}
+		for _, query := range []string{
+			`INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES ('payToService', '', 'Internet', -5, 1)`,
+			`INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES ('payToService', '', 'Closed', -5, 1)`,
+		} {
+			_, err = db.Exec(query)
+			if err != nil {
+				t.Fatalf("can't log payment: %v", err)
+			}
+		}
+		err = Init(db)
+		if err != nil {
+			t.Fatalf("can't init db: %v", err)
+		}
+
+		var serviceId int64
+		err = db.QueryRow(`SELECT service_id FROM servicePayments WHERE operation_id = (SELECT max(id) - 1 FROM operationsLogging)`).Scan(&serviceId)
+		if err != nil || serviceId != 1 {
+			t.Errorf("legacy payment not linked to its service: %d, %v", serviceId, err)
+		}
+		var linked int
+		err = db.QueryRow(`SELECT count(*) FROM servicePayments`).Scan(&linked)
+		if err != nil || linked != 1 {
+			t.Errorf("legacy payments linked not match: %d, %v", linked, err)
+		}
+	})
+}
+
+func TestMigrate_Timestamps(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openAtmDb(t, driver)
+		defer closeDb()
+
+		err := Migrate(db, 21)
+		if err != nil {
+			t.Fatalf("can't revert to version 21: %v", err)
+		}
+		startsAt := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+		_, err = db.Exec(`INSERT INTO atmMaintenance(atm_id, startsAt, endsAt) VALUES (1, '2021-03-04T10:00:00Z', '2021-03-04T12:00:00Z')`)
+		if err != nil {
+			t.Fatalf("can't add fixture: %v", err)
+		}
+		err = Init(db)
+		if err != nil {
+			t.Fatalf("can't init db: %v", err)
+		}
+
+		err = AtmOperational(1, startsAt, db)
+		if !errors.Is(err, ErrAtmNotOperational) {
+			t.Errorf("Not ErrAtmNotOperational error during legacy maintenance: %v", err)
+		}
+		windows, err := AtmMaintenanceWindows(1, startsAt, db)
+		if err != nil || len(windows) != 1 || !windows[0].StartsAt.Equal(startsAt) {
+			t.Errorf("legacy maintenance windows not match: %v, %v", windows, err)
+		}
+		states, err := MigrationStatus(db)
+		if err != nil {
+			t.Fatalf("can't get migration states: %v", err)
+		}
+		for _, state := range states {
+			if _, err = parseTimestamp(state.AppliedAt); err != nil {
+				t.Errorf("migration %d applied at not converted: %v", state.Version, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,468 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migrations are applied in this order; versions must only grow and a
+// released migration is never edited, a new one is added instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: map[Dialect][]string{
+			SQLite: {
+				managerDDL, usersDDL, cardsDDL, atmDDL, servicesDDL, sumTransferUsersDDL, operationsLoggingDDL,
+				managerInitialData, sumTransferUsersDDLInitialData,
+			},
+			Postgres: {
+				managerPostgresDDL, usersPostgresDDL, cardsPostgresDDL, atmPostgresDDL, servicesPostgresDDL, sumTransferUsersPostgresDDL, operationsLoggingPostgresDDL,
+				managerInitialData, sumTransferUsersDDLInitialData,
+			},
+		},
+		down: map[Dialect][]string{
+			SQLite:   dropInitialSchema,
+			Postgres: dropInitialSchema,
+		},
+	},
+	{
+		version: 2,
+		name:    "unique Luhn card numbers",
+		up: map[Dialect][]string{
+			SQLite:   {createUniqueNumberCardSQL},
+			Postgres: {createUniqueNumberCardSQL},
+		},
+		apply: renumberLegacyCards,
+		down: map[Dialect][]string{
+			SQLite:   {dropUniqueNumberCardSQL},
+			Postgres: {dropUniqueNumberCardSQL},
+		},
+	},
+	{
+		version: 3,
+		name:    "default card of user",
+		up: map[Dialect][]string{
+			SQLite:   {addDefaultCardUserSQL},
+			Postgres: {addDefaultCardUserPostgresSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite:   rebuildSQLiteTable("users", "id, name, login, password, passportSeries, phoneNumber, hideShow", usersDDL),
+			Postgres: {dropDefaultCardUserPostgresSQL},
+		},
+	},
+	{
+		version: 4,
+		name:    "card expiry, CVV and status",
+		up: map[Dialect][]string{
+			SQLite:   {addExpiryMonthCardSQL, addExpiryYearCardSQL, addCVVCardSQL, addStatusCardSQL},
+			Postgres: {addExpiryMonthCardPostgresSQL, addExpiryYearCardPostgresSQL, addCVVCardPostgresSQL, addStatusCardPostgresSQL},
+		},
+		apply: setLegacyCardsExpiry,
+		down: map[Dialect][]string{
+			SQLite: append(
+				rebuildSQLiteTable("cards", "id, numberCard, name, balance, user_id", cardsDDL),
+				createUniqueNumberCardSQL,
+			),
+			Postgres: {dropCardLifecyclePostgresSQL},
+		},
+	},
+	{
+		version: 5,
+		name:    "card PIN",
+		up: map[Dialect][]string{
+			SQLite:   {addPINCardSQL, addPINAttemptsCardSQL},
+			Postgres: {addPINCardPostgresSQL, addPINAttemptsCardPostgresSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite: append(
+				rebuildSQLiteTable("cards", "id, numberCard, name, balance, user_id, expiryMonth, expiryYear, cvv, status",
+					cardsDDL, addExpiryMonthCardSQL, addExpiryYearCardSQL, addCVVCardSQL, addStatusCardSQL),
+				createUniqueNumberCardSQL,
+			),
+			Postgres: {dropPINCardPostgresSQL},
+		},
+	},
+	{
+		version: 6,
+		name:    "atm denominations and operations",
+		up: map[Dialect][]string{
+			SQLite:   {atmDenominationsDDL, addAtmOperationsLoggingSQL},
+			Postgres: {atmDenominationsPostgresDDL, addAtmOperationsLoggingPostgresSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite: append(
+				rebuildSQLiteTable("operationsLogging", "id, name, time, recipientSender, balance, user_id", operationsLoggingDDL),
+				dropAtmDenominationsSQL,
+			),
+			Postgres: {dropAtmOperationsLoggingPostgresSQL, dropAtmDenominationsSQL},
+		},
+	},
+	{
+		version: 7,
+		name:    "atm cassettes",
+		up: map[Dialect][]string{
+			SQLite:   {addNotesAtmDenominationsSQL},
+			Postgres: {addNotesAtmDenominationsPostgresSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite:   rebuildSQLiteTable("atmDenominations", "atm_id, denomination", atmDenominationsDDL),
+			Postgres: {dropNotesAtmDenominationsPostgresSQL},
+		},
+	},
+	{
+		version: 8,
+		name:    "atm location",
+		up: map[Dialect][]string{
+			SQLite:   {addLatitudeAtmSQL, addLongitudeAtmSQL, createLatitudeAtmIndexSQL},
+			Postgres: {addLatitudeAtmPostgresSQL, addLongitudeAtmPostgresSQL, createLatitudeAtmIndexSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite:   rebuildSQLiteTable("atm", "id, name, address", atmDDL),
+			Postgres: {dropLatitudeAtmIndexSQL, dropLocationAtmPostgresSQL},
+		},
+	},
+	{
+		version: 9,
+		name:    "atm status, working hours and maintenance",
+		up: map[Dialect][]string{
+			SQLite:   {addStatusAtmSQL, atmWorkingHoursDDL, atmMaintenanceDDL, atmStatusHistoryDDL},
+			Postgres: {addStatusAtmPostgresSQL, atmWorkingHoursPostgresDDL, atmMaintenancePostgresDDL, atmStatusHistoryPostgresDDL},
+		},
+		down: map[Dialect][]string{
+			SQLite: append(append(dropAtmOperationalTables,
+				rebuildSQLiteTable("atm", "id, name, address, latitude, longitude", atmDDL, addLatitudeAtmSQL, addLongitudeAtmSQL)...),
+				createLatitudeAtmIndexSQL,
+			),
+			Postgres: append(dropAtmOperationalTables, dropStatusAtmPostgresSQL),
+		},
+	},
+	{
+		version: 10,
+		name:    "atm reversals",
+		up: map[Dialect][]string{
+			SQLite:   {addCardOperationsLoggingSQL, atmReversalsDDL},
+			Postgres: {addCardOperationsLoggingPostgresSQL, atmReversalsPostgresDDL},
+		},
+		down: map[Dialect][]string{
+			SQLite: append([]string{dropAtmReversalsSQL},
+				rebuildSQLiteTable("operationsLogging", "id, name, time, recipientSender, balance, user_id, atm_id", operationsLoggingDDL, addAtmOperationsLoggingSQL)...),
+			Postgres: {dropAtmReversalsSQL, dropCardOperationsLoggingPostgresSQL},
+		},
+	},
+	{
+		version: 11,
+		name:    "service payment fields",
+		up: map[Dialect][]string{
+			SQLite:   {serviceFieldsDDL, addReferenceOperationsLoggingSQL},
+			Postgres: {serviceFieldsPostgresDDL, addReferenceOperationsLoggingPostgresSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite: append([]string{dropServiceFieldsSQL},
+				rebuildSQLiteTable("operationsLogging", "id, name, time, recipientSender, balance, user_id, atm_id, card_id",
+					operationsLoggingDDL, addAtmOperationsLoggingSQL, addCardOperationsLoggingSQL)...),
+			Postgres: {dropServiceFieldsSQL, dropReferenceOperationsLoggingPostgresSQL},
+		},
+	},
+	{
+		version: 12,
+		name:    "service catalog",
+		up: map[Dialect][]string{
+			SQLite:   {addCategoryServicesSQL, addDescriptionServicesSQL, addActiveServicesSQL, addMinAmountServicesSQL, addMaxAmountServicesSQL},
+			Postgres: {addCatalogServicesPostgresSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite:   rebuildSQLiteTable("services", "id, name, balance", servicesDDL),
+			Postgres: {dropCatalogServicesPostgresSQL},
+		},
+	},
+	{
+		version: 13,
+		name:    "ledger",
+		up: map[Dialect][]string{
+			SQLite:   {ledgerJournalDDL, ledgerPostingsDDL, ledgerPostingsAccountIndexSQL},
+			Postgres: {ledgerJournalPostgresDDL, ledgerPostingsPostgresDDL, ledgerPostingsAccountIndexSQL},
+		},
+		apply: openLedger,
+		down: map[Dialect][]string{
+			SQLite:   {dropLedgerPostingsSQL, dropLedgerJournalSQL},
+			Postgres: {dropLedgerPostingsSQL, dropLedgerJournalSQL},
+		},
+	},
+	{
+		version: 14,
+		name:    "operations chain",
+		up: map[Dialect][]string{
+			SQLite:   {addHashOperationsLoggingSQL, addPrevHashOperationsLoggingSQL},
+			Postgres: {addChainOperationsLoggingPostgresSQL},
+		},
+		apply: chainOperations,
+		down: map[Dialect][]string{
+			SQLite: rebuildSQLiteTable("operationsLogging", "id, name, time, recipientSender, balance, user_id, atm_id, card_id, reference",
+				operationsLoggingDDL, addAtmOperationsLoggingSQL, addCardOperationsLoggingSQL, addReferenceOperationsLoggingSQL),
+			Postgres: {dropChainOperationsLoggingPostgresSQL},
+		},
+	},
+	{
+		version: 15,
+		name:    "operation times",
+		up: map[Dialect][]string{
+			SQLite:   {operationsLoggingTimeIndexSQL},
+			Postgres: {operationsLoggingTimeIndexSQL},
+		},
+		apply: convertOperationTimes,
+		down: map[Dialect][]string{
+			SQLite:   {dropOperationsLoggingTimeIndexSQL},
+			Postgres: {dropOperationsLoggingTimeIndexSQL},
+		},
+	},
+	{
+		version: 16,
+		name:    "operation history indexes",
+		up: map[Dialect][]string{
+			SQLite:   {operationsLoggingUserIndexSQL, operationsLoggingCardIndexSQL, operationsLoggingCounterpartyIndexSQL},
+			Postgres: {operationsLoggingUserIndexSQL, operationsLoggingCardIndexSQL, operationsLoggingCounterpartyIndexSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite:   {dropOperationsLoggingCounterpartyIndexSQL, dropOperationsLoggingCardIndexSQL, dropOperationsLoggingUserIndexSQL},
+			Postgres: {dropOperationsLoggingCounterpartyIndexSQL, dropOperationsLoggingCardIndexSQL, dropOperationsLoggingUserIndexSQL},
+		},
+	},
+	{
+		version: 17,
+		name:    "revoke seeded manager password",
+		up: map[Dialect][]string{
+			SQLite:   {revokeInitialManagerPasswordSQL},
+			Postgres: {revokeInitialManagerPasswordSQL},
+		},
+		apply: revokeSeededManagerPassword,
+		// Reverting doesn't give the seeded password back.
+		down: map[Dialect][]string{
+			SQLite:   {},
+			Postgres: {},
+		},
+	},
+	{
+		version: 18,
+		name:    "atm withdrawal notes",
+		up: map[Dialect][]string{
+			SQLite:   {atmWithdrawalNotesDDL},
+			Postgres: {atmWithdrawalNotesPostgresDDL},
+		},
+		down: map[Dialect][]string{
+			SQLite:   {dropAtmWithdrawalNotesSQL},
+			Postgres: {dropAtmWithdrawalNotesSQL},
+		},
+	},
+	{
+		version: 19,
+		name:    "service payments",
+		up: map[Dialect][]string{
+			SQLite:   {servicePaymentsDDL, servicePaymentsServiceIndexSQL},
+			Postgres: {servicePaymentsPostgresDDL, servicePaymentsServiceIndexSQL},
+		},
+		apply: linkLegacyServicePayments,
+		down: map[Dialect][]string{
+			SQLite:   {dropServicePaymentsSQL},
+			Postgres: {dropServicePaymentsSQL},
+		},
+	},
+	{
+		version: 20,
+		name:    "card CVV attempts",
+		up: map[Dialect][]string{
+			SQLite:   {addCVVAttemptsCardSQL},
+			Postgres: {addCVVAttemptsCardPostgresSQL},
+		},
+		down: map[Dialect][]string{
+			SQLite: append(
+				rebuildSQLiteTable("cards", "id, numberCard, name, balance, user_id, expiryMonth, expiryYear, cvv, status, pin, pinAttempts",
+					cardsDDL, addExpiryMonthCardSQL, addExpiryYearCardSQL, addCVVCardSQL, addStatusCardSQL, addPINCardSQL, addPINAttemptsCardSQL),
+				createUniqueNumberCardSQL,
+			),
+			Postgres: {dropCVVAttemptsCardPostgresSQL},
+		},
+	},
+	{
+		version: 21,
+		name:    "card block reason",
+		up: map[Dialect][]string{
+			SQLite:   {addBlockReasonCardSQL},
+			Postgres: {addBlockReasonCardPostgresSQL},
+		},
+		apply: setLegacyBlockReasons,
+		down: map[Dialect][]string{
+			SQLite: append(
+				rebuildSQLiteTable("cards", "id, numberCard, name, balance, user_id, expiryMonth, expiryYear, cvv, status, pin, pinAttempts, cvvAttempts",
+					cardsDDL, addExpiryMonthCardSQL, addExpiryYearCardSQL, addCVVCardSQL, addStatusCardSQL, addPINCardSQL, addPINAttemptsCardSQL, addCVVAttemptsCardSQL),
+				createUniqueNumberCardSQL,
+			),
+			Postgres: {dropBlockReasonCardPostgresSQL},
+		},
+	},
+	{
+		version: 22,
+		name:    "millisecond timestamps",
+		up: map[Dialect][]string{
+			SQLite:   rewriteTimestamps(len("2006-01-02T15:04:05Z"), ".000Z"),
+			Postgres: rewriteTimestamps(len("2006-01-02T15:04:05Z"), ".000Z"),
+		},
+		down: map[Dialect][]string{
+			SQLite:   rewriteTimestamps(len("2006-01-02T15:04:05.000Z"), "Z"),
+			Postgres: rewriteTimestamps(len("2006-01-02T15:04:05.000Z"), "Z"),
+		},
+	},
+}
+
+var dropInitialSchema = []string{
+	`DROP TABLE IF EXISTS operationsLogging`,
+	`DROP TABLE IF EXISTS sumTransferUsers`,
+	`DROP TABLE IF EXISTS services`,
+	`DROP TABLE IF EXISTS atm`,
+	`DROP TABLE IF EXISTS cards`,
+	`DROP TABLE IF EXISTS users`,
+	`DROP TABLE IF EXISTS manager`,
+}
+
+// timestampColumns are the columns beside operationsLogging.time that kept
+// UTC times in time.RFC3339 before timestampLayout.
+var timestampColumns = [][2]string{
+	{"schema_migrations", "appliedAt"},
+	{"atmMaintenance", "startsAt"},
+	{"atmMaintenance", "endsAt"},
+	{"atmStatusHistory", "changedAt"},
+	{"ledgerJournal", "time"},
+}
+
+// rewriteTimestamps returns the statements replacing what follows the
+// seconds of the timestamps of length in timestampColumns with suffix.
+// Both layouts are UTC, so the rest of the text is kept.
+func rewriteTimestamps(length int, suffix string) []string {
+	var statements []string
+	for _, column := range timestampColumns {
+		table, name := column[0], column[1]
+		statements = append(statements, fmt.Sprintf(
+			`UPDATE %s SET %s = substr(%s, 1, 19) || '%s' WHERE length(%s) = %d`, table, name, name, suffix, name, length))
+	}
+	return statements
+}
+
+// rebuildSQLiteTable returns table to the schema ddls create, keeping
+// columns: the SQLite we link can't drop columns. ddls are the CREATE TABLE
+// of the table followed by its ALTER TABLE statements. Indexes of the table
+// are dropped with it and must be created again by the caller.
+func rebuildSQLiteTable(table, columns string, ddls ...string) []string {
+	var statements []string
+	for _, ddl := range ddls {
+		ddl = strings.Replace(ddl, "CREATE TABLE IF NOT EXISTS "+table, "CREATE TABLE "+table+"_new", 1)
+		ddl = strings.Replace(ddl, "ALTER TABLE "+table+" ", "ALTER TABLE "+table+"_new ", 1)
+		statements = append(statements, ddl)
+	}
+	return append(statements,
+		`INSERT INTO `+table+`_new(`+columns+`) SELECT `+columns+` FROM `+table,
+		`DROP TABLE `+table,
+		`ALTER TABLE `+table+`_new RENAME TO `+table,
+	)
+}
+
+// renumberLegacyCards gives cards issued before PANs a Luhn valid number
+// with the current BIN; the operations log keeps the old numbers.
+func renumberLegacyCards(ctx context.Context, tx *sql.Tx) (err error) {
+	rows, err := tx.QueryContext(ctx, selectNumberCardsSQL)
+	if err != nil {
+		return queryError(selectNumberCardsSQL, err)
+	}
+	var legacy []int64
+	for rows.Next() {
+		var id int64
+		var numberCard string
+		err = rows.Scan(&id, &numberCard)
+		if err != nil {
+			_ = rows.Close()
+			return dbError(err)
+		}
+		if !ValidCardNumber(numberCard) {
+			legacy = append(legacy, id)
+		}
+	}
+	if rows.Err() != nil {
+		_ = rows.Close()
+		return dbError(rows.Err())
+	}
+	err = rows.Close()
+	if err != nil {
+		return dbError(err)
+	}
+
+	for _, id := range legacy {
+		numberCard, err := newCardNumber(CardBIN(), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, updateNumberCardSQL, numberCard, id)
+		if err != nil {
+			return queryError(updateNumberCardSQL, err)
+		}
+	}
+	return nil
+}
+
+// setLegacyCardsExpiry treats cards issued before expiry dates as issued at
+// migration time. They have no CVV.
+func setLegacyCardsExpiry(ctx context.Context, tx *sql.Tx) error {
+	month, year := cardExpiry(time.Now())
+	_, err := tx.ExecContext(ctx, updateLegacyExpiryCardsSQL, month, year)
+	if err != nil {
+		return queryError(updateLegacyExpiryCardsSQL, err)
+	}
+	return nil
+}
+
+// setLegacyBlockReasons takes the blocked cards with maxPINAttempts wrong
+// PINs as blocked for them and the others as blocked by a manager.
+func setLegacyBlockReasons(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, updateLegacyBlockReasonCardsSQL, maxPINAttempts, blockedByPIN, blockedByManager, CardBlocked)
+	if err != nil {
+		return queryError(updateLegacyBlockReasonCardsSQL, err)
+	}
+	return nil
+}
+
+// convertOperationTimes rewrites the times of the operations logged with
+// time.Time.String to UTC timestampLayout and chains the log again: the
+// times are hashed. A broken chain isn't converted, so that the conversion
+// doesn't cover edits, and neither is a log with a time it can't read.
+// Reverting keeps the converted times.
+//
+// Checkpoints live outside the database, so the migration can't see them,
+// and those taken before a log with legacy times is converted don't verify
+// after it. The cutover is: verify the checkpoints against the database and
+// back it up, migrate, then append a checkpoint of the converted chain.
+// Older checkpoints verify against the backup only.
+func convertOperationTimes(ctx context.Context, tx *sql.Tx) error {
+	operations, err := selectChainedOperations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	report := verifyChain(operations)
+	if !report.Intact() {
+		return fmt.Errorf("operation %d: %w", report.BrokenAt, ErrOperationsChainBroken)
+	}
+	for _, operation := range operations {
+		if _, err := parseTimestamp(operation.time); err == nil {
+			continue
+		}
+		t, err := parseLegacyOperationTime(operation.time)
+		if err != nil {
+			return fmt.Errorf("operation %d: %w", operation.opLog.Id, err)
+		}
+		_, err = tx.ExecContext(ctx, updateTimeOperationSQL, formatTimestamp(t), operation.opLog.Id)
+		if err != nil {
+			return queryError(updateTimeOperationSQL, err)
+		}
+	}
+	return chainOperations(ctx, tx)
+}
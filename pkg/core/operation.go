@@ -0,0 +1,251 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidOperationsFilter = errors.New("invalid operations filter")
+var ErrInvalidOperationTime = errors.New("invalid operation time")
+
+// OperationType is the name of an operation in the operations log and of
+// the ledger journal that records its money movement.
+type OperationType string
+
+const (
+	OperationTransferSend     OperationType = "translatedToSend"
+	OperationTransferGet      OperationType = "translatedToGet"
+	OperationPayService       OperationType = "payToService"
+	OperationAtmWithdraw      OperationType = "atmWithdraw"
+	OperationAtmDeposit       OperationType = "atmDeposit"
+	OperationAtmReversal      OperationType = "atmReversal"
+	OperationAtmReplenish     OperationType = "atmReplenish"
+	OperationAtmCollect       OperationType = "atmCollect"
+	OperationPINSet           OperationType = "pinSet"
+	OperationPINChanged       OperationType = "pinChanged"
+	OperationPINVerifyFailed  OperationType = "pinVerifyFailed"
+	OperationPINBlocked       OperationType = "pinBlocked"
+	OperationPINAttemptsReset OperationType = "pinAttemptsReset"
+	OperationCVVVerifyFailed  OperationType = "cvvVerifyFailed"
+	OperationCVVBlocked       OperationType = "cvvBlocked"
+)
+
+// Journals not named after a single logged operation.
+const (
+	OperationTransfer      OperationType = "transfer"
+	OperationIssueCard     OperationType = "issueCard"
+	OperationLedgerOpening OperationType = "opening"
+)
+
+// timestampLayout keeps the times stored as text, of operations, journals,
+// ATM status and checkpoints, in UTC with milliseconds and a fixed width, so
+// that they sort and compare as text.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// legacyOperationTimeLayout is time.Time.String without the monotonic
+// clock reading, the way operations were logged before.
+const legacyOperationTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// operationTime is now as the log keeps it.
+func operationTime(now time.Time) time.Time {
+	return now.UTC().Truncate(time.Millisecond)
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	t, err := time.Parse(timestampLayout, value)
+	if err != nil {
+		return t, dbError(err)
+	}
+	return t, nil
+}
+
+// parseLegacyOperationTime reads the times logged before timestampLayout.
+func parseLegacyOperationTime(value string) (time.Time, error) {
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	t, err := time.Parse(legacyOperationTimeLayout, value)
+	if err != nil {
+		return t, fmt.Errorf("%q: %w", value, ErrInvalidOperationTime)
+	}
+	return operationTime(t), nil
+}
+
+func scanOperation(rows *sql.Rows) (opLog OperationsLogging, err error) {
+	var t string
+	err = rows.Scan(&opLog.Id, &opLog.Name, &t, &opLog.RecipientSender, &opLog.Balance, &opLog.Atm_id, &opLog.Card_id, &opLog.Reference)
+	if err != nil {
+		return opLog, dbError(err)
+	}
+	opLog.Time, err = parseTimestamp(t)
+	return opLog, err
+}
+
+// Operations pages hold DefaultOperationsLimit operations unless the filter
+// asks for another limit, at most MaxOperationsLimit.
+const (
+	DefaultOperationsLimit = 100
+	MaxOperationsLimit     = 1000
+)
+
+// OperationsFilter narrows QueryOperationsContext; the zero value keeps
+// every operation. From is inclusive and To exclusive, MaxAmount 0 is no
+// limit; amounts are compared without their sign.
+type OperationsFilter struct {
+	UserId       int64
+	CardId       int64
+	Type         OperationType
+	From         time.Time
+	To           time.Time
+	MinAmount    int64
+	MaxAmount    int64
+	Counterparty string
+	// Cursor is the NextCursor of the previous page, 0 for the first page.
+	Cursor int64
+	Limit  int
+}
+
+// OperationsPage is a page of operations, newest first. NextCursor is 0 on
+// the last page.
+type OperationsPage struct {
+	Operations []OperationsLogging
+	NextCursor int64
+}
+
+// checkOperationsFilter refuses ranges out of order and returns the limit
+// of the page.
+func checkOperationsFilter(filter OperationsFilter) (int, error) {
+	if filter.UserId < 0 || filter.CardId < 0 || filter.Cursor < 0 || filter.MinAmount < 0 || filter.MaxAmount < 0 {
+		return 0, ErrInvalidOperationsFilter
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return 0, ErrInvalidOperationsFilter
+	}
+	if filter.MaxAmount > 0 && filter.MaxAmount < filter.MinAmount {
+		return 0, ErrInvalidOperationsFilter
+	}
+	switch {
+	case filter.Limit < 0:
+		return 0, ErrInvalidOperationsFilter
+	case filter.Limit == 0:
+		return DefaultOperationsLimit, nil
+	case filter.Limit > MaxOperationsLimit:
+		return MaxOperationsLimit, nil
+	}
+	return filter.Limit, nil
+}
+
+// operationsQuery is queryOperationsSQL with the conditions of the set
+// fields of filter only, so that the planner picks the index of the field.
+func operationsQuery(filter OperationsFilter, limit int) (query string, args []interface{}) {
+	var conditions []string
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Cursor != 0 {
+		where("id < $%d", filter.Cursor)
+	}
+	if filter.UserId != 0 {
+		where("user_id = $%d", filter.UserId)
+	}
+	if filter.CardId != 0 {
+		where("card_id = $%d", filter.CardId)
+	}
+	if filter.Type != "" {
+		where("name = $%d", string(filter.Type))
+	}
+	if !filter.From.IsZero() {
+		where("time >= $%d", formatTimestamp(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where("time < $%d", formatTimestamp(filter.To))
+	}
+	where("abs(balance) >= $%d", filter.MinAmount)
+	if filter.MaxAmount != 0 {
+		where("abs(balance) <= $%d", filter.MaxAmount)
+	}
+	if filter.Counterparty != "" {
+		where("recipientSender = $%d", filter.Counterparty)
+	}
+	args = append(args, limit)
+	query = queryOperationsSQL + "\nWHERE " + strings.Join(conditions, "\n  AND ") +
+		fmt.Sprintf("\nORDER BY id DESC\nLIMIT $%d", len(args))
+	return query, args
+}
+
+// QueryOperationsContext returns a page of the operations matching filter,
+// newest first. Pages follow the operation ids, so operations logged while
+// browsing don't shift the pages after the first.
+func QueryOperationsContext(ctx context.Context, filter OperationsFilter, db *sql.DB) (page OperationsPage, err error) {
+	limit, err := checkOperationsFilter(filter)
+	if err != nil {
+		return page, err
+	}
+	query, args := operationsQuery(filter, limit+1)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return page, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			page, err = OperationsPage{}, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		opLog := OperationsLogging{}
+		var t string
+		err = rows.Scan(&opLog.Id, &opLog.Name, &t, &opLog.RecipientSender, &opLog.Balance, &opLog.User_id, &opLog.Atm_id, &opLog.Card_id, &opLog.Reference)
+		if err != nil {
+			return OperationsPage{}, dbError(err)
+		}
+		opLog.Time, err = parseTimestamp(t)
+		if err != nil {
+			return OperationsPage{}, err
+		}
+		page.Operations = append(page.Operations, opLog)
+	}
+	if rows.Err() != nil {
+		return OperationsPage{}, dbError(rows.Err())
+	}
+	return operationsPage(page.Operations, limit), nil
+}
+
+func QueryOperations(filter OperationsFilter, db *sql.DB) (OperationsPage, error) {
+	return QueryOperationsContext(context.Background(), filter, db)
+}
+
+// operationsPage keeps limit of operations, queried one more to know
+// whether a page follows.
+func operationsPage(operations []OperationsLogging, limit int) OperationsPage {
+	if len(operations) <= limit {
+		return OperationsPage{Operations: operations}
+	}
+	operations = operations[:limit]
+	return OperationsPage{Operations: operations, NextCursor: operations[limit-1].Id}
+}
+
+func (receiver OperationsFilter) matches(opLog OperationsLogging) bool {
+	amount := int64(opLog.Balance)
+	if amount < 0 {
+		amount = -amount
+	}
+	return (receiver.Cursor == 0 || opLog.Id < receiver.Cursor) &&
+		(receiver.UserId == 0 || int64(opLog.User_id) == receiver.UserId) &&
+		(receiver.CardId == 0 || opLog.Card_id == receiver.CardId) &&
+		(receiver.Type == "" || opLog.Name == receiver.Type) &&
+		(receiver.From.IsZero() || !opLog.Time.Before(operationTime(receiver.From))) &&
+		(receiver.To.IsZero() || opLog.Time.Before(operationTime(receiver.To))) &&
+		amount >= receiver.MinAmount &&
+		(receiver.MaxAmount == 0 || amount <= receiver.MaxAmount) &&
+		(receiver.Counterparty == "" || opLog.RecipientSender == receiver.Counterparty)
+}
@@ -0,0 +1,132 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryOperations(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		for _, amount := range []int64{10, 20, 30} {
+			_, err := Session{UserId: 1}.Transfer(context.Background(), 1, RecipientByLogin("petya"), amount, db)
+			if err != nil {
+				t.Fatalf("can't transfer: %v", err)
+			}
+		}
+		day := func(n int) time.Time {
+			return time.Date(2021, 1, n, 12, 0, 0, 0, time.UTC)
+		}
+		for id := 1; id <= 6; id++ {
+			_, err := db.Exec(`UPDATE operationsLogging SET time = $1 WHERE id = $2`, formatTimestamp(day(id)), id)
+			if err != nil {
+				t.Fatalf("can't set operation time: %v", err)
+			}
+		}
+
+		ids := func(page OperationsPage) (ids []int64) {
+			for _, opLog := range page.Operations {
+				ids = append(ids, opLog.Id)
+			}
+			return ids
+		}
+		tests := []struct {
+			name   string
+			filter OperationsFilter
+			want   []int64
+		}{
+			{"sent", OperationsFilter{UserId: 1, Type: OperationTransferSend}, []int64{5, 3, 1}},
+			{"received", OperationsFilter{UserId: 2}, []int64{6, 4, 2}},
+			{"card", OperationsFilter{CardId: 1}, []int64{5, 3, 1}},
+			{"days", OperationsFilter{From: day(2), To: day(5)}, []int64{4, 3, 2}},
+			{"amounts", OperationsFilter{MinAmount: 15, MaxAmount: 25}, []int64{4, 3}},
+			{"counterparty", OperationsFilter{Counterparty: "nobody"}, nil},
+		}
+		for _, test := range tests {
+			page, err := QueryOperations(test.filter, db)
+			if err != nil || page.NextCursor != 0 || len(ids(page)) != len(test.want) {
+				t.Errorf("%s: got %v, want %v: %v", test.name, ids(page), test.want, err)
+				continue
+			}
+			for i, id := range ids(page) {
+				if id != test.want[i] {
+					t.Errorf("%s: got %v, want %v", test.name, ids(page), test.want)
+					break
+				}
+			}
+		}
+
+		page, err := QueryOperations(OperationsFilter{Limit: 4}, db)
+		if err != nil || len(page.Operations) != 4 || page.NextCursor != 3 || page.Operations[0].User_id != 2 {
+			t.Fatalf("first page not match: %v, %v", page, err)
+		}
+		_, err = Session{UserId: 1}.Transfer(context.Background(), 1, RecipientByLogin("petya"), 40, db)
+		if err != nil {
+			t.Fatalf("can't transfer: %v", err)
+		}
+		page, err = QueryOperations(OperationsFilter{Cursor: page.NextCursor, Limit: 4}, db)
+		if err != nil || len(page.Operations) != 2 || page.Operations[0].Id != 2 || page.NextCursor != 0 {
+			t.Errorf("next page not match: %v, %v", page, err)
+		}
+
+		_, err = QueryOperations(OperationsFilter{From: day(5), To: day(2)}, db)
+		if !errors.Is(err, ErrInvalidOperationsFilter) {
+			t.Errorf("Not ErrInvalidOperationsFilter error: %v", err)
+		}
+		_, err = QueryOperations(OperationsFilter{Limit: -1}, db)
+		if !errors.Is(err, ErrInvalidOperationsFilter) {
+			t.Errorf("Not ErrInvalidOperationsFilter error: %v", err)
+		}
+	})
+}
+
+func TestQueryOperations_Plan(t *testing.T) {
+	db, closeDb := openTestDb(t, "sqlite3")
+	defer closeDb()
+	err := Init(db)
+	if err != nil {
+		t.Fatalf("can't init db: %v", err)
+	}
+
+	tests := []struct {
+		filter OperationsFilter
+		index  string
+	}{
+		{OperationsFilter{UserId: 1}, "operationsLogging_user"},
+		{OperationsFilter{UserId: 1, Cursor: 100, MinAmount: 5}, "operationsLogging_user"},
+		{OperationsFilter{CardId: 1, Type: OperationTransferSend}, "operationsLogging_card"},
+		{OperationsFilter{Counterparty: "Internet"}, "operationsLogging_counterparty"},
+	}
+	for _, test := range tests {
+		query, args := operationsQuery(test.filter, DefaultOperationsLimit)
+		rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+		if err != nil {
+			t.Fatalf("can't explain query: %v", err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, notUsed int
+			var detail string
+			err = rows.Scan(&id, &parent, &notUsed, &detail)
+			if err != nil {
+				t.Fatalf("can't scan plan: %v", err)
+			}
+			plan = append(plan, detail)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatalf("can't close plan: %v", err)
+		}
+		joined := strings.Join(plan, "; ")
+		if !strings.Contains(joined, "USING INDEX "+test.index) || strings.Contains(joined, "TEMP B-TREE") {
+			t.Errorf("%+v: plan not using %s in id order: %s", test.filter, test.index, joined)
+		}
+	}
+}
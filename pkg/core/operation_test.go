@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOperationTime(t *testing.T) {
+	at := time.Date(2021, 3, 4, 5, 6, 7, 890123456, time.FixedZone("", 5*60*60))
+	if got := formatTimestamp(operationTime(at)); got != "2021-03-04T00:06:07.890Z" {
+		t.Errorf("operation time not match: %s", got)
+	}
+	parsed, err := parseTimestamp("2021-03-04T00:06:07.890Z")
+	if err != nil || !parsed.Equal(operationTime(at)) {
+		t.Errorf("can't parse operation time: %v, %v", parsed, err)
+	}
+	if formatTimestamp(time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)) >= formatTimestamp(time.Date(2021, 3, 4, 0, 0, 0, 1000000, time.UTC)) {
+		t.Error("operation times don't sort as text")
+	}
+
+	legacy, err := parseLegacyOperationTime("2021-03-04 05:06:07.890123456 +0500 +05 m=+1.000000001")
+	if err != nil || !legacy.Equal(operationTime(at)) {
+		t.Errorf("legacy time not match: %v, %v", legacy, err)
+	}
+	_, err = parseLegacyOperationTime("")
+	if !errors.Is(err, ErrInvalidOperationTime) {
+		t.Errorf("Not ErrInvalidOperationTime error: %v", err)
+	}
+}
+
+func TestOperationsPage(t *testing.T) {
+	operations := []OperationsLogging{{Id: 9}, {Id: 7}, {Id: 4}}
+	page := operationsPage(operations, 2)
+	if len(page.Operations) != 2 || page.NextCursor != 7 {
+		t.Errorf("page not match: %v", page)
+	}
+	page = operationsPage(operations, 3)
+	if len(page.Operations) != 3 || page.NextCursor != 0 {
+		t.Errorf("last page not match: %v", page)
+	}
+	limit, err := checkOperationsFilter(OperationsFilter{Limit: MaxOperationsLimit + 1})
+	if err != nil || limit != MaxOperationsLimit {
+		t.Errorf("limit not match: %d, %v", limit, err)
+	}
+}
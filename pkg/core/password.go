@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrManagerPasswordNotSet is returned for the seeded admin until its
+// password is set with SetManagerPassword.
+var ErrManagerPasswordNotSet = errors.New("manager password not set")
+
+const passwordHashCost = bcrypt.DefaultCost
+
+// initialManagerPasswordHash is what the initial schema seeds admin with;
+// migration 17 revokes it, and seededManagerPassword is kept only to find
+// the managers still using it.
+const initialManagerPasswordHash = `$2a$10$SeYGLd1oS1qNuHWw/R55Iez/vz8GK9ioQ89xFfcVAmrJcYMSXuhN2`
+const seededManagerPassword = "boss"
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares password with the stored value. Rows written before
+// passwords were hashed still hold plaintext; they are accepted once and
+// reported with rehash so the caller can replace them with a hash.
+// An empty stored value never matches: it marks an account without password.
+func checkPassword(stored, password string) (ok bool, rehash bool) {
+	if stored == "" {
+		return false, false
+	}
+	if !isPasswordHash(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err == nil && cost < passwordHashCost
+}
+
+func SetManagerPasswordContext(ctx context.Context, login, password string, db *sql.DB) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, updatePasswordManagerSQL, hash, login)
+	if err != nil {
+		return queryError(updatePasswordManagerSQL, err)
+	}
+	return nil
+}
+
+func SetManagerPassword(login, password string, db *sql.DB) error {
+	return SetManagerPasswordContext(context.Background(), login, password, db)
+}
+
+func SetUserPasswordContext(ctx context.Context, userId int64, password string, db *sql.DB) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, updatePasswordUserSQL, hash, userId)
+	if err != nil {
+		return queryError(updatePasswordUserSQL, err)
+	}
+	return nil
+}
+
+func SetUserPassword(userId int64, password string, db *sql.DB) error {
+	return SetUserPasswordContext(context.Background(), userId, password, db)
+}
+
+// revokeSeededManagerPassword clears the password of managers still using
+// the one seeded by the initial schema, plaintext or rehashed on login.
+func revokeSeededManagerPassword(ctx context.Context, tx *sql.Tx) error {
+	logins, err := selectSeededManagers(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, login := range logins {
+		_, err = tx.ExecContext(ctx, updatePasswordManagerSQL, "", login)
+		if err != nil {
+			return queryError(updatePasswordManagerSQL, err)
+		}
+	}
+	return nil
+}
+
+func selectSeededManagers(ctx context.Context, tx *sql.Tx) (logins []string, err error) {
+	rows, err := tx.QueryContext(ctx, selectPasswordsManagerSQL)
+	if err != nil {
+		return nil, queryError(selectPasswordsManagerSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			logins, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		var login, stored string
+		err = rows.Scan(&login, &stored)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		if ok, _ := checkPassword(stored, seededManagerPassword); ok {
+			logins = append(logins, login)
+		}
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return logins, nil
+}
@@ -0,0 +1,309 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrInvalidServiceField = errors.New("invalid service field")
+var ErrMissingPaymentField = errors.New("payment field missing")
+var ErrUnknownPaymentField = errors.New("payment field unknown to service")
+var ErrInvalidPaymentField = errors.New("payment field doesn't match service rules")
+
+// ServiceField is a value a service needs with each payment, like the
+// phone number to top up or a contract id.
+type ServiceField struct {
+	Name string
+	// Pattern is a regular expression the whole value must match; empty
+	// accepts any value.
+	Pattern   string
+	MinLength int
+	// MaxLength 0 is no limit.
+	MaxLength int
+}
+
+// PaymentFieldError tells which payment field was refused.
+type PaymentFieldError struct {
+	Field string
+	Err   error
+}
+
+type PaymentResult struct {
+	CardBalance int64
+	OperationId int64
+	Reference   string
+}
+
+func (receiver *PaymentFieldError) Error() string {
+	return receiver.Field + ": " + receiver.Err.Error()
+}
+
+func (receiver *PaymentFieldError) Unwrap() error {
+	return receiver.Err
+}
+
+// checkServiceFields refuses fields without a name or with names repeated,
+// patterns not compiling and lengths out of order. The names can't hold the
+// separators of the payment reference.
+func checkServiceFields(fields []ServiceField) error {
+	names := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if field.Name == "" || strings.ContainsAny(field.Name, "=;") || names[field.Name] {
+			return ErrInvalidServiceField
+		}
+		names[field.Name] = true
+		if _, err := compileFieldPattern(field.Pattern); err != nil {
+			return ErrInvalidServiceField
+		}
+		if field.MinLength < 0 || field.MaxLength < 0 || field.MaxLength > 0 && field.MaxLength < field.MinLength {
+			return ErrInvalidServiceField
+		}
+	}
+	return nil
+}
+
+func compileFieldPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+// paymentReference validates the values of a payment against the fields of
+// the service and joins them into the reference logged with it, in the
+// order of the fields: "phone=900000001;contract=A-17". Values can't hold
+// the separators either, whatever the pattern of their field.
+func paymentReference(fields []ServiceField, values map[string]string) (string, error) {
+	for name := range values {
+		if !hasServiceField(fields, name) {
+			return "", &PaymentFieldError{Field: name, Err: ErrUnknownPaymentField}
+		}
+	}
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		value, ok := values[field.Name]
+		if !ok || value == "" {
+			return "", &PaymentFieldError{Field: field.Name, Err: ErrMissingPaymentField}
+		}
+		if strings.ContainsAny(value, "=;") {
+			return "", &PaymentFieldError{Field: field.Name, Err: ErrInvalidPaymentField}
+		}
+		length := utf8.RuneCountInString(value)
+		if length < field.MinLength || field.MaxLength > 0 && length > field.MaxLength {
+			return "", &PaymentFieldError{Field: field.Name, Err: ErrInvalidPaymentField}
+		}
+		pattern, err := compileFieldPattern(field.Pattern)
+		if err != nil || !pattern.MatchString(value) {
+			return "", &PaymentFieldError{Field: field.Name, Err: ErrInvalidPaymentField}
+		}
+		parts = append(parts, field.Name+"="+value)
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+func hasServiceField(fields []ServiceField, name string) bool {
+	for _, field := range fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetServiceFieldsContext replaces the fields payments to the service name
+// must carry; no fields take payments without reference.
+func SetServiceFieldsContext(ctx context.Context, name string, fields []ServiceField, db *sql.DB) (err error) {
+	err = checkServiceFields(fields)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	service, err := selectService(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, deleteServiceFieldsSQL, service.Id)
+	if err != nil {
+		return queryError(deleteServiceFieldsSQL, err)
+	}
+	for position, field := range fields {
+		_, err = tx.ExecContext(ctx, insertServiceFieldSQL, service.Id, position, field.Name, field.Pattern, field.MinLength, field.MaxLength)
+		if err != nil {
+			return queryError(insertServiceFieldSQL, err)
+		}
+	}
+	return nil
+}
+
+func SetServiceFields(name string, fields []ServiceField, db *sql.DB) error {
+	return SetServiceFieldsContext(context.Background(), name, fields, db)
+}
+
+func ServiceFieldsContext(ctx context.Context, name string, db *sql.DB) (fields []ServiceField, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			fields = nil
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			fields = nil
+		}
+	}()
+
+	service, err := selectService(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+	return selectServiceFields(ctx, tx, service.Id)
+}
+
+func ServiceFields(name string, db *sql.DB) ([]ServiceField, error) {
+	return ServiceFieldsContext(context.Background(), name, db)
+}
+
+// PayServiceContext pays amount to the service name from the session user's
+// card idCardSender, or from the default card when it is 0. The service must
+// be active and take the amount. values holds the payment fields of the
+// service; they are logged with the payment as its reference.
+func (receiver Session) PayServiceContext(ctx context.Context, idCardSender int64, amount int64, name string, values map[string]string, db *sql.DB) (result PaymentResult, err error) {
+	if amount <= 0 {
+		return result, ErrInvalidAmount
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			result = PaymentResult{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			result = PaymentResult{}
+		}
+	}()
+
+	sender, err := selectSenderCard(ctx, tx, receiver.UserId, idCardSender)
+	if err != nil {
+		return result, err
+	}
+	service, err := selectService(ctx, tx, name)
+	if err != nil {
+		return result, err
+	}
+	err = checkServiceAmount(service, amount)
+	if err != nil {
+		return result, err
+	}
+	fields, err := selectServiceFields(ctx, tx, service.Id)
+	if err != nil {
+		return result, err
+	}
+	result.Reference, err = paymentReference(fields, values)
+	if err != nil {
+		return result, err
+	}
+	if sender.balance <= amount {
+		return result, ErrInsufficientFunds
+	}
+
+	_, err = tx.ExecContext(ctx, addBalanceToCardSQL, -amount, sender.id)
+	if err != nil {
+		return result, queryError(addBalanceToCardSQL, err)
+	}
+	_, err = tx.ExecContext(ctx, addBalanceServiceByIdSQL, amount, service.Id)
+	if err != nil {
+		return result, queryError(addBalanceServiceByIdSQL, err)
+	}
+	result.OperationId, err = insertOperation(ctx, tx, DialectOf(db), insertPaymentOperationsLoggingSQL,
+		OperationPayService, formatTimestamp(time.Now()), name, -amount, receiver.UserId, sender.id, result.Reference)
+	if err != nil {
+		return result, err
+	}
+	_, err = tx.ExecContext(ctx, insertServicePaymentSQL, result.OperationId, service.Id)
+	if err != nil {
+		return result, queryError(insertServicePaymentSQL, err)
+	}
+	err = postJournal(ctx, tx, DialectOf(db), result.OperationId, string(OperationPayService),
+		Posting{Account: CardAccount(sender.id), Amount: amount},
+		Posting{Account: ServiceAccount(service.Id), Amount: -amount},
+	)
+	if err != nil {
+		return result, err
+	}
+	result.CardBalance = sender.balance - amount
+	return result, nil
+}
+
+func (receiver Session) PayService(idCardSender int64, amount int64, name string, values map[string]string, db *sql.DB) (PaymentResult, error) {
+	return receiver.PayServiceContext(context.Background(), idCardSender, amount, name, values, db)
+}
+
+func selectServiceFields(ctx context.Context, tx *sql.Tx, serviceId int64) (fields []ServiceField, err error) {
+	rows, err := tx.QueryContext(ctx, getServiceFieldsSQL, serviceId)
+	if err != nil {
+		return nil, queryError(getServiceFieldsSQL, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			fields, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		field := ServiceField{}
+		err = rows.Scan(&field.Name, &field.Pattern, &field.MinLength, &field.MaxLength)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		fields = append(fields, field)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return fields, nil
+}
+
+// linkLegacyServicePayments links the payments logged before
+// servicePayments to their services.
+func linkLegacyServicePayments(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, linkLegacyServicePaymentsSQL, OperationPayService)
+	if err != nil {
+		return queryError(linkLegacyServicePaymentsSQL, err)
+	}
+	return nil
+}
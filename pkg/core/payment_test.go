@@ -0,0 +1,150 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var megafonFields = []ServiceField{
+	{Name: "phone", Pattern: `9\d{8}`},
+	{Name: "contract", Pattern: `[A-Z]-\d+`, MinLength: 3, MaxLength: 6},
+}
+
+func TestPaymentReference(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   string
+		field  string
+		err    error
+	}{
+		{"valid", map[string]string{"contract": "A-17", "phone": "900000001"}, "phone=900000001;contract=A-17", "", nil},
+		{"missing", map[string]string{"phone": "900000001"}, "", "contract", ErrMissingPaymentField},
+		{"empty", map[string]string{"phone": "", "contract": "A-17"}, "", "phone", ErrMissingPaymentField},
+		{"unknown", map[string]string{"phone": "900000001", "contract": "A-17", "email": "a@b.c"}, "", "email", ErrUnknownPaymentField},
+		{"pattern", map[string]string{"phone": "800000001", "contract": "A-17"}, "", "phone", ErrInvalidPaymentField},
+		{"partial match", map[string]string{"phone": "9000000012", "contract": "A-17"}, "", "phone", ErrInvalidPaymentField},
+		{"too long", map[string]string{"phone": "900000001", "contract": "A-12345"}, "", "contract", ErrInvalidPaymentField},
+	}
+	for _, test := range tests {
+		got, err := paymentReference(megafonFields, test.values)
+		if got != test.want || !errors.Is(err, test.err) {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, got, err, test.want, test.err)
+		}
+		var fieldErr *PaymentFieldError
+		if test.err != nil && (!errors.As(err, &fieldErr) || fieldErr.Field != test.field) {
+			t.Errorf("%s: field not match: %v, want %s", test.name, err, test.field)
+		}
+	}
+
+	got, err := paymentReference(nil, nil)
+	if got != "" || err != nil {
+		t.Errorf("reference without fields not match: %q, %v", got, err)
+	}
+	for _, value := range []string{"1;contract=X", "a=b", ";"} {
+		got, err = paymentReference([]ServiceField{{Name: "account"}}, map[string]string{"account": value})
+		if got != "" || !errors.Is(err, ErrInvalidPaymentField) {
+			t.Errorf("value %q with separators not refused: %q, %v", value, got, err)
+		}
+	}
+}
+
+func TestCheckServiceFields(t *testing.T) {
+	invalid := [][]ServiceField{
+		{{Name: ""}},
+		{{Name: "a=b"}},
+		{{Name: "phone"}, {Name: "phone"}},
+		{{Name: "phone", Pattern: `(\d`}},
+		{{Name: "phone", MinLength: -1}},
+		{{Name: "phone", MinLength: 5, MaxLength: 4}},
+	}
+	for _, fields := range invalid {
+		if err := checkServiceFields(fields); !errors.Is(err, ErrInvalidServiceField) {
+			t.Errorf("Not ErrInvalidServiceField error for %v: %v", fields, err)
+		}
+	}
+	if err := checkServiceFields(megafonFields); err != nil {
+		t.Errorf("valid fields refused: %v", err)
+	}
+}
+
+func TestPayService(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		vasya := Session{UserId: 1}
+
+		err := SetServiceFields("Megafon", megafonFields, db)
+		if !errors.Is(err, ErrServiceNotFound) {
+			t.Errorf("Not ErrServiceNotFound error: %v", err)
+		}
+		err = AddService("Megafon", db)
+		if err != nil {
+			t.Fatalf("can't add service: %v", err)
+		}
+		err = SetServiceFields("Megafon", megafonFields, db)
+		if err != nil {
+			t.Fatalf("can't set service fields: %v", err)
+		}
+		fields, err := ServiceFields("Megafon", db)
+		if err != nil || !reflect.DeepEqual(fields, megafonFields) {
+			t.Errorf("service fields not match: %v, %v", fields, err)
+		}
+
+		values := map[string]string{"phone": "900000001", "contract": "A-17"}
+		result, err := vasya.PayService(0, 50, "Megafon", values, db)
+		if err != nil {
+			t.Fatalf("can't pay service: %v", err)
+		}
+		if result.CardBalance != 150 || result.Reference != "phone=900000001;contract=A-17" || result.OperationId != 1 {
+			t.Errorf("payment not match: %+v", result)
+		}
+		_, err = vasya.PayService(1, 200, "Megafon", values, db)
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("Not ErrInsufficientFunds error: %v", err)
+		}
+		_, err = vasya.PayService(1, 150, "Megafon", values, db)
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("Not ErrInsufficientFunds error for the whole balance: %v", err)
+		}
+		_, err = vasya.PayService(1, -10, "Megafon", values, db)
+		if !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("Not ErrInvalidAmount error: %v", err)
+		}
+		err = vasya.TransferServices(1, 10, "Megafon", db)
+		if !errors.Is(err, ErrMissingPaymentField) {
+			t.Errorf("Not ErrMissingPaymentField error for payment without fields: %v", err)
+		}
+		if balance := cardBalance(t, db, 1); balance != 150 {
+			t.Errorf("card balance changed by failed payments: %d", balance)
+		}
+
+		opLogs, err := vasya.ViewOperationsLogging(db)
+		want := []OperationsLogging{{Id: 1, Name: OperationPayService, RecipientSender: "Megafon", Balance: -50, Card_id: 1, Reference: "phone=900000001;contract=A-17"}}
+		if err != nil || len(opLogs) != 1 {
+			t.Fatalf("operations logging not match: %v, %v", opLogs, err)
+		}
+		opLogs[0].Time = time.Time{}
+		if opLogs[0] != want[0] {
+			t.Errorf("payment log not match: %v, want %v", opLogs[0], want[0])
+		}
+
+		err = SetServiceFields("Megafon", nil, db)
+		if err != nil {
+			t.Fatalf("can't clear service fields: %v", err)
+		}
+		err = vasya.TransferServices(1, 10, "Megafon", db)
+		if err != nil {
+			t.Errorf("can't pay service without fields: %v", err)
+		}
+		services, err := GetAllServices(ServiceFilter{}, db)
+		if err != nil || len(services) != 1 || services[0].Balance != 60 {
+			t.Errorf("service balance not match: %v, %v", services, err)
+		}
+	})
+}
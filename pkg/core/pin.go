@@ -0,0 +1,270 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrInvalidPINFormat = errors.New("PIN must be 4 to 6 digits")
+var ErrPINNotSet = errors.New("PIN not set")
+var ErrPINAlreadySet = errors.New("PIN already set")
+var ErrWrongPIN = errors.New("wrong PIN")
+var ErrPINAttemptsExceeded = errors.New("PIN attempts exceeded, card blocked")
+
+// maxPINAttempts wrong PINs in a row block the card until a manager calls
+// ResetPINAttempts or UnblockCard.
+const maxPINAttempts = 3
+
+type pinCard struct {
+	pin         string
+	pinAttempts int
+	status      CardStatus
+	blockReason string
+	numberCard  string
+	userId      int64
+}
+
+func validPINFormat(pin string) bool {
+	return len(pin) >= 4 && len(pin) <= 6 && isDigits(pin)
+}
+
+// SetPINContext sets the first PIN of the session user's card idCard.
+func (receiver Session) SetPINContext(ctx context.Context, idCard int64, pin string, db *sql.DB) (err error) {
+	if !validPINFormat(pin) {
+		return ErrInvalidPINFormat
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	card, err := selectPINCard(ctx, tx, idCard)
+	if err != nil {
+		return err
+	}
+	if card.userId != receiver.UserId {
+		return ErrCardNotFound
+	}
+	if card.status != CardActive {
+		return ErrCardNotActive
+	}
+	if card.pin != "" {
+		return ErrPINAlreadySet
+	}
+	return updatePIN(ctx, tx, DialectOf(db), idCard, card, pin, OperationPINSet)
+}
+
+func (receiver Session) SetPIN(idCard int64, pin string, db *sql.DB) error {
+	return receiver.SetPINContext(context.Background(), idCard, pin, db)
+}
+
+// ChangePINContext replaces the PIN of the card; a wrong oldPIN counts as a
+// failed attempt like in VerifyPINContext.
+func ChangePINContext(ctx context.Context, idCard int64, oldPIN, newPIN string, db *sql.DB) (err error) {
+	if !validPINFormat(newPIN) {
+		return ErrInvalidPINFormat
+	}
+
+	var pinErr error
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			return
+		}
+		err = pinErr
+	}()
+
+	card, pinErr, err := checkPIN(ctx, tx, DialectOf(db), idCard, oldPIN)
+	if err != nil || pinErr != nil {
+		return err
+	}
+	return updatePIN(ctx, tx, DialectOf(db), idCard, card, newPIN, OperationPINChanged)
+}
+
+func ChangePIN(idCard int64, oldPIN, newPIN string, db *sql.DB) error {
+	return ChangePINContext(context.Background(), idCard, oldPIN, newPIN, db)
+}
+
+// VerifyPINContext checks pin against the card. Wrong PINs are counted and
+// logged even though an error is returned; the maxPINAttempts-th in a row
+// blocks the card and returns ErrPINAttemptsExceeded.
+func VerifyPINContext(ctx context.Context, idCard int64, pin string, db *sql.DB) (err error) {
+	var pinErr error
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			return
+		}
+		err = pinErr
+	}()
+
+	_, pinErr, err = checkPIN(ctx, tx, DialectOf(db), idCard, pin)
+	return err
+}
+
+func VerifyPIN(idCard int64, pin string, db *sql.DB) error {
+	return VerifyPINContext(context.Background(), idCard, pin, db)
+}
+
+// ResetPINAttemptsContext clears the failure counter of the card and
+// unblocks it when it was blocked for wrong PINs. Cards blocked by
+// BlockCard or for wrong CVVs stay blocked.
+func ResetPINAttemptsContext(ctx context.Context, idCard int64, db *sql.DB) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+		}
+	}()
+
+	card, err := selectPINCard(ctx, tx, idCard)
+	if err != nil {
+		return err
+	}
+	status, blockReason := card.status, card.blockReason
+	if status == CardBlocked && blockReason == blockedByPIN {
+		status, blockReason = CardActive, ""
+	}
+	_, err = tx.ExecContext(ctx, resetPINAttemptsCardSQL, 0, status, blockReason, idCard)
+	if err != nil {
+		return queryError(resetPINAttemptsCardSQL, err)
+	}
+	_, err = logOperation(ctx, tx, DialectOf(db), OperationPINAttemptsReset, time.Now(), card.numberCard, 0, card.userId)
+	return err
+}
+
+func ResetPINAttempts(idCard int64, db *sql.DB) error {
+	return ResetPINAttemptsContext(context.Background(), idCard, db)
+}
+
+func selectPINCard(ctx context.Context, tx *sql.Tx, idCard int64) (card pinCard, err error) {
+	err = tx.QueryRowContext(ctx, selectPINCardSQL, idCard).Scan(&card.pin, &card.pinAttempts, &card.status, &card.blockReason, &card.numberCard, &card.userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return card, ErrCardNotFound
+		}
+		return card, queryError(selectPINCardSQL, err)
+	}
+	return card, nil
+}
+
+// checkPIN returns the outcome of the attempt in pinErr apart from err: the
+// failure counter written for a wrong PIN must be committed, not rolled back.
+func checkPIN(ctx context.Context, tx *sql.Tx, dialect Dialect, idCard int64, pin string) (card pinCard, pinErr error, err error) {
+	card, err = selectPINCard(ctx, tx, idCard)
+	if err != nil {
+		return card, nil, err
+	}
+	if card.status != CardActive {
+		return card, nil, ErrCardNotActive
+	}
+	if card.pin == "" {
+		return card, nil, ErrPINNotSet
+	}
+
+	ok, rehash, err := checkCardSecret(card.pin, cardSecretPIN, idCard, pin)
+	if err != nil {
+		return card, nil, err
+	}
+	if ok {
+		if rehash {
+			card.pin, err = hashCardSecret(cardSecretPIN, idCard, pin)
+			if err != nil {
+				return card, nil, err
+			}
+			_, err = tx.ExecContext(ctx, updatePINCardSQL, card.pin, idCard)
+			if err != nil {
+				return card, nil, queryError(updatePINCardSQL, err)
+			}
+			return card, nil, nil
+		}
+		if card.pinAttempts > 0 {
+			_, err = tx.ExecContext(ctx, updatePINAttemptsCardSQL, 0, idCard)
+			if err != nil {
+				return card, nil, queryError(updatePINAttemptsCardSQL, err)
+			}
+		}
+		return card, nil, nil
+	}
+
+	card.pinAttempts, err = incrementCardAttempts(ctx, tx, incrementPINAttemptsCardSQL, selectPINAttemptsCardSQL, idCard)
+	if err != nil {
+		return card, nil, err
+	}
+	name := OperationPINVerifyFailed
+	pinErr = ErrWrongPIN
+	if card.pinAttempts >= maxPINAttempts {
+		name = OperationPINBlocked
+		pinErr = ErrPINAttemptsExceeded
+		card.status, card.blockReason = CardBlocked, blockedByPIN
+		_, err = tx.ExecContext(ctx, blockCardSQL, card.status, card.blockReason, idCard)
+		if err != nil {
+			return card, nil, queryError(blockCardSQL, err)
+		}
+	}
+	_, err = logOperation(ctx, tx, dialect, name, time.Now(), card.numberCard, 0, card.userId)
+	if err != nil {
+		return card, nil, err
+	}
+	return card, pinErr, nil
+}
+
+func updatePIN(ctx context.Context, tx *sql.Tx, dialect Dialect, idCard int64, card pinCard, pin string, name OperationType) error {
+	pinHash, err := hashCardSecret(cardSecretPIN, idCard, pin)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, updatePINCardSQL, pinHash, idCard)
+	if err != nil {
+		return queryError(updatePINCardSQL, err)
+	}
+	_, err = logOperation(ctx, tx, dialect, name, time.Now(), card.numberCard, 0, card.userId)
+	return err
+}
@@ -0,0 +1,222 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestPIN(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		vasya := Session{UserId: 1}
+
+		err := VerifyPIN(1, "1234", db)
+		if !errors.Is(err, ErrPINNotSet) {
+			t.Errorf("Not ErrPINNotSet error: %v", err)
+		}
+		for _, pin := range []string{"123", "1234567", "12a4", ""} {
+			err = vasya.SetPIN(1, pin, db)
+			if !errors.Is(err, ErrInvalidPINFormat) {
+				t.Errorf("Not ErrInvalidPINFormat error for %q: %v", pin, err)
+			}
+		}
+		err = vasya.SetPIN(2, "1234", db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for foreign card: %v", err)
+		}
+		err = vasya.SetPIN(1, "1234", db)
+		if err != nil {
+			t.Errorf("can't set PIN: %v", err)
+		}
+		err = vasya.SetPIN(1, "4321", db)
+		if !errors.Is(err, ErrPINAlreadySet) {
+			t.Errorf("Not ErrPINAlreadySet error: %v", err)
+		}
+		var pinHash string
+		err = db.QueryRow(`SELECT pin FROM cards WHERE id = 1`).Scan(&pinHash)
+		if err != nil || pinHash == "" || pinHash == "1234" {
+			t.Errorf("PIN not stored hashed: %q, %v", pinHash, err)
+		}
+
+		err = VerifyPIN(1, "1234", db)
+		if err != nil {
+			t.Errorf("can't verify PIN: %v", err)
+		}
+		err = VerifyPIN(1, "0000", db)
+		if !errors.Is(err, ErrWrongPIN) {
+			t.Errorf("Not ErrWrongPIN error: %v", err)
+		}
+		var attempts int
+		err = db.QueryRow(`SELECT pinAttempts FROM cards WHERE id = 1`).Scan(&attempts)
+		if err != nil || attempts != 1 {
+			t.Errorf("failed attempt not counted: %d, %v", attempts, err)
+		}
+		err = VerifyPIN(1, "1234", db)
+		if err != nil {
+			t.Errorf("can't verify PIN: %v", err)
+		}
+		err = db.QueryRow(`SELECT pinAttempts FROM cards WHERE id = 1`).Scan(&attempts)
+		if err != nil || attempts != 0 {
+			t.Errorf("failed attempts not cleared: %d, %v", attempts, err)
+		}
+
+		err = ChangePIN(1, "1234", "56789", db)
+		if err != nil {
+			t.Errorf("can't change PIN: %v", err)
+		}
+		err = VerifyPIN(1, "1234", db)
+		if !errors.Is(err, ErrWrongPIN) {
+			t.Errorf("Not ErrWrongPIN error for old PIN: %v", err)
+		}
+		err = VerifyPIN(1, "56789", db)
+		if err != nil {
+			t.Errorf("can't verify changed PIN: %v", err)
+		}
+
+		opLogs, err := vasya.ViewOperationsLogging(db)
+		if err != nil || len(opLogs) != 4 || opLogs[0].Name != "pinSet" || opLogs[1].Name != "pinVerifyFailed" || opLogs[2].Name != "pinChanged" || opLogs[3].Name != "pinVerifyFailed" {
+			t.Errorf("operations logging not match: %v, %v", opLogs, err)
+		}
+	})
+}
+
+func TestPIN_Lockout(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		vasya := Session{UserId: 1}
+
+		err := vasya.SetPIN(1, "1234", db)
+		if err != nil {
+			t.Fatalf("can't set PIN: %v", err)
+		}
+		for i := 1; i < maxPINAttempts; i++ {
+			err = VerifyPIN(1, "0000", db)
+			if !errors.Is(err, ErrWrongPIN) {
+				t.Errorf("Not ErrWrongPIN error: %v", err)
+			}
+		}
+		err = VerifyPIN(1, "0000", db)
+		if !errors.Is(err, ErrPINAttemptsExceeded) {
+			t.Errorf("Not ErrPINAttemptsExceeded error: %v", err)
+		}
+		err = VerifyPIN(1, "1234", db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("Not ErrCardNotActive error for locked card: %v", err)
+		}
+		err = vasya.TransferMoney(1, 2, 50, db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("Not ErrCardNotActive error for transfer from locked card: %v", err)
+		}
+		opLogs, err := vasya.ViewOperationsLogging(db)
+		if err != nil || len(opLogs) != maxPINAttempts+1 || opLogs[maxPINAttempts].Name != "pinBlocked" {
+			t.Errorf("operations logging not match: %v, %v", opLogs, err)
+		}
+
+		err = ResetPINAttempts(1, db)
+		if err != nil {
+			t.Errorf("can't reset PIN attempts: %v", err)
+		}
+		err = VerifyPIN(1, "1234", db)
+		if err != nil {
+			t.Errorf("can't verify PIN after reset: %v", err)
+		}
+
+		err = BlockCard(1, db)
+		if err != nil {
+			t.Fatalf("can't block card: %v", err)
+		}
+		err = ResetPINAttempts(1, db)
+		if err != nil {
+			t.Errorf("can't reset PIN attempts: %v", err)
+		}
+		err = VerifyPIN(1, "1234", db)
+		if !errors.Is(err, ErrCardNotActive) {
+			t.Errorf("reset PIN attempts unblocked card blocked by manager: %v", err)
+		}
+		err = ResetPINAttempts(9, db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for unknown card: %v", err)
+		}
+	})
+}
+
+func TestPIN_Legacy(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		legacy, err := hashPassword("1234")
+		if err != nil {
+			t.Fatalf("can't hash PIN: %v", err)
+		}
+		_, err = db.Exec(`UPDATE cards SET pin = $1 WHERE id = 1`, legacy)
+		if err != nil {
+			t.Fatalf("can't set PIN: %v", err)
+		}
+		err = VerifyPIN(1, "1234", db)
+		if err != nil {
+			t.Errorf("can't verify legacy PIN: %v", err)
+		}
+		var stored string
+		err = db.QueryRow(`SELECT pin FROM cards WHERE id = 1`).Scan(&stored)
+		want, hashErr := hashCardSecret(cardSecretPIN, 1, "1234")
+		if err != nil || hashErr != nil || stored != want {
+			t.Errorf("legacy PIN not rehashed with the key: %s, %v, %v", stored, err, hashErr)
+		}
+		err = VerifyPIN(1, "1234", db)
+		if err != nil {
+			t.Errorf("can't verify rehashed PIN: %v", err)
+		}
+	})
+}
+
+func TestPIN_ConcurrentLockout(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		err := Session{UserId: 1}.SetPIN(1, "1234", db)
+		if err != nil {
+			t.Fatalf("can't set PIN: %v", err)
+		}
+		errs := make([]error, 2*maxPINAttempts)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = VerifyPIN(1, "0000", db)
+			}(i)
+		}
+		wg.Wait()
+
+		counts := make(map[error]int)
+		for _, err := range errs {
+			switch {
+			case errors.Is(err, ErrWrongPIN):
+				counts[ErrWrongPIN]++
+			case errors.Is(err, ErrPINAttemptsExceeded):
+				counts[ErrPINAttemptsExceeded]++
+			case errors.Is(err, ErrCardNotActive):
+				counts[ErrCardNotActive]++
+			default:
+				t.Errorf("unexpected error for wrong PIN: %v", err)
+			}
+		}
+		if counts[ErrWrongPIN] != maxPINAttempts-1 || counts[ErrPINAttemptsExceeded] != 1 || counts[ErrCardNotActive] != maxPINAttempts {
+			t.Errorf("concurrent wrong PINs not counted: %v", counts)
+		}
+		var attempts int
+		var status CardStatus
+		err = db.QueryRow(`SELECT pinAttempts, status FROM cards WHERE id = 1`).Scan(&attempts, &status)
+		if err != nil || attempts != maxPINAttempts || status != CardBlocked {
+			t.Errorf("card not blocked after concurrent wrong PINs: %d, %v, %v", attempts, status, err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Divergence is a card or service whose balance the operations log doesn't
+// account for.
+type Divergence struct {
+	Id      int64
+	Balance int64
+	Logged  int64
+}
+
+type ReconcileReport struct {
+	Cards    []Divergence
+	Services []Divergence
+	// SumTransferUsers should be the total of the translatedToSend
+	// operations, TransfersLogged.
+	SumTransferUsers int64
+	TransfersLogged  int64
+}
+
+func (receiver ReconcileReport) Consistent() bool {
+	return len(receiver.Cards) == 0 && len(receiver.Services) == 0 && receiver.SumTransferUsers == receiver.TransfersLogged
+}
+
+// ReconcileContext checks the card and service balances against the
+// operations logged for them since the ledger opened, on top of their
+// opening balances, and sumTransferUsers against every transfer logged.
+// Payments are matched to services by the service id logged with them in
+// servicePayments, so renaming a service keeps its payments.
+func ReconcileContext(ctx context.Context, db *sql.DB) (report ReconcileReport, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			report = ReconcileReport{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			report = ReconcileReport{}
+		}
+	}()
+
+	report.Cards, err = selectDivergences(ctx, tx, selectCardDivergencesSQL)
+	if err != nil {
+		return report, err
+	}
+	report.Services, err = selectDivergences(ctx, tx, selectServiceDivergencesSQL)
+	if err != nil {
+		return report, err
+	}
+	err = tx.QueryRowContext(ctx, selectLoggedTransfersSQL, OperationTransferSend).Scan(&report.SumTransferUsers, &report.TransfersLogged)
+	if err != nil {
+		return report, queryError(selectLoggedTransfersSQL, err)
+	}
+	return report, nil
+}
+
+func Reconcile(db *sql.DB) (ReconcileReport, error) {
+	return ReconcileContext(context.Background(), db)
+}
+
+func selectDivergences(ctx context.Context, tx *sql.Tx, query string) (divergences []Divergence, err error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, queryError(query, err)
+	}
+	defer func() {
+		if innerErr := rows.Close(); innerErr != nil {
+			divergences, err = nil, dbError(innerErr)
+		}
+	}()
+
+	for rows.Next() {
+		divergence := Divergence{}
+		err = rows.Scan(&divergence.Id, &divergence.Balance, &divergence.Logged)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		divergences = append(divergences, divergence)
+	}
+	if rows.Err() != nil {
+		return nil, dbError(rows.Err())
+	}
+	return divergences, nil
+}
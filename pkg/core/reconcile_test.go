@@ -0,0 +1,83 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openLedgerDb(t, driver)
+		defer closeDb()
+
+		report, err := Reconcile(db)
+		if err != nil {
+			t.Fatalf("can't reconcile: %v", err)
+		}
+		if report.Consistent() || report.SumTransferUsers != 50 || report.TransfersLogged != 0 {
+			t.Errorf("transfers without log not found: %+v", report)
+		}
+		_, err = db.Exec(`INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES ('translatedToSend', '', '2021600000000024', -50, 1)`)
+		if err != nil {
+			t.Fatalf("can't log transfer: %v", err)
+		}
+
+		vasya := Session{UserId: 1, Login: "vasya"}
+		_, err = vasya.Transfer(context.Background(), 1, RecipientByLogin("petya"), 50, db)
+		if err != nil {
+			t.Fatalf("can't transfer: %v", err)
+		}
+		_, err = vasya.PayService(1, 20, "Internet", nil, db)
+		if err != nil {
+			t.Fatalf("can't pay service: %v", err)
+		}
+		_, err = IssueCard("AlifMobi", 70, 2, db)
+		if err != nil {
+			t.Fatalf("can't issue card: %v", err)
+		}
+		err = UpdateService(Service{Id: 1, Name: "Internet Plus", Category: ServiceOther, Active: true}, db)
+		if err != nil {
+			t.Fatalf("can't rename service: %v", err)
+		}
+
+		report, err = Reconcile(db)
+		if err != nil || !report.Consistent() || report.TransfersLogged != 100 {
+			t.Errorf("balances not reconciled: %+v, %v", report, err)
+		}
+
+		_, err = db.Exec(`UPDATE cards SET balance = balance + 5 WHERE id = 1`)
+		if err != nil {
+			t.Fatalf("can't change card balance: %v", err)
+		}
+		_, err = db.Exec(`UPDATE sumTransferUsers SET balance = balance + 1`)
+		if err != nil {
+			t.Fatalf("can't change transfers sum: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES ('payToService', '', 'Internet Plus', -7, 1)`)
+		if err != nil {
+			t.Fatalf("can't log payment: %v", err)
+		}
+		_, err = db.Exec(`INSERT INTO servicePayments(operation_id, service_id) SELECT max(id), 1 FROM operationsLogging`)
+		if err != nil {
+			t.Fatalf("can't link payment: %v", err)
+		}
+
+		report, err = Reconcile(db)
+		if err != nil {
+			t.Fatalf("can't reconcile: %v", err)
+		}
+		want := ReconcileReport{
+			Cards:            []Divergence{{Id: 1, Balance: 135, Logged: 130}},
+			Services:         []Divergence{{Id: 1, Balance: 50, Logged: 57}},
+			SumTransferUsers: 101,
+			TransfersLogged:  100,
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("report not match: %+v, want %+v", report, want)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var ErrInvalidService = errors.New("invalid service")
+var ErrServiceNotActive = errors.New("service not active")
+var ErrAmountOutOfServiceLimits = errors.New("amount out of the service limits")
+
+type ServiceCategory string
+
+const (
+	ServiceMobile     ServiceCategory = "mobile"
+	ServiceUtilities  ServiceCategory = "utilities"
+	ServiceInternet   ServiceCategory = "internet"
+	ServiceGovernment ServiceCategory = "government"
+	ServiceOther      ServiceCategory = "other"
+)
+
+// ServiceFilter narrows GetAllServicesContext; the zero value keeps every
+// service.
+type ServiceFilter struct {
+	Category   ServiceCategory
+	ActiveOnly bool
+}
+
+func validServiceCategory(category ServiceCategory) bool {
+	switch category {
+	case ServiceMobile, ServiceUtilities, ServiceInternet, ServiceGovernment, ServiceOther:
+		return true
+	}
+	return false
+}
+
+// checkService refuses services without name or category, and payment
+// limits out of order; MaxAmount 0 is no limit.
+func checkService(service Service) error {
+	if service.Name == "" || !validServiceCategory(service.Category) {
+		return ErrInvalidService
+	}
+	if service.MinAmount < 0 || service.MaxAmount < 0 || service.MaxAmount > 0 && service.MaxAmount < service.MinAmount {
+		return ErrInvalidService
+	}
+	return nil
+}
+
+// checkServiceAmount refuses payments to inactive services and out of the
+// service limits.
+func checkServiceAmount(service Service, amount int64) error {
+	if !service.Active {
+		return ErrServiceNotActive
+	}
+	if amount < service.MinAmount || service.MaxAmount > 0 && amount > service.MaxAmount {
+		return ErrAmountOutOfServiceLimits
+	}
+	return nil
+}
+
+// UpdateServiceContext replaces the catalog data of the service
+// service.Id: name, category, description, active flag and payment limits.
+// The balance isn't touched.
+func UpdateServiceContext(ctx context.Context, service Service, db *sql.DB) error {
+	err := checkService(service)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, updateServiceSQL, service.Name, service.Category, service.Description, service.Active, service.MinAmount, service.MaxAmount, service.Id)
+	if err != nil {
+		return queryError(updateServiceSQL, err)
+	}
+	return serviceUpdated(result)
+}
+
+func UpdateService(service Service, db *sql.DB) error {
+	return UpdateServiceContext(context.Background(), service, db)
+}
+
+// DeactivateServiceContext stops the service from taking payments; it stays
+// in the catalog.
+func DeactivateServiceContext(ctx context.Context, id int64, db *sql.DB) error {
+	result, err := db.ExecContext(ctx, updateActiveServiceSQL, false, id)
+	if err != nil {
+		return queryError(updateActiveServiceSQL, err)
+	}
+	return serviceUpdated(result)
+}
+
+func DeactivateService(id int64, db *sql.DB) error {
+	return DeactivateServiceContext(context.Background(), id, db)
+}
+
+func serviceUpdated(result sql.Result) error {
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return dbError(err)
+	}
+	if updated == 0 {
+		return ErrServiceNotFound
+	}
+	return nil
+}
+
+func selectService(ctx context.Context, tx *sql.Tx, name string) (service Service, err error) {
+	err = tx.QueryRowContext(ctx, selectServiceSQL, name).Scan(&service.Id, &service.Name, &service.Balance, &service.Category, &service.Description, &service.Active, &service.MinAmount, &service.MaxAmount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return service, ErrServiceNotFound
+		}
+		return service, queryError(selectServiceSQL, err)
+	}
+	return service, nil
+}
@@ -0,0 +1,101 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestServiceCatalog(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		for _, name := range []string{"Megafon", "Internet", "Water"} {
+			if err := AddService(name, db); err != nil {
+				t.Fatalf("can't add service %s: %v", name, err)
+			}
+		}
+
+		services, err := GetAllServices(ServiceFilter{}, db)
+		if err != nil || len(services) != 3 {
+			t.Fatalf("services not match: %v, %v", services, err)
+		}
+		if want := (Service{Id: 1, Name: "Megafon", Category: ServiceOther, Active: true}); services[0] != want {
+			t.Errorf("new service not match: %v, want %v", services[0], want)
+		}
+
+		megafon := Service{Id: 1, Name: "Megafon", Category: ServiceMobile, Description: "Mobile top up", Active: true, MinAmount: 5, MaxAmount: 100}
+		updates := []Service{
+			megafon,
+			{Id: 2, Name: "Babilon-T", Category: ServiceInternet, Active: true},
+			{Id: 3, Name: "Water", Category: ServiceUtilities, Active: true, MinAmount: 10},
+		}
+		for _, service := range updates {
+			if err := UpdateService(service, db); err != nil {
+				t.Errorf("can't update service %v: %v", service, err)
+			}
+		}
+		invalid := []Service{
+			{Id: 1, Name: "", Category: ServiceMobile},
+			{Id: 1, Name: "Megafon", Category: "games"},
+			{Id: 1, Name: "Megafon", Category: ServiceMobile, MinAmount: -1},
+			{Id: 1, Name: "Megafon", Category: ServiceMobile, MinAmount: 10, MaxAmount: 5},
+		}
+		for _, service := range invalid {
+			if err := UpdateService(service, db); !errors.Is(err, ErrInvalidService) {
+				t.Errorf("Not ErrInvalidService error for %v: %v", service, err)
+			}
+		}
+		err = UpdateService(Service{Id: 9, Name: "Tcell", Category: ServiceMobile}, db)
+		if !errors.Is(err, ErrServiceNotFound) {
+			t.Errorf("Not ErrServiceNotFound error: %v", err)
+		}
+
+		services, err = GetAllServices(ServiceFilter{Category: ServiceMobile}, db)
+		if err != nil || !reflect.DeepEqual(services, []Service{megafon}) {
+			t.Errorf("mobile services not match: %v, %v", services, err)
+		}
+
+		vasya := Session{UserId: 1}
+		_, err = vasya.PayService(1, 4, "Megafon", nil, db)
+		if !errors.Is(err, ErrAmountOutOfServiceLimits) {
+			t.Errorf("Not ErrAmountOutOfServiceLimits error below minimum: %v", err)
+		}
+		_, err = vasya.PayService(1, 101, "Megafon", nil, db)
+		if !errors.Is(err, ErrAmountOutOfServiceLimits) {
+			t.Errorf("Not ErrAmountOutOfServiceLimits error above maximum: %v", err)
+		}
+		_, err = vasya.PayService(1, 100, "Megafon", nil, db)
+		if err != nil {
+			t.Errorf("can't pay service: %v", err)
+		}
+
+		err = DeactivateService(2, db)
+		if err != nil {
+			t.Errorf("can't deactivate service: %v", err)
+		}
+		err = DeactivateService(9, db)
+		if !errors.Is(err, ErrServiceNotFound) {
+			t.Errorf("Not ErrServiceNotFound error: %v", err)
+		}
+		err = vasya.TransferServices(1, 10, "Babilon-T", db)
+		if !errors.Is(err, ErrServiceNotActive) {
+			t.Errorf("Not ErrServiceNotActive error: %v", err)
+		}
+		services, err = GetAllServices(ServiceFilter{ActiveOnly: true}, db)
+		if err != nil || len(services) != 2 || services[0].Id != 1 || services[1].Id != 3 || services[0].Balance != 100 {
+			t.Errorf("active services not match: %v, %v", services, err)
+		}
+		services, err = GetAllServices(ServiceFilter{Category: ServiceInternet, ActiveOnly: true}, db)
+		if err != nil || len(services) != 0 {
+			t.Errorf("active internet services not match: %v, %v", services, err)
+		}
+		services, err = GetAllServices(ServiceFilter{Category: ServiceInternet}, db)
+		if err != nil || len(services) != 1 || services[0].Active {
+			t.Errorf("internet services not match: %v, %v", services, err)
+		}
+	})
+}
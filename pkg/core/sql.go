@@ -66,57 +66,440 @@ CREATE TABLE IF NOT EXISTS services
 );`
 
 const managerInitialData = `INSERT INTO manager(name, login, password)
-VALUES ('IBank', 'admin', 'boss')
+VALUES ('IBank', 'admin', '` + initialManagerPasswordHash + `')
        ON CONFLICT DO NOTHING;`
 const sumTransferUsersDDLInitialData = `INSERT INTO sumTransferUsers(id,balance)
 VALUES (1,0)
        ON CONFLICT DO NOTHING;`
 
-const loginManagerSQL = `SELECT login, password FROM manager WHERE login = ?`
-const loginUsersSQL = `SELECT id, login, password, hideShow FROM users WHERE login = ?`
+const loginManagerSQL = `SELECT login, password FROM manager WHERE login = $1`
+const loginUsersSQL = `SELECT id, login, password, hideShow FROM users WHERE login = $1`
 
-const selectBalanceSumTransferUsers = `SELECT balance FROM sumTransferUsers`
-const selectIdUserPhoneNumberSQL = `SELECT id FROM users WHERE phoneNumber = ?`
-const selectIdCardForTransferPhoneNumberSQL = `SELECT id FROM cards WHERE user_id= ?`
-const selectIdCardForTransferCountNumberSQL = `SELECT id FROM cards WHERE numberCard= ?`
-
-const selectIdUserLoginNumberSQL = `SELECT id FROM users WHERE login = ?`
-
-const getAllAtmsSQL = `SELECT id, name, address FROM atm;`
-const getAllServicesSQL = `SELECT id, name, balance FROM services;`
-const getAllCardsSQL = `SELECT id, name, balance, user_id, numberCard FROM cards;`
-const getAllUsersSQL = `SELECT id, name, passportSeries, phoneNumber FROM users;`
-const getUserCardsSQL = `SELECT id, name, balance, numberCard FROM cards WHERE user_id = ?`
-const getHideUserSQL = `SELECT id, name, passportSeries, phoneNumber FROM users WHERE hideShow = ?`
-const getOperationsLoggingUserSQL = `SELECT id, name, time, recipientSender, balance FROM operationsLogging WHERE user_id = ?`
-const getAllOperationsLoggingUserSQL = `SELECT id, name, time, recipientSender, balance FROM operationsLogging`
+const updatePasswordManagerSQL = `UPDATE manager SET password = $1 WHERE login = $2`
+const updatePasswordUserSQL = `UPDATE users SET password = $1 WHERE id = $2`
+const selectPasswordsManagerSQL = `SELECT login, password FROM manager`
+const revokeInitialManagerPasswordSQL = `UPDATE manager SET password = '' WHERE password = '` + initialManagerPasswordHash + `'`
 
-const insertAtmSQL = `INSERT INTO atm(name, address) VALUES ( :name, :address);`
-const insertServiceSQL = `INSERT INTO services(name , balance) VALUES( :name, :balance);`
-const insertCardSQL = `INSERT INTO cards(name, balance, user_id, numberCard) VALUES ( :name, :balance, :user_id, :numberCard);`
-const insertUserSQL = `INSERT INTO users(name, login, password, passportSeries, phoneNumber, hideShow) VALUES (:name , :login, :password, :passportSeries, :phoneNumber, :hideShow);`
-const insertOperationsLoggingSQL = `INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES (:name, :time, :recipientSender, :balance, :user_id);`
+const selectBalanceSumTransferUsers = `SELECT balance FROM sumTransferUsers`
+const selectIdUserPhoneNumberSQL = `SELECT id FROM users WHERE phoneNumber = $1`
+const selectIdCardForTransferCountNumberSQL = `SELECT id FROM cards WHERE numberCard= $1`
 
-const updateBalanceToCardSenderSQL = `UPDATE cards SET balance=? WHERE user_id = ?`
-const updateBalanceToCardRecipientSQL = `UPDATE cards SET balance=? WHERE id = ?`
-const updateBalanceSumTransferUsersSQL = `UPDATE sumTransferUsers SET balance = ?`
+const selectIdUserLoginNumberSQL = `SELECT id FROM users WHERE login = $1`
 
-const selectBalanceToCardSenderSQL = `SELECT balance FROM cards WHERE user_id = ?`
-const selectBalanceToCardRecipientSQL = `SELECT balance FROM cards WHERE id = ?`
-const selectNumberCardToIdCardSQL = `SELECT numberCard FROM cards WHERE id = ?`
-const selectNumberCardFromUser_idCardSQL = `SELECT numberCard FROM cards WHERE user_id = ?`
-const selectUser_idWhereIdCardSQL = `SELECT user_id FROM cards WHERE id = ?`
+const getAllAtmsSQL = `SELECT id, name, address, coalesce(latitude, 0), coalesce(longitude, 0), status FROM atm ORDER BY id`
+const getAllServicesSQL = `
+SELECT id, name, balance, category, description, active, minAmount, maxAmount
+FROM services
+WHERE ($1 = '' OR category = $1) AND (NOT $2 OR active)
+ORDER BY id`
+const getAllCardsSQL = `SELECT id, name, balance, user_id, numberCard, status, expiryMonth, expiryYear FROM cards ORDER BY id`
+const getAllUsersSQL = `SELECT id, name, passportSeries, phoneNumber FROM users ORDER BY id`
+const exportClientsSQL = `SELECT id, login, name, passportSeries, phoneNumber, hideShow FROM users;`
+const getUserCardsSQL = `SELECT id, name, balance, numberCard, status, expiryMonth, expiryYear FROM cards WHERE user_id = $1 ORDER BY id`
+const getHideUserSQL = `SELECT id, name, passportSeries, phoneNumber FROM users WHERE hideShow = $1 ORDER BY id`
+const getOperationsLoggingUserSQL = `SELECT id, name, time, recipientSender, balance, coalesce(atm_id, 0), coalesce(card_id, 0), coalesce(reference, '') FROM operationsLogging WHERE user_id = $1 ORDER BY id`
+const getAllOperationsLoggingUserSQL = `SELECT id, name, time, recipientSender, balance, coalesce(atm_id, 0), coalesce(card_id, 0), coalesce(reference, '') FROM operationsLogging ORDER BY id`
 
-const selectDescIdFromCardSQL = `SELECT id FROM cards ORDER BY id DESC LIMIT 1;`
+const insertAtmSQL = `INSERT INTO atm(name, address, latitude, longitude) VALUES ( $1, $2, $3, $4);`
+const insertServiceSQL = `INSERT INTO services(name , balance) VALUES( $1, $2);`
+const insertCardSQL = `INSERT INTO cards(name, balance, user_id, numberCard, expiryMonth, expiryYear) VALUES ( $1, $2, $3, $4, $5, $6);`
+const insertUserSQL = `INSERT INTO users(name, login, password, passportSeries, phoneNumber, hideShow) VALUES ($1 , $2, $3, $4, $5, $6);`
+const insertOperationsLoggingSQL = `INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id) VALUES ($1, $2, $3, $4, $5);`
+const insertCardOperationsLoggingSQL = `INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id, card_id) VALUES ($1, $2, $3, $4, $5, $6);`
 
-const selectBalanceOnServiceSQL = `SELECT balance FROM services WHERE name = ?`
-const updateBalanceServiceSQL = `UPDATE services SET balance=? WHERE name = ?`
+const selectBalanceToCardRecipientSQL = `SELECT balance FROM cards WHERE id = $1`
 
-const updateHideShowUser = `UPDATE users SET hideShow = ? WHERE id = ?`
+const updateHideShowUser = `UPDATE users SET hideShow = $1 WHERE id = $2`
 
-const searchUserForPhoneNumberSQL = `SELECT id, name, passportSeries, phoneNumber FROM users WHERE phoneNumber = ?`
+const searchUserForPhoneNumberSQL = `SELECT id, name, passportSeries, phoneNumber FROM users WHERE phoneNumber = $1`
 
 const staticCountUserSQL = `SELECT count(id) FROM users`
 const staticSumBalanceUsersSQL = `SELECT sum(balance) FROM cards`
 const staticBalanceOfServicesSQL = `SELECT sum(balance) FROM services`
 const staticBalanceOfServiceSQL = `SELECT name, balance FROM services`
+
+const selectCardForTransferSenderSQL = `SELECT balance, numberCard, status, expiryMonth, expiryYear FROM cards WHERE id = $1 AND user_id = $2`
+const selectCardForTransferRecipientSQL = `SELECT id, balance, numberCard, user_id, status, expiryMonth, expiryYear FROM cards WHERE id = $1`
+const selectDefaultCardIdUserSQL = `SELECT coalesce(defaultCard_id, (SELECT id FROM cards WHERE user_id = $1 AND status = 'active' ORDER BY id LIMIT 1)) FROM users WHERE id = $1`
+const updateDefaultCardUserSQL = `UPDATE users SET defaultCard_id = $1 WHERE id = $2 AND EXISTS (SELECT id FROM cards WHERE id = $1 AND user_id = $2 AND status = 'active')`
+const resetDefaultCardUserSQL = `UPDATE users SET defaultCard_id = NULL WHERE defaultCard_id = $1`
+const addBalanceToCardSQL = `UPDATE cards SET balance = balance + $1 WHERE id = $2`
+const addBalanceSumTransferUsersSQL = `UPDATE sumTransferUsers SET balance = balance + $1`
+
+const schemaMigrationsDDL = `
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version   INTEGER PRIMARY KEY,
+    name      TEXT NOT NULL,
+    appliedAt TEXT NOT NULL
+);`
+
+const getSchemaMigrationsSQL = `SELECT version, appliedAt FROM schema_migrations ORDER BY version`
+const countSchemaMigrationSQL = `SELECT count(version) FROM schema_migrations WHERE version = $1`
+const insertSchemaMigrationSQL = `INSERT INTO schema_migrations(version, name, appliedAt) VALUES ($1, $2, $3)`
+const deleteSchemaMigrationSQL = `DELETE FROM schema_migrations WHERE version = $1`
+
+const createUniqueNumberCardSQL = `CREATE UNIQUE INDEX IF NOT EXISTS cards_numberCard_key ON cards(numberCard)`
+const dropUniqueNumberCardSQL = `DROP INDEX IF EXISTS cards_numberCard_key`
+const selectNumberCardsSQL = `SELECT id, numberCard FROM cards ORDER BY id`
+const updateNumberCardSQL = `UPDATE cards SET numberCard = $1 WHERE id = $2`
+const updateIssuedCardSQL = `UPDATE cards SET numberCard = $1, cvv = $2 WHERE id = $3`
+
+const addDefaultCardUserSQL = `ALTER TABLE users ADD COLUMN defaultCard_id INTEGER REFERENCES cards(id)`
+
+const addExpiryMonthCardSQL = `ALTER TABLE cards ADD COLUMN expiryMonth INTEGER NOT NULL DEFAULT 0`
+const addExpiryYearCardSQL = `ALTER TABLE cards ADD COLUMN expiryYear INTEGER NOT NULL DEFAULT 0`
+const addCVVCardSQL = `ALTER TABLE cards ADD COLUMN cvv TEXT NOT NULL DEFAULT ''`
+const addStatusCardSQL = `ALTER TABLE cards ADD COLUMN status TEXT NOT NULL DEFAULT 'active' CHECK ( status IN ('active', 'blocked', 'expired', 'closed') )`
+const updateLegacyExpiryCardsSQL = `UPDATE cards SET expiryMonth = $1, expiryYear = $2 WHERE expiryYear = 0`
+
+const selectCVVCardSQL = `SELECT cvv, cvvAttempts, status, numberCard, user_id FROM cards WHERE id = $1`
+const selectStatusCardSQL = `SELECT status, expiryMonth, expiryYear FROM cards WHERE id = $1`
+const updateStatusCardSQL = `UPDATE cards SET status = $1 WHERE id = $2`
+const expireCardsSQL = `UPDATE cards SET status = $1 WHERE expiryYear > 0 AND (expiryYear < $2 OR expiryYear = $2 AND expiryMonth < $3) AND status IN ($4, $5)`
+
+const addPINCardSQL = `ALTER TABLE cards ADD COLUMN pin TEXT NOT NULL DEFAULT ''`
+const addPINAttemptsCardSQL = `ALTER TABLE cards ADD COLUMN pinAttempts INTEGER NOT NULL DEFAULT 0`
+
+const selectPINCardSQL = `SELECT pin, pinAttempts, status, blockReason, numberCard, user_id FROM cards WHERE id = $1`
+const updatePINCardSQL = `UPDATE cards SET pin = $1, pinAttempts = 0 WHERE id = $2`
+const updatePINAttemptsCardSQL = `UPDATE cards SET pinAttempts = $1 WHERE id = $2`
+const resetPINAttemptsCardSQL = `UPDATE cards SET pinAttempts = $1, status = $2, blockReason = $3 WHERE id = $4`
+const incrementPINAttemptsCardSQL = `UPDATE cards SET pinAttempts = pinAttempts + 1 WHERE id = $1 AND status = $2`
+const selectPINAttemptsCardSQL = `SELECT pinAttempts FROM cards WHERE id = $1`
+
+const addCVVAttemptsCardSQL = `ALTER TABLE cards ADD COLUMN cvvAttempts INTEGER NOT NULL DEFAULT 0`
+const updateCVVCardSQL = `UPDATE cards SET cvv = $1, cvvAttempts = 0 WHERE id = $2`
+const incrementCVVAttemptsCardSQL = `UPDATE cards SET cvvAttempts = cvvAttempts + 1 WHERE id = $1 AND status = $2`
+const selectCVVAttemptsCardSQL = `SELECT cvvAttempts FROM cards WHERE id = $1`
+const resetAttemptsCardSQL = `UPDATE cards SET pinAttempts = 0, cvvAttempts = 0, blockReason = '' WHERE id = $1`
+
+const addBlockReasonCardSQL = `ALTER TABLE cards ADD COLUMN blockReason TEXT NOT NULL DEFAULT ''`
+const blockCardSQL = `UPDATE cards SET status = $1, blockReason = $2 WHERE id = $3`
+const updateLegacyBlockReasonCardsSQL = `
+UPDATE cards
+SET blockReason = CASE WHEN pinAttempts >= $1 THEN $2 ELSE $3 END
+WHERE status = $4`
+
+const atmDenominationsDDL = `
+CREATE TABLE IF NOT EXISTS atmDenominations
+(
+    atm_id       INTEGER NOT NULL REFERENCES atm(id),
+    denomination INTEGER NOT NULL CHECK ( denomination > 0 ),
+    PRIMARY KEY (atm_id, denomination)
+);`
+
+const dropAtmDenominationsSQL = `DROP TABLE IF EXISTS atmDenominations`
+const addAtmOperationsLoggingSQL = `ALTER TABLE operationsLogging ADD COLUMN atm_id INTEGER REFERENCES atm(id)`
+
+const selectAtmSQL = `SELECT id, name, address, coalesce(latitude, 0), coalesce(longitude, 0), status FROM atm WHERE id = $1`
+const insertAtmOperationsLoggingSQL = `INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id, atm_id, card_id) VALUES ($1, $2, $3, $4, $5, $6, $7);`
+
+const addNotesAtmDenominationsSQL = `ALTER TABLE atmDenominations ADD COLUMN notes INTEGER NOT NULL DEFAULT 0 CHECK ( notes >= 0 )`
+
+const getAtmCassettesSQL = `SELECT denomination, notes FROM atmDenominations WHERE atm_id = $1 ORDER BY denomination DESC`
+const deleteAtmDenominationSQL = `DELETE FROM atmDenominations WHERE atm_id = $1 AND denomination = $2 AND notes = 0`
+const insertAtmCassetteSQL = `INSERT INTO atmDenominations(atm_id, denomination) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+const addNotesAtmCassetteSQL = `UPDATE atmDenominations SET notes = notes + $1 WHERE atm_id = $2 AND denomination = $3`
+const insertAtmCashOperationsLoggingSQL = `INSERT INTO operationsLogging(name, time, recipientSender, balance, atm_id) VALUES ($1, $2, $3, $4, $5);`
+const getLowCashAtmsSQL = `
+SELECT atm.id, atm.name, atm.address, coalesce(atm.latitude, 0), coalesce(atm.longitude, 0), atm.status,
+       coalesce(sum(atmDenominations.denomination * atmDenominations.notes), 0) AS cash
+FROM atm LEFT JOIN atmDenominations ON atmDenominations.atm_id = atm.id
+GROUP BY atm.id, atm.name, atm.address, atm.latitude, atm.longitude, atm.status
+HAVING coalesce(sum(atmDenominations.denomination * atmDenominations.notes), 0) < $1
+ORDER BY cash, atm.id`
+
+const addLatitudeAtmSQL = `ALTER TABLE atm ADD COLUMN latitude REAL CHECK ( latitude BETWEEN -90 AND 90 )`
+const addLongitudeAtmSQL = `ALTER TABLE atm ADD COLUMN longitude REAL CHECK ( longitude BETWEEN -180 AND 180 )`
+const createLatitudeAtmIndexSQL = `CREATE INDEX IF NOT EXISTS atm_latitude_idx ON atm(latitude)`
+const dropLatitudeAtmIndexSQL = `DROP INDEX IF EXISTS atm_latitude_idx`
+
+// getAtmsInLatitudeSQL reads the located ATMs between two latitudes with at
+// least the given cash and the status, if any; the distance itself is
+// computed in Go.
+const getAtmsInLatitudeSQL = `
+SELECT atm.id, atm.name, atm.address, atm.latitude, atm.longitude, atm.status,
+       coalesce(sum(atmDenominations.denomination * atmDenominations.notes), 0) AS cash
+FROM atm LEFT JOIN atmDenominations ON atmDenominations.atm_id = atm.id
+WHERE atm.latitude BETWEEN $1 AND $2 AND atm.longitude IS NOT NULL AND ($3 = '' OR atm.status = $3)
+GROUP BY atm.id, atm.name, atm.address, atm.latitude, atm.longitude, atm.status
+HAVING coalesce(sum(atmDenominations.denomination * atmDenominations.notes), 0) >= $4`
+
+const addStatusAtmSQL = `ALTER TABLE atm ADD COLUMN status TEXT NOT NULL DEFAULT 'online' CHECK ( status IN ('online', 'offline', 'out_of_service', 'maintenance') )`
+
+const atmWorkingHoursDDL = `
+CREATE TABLE IF NOT EXISTS atmWorkingHours
+(
+    atm_id  INTEGER NOT NULL REFERENCES atm(id),
+    weekday INTEGER NOT NULL CHECK ( weekday BETWEEN 0 AND 6 ),
+    opens   INTEGER NOT NULL CHECK ( opens BETWEEN 0 AND 1440 ),
+    closes  INTEGER NOT NULL CHECK ( closes BETWEEN 0 AND 1440 ),
+    PRIMARY KEY (atm_id, weekday)
+);`
+
+const atmMaintenanceDDL = `
+CREATE TABLE IF NOT EXISTS atmMaintenance
+(
+    id       INTEGER PRIMARY KEY AUTOINCREMENT,
+    atm_id   INTEGER NOT NULL REFERENCES atm(id),
+    startsAt TEXT NOT NULL,
+    endsAt   TEXT NOT NULL
+);`
+
+const atmStatusHistoryDDL = `
+CREATE TABLE IF NOT EXISTS atmStatusHistory
+(
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    atm_id         INTEGER NOT NULL REFERENCES atm(id),
+    previousStatus TEXT NOT NULL,
+    status         TEXT NOT NULL,
+    reason         TEXT NOT NULL,
+    changedAt      TEXT NOT NULL
+);`
+
+var dropAtmOperationalTables = []string{
+	`DROP TABLE IF EXISTS atmStatusHistory`,
+	`DROP TABLE IF EXISTS atmMaintenance`,
+	`DROP TABLE IF EXISTS atmWorkingHours`,
+}
+
+const updateStatusAtmSQL = `UPDATE atm SET status = $1 WHERE id = $2`
+const insertAtmStatusHistorySQL = `INSERT INTO atmStatusHistory(atm_id, previousStatus, status, reason, changedAt) VALUES ($1, $2, $3, $4, $5)`
+const getAtmStatusHistorySQL = `SELECT previousStatus, status, reason, changedAt FROM atmStatusHistory WHERE atm_id = $1 ORDER BY id`
+const deleteAtmWorkingHoursSQL = `DELETE FROM atmWorkingHours WHERE atm_id = $1`
+const insertAtmWorkingHoursSQL = `INSERT INTO atmWorkingHours(atm_id, weekday, opens, closes) VALUES ($1, $2, $3, $4)`
+const getAtmWorkingHoursSQL = `SELECT weekday, opens, closes FROM atmWorkingHours WHERE atm_id = $1 ORDER BY weekday`
+const insertAtmMaintenanceSQL = `INSERT INTO atmMaintenance(atm_id, startsAt, endsAt) VALUES ($1, $2, $3);`
+const getAtmMaintenanceSQL = `SELECT id, startsAt, endsAt FROM atmMaintenance WHERE atm_id = $1 AND endsAt > $2 ORDER BY startsAt, id`
+const countAtmMaintenanceAtSQL = `SELECT count(id) FROM atmMaintenance WHERE atm_id = $1 AND startsAt <= $2 AND endsAt > $2`
+
+const addCardOperationsLoggingSQL = `ALTER TABLE operationsLogging ADD COLUMN card_id INTEGER REFERENCES cards(id)`
+
+const atmReversalsDDL = `
+CREATE TABLE IF NOT EXISTS atmReversals
+(
+    operation_id INTEGER PRIMARY KEY REFERENCES operationsLogging(id),
+    reversal_id  INTEGER NOT NULL REFERENCES operationsLogging(id)
+);`
+
+const dropAtmReversalsSQL = `DROP TABLE IF EXISTS atmReversals`
+
+const selectCardByNumberSQL = `SELECT id, name, balance, user_id, numberCard, status, expiryMonth, expiryYear FROM cards WHERE numberCard = $1`
+const selectAtmOperationSQL = `SELECT name, coalesce(user_id, 0), coalesce(atm_id, 0), coalesce(card_id, 0), balance FROM operationsLogging WHERE id = $1`
+const countAtmReversalSQL = `SELECT count(operation_id) FROM atmReversals WHERE operation_id = $1`
+const insertAtmReversalSQL = `INSERT INTO atmReversals(operation_id, reversal_id) VALUES ($1, $2)`
+
+const atmWithdrawalNotesDDL = `
+CREATE TABLE IF NOT EXISTS atmWithdrawalNotes
+(
+    operation_id INTEGER NOT NULL REFERENCES operationsLogging(id),
+    denomination INTEGER NOT NULL,
+    notes        INTEGER NOT NULL,
+    PRIMARY KEY (operation_id, denomination)
+);`
+
+const dropAtmWithdrawalNotesSQL = `DROP TABLE IF EXISTS atmWithdrawalNotes`
+const insertAtmWithdrawalNotesSQL = `INSERT INTO atmWithdrawalNotes(operation_id, denomination, notes) VALUES ($1, $2, $3)`
+const getAtmWithdrawalNotesSQL = `SELECT denomination, notes FROM atmWithdrawalNotes WHERE operation_id = $1 ORDER BY denomination DESC`
+
+const servicePaymentsDDL = `
+CREATE TABLE IF NOT EXISTS servicePayments
+(
+    operation_id INTEGER PRIMARY KEY REFERENCES operationsLogging(id),
+    service_id   INTEGER NOT NULL REFERENCES services(id)
+);`
+
+const dropServicePaymentsSQL = `DROP TABLE IF EXISTS servicePayments`
+const servicePaymentsServiceIndexSQL = `CREATE INDEX IF NOT EXISTS servicePayments_service ON servicePayments(service_id)`
+const insertServicePaymentSQL = `INSERT INTO servicePayments(operation_id, service_id) VALUES ($1, $2)`
+
+// linkLegacyServicePaymentsSQL links the payments logged before
+// servicePayments to their services by the names the services have when
+// migrating. Names aren't unique: a payment goes to the first service with
+// its name.
+const linkLegacyServicePaymentsSQL = `
+INSERT INTO servicePayments(operation_id, service_id)
+SELECT o.id, (SELECT min(s.id) FROM services s WHERE s.name = o.recipientSender)
+FROM operationsLogging o
+WHERE o.name = $1
+  AND EXISTS (SELECT 1 FROM services s WHERE s.name = o.recipientSender)`
+
+const serviceFieldsDDL = `
+CREATE TABLE IF NOT EXISTS serviceFields
+(
+    service_id INTEGER NOT NULL REFERENCES services(id),
+    position   INTEGER NOT NULL,
+    name       TEXT    NOT NULL,
+    pattern    TEXT    NOT NULL,
+    minLength  INTEGER NOT NULL CHECK ( minLength >= 0 ),
+    maxLength  INTEGER NOT NULL CHECK ( maxLength >= 0 ),
+    PRIMARY KEY (service_id, name)
+);`
+
+const dropServiceFieldsSQL = `DROP TABLE IF EXISTS serviceFields`
+const addReferenceOperationsLoggingSQL = `ALTER TABLE operationsLogging ADD COLUMN reference TEXT`
+
+const deleteServiceFieldsSQL = `DELETE FROM serviceFields WHERE service_id = $1`
+const insertServiceFieldSQL = `INSERT INTO serviceFields(service_id, position, name, pattern, minLength, maxLength) VALUES ($1, $2, $3, $4, $5, $6)`
+const getServiceFieldsSQL = `SELECT name, pattern, minLength, maxLength FROM serviceFields WHERE service_id = $1 ORDER BY position`
+const addBalanceServiceByIdSQL = `UPDATE services SET balance = balance + $1 WHERE id = $2`
+const insertPaymentOperationsLoggingSQL = `INSERT INTO operationsLogging(name, time, recipientSender, balance, user_id, card_id, reference) VALUES ($1, $2, $3, $4, $5, $6, $7);`
+
+const addCategoryServicesSQL = `ALTER TABLE services ADD COLUMN category TEXT NOT NULL DEFAULT 'other' CHECK ( category IN ('mobile', 'utilities', 'internet', 'government', 'other') )`
+const addDescriptionServicesSQL = `ALTER TABLE services ADD COLUMN description TEXT NOT NULL DEFAULT ''`
+const addActiveServicesSQL = `ALTER TABLE services ADD COLUMN active INTEGER NOT NULL DEFAULT 1 CHECK ( active IN (0, 1) )`
+const addMinAmountServicesSQL = `ALTER TABLE services ADD COLUMN minAmount INTEGER NOT NULL DEFAULT 0 CHECK ( minAmount >= 0 )`
+const addMaxAmountServicesSQL = `ALTER TABLE services ADD COLUMN maxAmount INTEGER NOT NULL DEFAULT 0 CHECK ( maxAmount >= 0 )`
+
+const selectServiceSQL = `
+SELECT id, name, balance, category, description, active, minAmount, maxAmount
+FROM services
+WHERE name = $1
+ORDER BY id
+LIMIT 1`
+const updateServiceSQL = `UPDATE services SET name = $1, category = $2, description = $3, active = $4, minAmount = $5, maxAmount = $6 WHERE id = $7`
+const updateActiveServiceSQL = `UPDATE services SET active = $1 WHERE id = $2`
+
+const ledgerJournalDDL = `
+CREATE TABLE IF NOT EXISTS ledgerJournal
+(
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    operation_id INTEGER REFERENCES operationsLogging(id),
+    name         TEXT NOT NULL,
+    time         TEXT NOT NULL
+);`
+
+const ledgerPostingsDDL = `
+CREATE TABLE IF NOT EXISTS ledgerPostings
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    journal_id INTEGER NOT NULL REFERENCES ledgerJournal(id),
+    account    TEXT    NOT NULL,
+    amount     INTEGER NOT NULL CHECK ( amount <> 0 )
+);`
+
+const ledgerPostingsAccountIndexSQL = `CREATE INDEX IF NOT EXISTS ledgerPostings_account ON ledgerPostings(account)`
+const dropLedgerPostingsSQL = `DROP TABLE IF EXISTS ledgerPostings`
+const dropLedgerJournalSQL = `DROP TABLE IF EXISTS ledgerJournal`
+
+const insertLedgerJournalSQL = `INSERT INTO ledgerJournal(operation_id, name, time) VALUES ($1, $2, $3);`
+const insertLedgerPostingSQL = `INSERT INTO ledgerPostings(journal_id, account, amount) VALUES ($1, $2, $3)`
+const selectLedgerBalanceSQL = `SELECT coalesce(sum(amount), 0) FROM ledgerPostings WHERE account = $1`
+const selectUnbalancedJournalsSQL = `SELECT journal_id FROM ledgerPostings GROUP BY journal_id HAVING sum(amount) <> 0 ORDER BY journal_id`
+
+// The ledger accounts of cards and services are 'card:' and 'service:'
+// followed by the id, like CardAccount and ServiceAccount build them.
+const selectCardLedgerMismatchSQL = `
+SELECT c.id, c.balance, coalesce(-sum(p.amount), 0)
+FROM cards c LEFT JOIN ledgerPostings p ON p.account = 'card:' || c.id
+GROUP BY c.id, c.balance
+HAVING c.balance <> coalesce(-sum(p.amount), 0)
+ORDER BY c.id`
+const selectServiceLedgerMismatchSQL = `
+SELECT s.id, s.balance, coalesce(-sum(p.amount), 0)
+FROM services s LEFT JOIN ledgerPostings p ON p.account = 'service:' || s.id
+GROUP BY s.id, s.balance
+HAVING s.balance <> coalesce(-sum(p.amount), 0)
+ORDER BY s.id`
+const selectTransfersLedgerSQL = `
+SELECT (SELECT coalesce(sum(balance), 0) FROM sumTransferUsers),
+       (SELECT coalesce(sum(amount), 0) FROM ledgerPostings WHERE account = 'clearing:transfers' AND amount > 0)`
+
+// The opening journal of the ledger migration carries the balances kept
+// before it: a credit to every card and service, the transfers total
+// through the clearing account and the equity:opening debit balancing them.
+const insertOpeningCardPostingsSQL = `
+INSERT INTO ledgerPostings(journal_id, account, amount)
+SELECT (SELECT max(id) FROM ledgerJournal), 'card:' || id, -balance FROM cards WHERE balance <> 0`
+const insertOpeningServicePostingsSQL = `
+INSERT INTO ledgerPostings(journal_id, account, amount)
+SELECT (SELECT max(id) FROM ledgerJournal), 'service:' || id, -balance FROM services WHERE balance <> 0`
+const insertOpeningTransfersDebitSQL = `
+INSERT INTO ledgerPostings(journal_id, account, amount)
+SELECT (SELECT max(id) FROM ledgerJournal), 'clearing:transfers', balance FROM sumTransferUsers WHERE balance <> 0`
+const insertOpeningTransfersCreditSQL = `
+INSERT INTO ledgerPostings(journal_id, account, amount)
+SELECT (SELECT max(id) FROM ledgerJournal), 'clearing:transfers', -balance FROM sumTransferUsers WHERE balance <> 0`
+const insertOpeningEquityPostingSQL = `
+INSERT INTO ledgerPostings(journal_id, account, amount)
+SELECT (SELECT max(id) FROM ledgerJournal), 'equity:opening', amount
+FROM (SELECT -sum(amount) AS amount FROM ledgerPostings WHERE journal_id = (SELECT max(id) FROM ledgerJournal)) opening
+WHERE amount <> 0`
+const deleteEmptyOpeningJournalSQL = `
+DELETE FROM ledgerJournal
+WHERE id = (SELECT max(id) FROM ledgerJournal)
+  AND NOT EXISTS (SELECT id FROM ledgerPostings WHERE journal_id = ledgerJournal.id)`
+
+// Reconciliation starts from the balances of the journals without
+// operation, the ledger opening and issued cards, and adds the operations
+// logged since the first journal with one: earlier operations are in the
+// opening balances already.
+const selectCardDivergencesSQL = `
+SELECT id, balance, logged
+FROM (SELECT c.id AS id,
+             c.balance AS balance,
+             coalesce((SELECT -sum(p.amount)
+                       FROM ledgerPostings p JOIN ledgerJournal j ON j.id = p.journal_id
+                       WHERE j.operation_id IS NULL AND p.account = 'card:' || c.id), 0)
+             + coalesce((SELECT sum(o.balance)
+                         FROM operationsLogging o
+                         WHERE o.card_id = c.id AND o.id >= (SELECT min(operation_id) FROM ledgerJournal)), 0) AS logged
+      FROM cards c) reconciled
+WHERE balance <> logged
+ORDER BY id`
+const selectServiceDivergencesSQL = `
+SELECT id, balance, logged
+FROM (SELECT s.id AS id,
+             s.balance AS balance,
+             coalesce((SELECT -sum(p.amount)
+                       FROM ledgerPostings p JOIN ledgerJournal j ON j.id = p.journal_id
+                       WHERE j.operation_id IS NULL AND p.account = 'service:' || s.id), 0)
+             - coalesce((SELECT sum(o.balance)
+                         FROM operationsLogging o JOIN servicePayments sp ON sp.operation_id = o.id
+                         WHERE sp.service_id = s.id
+                           AND o.id >= (SELECT min(operation_id) FROM ledgerJournal)), 0) AS logged
+      FROM services s) reconciled
+WHERE balance <> logged
+ORDER BY id`
+const selectLoggedTransfersSQL = `
+SELECT (SELECT coalesce(sum(balance), 0) FROM sumTransferUsers),
+       (SELECT coalesce(-sum(balance), 0) FROM operationsLogging WHERE name = $1)`
+
+const addHashOperationsLoggingSQL = `ALTER TABLE operationsLogging ADD COLUMN hash TEXT`
+const addPrevHashOperationsLoggingSQL = `ALTER TABLE operationsLogging ADD COLUMN prevHash TEXT`
+
+const selectChainOperationsSQL = `
+SELECT id, name, time, recipientSender, coalesce(balance, 0), coalesce(user_id, 0), coalesce(atm_id, 0), coalesce(card_id, 0), coalesce(reference, ''),
+       coalesce(hash, ''), coalesce(prevHash, '')
+FROM operationsLogging
+ORDER BY id`
+const selectChainOperationsAfterSQL = `
+SELECT id, name, time, recipientSender, coalesce(balance, 0), coalesce(user_id, 0), coalesce(atm_id, 0), coalesce(card_id, 0), coalesce(reference, ''),
+       coalesce(hash, ''), coalesce(prevHash, '')
+FROM operationsLogging
+WHERE id > $1
+ORDER BY id`
+const selectHashOperationSQL = `SELECT coalesce(hash, '') FROM operationsLogging WHERE id = $1`
+const selectChainOperationSQL = `
+SELECT id, name, time, recipientSender, coalesce(balance, 0), coalesce(user_id, 0), coalesce(atm_id, 0), coalesce(card_id, 0), coalesce(reference, '')
+FROM operationsLogging
+WHERE id = $1`
+const selectPrevHashOperationSQL = `SELECT coalesce(hash, '') FROM operationsLogging WHERE id < $1 ORDER BY id DESC LIMIT 1`
+const updateHashOperationSQL = `UPDATE operationsLogging SET hash = $1, prevHash = $2 WHERE id = $3`
+
+const operationsLoggingTimeIndexSQL = `CREATE INDEX IF NOT EXISTS operationsLogging_time ON operationsLogging(time)`
+const dropOperationsLoggingTimeIndexSQL = `DROP INDEX IF EXISTS operationsLogging_time`
+const updateTimeOperationSQL = `UPDATE operationsLogging SET time = $1 WHERE id = $2`
+
+// queryOperationsSQL is completed by operationsQuery with the conditions
+// of the filter, the order and the limit.
+const queryOperationsSQL = `
+SELECT id, name, time, recipientSender, balance, coalesce(user_id, 0), coalesce(atm_id, 0), coalesce(card_id, 0), coalesce(reference, '')
+FROM operationsLogging`
+const operationsLoggingUserIndexSQL = `CREATE INDEX IF NOT EXISTS operationsLogging_user ON operationsLogging(user_id, id)`
+const operationsLoggingCardIndexSQL = `CREATE INDEX IF NOT EXISTS operationsLogging_card ON operationsLogging(card_id, id)`
+const operationsLoggingCounterpartyIndexSQL = `CREATE INDEX IF NOT EXISTS operationsLogging_counterparty ON operationsLogging(recipientSender, id)`
+const dropOperationsLoggingUserIndexSQL = `DROP INDEX IF EXISTS operationsLogging_user`
+const dropOperationsLoggingCardIndexSQL = `DROP INDEX IF EXISTS operationsLogging_card`
+const dropOperationsLoggingCounterpartyIndexSQL = `DROP INDEX IF EXISTS operationsLogging_counterparty`
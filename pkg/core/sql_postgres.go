@@ -0,0 +1,221 @@
+package core
+
+const managerPostgresDDL = `
+CREATE TABLE IF NOT EXISTS manager
+(
+    id      BIGSERIAL PRIMARY KEY,
+    name    TEXT    NOT NULL,
+    login   TEXT    NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);`
+
+const sumTransferUsersPostgresDDL = `
+CREATE TABLE IF NOT EXISTS sumTransferUsers
+(
+    id      BIGSERIAL PRIMARY KEY,
+    balance BIGINT NOT NULL
+);`
+
+const usersPostgresDDL = `
+CREATE TABLE IF NOT EXISTS users
+(
+    id      BIGSERIAL PRIMARY KEY,
+    name    TEXT    NOT NULL,
+    login   TEXT    NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+	passportSeries TEXT NOT NULL UNIQUE,
+	phoneNumber BIGINT NOT NULL,
+	hideShow INTEGER NOT NULL
+);`
+
+const operationsLoggingPostgresDDL = `
+CREATE TABLE IF NOT EXISTS operationsLogging
+(
+   id      BIGSERIAL PRIMARY KEY,
+   name    TEXT NOT NULL,
+   time    TEXT NOT NULL,
+   recipientSender TEXT NOT NULL,
+   balance BIGINT,
+   user_id BIGINT REFERENCES users(id)
+);`
+
+const atmPostgresDDL = `
+CREATE TABLE IF NOT EXISTS atm
+(
+    id      BIGSERIAL PRIMARY KEY,
+    name    TEXT    NOT NULL UNIQUE,
+    address TEXT NOT NULL
+);`
+
+const cardsPostgresDDL = `
+CREATE TABLE IF NOT EXISTS cards
+(
+   id      BIGSERIAL PRIMARY KEY,
+   numberCard TEXT NOT NULL,
+   name    TEXT    NOT NULL,
+   balance BIGINT NOT NULL CHECK ( balance > 0 ),
+   user_id BIGINT REFERENCES users(id)
+);`
+
+const servicesPostgresDDL = `
+CREATE TABLE IF NOT EXISTS services
+(
+   id      BIGSERIAL PRIMARY KEY,
+   name    TEXT    NOT NULL,
+   balance BIGINT NOT NULL 
+);`
+
+// lockSchemaMigrationsPostgresSQL serializes migrations of concurrent
+// processes until the end of the transaction.
+const lockSchemaMigrationsPostgresSQL = `SELECT pg_advisory_xact_lock(8583001)`
+
+const addDefaultCardUserPostgresSQL = `ALTER TABLE users ADD COLUMN IF NOT EXISTS defaultCard_id BIGINT REFERENCES cards(id)`
+const dropDefaultCardUserPostgresSQL = `ALTER TABLE users DROP COLUMN IF EXISTS defaultCard_id`
+
+const addExpiryMonthCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS expiryMonth INTEGER NOT NULL DEFAULT 0`
+const addExpiryYearCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS expiryYear INTEGER NOT NULL DEFAULT 0`
+const addCVVCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS cvv TEXT NOT NULL DEFAULT ''`
+const addStatusCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active' CHECK ( status IN ('active', 'blocked', 'expired', 'closed') )`
+const dropCardLifecyclePostgresSQL = `ALTER TABLE cards DROP COLUMN IF EXISTS expiryMonth, DROP COLUMN IF EXISTS expiryYear, DROP COLUMN IF EXISTS cvv, DROP COLUMN IF EXISTS status`
+
+const addPINCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS pin TEXT NOT NULL DEFAULT ''`
+const addPINAttemptsCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS pinAttempts INTEGER NOT NULL DEFAULT 0`
+const dropPINCardPostgresSQL = `ALTER TABLE cards DROP COLUMN IF EXISTS pin, DROP COLUMN IF EXISTS pinAttempts`
+
+const addCVVAttemptsCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS cvvAttempts INTEGER NOT NULL DEFAULT 0`
+const dropCVVAttemptsCardPostgresSQL = `ALTER TABLE cards DROP COLUMN IF EXISTS cvvAttempts`
+
+const addBlockReasonCardPostgresSQL = `ALTER TABLE cards ADD COLUMN IF NOT EXISTS blockReason TEXT NOT NULL DEFAULT ''`
+const dropBlockReasonCardPostgresSQL = `ALTER TABLE cards DROP COLUMN IF EXISTS blockReason`
+
+const atmDenominationsPostgresDDL = `
+CREATE TABLE IF NOT EXISTS atmDenominations
+(
+    atm_id       BIGINT NOT NULL REFERENCES atm(id),
+    denomination BIGINT NOT NULL CHECK ( denomination > 0 ),
+    PRIMARY KEY (atm_id, denomination)
+);`
+
+const addAtmOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging ADD COLUMN IF NOT EXISTS atm_id BIGINT REFERENCES atm(id)`
+const dropAtmOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging DROP COLUMN IF EXISTS atm_id`
+
+const addNotesAtmDenominationsPostgresSQL = `ALTER TABLE atmDenominations ADD COLUMN IF NOT EXISTS notes BIGINT NOT NULL DEFAULT 0 CHECK ( notes >= 0 )`
+const dropNotesAtmDenominationsPostgresSQL = `ALTER TABLE atmDenominations DROP COLUMN IF EXISTS notes`
+
+const addLatitudeAtmPostgresSQL = `ALTER TABLE atm ADD COLUMN IF NOT EXISTS latitude DOUBLE PRECISION CHECK ( latitude BETWEEN -90 AND 90 )`
+const addLongitudeAtmPostgresSQL = `ALTER TABLE atm ADD COLUMN IF NOT EXISTS longitude DOUBLE PRECISION CHECK ( longitude BETWEEN -180 AND 180 )`
+const dropLocationAtmPostgresSQL = `ALTER TABLE atm DROP COLUMN IF EXISTS latitude, DROP COLUMN IF EXISTS longitude`
+
+const addStatusAtmPostgresSQL = `ALTER TABLE atm ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'online' CHECK ( status IN ('online', 'offline', 'out_of_service', 'maintenance') )`
+const dropStatusAtmPostgresSQL = `ALTER TABLE atm DROP COLUMN IF EXISTS status`
+
+const atmWorkingHoursPostgresDDL = `
+CREATE TABLE IF NOT EXISTS atmWorkingHours
+(
+    atm_id  BIGINT NOT NULL REFERENCES atm(id),
+    weekday INTEGER NOT NULL CHECK ( weekday BETWEEN 0 AND 6 ),
+    opens   INTEGER NOT NULL CHECK ( opens BETWEEN 0 AND 1440 ),
+    closes  INTEGER NOT NULL CHECK ( closes BETWEEN 0 AND 1440 ),
+    PRIMARY KEY (atm_id, weekday)
+);`
+
+const atmMaintenancePostgresDDL = `
+CREATE TABLE IF NOT EXISTS atmMaintenance
+(
+    id       BIGSERIAL PRIMARY KEY,
+    atm_id   BIGINT NOT NULL REFERENCES atm(id),
+    startsAt TEXT NOT NULL,
+    endsAt   TEXT NOT NULL
+);`
+
+const atmStatusHistoryPostgresDDL = `
+CREATE TABLE IF NOT EXISTS atmStatusHistory
+(
+    id             BIGSERIAL PRIMARY KEY,
+    atm_id         BIGINT NOT NULL REFERENCES atm(id),
+    previousStatus TEXT NOT NULL,
+    status         TEXT NOT NULL,
+    reason         TEXT NOT NULL,
+    changedAt      TEXT NOT NULL
+);`
+
+const addCardOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging ADD COLUMN IF NOT EXISTS card_id BIGINT REFERENCES cards(id)`
+const dropCardOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging DROP COLUMN IF EXISTS card_id`
+
+const atmReversalsPostgresDDL = `
+CREATE TABLE IF NOT EXISTS atmReversals
+(
+    operation_id BIGINT PRIMARY KEY REFERENCES operationsLogging(id),
+    reversal_id  BIGINT NOT NULL REFERENCES operationsLogging(id)
+);`
+
+const servicePaymentsPostgresDDL = `
+CREATE TABLE IF NOT EXISTS servicePayments
+(
+    operation_id BIGINT PRIMARY KEY REFERENCES operationsLogging(id),
+    service_id   BIGINT NOT NULL REFERENCES services(id)
+);`
+
+const atmWithdrawalNotesPostgresDDL = `
+CREATE TABLE IF NOT EXISTS atmWithdrawalNotes
+(
+    operation_id BIGINT  NOT NULL REFERENCES operationsLogging(id),
+    denomination BIGINT  NOT NULL,
+    notes        INTEGER NOT NULL,
+    PRIMARY KEY (operation_id, denomination)
+);`
+
+const serviceFieldsPostgresDDL = `
+CREATE TABLE IF NOT EXISTS serviceFields
+(
+    service_id BIGINT  NOT NULL REFERENCES services(id),
+    position   INTEGER NOT NULL,
+    name       TEXT    NOT NULL,
+    pattern    TEXT    NOT NULL,
+    minLength  INTEGER NOT NULL CHECK ( minLength >= 0 ),
+    maxLength  INTEGER NOT NULL CHECK ( maxLength >= 0 ),
+    PRIMARY KEY (service_id, name)
+);`
+
+const addReferenceOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging ADD COLUMN IF NOT EXISTS reference TEXT`
+const dropReferenceOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging DROP COLUMN IF EXISTS reference`
+
+const addCatalogServicesPostgresSQL = `
+ALTER TABLE services
+    ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT 'other' CHECK ( category IN ('mobile', 'utilities', 'internet', 'government', 'other') ),
+    ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE,
+    ADD COLUMN IF NOT EXISTS minAmount BIGINT NOT NULL DEFAULT 0 CHECK ( minAmount >= 0 ),
+    ADD COLUMN IF NOT EXISTS maxAmount BIGINT NOT NULL DEFAULT 0 CHECK ( maxAmount >= 0 )`
+const dropCatalogServicesPostgresSQL = `
+ALTER TABLE services
+    DROP COLUMN IF EXISTS category,
+    DROP COLUMN IF EXISTS description,
+    DROP COLUMN IF EXISTS active,
+    DROP COLUMN IF EXISTS minAmount,
+    DROP COLUMN IF EXISTS maxAmount`
+
+const ledgerJournalPostgresDDL = `
+CREATE TABLE IF NOT EXISTS ledgerJournal
+(
+    id           BIGSERIAL PRIMARY KEY,
+    operation_id BIGINT REFERENCES operationsLogging(id),
+    name         TEXT NOT NULL,
+    time         TEXT NOT NULL
+);`
+
+const ledgerPostingsPostgresDDL = `
+CREATE TABLE IF NOT EXISTS ledgerPostings
+(
+    id         BIGSERIAL PRIMARY KEY,
+    journal_id BIGINT NOT NULL REFERENCES ledgerJournal(id),
+    account    TEXT   NOT NULL,
+    amount     BIGINT NOT NULL CHECK ( amount <> 0 )
+);`
+
+// lockOperationsChainPostgresSQL serializes the operations logged by
+// concurrent transactions, so that each chains to the one before it.
+const lockOperationsChainPostgresSQL = `SELECT pg_advisory_xact_lock(8583002)`
+
+const addChainOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging ADD COLUMN IF NOT EXISTS hash TEXT, ADD COLUMN IF NOT EXISTS prevHash TEXT`
+const dropChainOperationsLoggingPostgresSQL = `ALTER TABLE operationsLogging DROP COLUMN IF EXISTS hash, DROP COLUMN IF EXISTS prevHash`
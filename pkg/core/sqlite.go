@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
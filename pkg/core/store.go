@@ -0,0 +1,397 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Store is the storage behind the core operations. SQLStore keeps them in
+// the database, MemoryStore keeps them in process memory and needs neither
+// a database driver nor cgo.
+type Store interface {
+	UserStore
+	CardStore
+	AtmStore
+	ServiceStore
+	OperationStore
+	StatStore
+	LedgerStore
+}
+
+type UserStore interface {
+	LoginManager(ctx context.Context, login, password string) (bool, error)
+	LoginUsers(ctx context.Context, login, password string) (Session, bool, error)
+	AddUser(ctx context.Context, name, login, password, passportSeries string, phoneNumber int) error
+	GetAllUsers(ctx context.Context) ([]User, error)
+	SetManagerPassword(ctx context.Context, login, password string) error
+	SetUserPassword(ctx context.Context, userId int64, password string) error
+	UserHideManager(ctx context.Context, userId int) error
+	UserShowManager(ctx context.Context, userId int) error
+	GetHideUsers(ctx context.Context) ([]UserHide, error)
+	GetShowUsers(ctx context.Context) ([]UserShow, error)
+	SearchUserByPhoneNumber(ctx context.Context, phoneNumber int) ([]User, error)
+}
+
+type CardStore interface {
+	AddCard(ctx context.Context, name string, balance int64, userId int64) error
+	IssueCard(ctx context.Context, name string, balance int64, userId int64) (IssuedCard, error)
+	VerifyCVV(ctx context.Context, idCard int64, cvv string) error
+	BlockCard(ctx context.Context, idCard int64) error
+	UnblockCard(ctx context.Context, idCard int64) error
+	CloseCard(ctx context.Context, idCard int64) error
+	ExpireCards(ctx context.Context) (int64, error)
+	SetPIN(ctx context.Context, session Session, idCard int64, pin string) error
+	ChangePIN(ctx context.Context, idCard int64, oldPIN, newPIN string) error
+	VerifyPIN(ctx context.Context, idCard int64, pin string) error
+	ResetPINAttempts(ctx context.Context, idCard int64) error
+	GetAllCards(ctx context.Context) ([]Card, error)
+	CardByNumber(ctx context.Context, numberCard string) (Card, error)
+	GetUserCards(ctx context.Context, session Session) ([]Card, error)
+	SetDefaultCard(ctx context.Context, session Session, idCard int64) error
+	DefaultCard(ctx context.Context, session Session) (int64, error)
+}
+
+type AtmStore interface {
+	AddAtm(ctx context.Context, name, address string, latitude, longitude float64) error
+	GetAllAtms(ctx context.Context) ([]Atm, error)
+	SetAtmDenominations(ctx context.Context, atmId int64, denominations []int64) error
+	AtmDenominations(ctx context.Context, atmId int64) ([]int64, error)
+	AtmCassettes(ctx context.Context, atmId int64) ([]Cassette, error)
+	ReplenishAtm(ctx context.Context, atmId int64, notes []Cassette) error
+	CollectAtm(ctx context.Context, atmId int64) ([]Cassette, error)
+	LowCashAtms(ctx context.Context, threshold int64) ([]AtmCash, error)
+	FindNearestAtms(ctx context.Context, latitude, longitude, radiusKm float64, limit int, filter AtmFilter) ([]NearestAtm, error)
+	SetAtmStatus(ctx context.Context, atmId int64, status AtmStatus, reason string) error
+	AtmStatusHistory(ctx context.Context, atmId int64) ([]AtmStatusChange, error)
+	SetAtmWorkingHours(ctx context.Context, atmId int64, hours []WorkingHours) error
+	AtmWorkingHours(ctx context.Context, atmId int64) ([]WorkingHours, error)
+	ScheduleAtmMaintenance(ctx context.Context, atmId int64, startsAt, endsAt time.Time) (int64, error)
+	AtmMaintenanceWindows(ctx context.Context, atmId int64, at time.Time) ([]MaintenanceWindow, error)
+	AtmOperational(ctx context.Context, atmId int64, at time.Time) error
+}
+
+type ServiceStore interface {
+	AddService(ctx context.Context, name string) error
+	GetAllServices(ctx context.Context, filter ServiceFilter) ([]Service, error)
+	UpdateService(ctx context.Context, service Service) error
+	DeactivateService(ctx context.Context, id int64) error
+	SetServiceFields(ctx context.Context, name string, fields []ServiceField) error
+	ServiceFields(ctx context.Context, name string) ([]ServiceField, error)
+}
+
+type OperationStore interface {
+	Transfer(ctx context.Context, session Session, fromCardId int64, to RecipientRef, amount int64) (TransferResult, error)
+	TransferServices(ctx context.Context, session Session, fromCardId int64, currency int, name string) error
+	PayService(ctx context.Context, session Session, fromCardId int64, amount int64, name string, values map[string]string) (PaymentResult, error)
+	Withdraw(ctx context.Context, session Session, atmId int64, idCard int64, amount int64) (AtmOperationResult, error)
+	Deposit(ctx context.Context, session Session, atmId int64, idCard int64, amount int64) (AtmOperationResult, error)
+	ReverseAtmWithdrawal(ctx context.Context, atmId int64, operationId int64, idCard int64, amount int64) (AtmOperationResult, error)
+	ViewOperationsLogging(ctx context.Context, session Session) ([]OperationsLogging, error)
+	ViewOperationsLoggingToSearch(ctx context.Context, idUser int) ([]OperationsLogging, error)
+	ViewAllOperationsLogging(ctx context.Context) ([]OperationsLogging, error)
+	QueryOperations(ctx context.Context, filter OperationsFilter) (OperationsPage, error)
+	VerifyOperationsChain(ctx context.Context) (ChainReport, error)
+}
+
+type StatStore interface {
+	StaticCountUsers(ctx context.Context) (int, error)
+	StaticSumBalanceUsers(ctx context.Context) (int, error)
+	StaticBalanceOfServices(ctx context.Context) (int, error)
+	StaticBalanceSumTransfer(ctx context.Context) (int, error)
+}
+
+type LedgerStore interface {
+	LedgerBalance(ctx context.Context, account string) (int64, error)
+	VerifyLedger(ctx context.Context) (LedgerReport, error)
+	Reconcile(ctx context.Context) (ReconcileReport, error)
+}
+
+var _ Store = (*SQLStore)(nil)
+
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (receiver *SQLStore) LoginManager(ctx context.Context, login, password string) (bool, error) {
+	return LoginManagerContext(ctx, login, password, receiver.db)
+}
+
+func (receiver *SQLStore) LoginUsers(ctx context.Context, login, password string) (Session, bool, error) {
+	return LoginUsersContext(ctx, login, password, receiver.db)
+}
+
+func (receiver *SQLStore) AddUser(ctx context.Context, name, login, password, passportSeries string, phoneNumber int) error {
+	return AddUserContext(ctx, name, login, password, passportSeries, phoneNumber, receiver.db)
+}
+
+func (receiver *SQLStore) GetAllUsers(ctx context.Context) ([]User, error) {
+	return GetAllUsersContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) SetManagerPassword(ctx context.Context, login, password string) error {
+	return SetManagerPasswordContext(ctx, login, password, receiver.db)
+}
+
+func (receiver *SQLStore) SetUserPassword(ctx context.Context, userId int64, password string) error {
+	return SetUserPasswordContext(ctx, userId, password, receiver.db)
+}
+
+func (receiver *SQLStore) UserHideManager(ctx context.Context, userId int) error {
+	return UserHideManagerContext(ctx, userId, receiver.db)
+}
+
+func (receiver *SQLStore) UserShowManager(ctx context.Context, userId int) error {
+	return UserShowManagerContext(ctx, userId, receiver.db)
+}
+
+func (receiver *SQLStore) GetHideUsers(ctx context.Context) ([]UserHide, error) {
+	return GetHideUsersContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) GetShowUsers(ctx context.Context) ([]UserShow, error) {
+	return GetShowUsersContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) SearchUserByPhoneNumber(ctx context.Context, phoneNumber int) ([]User, error) {
+	return SearchUserByPhoneNumberContext(ctx, phoneNumber, receiver.db)
+}
+
+func (receiver *SQLStore) AddCard(ctx context.Context, name string, balance int64, userId int64) error {
+	return AddCardContext(ctx, name, balance, userId, receiver.db)
+}
+
+func (receiver *SQLStore) IssueCard(ctx context.Context, name string, balance int64, userId int64) (IssuedCard, error) {
+	return IssueCardContext(ctx, name, balance, userId, receiver.db)
+}
+
+func (receiver *SQLStore) VerifyCVV(ctx context.Context, idCard int64, cvv string) error {
+	return VerifyCVVContext(ctx, idCard, cvv, receiver.db)
+}
+
+func (receiver *SQLStore) BlockCard(ctx context.Context, idCard int64) error {
+	return BlockCardContext(ctx, idCard, receiver.db)
+}
+
+func (receiver *SQLStore) UnblockCard(ctx context.Context, idCard int64) error {
+	return UnblockCardContext(ctx, idCard, receiver.db)
+}
+
+func (receiver *SQLStore) CloseCard(ctx context.Context, idCard int64) error {
+	return CloseCardContext(ctx, idCard, receiver.db)
+}
+
+func (receiver *SQLStore) ExpireCards(ctx context.Context) (int64, error) {
+	return ExpireCardsContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) SetPIN(ctx context.Context, session Session, idCard int64, pin string) error {
+	return session.SetPINContext(ctx, idCard, pin, receiver.db)
+}
+
+func (receiver *SQLStore) ChangePIN(ctx context.Context, idCard int64, oldPIN, newPIN string) error {
+	return ChangePINContext(ctx, idCard, oldPIN, newPIN, receiver.db)
+}
+
+func (receiver *SQLStore) VerifyPIN(ctx context.Context, idCard int64, pin string) error {
+	return VerifyPINContext(ctx, idCard, pin, receiver.db)
+}
+
+func (receiver *SQLStore) ResetPINAttempts(ctx context.Context, idCard int64) error {
+	return ResetPINAttemptsContext(ctx, idCard, receiver.db)
+}
+
+func (receiver *SQLStore) GetAllCards(ctx context.Context) ([]Card, error) {
+	return GetAllCardsContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) CardByNumber(ctx context.Context, numberCard string) (Card, error) {
+	return CardByNumberContext(ctx, numberCard, receiver.db)
+}
+
+func (receiver *SQLStore) GetUserCards(ctx context.Context, session Session) ([]Card, error) {
+	return session.GetUserCardsContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) SetDefaultCard(ctx context.Context, session Session, idCard int64) error {
+	return session.SetDefaultCardContext(ctx, idCard, receiver.db)
+}
+
+func (receiver *SQLStore) DefaultCard(ctx context.Context, session Session) (int64, error) {
+	return session.DefaultCardContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) AddAtm(ctx context.Context, name, address string, latitude, longitude float64) error {
+	return AddAtmContext(ctx, name, address, latitude, longitude, receiver.db)
+}
+
+func (receiver *SQLStore) GetAllAtms(ctx context.Context) ([]Atm, error) {
+	return GetAllAtmsContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) SetAtmDenominations(ctx context.Context, atmId int64, denominations []int64) error {
+	return SetAtmDenominationsContext(ctx, atmId, denominations, receiver.db)
+}
+
+func (receiver *SQLStore) AtmDenominations(ctx context.Context, atmId int64) ([]int64, error) {
+	return AtmDenominationsContext(ctx, atmId, receiver.db)
+}
+
+func (receiver *SQLStore) AtmCassettes(ctx context.Context, atmId int64) ([]Cassette, error) {
+	return AtmCassettesContext(ctx, atmId, receiver.db)
+}
+
+func (receiver *SQLStore) ReplenishAtm(ctx context.Context, atmId int64, notes []Cassette) error {
+	return ReplenishAtmContext(ctx, atmId, notes, receiver.db)
+}
+
+func (receiver *SQLStore) CollectAtm(ctx context.Context, atmId int64) ([]Cassette, error) {
+	return CollectAtmContext(ctx, atmId, receiver.db)
+}
+
+func (receiver *SQLStore) LowCashAtms(ctx context.Context, threshold int64) ([]AtmCash, error) {
+	return LowCashAtmsContext(ctx, threshold, receiver.db)
+}
+
+func (receiver *SQLStore) FindNearestAtms(ctx context.Context, latitude, longitude, radiusKm float64, limit int, filter AtmFilter) ([]NearestAtm, error) {
+	return FindNearestAtmsContext(ctx, latitude, longitude, radiusKm, limit, filter, receiver.db)
+}
+
+func (receiver *SQLStore) SetAtmStatus(ctx context.Context, atmId int64, status AtmStatus, reason string) error {
+	return SetAtmStatusContext(ctx, atmId, status, reason, receiver.db)
+}
+
+func (receiver *SQLStore) AtmStatusHistory(ctx context.Context, atmId int64) ([]AtmStatusChange, error) {
+	return AtmStatusHistoryContext(ctx, atmId, receiver.db)
+}
+
+func (receiver *SQLStore) SetAtmWorkingHours(ctx context.Context, atmId int64, hours []WorkingHours) error {
+	return SetAtmWorkingHoursContext(ctx, atmId, hours, receiver.db)
+}
+
+func (receiver *SQLStore) AtmWorkingHours(ctx context.Context, atmId int64) ([]WorkingHours, error) {
+	return AtmWorkingHoursContext(ctx, atmId, receiver.db)
+}
+
+func (receiver *SQLStore) ScheduleAtmMaintenance(ctx context.Context, atmId int64, startsAt, endsAt time.Time) (int64, error) {
+	return ScheduleAtmMaintenanceContext(ctx, atmId, startsAt, endsAt, receiver.db)
+}
+
+func (receiver *SQLStore) AtmMaintenanceWindows(ctx context.Context, atmId int64, at time.Time) ([]MaintenanceWindow, error) {
+	return AtmMaintenanceWindowsContext(ctx, atmId, at, receiver.db)
+}
+
+func (receiver *SQLStore) AtmOperational(ctx context.Context, atmId int64, at time.Time) error {
+	return AtmOperationalContext(ctx, atmId, at, receiver.db)
+}
+
+func (receiver *SQLStore) AddService(ctx context.Context, name string) error {
+	return AddServiceContext(ctx, name, receiver.db)
+}
+
+func (receiver *SQLStore) GetAllServices(ctx context.Context, filter ServiceFilter) ([]Service, error) {
+	return GetAllServicesContext(ctx, filter, receiver.db)
+}
+
+func (receiver *SQLStore) UpdateService(ctx context.Context, service Service) error {
+	return UpdateServiceContext(ctx, service, receiver.db)
+}
+
+func (receiver *SQLStore) DeactivateService(ctx context.Context, id int64) error {
+	return DeactivateServiceContext(ctx, id, receiver.db)
+}
+
+func (receiver *SQLStore) SetServiceFields(ctx context.Context, name string, fields []ServiceField) error {
+	return SetServiceFieldsContext(ctx, name, fields, receiver.db)
+}
+
+func (receiver *SQLStore) ServiceFields(ctx context.Context, name string) ([]ServiceField, error) {
+	return ServiceFieldsContext(ctx, name, receiver.db)
+}
+
+func (receiver *SQLStore) Transfer(ctx context.Context, session Session, fromCardId int64, to RecipientRef, amount int64) (TransferResult, error) {
+	return session.Transfer(ctx, fromCardId, to, amount, receiver.db)
+}
+
+func (receiver *SQLStore) TransferServices(ctx context.Context, session Session, fromCardId int64, currency int, name string) error {
+	return session.TransferServicesContext(ctx, fromCardId, currency, name, receiver.db)
+}
+
+func (receiver *SQLStore) PayService(ctx context.Context, session Session, fromCardId int64, amount int64, name string, values map[string]string) (PaymentResult, error) {
+	return session.PayServiceContext(ctx, fromCardId, amount, name, values, receiver.db)
+}
+
+func (receiver *SQLStore) Withdraw(ctx context.Context, session Session, atmId int64, idCard int64, amount int64) (AtmOperationResult, error) {
+	return session.WithdrawContext(ctx, atmId, idCard, amount, receiver.db)
+}
+
+func (receiver *SQLStore) Deposit(ctx context.Context, session Session, atmId int64, idCard int64, amount int64) (AtmOperationResult, error) {
+	return session.DepositContext(ctx, atmId, idCard, amount, receiver.db)
+}
+
+func (receiver *SQLStore) ReverseAtmWithdrawal(ctx context.Context, atmId int64, operationId int64, idCard int64, amount int64) (AtmOperationResult, error) {
+	return ReverseAtmWithdrawalContext(ctx, atmId, operationId, idCard, amount, receiver.db)
+}
+
+func (receiver *SQLStore) ViewOperationsLogging(ctx context.Context, session Session) ([]OperationsLogging, error) {
+	return session.ViewOperationsLoggingContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) ViewOperationsLoggingToSearch(ctx context.Context, idUser int) ([]OperationsLogging, error) {
+	return ViewOperationsLoggingToSearchContext(ctx, idUser, receiver.db)
+}
+
+func (receiver *SQLStore) ViewAllOperationsLogging(ctx context.Context) ([]OperationsLogging, error) {
+	return ViewAllOperationsLoggingContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) QueryOperations(ctx context.Context, filter OperationsFilter) (OperationsPage, error) {
+	return QueryOperationsContext(ctx, filter, receiver.db)
+}
+
+func (receiver *SQLStore) VerifyOperationsChain(ctx context.Context) (ChainReport, error) {
+	return VerifyOperationsChainContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) StaticCountUsers(ctx context.Context) (int, error) {
+	return receiver.static(ctx, staticCountUserSQL)
+}
+
+func (receiver *SQLStore) StaticSumBalanceUsers(ctx context.Context) (int, error) {
+	return receiver.static(ctx, staticSumBalanceUsersSQL)
+}
+
+func (receiver *SQLStore) StaticBalanceOfServices(ctx context.Context) (int, error) {
+	return receiver.static(ctx, staticBalanceOfServicesSQL)
+}
+
+func (receiver *SQLStore) StaticBalanceSumTransfer(ctx context.Context) (int, error) {
+	return receiver.static(ctx, selectBalanceSumTransferUsers)
+}
+
+func (receiver *SQLStore) LedgerBalance(ctx context.Context, account string) (int64, error) {
+	return LedgerBalanceContext(ctx, account, receiver.db)
+}
+
+func (receiver *SQLStore) VerifyLedger(ctx context.Context) (LedgerReport, error) {
+	return VerifyLedgerContext(ctx, receiver.db)
+}
+
+func (receiver *SQLStore) Reconcile(ctx context.Context) (ReconcileReport, error) {
+	return ReconcileContext(ctx, receiver.db)
+}
+
+// static unlike the Static* functions reports query errors; sum over an
+// empty table is NULL and counts as zero.
+func (receiver *SQLStore) static(ctx context.Context, query string) (int, error) {
+	var value sql.NullInt64
+	err := receiver.db.QueryRowContext(ctx, query).Scan(&value)
+	if err != nil {
+		return 0, queryError(query, err)
+	}
+	return int(value.Int64), nil
+}
@@ -0,0 +1,29 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestSQLStore(t *testing.T) {
+	testStore(t, func(t *testing.T) (Store, func()) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("can't open db: %v", err)
+		}
+		db.SetMaxOpenConns(1)
+
+		err = Init(db)
+		if err != nil {
+			t.Fatalf("can't init db: %v", err)
+		}
+		return NewSQLStore(db), func() {
+			if err := db.Close(); err != nil {
+				t.Errorf("can't close db: %v", err)
+			}
+		}
+	})
+}
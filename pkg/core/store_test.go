@@ -0,0 +1,859 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) (Store, func()) {
+		return NewMemoryStore(), func() {}
+	})
+}
+
+// storeTests check every Store implementation feature by feature; each
+// test gets a store of its own, holding the same initial data as Init.
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, store Store)
+}{
+	{"managers", testStoreManagers},
+	{"users", testStoreUsers},
+	{"cards", testStoreCards},
+	{"concurrent card issue", testStoreConcurrentCards},
+	{"CVV lockout", testStoreCVVLockout},
+	{"transfers", testStoreTransfers},
+	{"services", testStoreServices},
+	{"PINs", testStorePINs},
+	{"atms", testStoreAtms},
+	{"atm status", testStoreAtmStatus},
+	{"operations", testStoreOperations},
+	{"statistics and ledger", testStoreLedger},
+}
+
+// testStore runs storeTests against the stores newStore opens; the
+// returned func closes them.
+func testStore(t *testing.T, newStore func(t *testing.T) (Store, func())) {
+	for _, test := range storeTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store, closeStore := newStore(t)
+			defer closeStore()
+			test.test(t, store)
+		})
+	}
+}
+
+// seedStore adds vasya with a card of 200, petya with a card of 400 and
+// kolya without card, and returns the session of vasya.
+func seedStore(t *testing.T, store Store) Session {
+	ctx := context.Background()
+	users := []struct {
+		name, login, passportSeries string
+		phoneNumber                 int
+	}{
+		{"Vasya", "vasya", "A132323", 9001},
+		{"Petya", "petya", "A000009", 9002},
+		{"Kolya", "kolya", "A000010", 9003},
+	}
+	for _, user := range users {
+		err := store.AddUser(ctx, user.name, user.login, "secret", user.passportSeries, user.phoneNumber)
+		if err != nil {
+			t.Fatalf("can't add user %s: %v", user.login, err)
+		}
+	}
+	for _, card := range []struct{ balance, userId int64 }{{200, 1}, {400, 2}} {
+		err := store.AddCard(ctx, "AlifMobi", card.balance, card.userId)
+		if err != nil {
+			t.Fatalf("can't add card: %v", err)
+		}
+	}
+	vasya, ok, err := store.LoginUsers(ctx, "vasya", "secret")
+	if err != nil || !ok || vasya.UserId != 1 {
+		t.Fatalf("can't login user: %v, %v", vasya, err)
+	}
+	return vasya
+}
+
+// seedAtm adds the ATM T1 paying notes of 50 and 20, with cassettes
+// holding 4 and 5 of them.
+func seedAtm(t *testing.T, store Store) Atm {
+	ctx := context.Background()
+	err := store.AddAtm(ctx, "T1", "rudaki 65", 38.5737, 68.7738)
+	if err != nil {
+		t.Fatalf("can't add atm: %v", err)
+	}
+	atms, err := store.GetAllAtms(ctx)
+	if err != nil || len(atms) != 1 {
+		t.Fatalf("atms not match: %v, %v", atms, err)
+	}
+	err = store.SetAtmDenominations(ctx, atms[0].Id, []int64{50, 20})
+	if err != nil {
+		t.Fatalf("can't set denominations: %v", err)
+	}
+	err = store.ReplenishAtm(ctx, atms[0].Id, []Cassette{{Denomination: 50, Notes: 4}, {Denomination: 20, Notes: 5}})
+	if err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+	return atms[0]
+}
+
+func testStoreManagers(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	_, err := store.LoginManager(ctx, "admin", seededManagerPassword)
+	if !errors.Is(err, ErrManagerPasswordNotSet) {
+		t.Errorf("Not ErrManagerPasswordNotSet error: %v", err)
+	}
+	err = store.SetManagerPassword(ctx, "admin", "9Lp-manager")
+	if err != nil {
+		t.Errorf("can't set manager password: %v", err)
+	}
+	ok, err := store.LoginManager(ctx, "admin", "9Lp-manager")
+	if err != nil || !ok {
+		t.Errorf("can't login seeded manager: %v", err)
+	}
+	_, err = store.LoginManager(ctx, "admin", "boss")
+	if !errors.Is(err, ErrInvalidPass) {
+		t.Errorf("Not ErrInvalidPass error: %v", err)
+	}
+	ok, err = store.LoginManager(ctx, "nobody", "9Lp-manager")
+	if err != nil || ok {
+		t.Errorf("logged in unknown manager: %v", err)
+	}
+}
+
+func testStoreUsers(t *testing.T, store Store) {
+	ctx := context.Background()
+	seedStore(t, store)
+
+	err := store.AddUser(ctx, "Vasya", "vasya", "secret", "A999999", 9009)
+	if err == nil {
+		t.Error("added user with existing login")
+	}
+	logins := []struct {
+		login, password string
+		err             error
+	}{
+		{"vasya", "secret", nil},
+		{"vasya", "password", ErrInvalidPass},
+	}
+	for _, login := range logins {
+		_, _, err = store.LoginUsers(ctx, login.login, login.password)
+		if !errors.Is(err, login.err) {
+			t.Errorf("login %s: got error %v, want %v", login.login, err, login.err)
+		}
+	}
+	err = store.UserHideManager(ctx, 3)
+	if err != nil {
+		t.Errorf("can't hide user: %v", err)
+	}
+	_, _, err = store.LoginUsers(ctx, "kolya", "secret")
+	if !errors.Is(err, ErrUserBlocked) {
+		t.Errorf("Not ErrUserBlocked error for hidden user: %v", err)
+	}
+	hidden, err := store.GetHideUsers(ctx)
+	if err != nil || len(hidden) != 1 || hidden[0].Id != 3 {
+		t.Errorf("hidden users not match: %v, %v", hidden, err)
+	}
+	err = store.UserShowManager(ctx, 3)
+	if err != nil {
+		t.Errorf("can't show user: %v", err)
+	}
+	_, _, err = store.LoginUsers(ctx, "kolya", "secret")
+	if err != nil {
+		t.Errorf("can't login shown user: %v", err)
+	}
+	found, err := store.SearchUserByPhoneNumber(ctx, 9002)
+	if err != nil || len(found) != 1 || found[0].Name != "Petya" {
+		t.Errorf("user by phone number not match: %v, %v", found, err)
+	}
+	users, err := store.GetAllUsers(ctx)
+	if err != nil || len(users) != 3 {
+		t.Errorf("users not match: %v, %v", users, err)
+	}
+	err = store.SetUserPassword(ctx, 1, "n3w-secret")
+	if err != nil {
+		t.Errorf("can't set user password: %v", err)
+	}
+	_, ok, err := store.LoginUsers(ctx, "vasya", "n3w-secret")
+	if err != nil || !ok {
+		t.Errorf("can't login with new password: %v", err)
+	}
+}
+
+func testStoreCards(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+
+	err := store.AddCard(ctx, "AlifMobi", 0, 2)
+	if !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("Not ErrInvalidAmount error for card with zero balance: %v", err)
+	}
+	cards, err := store.GetUserCards(ctx, vasya)
+	if err != nil || len(cards) != 1 || cards[0].Balance != 200 {
+		t.Fatalf("user cards not match: %v, %v", cards, err)
+	}
+	all, err := store.GetAllCards(ctx)
+	if err != nil || len(all) != 2 {
+		t.Errorf("all cards not match: %v, %v", all, err)
+	}
+
+	err = store.SetDefaultCard(ctx, vasya, 2)
+	if !errors.Is(err, ErrCardNotFound) {
+		t.Errorf("Not ErrCardNotFound error for foreign default card: %v", err)
+	}
+	err = store.SetDefaultCard(ctx, vasya, cards[0].Id)
+	if err != nil {
+		t.Errorf("can't set default card: %v", err)
+	}
+	idCard, err := store.DefaultCard(ctx, vasya)
+	if err != nil || idCard != cards[0].Id {
+		t.Errorf("default card not match: %v, %v", idCard, err)
+	}
+
+	issued, err := store.IssueCard(ctx, "AlifMobi", 100, 3)
+	if err != nil || !ValidCardNumber(issued.NumberCard) {
+		t.Fatalf("can't issue card: %v, %v", issued, err)
+	}
+	card, err := store.CardByNumber(ctx, issued.NumberCard)
+	if err != nil || card.Id != issued.Id || card.User_id != 3 || card.Balance != 100 {
+		t.Errorf("card by number not match: %v, %v", card, err)
+	}
+	_, err = store.CardByNumber(ctx, "2021600000000099")
+	if !errors.Is(err, ErrCardNotFound) {
+		t.Errorf("Not ErrCardNotFound error: %v", err)
+	}
+	err = store.VerifyCVV(ctx, issued.Id, issued.CVV)
+	if err != nil {
+		t.Errorf("can't verify CVV: %v", err)
+	}
+
+	steps := []struct {
+		name   string
+		change func(ctx context.Context, idCard int64) error
+		err    error
+		status CardStatus
+	}{
+		{"block", store.BlockCard, nil, CardBlocked},
+		{"unblock", store.UnblockCard, nil, CardActive},
+		{"block again", store.BlockCard, nil, CardBlocked},
+		{"close", store.CloseCard, nil, CardClosed},
+		{"unblock closed", store.UnblockCard, ErrInvalidCardStatus, CardClosed},
+	}
+	for _, step := range steps {
+		err = step.change(ctx, issued.Id)
+		if !errors.Is(err, step.err) {
+			t.Errorf("%s: got error %v, want %v", step.name, err, step.err)
+		}
+		card, err = store.CardByNumber(ctx, issued.NumberCard)
+		if err != nil || card.Status != step.status {
+			t.Errorf("%s: card status not match: %v, %v", step.name, card, err)
+		}
+	}
+	_, err = store.Transfer(ctx, Session{UserId: 3}, issued.Id, RecipientByLogin("petya"), 10)
+	if !errors.Is(err, ErrCardNotActive) {
+		t.Errorf("Not ErrCardNotActive error for transfer from closed card: %v", err)
+	}
+	_, err = store.Transfer(ctx, vasya, cards[0].Id, RecipientByLogin("kolya"), 10)
+	if !errors.Is(err, ErrRecipientHasNoCard) {
+		t.Errorf("Not ErrRecipientHasNoCard error for recipient with closed card: %v", err)
+	}
+}
+
+func testStoreCVVLockout(t *testing.T, store Store) {
+	ctx := context.Background()
+	seedStore(t, store)
+
+	issued, err := store.IssueCard(ctx, "AlifMobi", 100, 3)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+	wrong := "1000"
+	steps := []struct {
+		name string
+		cvv  string
+		err  error
+	}{
+		{"wrong", wrong, ErrInvalidCVV},
+		{"wrong again", wrong, ErrInvalidCVV},
+		{"right resets", issued.CVV, nil},
+		{"wrong after reset", wrong, ErrInvalidCVV},
+		{"wrong second", wrong, ErrInvalidCVV},
+		{"wrong third", wrong, ErrCVVAttemptsExceeded},
+		{"right on blocked card", issued.CVV, ErrCardNotActive},
+	}
+	for _, step := range steps {
+		err = store.VerifyCVV(ctx, issued.Id, step.cvv)
+		if !errors.Is(err, step.err) {
+			t.Errorf("%s: got error %v, want %v", step.name, err, step.err)
+		}
+	}
+	card, err := store.CardByNumber(ctx, issued.NumberCard)
+	if err != nil || card.Status != CardBlocked {
+		t.Errorf("card not blocked after wrong CVVs: %v, %v", card, err)
+	}
+
+	err = store.UnblockCard(ctx, issued.Id)
+	if err != nil {
+		t.Fatalf("can't unblock card: %v", err)
+	}
+	err = store.VerifyCVV(ctx, issued.Id, wrong)
+	if !errors.Is(err, ErrInvalidCVV) {
+		t.Errorf("wrong CVVs not cleared by unblock: %v", err)
+	}
+}
+
+func testStoreConcurrentCards(t *testing.T, store Store) {
+	ctx := context.Background()
+	seedStore(t, store)
+
+	cards := make([]IssuedCard, 10)
+	var wg sync.WaitGroup
+	for i := range cards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			cards[i], err = store.IssueCard(ctx, "AlifMobi", 100, 3)
+			if err != nil {
+				t.Errorf("can't issue card: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	numbers := make(map[string]bool)
+	for _, issued := range cards {
+		card, err := store.CardByNumber(ctx, issued.NumberCard)
+		if err != nil || card.Id != issued.Id || numbers[issued.NumberCard] {
+			t.Errorf("issued card number not unique: %v, %v", issued, err)
+		}
+		numbers[issued.NumberCard] = true
+	}
+}
+
+func testStoreTransfers(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+
+	result, err := store.Transfer(ctx, vasya, 1, RecipientByLogin("petya"), 50)
+	if err != nil || result.RecipientCardId != 2 || result.SenderBalance != 150 || result.RecipientBalance != 450 {
+		t.Errorf("transfer result not match: %v, %v", result, err)
+	}
+	tests := []struct {
+		name       string
+		fromCardId int64
+		to         RecipientRef
+		amount     int64
+		err        error
+	}{
+		{"by phone number", 0, RecipientByPhoneNumber(9002), 10, nil},
+		{"by card number", 1, RecipientByNumberCard(cardNumber(t, store, 2)), 10, nil},
+		{"insufficient funds", 1, RecipientByLogin("petya"), 500, ErrInsufficientFunds},
+		{"whole balance", 1, RecipientByLogin("petya"), 130, ErrInsufficientFunds},
+		{"invalid amount", 1, RecipientByLogin("petya"), 0, ErrInvalidAmount},
+		{"foreign card", 2, RecipientByLogin("petya"), 10, ErrCardNotFound},
+		{"same card", 1, RecipientByLogin("vasya"), 10, ErrSameCard},
+		{"unknown recipient", 1, RecipientByLogin("nobody"), 10, ErrRecipientNotFound},
+		{"recipient without card", 1, RecipientByLogin("kolya"), 10, ErrRecipientHasNoCard},
+		{"no recipient", 1, RecipientRef{}, 10, ErrInvalidRecipient},
+		{"ambiguous recipient", 1, RecipientRef{PhoneNumber: 9002, Login: "petya"}, 10, ErrInvalidRecipient},
+	}
+	for _, test := range tests {
+		_, err = store.Transfer(ctx, vasya, test.fromCardId, test.to, test.amount)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	cards, err := store.GetAllCards(ctx)
+	if err != nil || len(cards) != 2 || cards[0].Balance != 130 || cards[1].Balance != 470 {
+		t.Errorf("card balances not match: %v, %v", cards, err)
+	}
+	sum, err := store.StaticBalanceSumTransfer(ctx)
+	if err != nil || sum != 70 {
+		t.Errorf("sumTransferUsers not match: %d, %v", sum, err)
+	}
+	clearing, err := store.LedgerBalance(ctx, ClearingTransfersAccount)
+	if err != nil || clearing != 0 {
+		t.Errorf("clearing balance not match: %d, %v", clearing, err)
+	}
+}
+
+func cardNumber(t *testing.T, store Store, idCard int64) string {
+	cards, err := store.GetAllCards(context.Background())
+	if err != nil {
+		t.Fatalf("can't get cards: %v", err)
+	}
+	for _, card := range cards {
+		if card.Id == idCard {
+			return card.NumberCard
+		}
+	}
+	t.Fatalf("card %d not found", idCard)
+	return ""
+}
+
+func testStoreServices(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+
+	err := store.AddService(ctx, "Internet")
+	if err != nil {
+		t.Fatalf("can't add service: %v", err)
+	}
+	err = store.TransferServices(ctx, vasya, 1, 20, "Internet")
+	if err != nil {
+		t.Errorf("can't pay service: %v", err)
+	}
+	err = store.UpdateService(ctx, Service{Id: 1, Name: "Internet", Category: ServiceInternet, Active: true, MinAmount: 5})
+	if err != nil {
+		t.Errorf("can't update service: %v", err)
+	}
+	services, err := store.GetAllServices(ctx, ServiceFilter{Category: ServiceInternet})
+	if err != nil || len(services) != 1 || services[0].Balance != 20 || services[0].MinAmount != 5 {
+		t.Errorf("internet services not match: %v, %v", services, err)
+	}
+	services, err = store.GetAllServices(ctx, ServiceFilter{Category: ServiceMobile})
+	if err != nil || len(services) != 0 {
+		t.Errorf("mobile services not match: %v, %v", services, err)
+	}
+	err = store.SetServiceFields(ctx, "Internet", []ServiceField{{Name: "contract", Pattern: `\d+`, MaxLength: 8}})
+	if err != nil {
+		t.Errorf("can't set service fields: %v", err)
+	}
+	fields, err := store.ServiceFields(ctx, "Internet")
+	if err != nil || len(fields) != 1 || fields[0].MaxLength != 8 {
+		t.Errorf("service fields not match: %v, %v", fields, err)
+	}
+
+	contract := map[string]string{"contract": "17"}
+	tests := []struct {
+		name    string
+		service string
+		amount  int64
+		values  map[string]string
+		err     error
+	}{
+		{"unknown service", "Water", 20, contract, ErrServiceNotFound},
+		{"under limit", "Internet", 4, contract, ErrAmountOutOfServiceLimits},
+		{"missing field", "Internet", 20, nil, ErrMissingPaymentField},
+		{"invalid field", "Internet", 20, map[string]string{"contract": "A17"}, ErrInvalidPaymentField},
+		{"insufficient funds", "Internet", 10000, contract, ErrInsufficientFunds},
+		{"whole balance", "Internet", 180, contract, ErrInsufficientFunds},
+		{"invalid amount", "Internet", -10, contract, ErrInvalidAmount},
+	}
+	for _, test := range tests {
+		_, err = store.PayService(ctx, vasya, 0, test.amount, test.service, test.values)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	payment, err := store.PayService(ctx, vasya, 0, 10, "Internet", contract)
+	if err != nil || payment.Reference != "contract=17" || payment.CardBalance != 170 {
+		t.Errorf("can't pay service: %v, %v", payment, err)
+	}
+	opLogs, err := store.ViewOperationsLogging(ctx, vasya)
+	if err != nil || len(opLogs) != 2 || opLogs[1].Reference != "contract=17" || opLogs[1].Name != OperationPayService {
+		t.Errorf("payment not logged: %v, %v", opLogs, err)
+	}
+	err = store.DeactivateService(ctx, 1)
+	if err != nil {
+		t.Errorf("can't deactivate service: %v", err)
+	}
+	_, err = store.PayService(ctx, vasya, 0, 10, "Internet", contract)
+	if !errors.Is(err, ErrServiceNotActive) {
+		t.Errorf("Not ErrServiceNotActive error: %v", err)
+	}
+	services, err = store.GetAllServices(ctx, ServiceFilter{ActiveOnly: true})
+	if err != nil || len(services) != 0 {
+		t.Errorf("active services not match: %v, %v", services, err)
+	}
+}
+
+func testStorePINs(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+
+	err := store.VerifyPIN(ctx, 1, "1234")
+	if !errors.Is(err, ErrPINNotSet) {
+		t.Errorf("Not ErrPINNotSet error: %v", err)
+	}
+	err = store.SetPIN(ctx, vasya, 1, "12a4")
+	if !errors.Is(err, ErrInvalidPINFormat) {
+		t.Errorf("Not ErrInvalidPINFormat error: %v", err)
+	}
+	err = store.SetPIN(ctx, vasya, 2, "1234")
+	if !errors.Is(err, ErrCardNotFound) {
+		t.Errorf("Not ErrCardNotFound error for foreign card: %v", err)
+	}
+	err = store.SetPIN(ctx, vasya, 1, "1234")
+	if err != nil {
+		t.Errorf("can't set PIN: %v", err)
+	}
+	err = store.SetPIN(ctx, vasya, 1, "1234")
+	if !errors.Is(err, ErrPINAlreadySet) {
+		t.Errorf("Not ErrPINAlreadySet error: %v", err)
+	}
+	err = store.VerifyPIN(ctx, 1, "1234")
+	if err != nil {
+		t.Errorf("can't verify PIN: %v", err)
+	}
+	for i := 1; i < maxPINAttempts; i++ {
+		err = store.VerifyPIN(ctx, 1, "0000")
+		if !errors.Is(err, ErrWrongPIN) {
+			t.Errorf("Not ErrWrongPIN error: %v", err)
+		}
+	}
+	err = store.ChangePIN(ctx, 1, "0000", "4321")
+	if !errors.Is(err, ErrPINAttemptsExceeded) {
+		t.Errorf("Not ErrPINAttemptsExceeded error: %v", err)
+	}
+	err = store.VerifyPIN(ctx, 1, "1234")
+	if !errors.Is(err, ErrCardNotActive) {
+		t.Errorf("Not ErrCardNotActive error for blocked card: %v", err)
+	}
+	err = store.ResetPINAttempts(ctx, 1)
+	if err != nil {
+		t.Errorf("can't reset PIN attempts: %v", err)
+	}
+	err = store.ChangePIN(ctx, 1, "1234", "4321")
+	if err != nil {
+		t.Errorf("can't change PIN: %v", err)
+	}
+	err = store.VerifyPIN(ctx, 1, "4321")
+	if err != nil {
+		t.Errorf("can't verify changed PIN: %v", err)
+	}
+
+	for i := 0; i < maxPINAttempts; i++ {
+		err = store.VerifyPIN(ctx, 1, "0000")
+	}
+	if !errors.Is(err, ErrPINAttemptsExceeded) {
+		t.Errorf("Not ErrPINAttemptsExceeded error: %v", err)
+	}
+	err = store.BlockCard(ctx, 1)
+	if err != nil {
+		t.Errorf("can't block card: %v", err)
+	}
+	err = store.ResetPINAttempts(ctx, 1)
+	if err != nil {
+		t.Errorf("can't reset PIN attempts: %v", err)
+	}
+	err = store.VerifyPIN(ctx, 1, "4321")
+	if !errors.Is(err, ErrCardNotActive) {
+		t.Errorf("reset PIN attempts unblocked card blocked by manager: %v", err)
+	}
+	err = store.UnblockCard(ctx, 1)
+	if err != nil {
+		t.Errorf("can't unblock card: %v", err)
+	}
+	err = store.VerifyPIN(ctx, 1, "0000")
+	if !errors.Is(err, ErrWrongPIN) {
+		t.Errorf("wrong PINs not cleared by unblock: %v", err)
+	}
+	err = store.VerifyPIN(ctx, 1, "4321")
+	if err != nil {
+		t.Errorf("can't verify PIN after unblock: %v", err)
+	}
+}
+
+func testStoreAtms(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+
+	_, err := store.Withdraw(ctx, vasya, 1, 0, 40)
+	if !errors.Is(err, ErrAtmNotFound) {
+		t.Errorf("Not ErrAtmNotFound error: %v", err)
+	}
+	atm := seedAtm(t, store)
+	err = store.AddAtm(ctx, "T1", "somoni 77", 38.5812, 68.7712)
+	if err == nil {
+		t.Error("added atm with existing name")
+	}
+	nearest, err := store.FindNearestAtms(ctx, 38.5760, 68.7730, 1, 0, AtmFilter{})
+	if err != nil || len(nearest) != 1 || nearest[0].Atm.Name != "T1" || nearest[0].DistanceKm > 1 {
+		t.Errorf("nearest atms not match: %v, %v", nearest, err)
+	}
+	nearest, err = store.FindNearestAtms(ctx, 38.5760, 68.7730, 1, 0, AtmFilter{MinCash: 1000})
+	if err != nil || len(nearest) != 0 {
+		t.Errorf("nearest atms with cash not match: %v, %v", nearest, err)
+	}
+	denominations, err := store.AtmDenominations(ctx, atm.Id)
+	if err != nil || !reflect.DeepEqual(denominations, []int64{50, 20}) {
+		t.Errorf("denominations not match: %v, %v", denominations, err)
+	}
+
+	withdrawal, err := store.Withdraw(ctx, vasya, atm.Id, 0, 40)
+	if err != nil || withdrawal.CardBalance != 160 || !reflect.DeepEqual(withdrawal.Notes, []Cassette{{Denomination: 20, Notes: 2}}) {
+		t.Errorf("can't withdraw: %v, %v", withdrawal, err)
+	}
+	tests := []struct {
+		name   string
+		amount int64
+		err    error
+	}{
+		{"not in denominations", 30, ErrAmountNotInDenominations},
+		{"whole balance", 160, ErrInsufficientFunds},
+		{"insufficient funds", 1000, ErrInsufficientFunds},
+		{"invalid amount", -20, ErrInvalidAmount},
+	}
+	for _, test := range tests {
+		_, err = store.Withdraw(ctx, vasya, atm.Id, 0, test.amount)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+	deposit, err := store.Deposit(ctx, vasya, atm.Id, 0, 40)
+	if err != nil || deposit.CardBalance != 200 {
+		t.Errorf("can't deposit: %v, %v", deposit, err)
+	}
+	_, err = store.ReverseAtmWithdrawal(ctx, atm.Id+1, withdrawal.OperationId, 1, 40)
+	if !errors.Is(err, ErrOperationNotFound) {
+		t.Errorf("Not ErrOperationNotFound error for other atm: %v", err)
+	}
+	_, err = store.ReverseAtmWithdrawal(ctx, atm.Id, deposit.OperationId, 1, 40)
+	if !errors.Is(err, ErrOperationNotFound) {
+		t.Errorf("Not ErrOperationNotFound error for deposit: %v", err)
+	}
+	reversal, err := store.ReverseAtmWithdrawal(ctx, atm.Id, withdrawal.OperationId, 1, 40)
+	if err != nil || reversal.CardBalance != 240 {
+		t.Errorf("can't reverse withdrawal: %v, %v", reversal, err)
+	}
+	_, err = store.ReverseAtmWithdrawal(ctx, atm.Id, withdrawal.OperationId, 1, 40)
+	if !errors.Is(err, ErrOperationReversed) {
+		t.Errorf("Not ErrOperationReversed error: %v", err)
+	}
+	opLogs, err := store.ViewOperationsLogging(ctx, vasya)
+	if err != nil || len(opLogs) != 3 || opLogs[2].Name != OperationAtmReversal || opLogs[2].Atm_id != atm.Id {
+		t.Errorf("atm operations not logged: %v, %v", opLogs, err)
+	}
+
+	cassettes, err := store.AtmCassettes(ctx, atm.Id)
+	if err != nil || !reflect.DeepEqual(cassettes, []Cassette{{Denomination: 50, Notes: 4}, {Denomination: 20, Notes: 7}}) {
+		t.Errorf("cassettes not match: %v, %v", cassettes, err)
+	}
+	lowCash, err := store.LowCashAtms(ctx, 1000)
+	if err != nil || len(lowCash) != 1 || lowCash[0].Cash != 340 {
+		t.Errorf("low cash atms not match: %v, %v", lowCash, err)
+	}
+	collected, err := store.CollectAtm(ctx, atm.Id)
+	if err != nil || len(collected) != 2 {
+		t.Errorf("can't collect atm: %v, %v", collected, err)
+	}
+	_, err = store.Withdraw(ctx, vasya, atm.Id, 0, 40)
+	if !errors.Is(err, ErrNotEnoughCash) {
+		t.Errorf("Not ErrNotEnoughCash error for collected atm: %v", err)
+	}
+}
+
+func testStoreAtmStatus(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+	atm := seedAtm(t, store)
+
+	err := store.SetAtmStatus(ctx, atm.Id, AtmMaintenance, "cash jam")
+	if err != nil {
+		t.Errorf("can't set atm status: %v", err)
+	}
+	_, err = store.Deposit(ctx, vasya, atm.Id, 0, 40)
+	if !errors.Is(err, ErrAtmNotOperational) {
+		t.Errorf("Not ErrAtmNotOperational error: %v", err)
+	}
+	err = store.SetAtmStatus(ctx, atm.Id, AtmOnline, "fixed")
+	if err != nil {
+		t.Errorf("can't set atm status: %v", err)
+	}
+	history, err := store.AtmStatusHistory(ctx, atm.Id)
+	if err != nil || len(history) != 2 || history[0].To != AtmMaintenance || history[1].Reason != "fixed" {
+		t.Errorf("atm status history not match: %v, %v", history, err)
+	}
+
+	now := time.Now()
+	_, err = store.ScheduleAtmMaintenance(ctx, atm.Id, now.Add(time.Hour), now.Add(2*time.Hour))
+	if err != nil {
+		t.Errorf("can't schedule maintenance: %v", err)
+	}
+	windows, err := store.AtmMaintenanceWindows(ctx, atm.Id, now)
+	if err != nil || len(windows) != 1 {
+		t.Errorf("maintenance windows not match: %v, %v", windows, err)
+	}
+	err = store.AtmOperational(ctx, atm.Id, now.Add(90*time.Minute))
+	if !errors.Is(err, ErrAtmNotOperational) {
+		t.Errorf("Not ErrAtmNotOperational error during maintenance: %v", err)
+	}
+	hours := []WorkingHours{{Weekday: now.AddDate(0, 0, 1).Weekday(), Opens: 0, Closes: 24 * 60}}
+	err = store.SetAtmWorkingHours(ctx, atm.Id, hours)
+	if err != nil {
+		t.Errorf("can't set working hours: %v", err)
+	}
+	got, err := store.AtmWorkingHours(ctx, atm.Id)
+	if err != nil || !reflect.DeepEqual(got, hours) {
+		t.Errorf("working hours not match: %v, %v", got, err)
+	}
+	err = store.AtmOperational(ctx, atm.Id, now)
+	if !errors.Is(err, ErrAtmNotOperational) {
+		t.Errorf("Not ErrAtmNotOperational error out of working hours: %v", err)
+	}
+	err = store.SetAtmWorkingHours(ctx, atm.Id, nil)
+	if err != nil {
+		t.Errorf("can't clear working hours: %v", err)
+	}
+	err = store.AtmOperational(ctx, atm.Id, now)
+	if err != nil {
+		t.Errorf("atm not operational: %v", err)
+	}
+}
+
+func testStoreOperations(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+
+	_, err := store.Transfer(ctx, vasya, 1, RecipientByLogin("petya"), 50)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	err = store.AddService(ctx, "Internet")
+	if err != nil {
+		t.Fatalf("can't add service: %v", err)
+	}
+	for _, amount := range []int64{20, 10} {
+		err = store.TransferServices(ctx, vasya, 1, int(amount), "Internet")
+		if err != nil {
+			t.Fatalf("can't pay service: %v", err)
+		}
+	}
+
+	opLogs, err := store.ViewOperationsLogging(ctx, vasya)
+	if err != nil || len(opLogs) != 3 || opLogs[0].Name != OperationTransferSend || opLogs[1].Name != OperationPayService {
+		t.Errorf("operations logging not match: %v, %v", opLogs, err)
+	}
+	opLogs, err = store.ViewOperationsLoggingToSearch(ctx, 2)
+	if err != nil || len(opLogs) != 1 || opLogs[0].Name != OperationTransferGet || opLogs[0].Balance != 50 {
+		t.Errorf("operations logging of user not match: %v, %v", opLogs, err)
+	}
+	opLogs, err = store.ViewAllOperationsLogging(ctx)
+	if err != nil || len(opLogs) != 4 {
+		t.Fatalf("all operations logging not match: %v, %v", opLogs, err)
+	}
+	chain, err := store.VerifyOperationsChain(ctx)
+	if err != nil || !chain.Intact() || chain.Head == "" || chain.Operations != 4 {
+		t.Errorf("operations chain not intact: %+v, %v", chain, err)
+	}
+
+	var paged []int64
+	filter := OperationsFilter{Limit: 3}
+	for {
+		page, err := store.QueryOperations(ctx, filter)
+		if err != nil || len(page.Operations) > 3 {
+			t.Fatalf("operations page not match: %v, %v", page, err)
+		}
+		for _, opLog := range page.Operations {
+			paged = append(paged, opLog.Id)
+		}
+		if page.NextCursor == 0 {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	if !reflect.DeepEqual(paged, []int64{opLogs[3].Id, opLogs[2].Id, opLogs[1].Id, opLogs[0].Id}) {
+		t.Errorf("operations pages not match: %v, %v", paged, opLogs)
+	}
+
+	tests := []struct {
+		name   string
+		filter OperationsFilter
+		want   int
+	}{
+		{"service payments", OperationsFilter{UserId: vasya.UserId, Type: OperationPayService, Counterparty: "Internet"}, 2},
+		{"amounts", OperationsFilter{MinAmount: 10, MaxAmount: 20}, 2},
+		{"card", OperationsFilter{CardId: 2}, 1},
+		{"future", OperationsFilter{From: time.Now().Add(time.Hour)}, 0},
+		{"past", OperationsFilter{To: time.Now().Add(-time.Hour)}, 0},
+	}
+	for _, test := range tests {
+		page, err := store.QueryOperations(ctx, test.filter)
+		if err != nil || len(page.Operations) != test.want || page.NextCursor != 0 {
+			t.Errorf("%s: got %v, want %d operations: %v", test.name, page, test.want, err)
+		}
+	}
+	_, err = store.QueryOperations(ctx, OperationsFilter{MinAmount: 20, MaxAmount: 10})
+	if !errors.Is(err, ErrInvalidOperationsFilter) {
+		t.Errorf("Not ErrInvalidOperationsFilter error: %v", err)
+	}
+}
+
+func testStoreLedger(t *testing.T, store Store) {
+	ctx := context.Background()
+	vasya := seedStore(t, store)
+	atm := seedAtm(t, store)
+
+	_, err := store.Transfer(ctx, vasya, 1, RecipientByLogin("petya"), 50)
+	if err != nil {
+		t.Fatalf("can't transfer: %v", err)
+	}
+	err = store.AddService(ctx, "Internet")
+	if err != nil {
+		t.Fatalf("can't add service: %v", err)
+	}
+	err = store.TransferServices(ctx, vasya, 1, 30, "Internet")
+	if err != nil {
+		t.Fatalf("can't pay service: %v", err)
+	}
+	_, err = store.Withdraw(ctx, vasya, atm.Id, 1, 20)
+	if err != nil {
+		t.Fatalf("can't withdraw: %v", err)
+	}
+
+	stats := []struct {
+		name   string
+		static func(ctx context.Context) (int, error)
+		want   int
+	}{
+		{"count users", store.StaticCountUsers, 3},
+		{"sum balance users", store.StaticSumBalanceUsers, 550},
+		{"balance of services", store.StaticBalanceOfServices, 30},
+		{"balance sum transfer", store.StaticBalanceSumTransfer, 50},
+	}
+	for _, stat := range stats {
+		got, err := stat.static(ctx)
+		if err != nil || got != stat.want {
+			t.Errorf("%s: got %d, want %d: %v", stat.name, got, stat.want, err)
+		}
+	}
+
+	accounts := []struct {
+		account string
+		want    int64
+	}{
+		{CardAccount(1), 100},
+		{CardAccount(2), 450},
+		{ServiceAccount(1), 30},
+		{AtmAccount(atm.Id), 20},
+		{ClearingTransfersAccount, 0},
+	}
+	for _, account := range accounts {
+		got, err := store.LedgerBalance(ctx, account.account)
+		if err != nil || got != account.want {
+			t.Errorf("%s: got balance %d, want %d: %v", account.account, got, account.want, err)
+		}
+	}
+	report, err := store.VerifyLedger(ctx)
+	if err != nil || !report.Balanced() {
+		t.Errorf("ledger not balanced: %+v, %v", report, err)
+	}
+	err = store.UpdateService(ctx, Service{Id: 1, Name: "Internet Plus", Category: ServiceInternet, Active: true})
+	if err != nil {
+		t.Fatalf("can't rename service: %v", err)
+	}
+	reconciled, err := store.Reconcile(ctx)
+	if err != nil || !reconciled.Consistent() || reconciled.TransfersLogged != 50 {
+		t.Errorf("balances not reconciled: %+v, %v", reconciled, err)
+	}
+}
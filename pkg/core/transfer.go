@@ -0,0 +1,256 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrInvalidRecipient = errors.New("recipient must be exactly one of phone number, card number or login")
+
+// RecipientRef points to the recipient of a transfer by exactly one of
+// phone number, card number or login.
+type RecipientRef struct {
+	PhoneNumber int
+	NumberCard  string
+	Login       string
+}
+
+type TransferResult struct {
+	RecipientCardId      int64
+	SenderBalance        int64
+	RecipientBalance     int64
+	SenderOperationId    int64
+	RecipientOperationId int64
+}
+
+// check refuses references with none or more than one of their fields set.
+func (receiver RecipientRef) check() error {
+	set := 0
+	if receiver.PhoneNumber != 0 {
+		set++
+	}
+	if receiver.NumberCard != "" {
+		set++
+	}
+	if receiver.Login != "" {
+		set++
+	}
+	if set != 1 {
+		return ErrInvalidRecipient
+	}
+	return nil
+}
+
+func RecipientByPhoneNumber(phoneNumber int) RecipientRef {
+	return RecipientRef{PhoneNumber: phoneNumber}
+}
+
+func RecipientByNumberCard(numberCard string) RecipientRef {
+	return RecipientRef{NumberCard: numberCard}
+}
+
+func RecipientByLogin(login string) RecipientRef {
+	return RecipientRef{Login: login}
+}
+
+// Transfer moves amount from the session user's card fromCardId, or from the
+// default card when it is 0, to the recipient in a single transaction: both
+// balances, both operationsLogging rows and sumTransferUsers are committed
+// together or not at all.
+func (receiver Session) Transfer(ctx context.Context, fromCardId int64, to RecipientRef, amount int64, db *sql.DB) (result TransferResult, err error) {
+	if amount <= 0 {
+		return result, ErrInvalidAmount
+	}
+	err = to.check()
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, dbError(err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = dbTxError(err, rollbackErr)
+			}
+			result = TransferResult{}
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = dbError(err)
+			result = TransferResult{}
+		}
+	}()
+
+	sender, err := selectSenderCard(ctx, tx, receiver.UserId, fromCardId)
+	if err != nil {
+		return result, err
+	}
+	// Cards keep a positive balance.
+	if sender.balance <= amount {
+		return result, ErrInsufficientFunds
+	}
+
+	recipientCardId, err := resolveRecipientCard(ctx, tx, to)
+	if err != nil {
+		return result, err
+	}
+	if recipientCardId == sender.id {
+		return result, ErrSameCard
+	}
+	recipient, err := selectRecipientCard(ctx, tx, recipientCardId)
+	if err != nil {
+		return result, err
+	}
+
+	return moveBetweenCards(ctx, tx, DialectOf(db), sender, recipient, amount)
+}
+
+type transferCard struct {
+	id          int64
+	balance     int64
+	numberCard  string
+	userId      int64
+	status      CardStatus
+	expiryMonth int
+	expiryYear  int
+}
+
+// selectSenderCard reads the card idCard of userId; 0 stands for the user's
+// default card. Cards of other users are reported as ErrCardNotFound, cards
+// not active or past expiry as ErrCardNotActive or ErrCardExpired.
+func selectSenderCard(ctx context.Context, tx *sql.Tx, userId int64, idCard int64) (card transferCard, err error) {
+	if idCard == 0 {
+		idCard, err = defaultCardId(ctx, tx, userId)
+		if err != nil {
+			return card, err
+		}
+	}
+	err = tx.QueryRowContext(ctx, selectCardForTransferSenderSQL, idCard, userId).Scan(&card.balance, &card.numberCard, &card.status, &card.expiryMonth, &card.expiryYear)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return card, ErrCardNotFound
+		}
+		return card, queryError(selectCardForTransferSenderSQL, err)
+	}
+	card.id = idCard
+	card.userId = userId
+	return card, checkCardUsable(card.status, card.expiryMonth, card.expiryYear)
+}
+
+func selectRecipientCard(ctx context.Context, tx *sql.Tx, idCard int64) (card transferCard, err error) {
+	err = tx.QueryRowContext(ctx, selectCardForTransferRecipientSQL, idCard).Scan(&card.id, &card.balance, &card.numberCard, &card.userId, &card.status, &card.expiryMonth, &card.expiryYear)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return card, ErrRecipientNotFound
+		}
+		return card, queryError(selectCardForTransferRecipientSQL, err)
+	}
+	return card, checkCardUsable(card.status, card.expiryMonth, card.expiryYear)
+}
+
+func moveBetweenCards(ctx context.Context, tx *sql.Tx, dialect Dialect, sender, recipient transferCard, amount int64) (result TransferResult, err error) {
+	_, err = tx.ExecContext(ctx, addBalanceToCardSQL, -amount, sender.id)
+	if err != nil {
+		return result, queryError(addBalanceToCardSQL, err)
+	}
+	_, err = tx.ExecContext(ctx, addBalanceToCardSQL, amount, recipient.id)
+	if err != nil {
+		return result, queryError(addBalanceToCardSQL, err)
+	}
+
+	t := time.Now()
+	result.SenderOperationId, err = logCardOperation(ctx, tx, dialect, OperationTransferSend, t, recipient.numberCard, -amount, sender.userId, sender.id)
+	if err != nil {
+		return result, err
+	}
+	result.RecipientOperationId, err = logCardOperation(ctx, tx, dialect, OperationTransferGet, t, sender.numberCard, amount, recipient.userId, recipient.id)
+	if err != nil {
+		return result, err
+	}
+
+	_, err = tx.ExecContext(ctx, addBalanceSumTransferUsersSQL, amount)
+	if err != nil {
+		return result, queryError(addBalanceSumTransferUsersSQL, err)
+	}
+	err = postJournal(ctx, tx, dialect, result.SenderOperationId, string(OperationTransfer), transferPostings(sender.id, recipient.id, amount)...)
+	if err != nil {
+		return result, err
+	}
+
+	result.RecipientCardId = recipient.id
+	result.SenderBalance = sender.balance - amount
+	result.RecipientBalance = recipient.balance + amount
+	return result, nil
+}
+
+// resolveRecipientCard finds the card of a reference that passed check.
+func resolveRecipientCard(ctx context.Context, tx *sql.Tx, to RecipientRef) (idCard int64, err error) {
+	if to.NumberCard != "" {
+		if !ValidCardNumber(to.NumberCard) {
+			return 0, ErrInvalidCardNumber
+		}
+		err = tx.QueryRowContext(ctx, selectIdCardForTransferCountNumberSQL, to.NumberCard).Scan(&idCard)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return 0, ErrRecipientNotFound
+			}
+			return 0, queryError(selectIdCardForTransferCountNumberSQL, err)
+		}
+		return idCard, nil
+	}
+
+	var userIdRecipient int64
+	switch {
+	case to.PhoneNumber != 0:
+		err = tx.QueryRowContext(ctx, selectIdUserPhoneNumberSQL, to.PhoneNumber).Scan(&userIdRecipient)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, queryError(selectIdUserPhoneNumberSQL, err)
+		}
+	case to.Login != "":
+		err = tx.QueryRowContext(ctx, selectIdUserLoginNumberSQL, to.Login).Scan(&userIdRecipient)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, queryError(selectIdUserLoginNumberSQL, err)
+		}
+	default:
+		return 0, ErrRecipientNotFound
+	}
+	if err == sql.ErrNoRows {
+		return 0, ErrRecipientNotFound
+	}
+
+	idCard, err = defaultCardId(ctx, tx, userIdRecipient)
+	if err == ErrCardNotFound {
+		return 0, ErrRecipientHasNoCard
+	}
+	return idCard, err
+}
+
+// defaultCardId is the card the user chose with SetDefaultCard, else the
+// user's first card.
+func defaultCardId(ctx context.Context, tx *sql.Tx, userId int64) (int64, error) {
+	var idCard sql.NullInt64
+	err := tx.QueryRowContext(ctx, selectDefaultCardIdUserSQL, userId).Scan(&idCard)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, queryError(selectDefaultCardIdUserSQL, err)
+	}
+	if !idCard.Valid {
+		return 0, ErrCardNotFound
+	}
+	return idCard.Int64, nil
+}
+
+func logOperation(ctx context.Context, tx *sql.Tx, dialect Dialect, name OperationType, t time.Time, recipientSender string, balance int64, userId int64) (int64, error) {
+	return insertOperation(ctx, tx, dialect, insertOperationsLoggingSQL, name, formatTimestamp(t), recipientSender, balance, userId)
+}
+
+// logCardOperation logs an operation changing the balance of the card
+// cardId.
+func logCardOperation(ctx context.Context, tx *sql.Tx, dialect Dialect, name OperationType, t time.Time, recipientSender string, balance int64, userId int64, cardId int64) (int64, error) {
+	return insertOperation(ctx, tx, dialect, insertCardOperationsLoggingSQL, name, formatTimestamp(t), recipientSender, balance, userId, cardId)
+}
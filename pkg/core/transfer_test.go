@@ -0,0 +1,244 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func openTransferDb(t *testing.T, driver string) (db *sql.DB, closeDb func()) {
+	db, closeDb = openTestDb(t, driver)
+	err := Init(db)
+	if err != nil {
+		closeDb()
+		t.Fatalf("can't init db: %v", err)
+	}
+	for _, query := range []string{
+		`INSERT INTO users(id, name, login, password, passportSeries, phoneNumber, hideShow) VALUES (1,'Vasya','vasya','secret','A132323',9001,3)`,
+		`INSERT INTO users(id, name, login, password, passportSeries, phoneNumber, hideShow) VALUES (2,'Petya','petya','secret','A000009',9002,3)`,
+		`INSERT INTO users(id, name, login, password, passportSeries, phoneNumber, hideShow) VALUES (3,'Kolya','kolya','secret','A000010',9003,3)`,
+		`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (1,'AlifMobi',200,1,'2021600000000016')`,
+		`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (2,'AlifMobi',400,2,'2021600000000024')`,
+	} {
+		_, err = db.Exec(query)
+		if err != nil {
+			closeDb()
+			t.Fatalf("can't add fixture: %v", err)
+		}
+	}
+	resetSequences(t, db, "users", "cards")
+	return db, closeDb
+}
+
+func cardBalance(t *testing.T, db *sql.DB, idCard int64) (balance int64) {
+	err := db.QueryRow(selectBalanceToCardRecipientSQL, idCard).Scan(&balance)
+	if err != nil {
+		t.Fatalf("can't select card balance: %v", err)
+	}
+	return balance
+}
+
+// failOperationsLogging makes every insert into operationsLogging fail.
+func failOperationsLogging(t *testing.T, db *sql.DB) {
+	queries := map[Dialect][]string{
+		SQLite: {`CREATE TRIGGER failOperationsLogging BEFORE INSERT ON operationsLogging
+BEGIN
+	SELECT RAISE(ABORT, 'operations logging unavailable');
+END;`},
+		Postgres: {
+			`CREATE FUNCTION failOperationsLogging() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'operations logging unavailable';
+END;
+$$ LANGUAGE plpgsql`,
+			`CREATE TRIGGER failOperationsLogging BEFORE INSERT ON operationsLogging FOR EACH ROW EXECUTE PROCEDURE failOperationsLogging()`,
+		},
+	}
+	for _, query := range queries[DialectOf(db)] {
+		_, err := db.Exec(query)
+		if err != nil {
+			t.Fatalf("can't create trigger: %v", err)
+		}
+	}
+}
+
+func TestTransfer_Ok(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		recipients := []RecipientRef{
+			RecipientByPhoneNumber(9002),
+			RecipientByNumberCard("2021600000000024"),
+			RecipientByLogin("petya"),
+		}
+		for _, to := range recipients {
+			db, closeDb := openTransferDb(t, driver)
+
+			result, err := Session{UserId: 1}.Transfer(context.Background(), 1, to, 50, db)
+			if err != nil {
+				t.Errorf("can't transfer money to %v: %v", to, err)
+			}
+			if result.RecipientCardId != 2 || result.SenderBalance != 150 || result.RecipientBalance != 450 {
+				t.Errorf("transfer result not match for %v: %v", to, result)
+			}
+			if result.SenderOperationId == 0 || result.RecipientOperationId == 0 {
+				t.Errorf("transfer operations not logged for %v: %v", to, result)
+			}
+			if cardBalance(t, db, 1) != 150 || cardBalance(t, db, 2) != 450 {
+				t.Errorf("card balances not updated for %v", to)
+			}
+			if StaticBalanceSumTransfer(db) != 50 {
+				t.Errorf("sumTransferUsers not updated for %v", to)
+			}
+
+			closeDb()
+		}
+	})
+}
+
+func TestTransfer_Rejected(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		tests := []struct {
+			name       string
+			session    Session
+			fromCardId int64
+			to         RecipientRef
+			amount     int64
+			err        error
+		}{
+			{"insufficient funds", Session{UserId: 1}, 1, RecipientByLogin("petya"), 500, ErrInsufficientFunds},
+			{"whole balance", Session{UserId: 1}, 1, RecipientByLogin("petya"), 200, ErrInsufficientFunds},
+			{"invalid amount", Session{UserId: 1}, 1, RecipientByLogin("petya"), 0, ErrInvalidAmount},
+			{"foreign card", Session{UserId: 1}, 2, RecipientByLogin("vasya"), 50, ErrCardNotFound},
+			{"unknown phone", Session{UserId: 1}, 1, RecipientByPhoneNumber(9999), 50, ErrRecipientNotFound},
+			{"unknown card", Session{UserId: 1}, 1, RecipientByNumberCard("2021600000000099"), 50, ErrRecipientNotFound},
+			{"invalid card number", Session{UserId: 1}, 1, RecipientByNumberCard("2021600000000025"), 50, ErrInvalidCardNumber},
+			{"recipient without card", Session{UserId: 1}, 1, RecipientByLogin("kolya"), 50, ErrRecipientHasNoCard},
+			{"same card", Session{UserId: 1}, 1, RecipientByLogin("vasya"), 50, ErrSameCard},
+			{"no recipient", Session{UserId: 1}, 1, RecipientRef{}, 50, ErrInvalidRecipient},
+			{"ambiguous recipient", Session{UserId: 1}, 1, RecipientRef{NumberCard: "2021600000000024", Login: "vasya"}, 50, ErrInvalidRecipient},
+			{"phone and login", Session{UserId: 1}, 1, RecipientRef{PhoneNumber: 9002, Login: "petya"}, 50, ErrInvalidRecipient},
+		}
+		for _, test := range tests {
+			db, closeDb := openTransferDb(t, driver)
+
+			_, err := test.session.Transfer(context.Background(), test.fromCardId, test.to, test.amount, db)
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			}
+			if cardBalance(t, db, 1) != 200 || cardBalance(t, db, 2) != 400 {
+				t.Errorf("%s: card balances changed on rejected transfer", test.name)
+			}
+			if StaticBalanceSumTransfer(db) != 0 {
+				t.Errorf("%s: sumTransferUsers changed on rejected transfer", test.name)
+			}
+
+			closeDb()
+		}
+	})
+}
+
+func TestTransfer_LogFailureRollback(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+
+		failOperationsLogging(t, db)
+
+		_, err := Session{UserId: 1}.Transfer(context.Background(), 1, RecipientByLogin("petya"), 100, db)
+		var typedErr *QueryError
+		if ok := errors.As(err, &typedErr); !ok {
+			t.Errorf("error not maptch QueryError: %v", err)
+		}
+		if cardBalance(t, db, 1) != 200 || cardBalance(t, db, 2) != 400 {
+			t.Error("card balances changed on failed operations logging")
+		}
+	})
+}
+
+func TestTransferMoney_ChosenCard(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		_, err := db.Exec(`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (3,'AlifMobi',300,1,'2021600000000032')`)
+		if err != nil {
+			t.Fatalf("can't add card: %v", err)
+		}
+
+		err = Session{UserId: 1}.TransferMoney(3, 2, 100, db)
+		if err != nil {
+			t.Errorf("can't transfer money: %v", err)
+		}
+		if cardBalance(t, db, 1) != 200 || cardBalance(t, db, 3) != 200 || cardBalance(t, db, 2) != 500 {
+			t.Error("card balances not match for transfer from chosen card")
+		}
+
+		err = Session{UserId: 1}.TransferMoney(2, 3, 100, db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for foreign card: %v", err)
+		}
+
+		err = Session{UserId: 1}.TransferServices(2, 50, "Internet", db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for payment from foreign card: %v", err)
+		}
+		err = AddService("Internet", db)
+		if err != nil {
+			t.Errorf("can't add service: %v", err)
+		}
+		err = Session{UserId: 1}.TransferServices(3, 50, "Internet", db)
+		if err != nil {
+			t.Errorf("can't pay service: %v", err)
+		}
+		if cardBalance(t, db, 1) != 200 || cardBalance(t, db, 3) != 150 {
+			t.Error("card balances not match for payment from chosen card")
+		}
+	})
+}
+
+func TestSetDefaultCard(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver string) {
+		db, closeDb := openTransferDb(t, driver)
+		defer closeDb()
+		_, err := db.Exec(`INSERT INTO cards(id, name, balance, user_id, numberCard) VALUES (3,'AlifMobi',300,1,'2021600000000032')`)
+		if err != nil {
+			t.Fatalf("can't add card: %v", err)
+		}
+		vasya := Session{UserId: 1}
+
+		idCard, err := vasya.DefaultCard(db)
+		if err != nil || idCard != 1 {
+			t.Errorf("first card not default: %v, %v", idCard, err)
+		}
+		err = vasya.SetDefaultCard(2, db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for foreign default card: %v", err)
+		}
+		err = vasya.SetDefaultCard(3, db)
+		if err != nil {
+			t.Errorf("can't set default card: %v", err)
+		}
+		idCard, err = vasya.DefaultCard(db)
+		if err != nil || idCard != 3 {
+			t.Errorf("default card not match: %v, %v", idCard, err)
+		}
+		_, err = Session{UserId: 3}.DefaultCard(db)
+		if !errors.Is(err, ErrCardNotFound) {
+			t.Errorf("Not ErrCardNotFound error for user without card: %v", err)
+		}
+
+		err = vasya.TransferMoney(0, 2, 100, db)
+		if err != nil {
+			t.Errorf("can't transfer money from default card: %v", err)
+		}
+		_, err = Session{UserId: 2}.Transfer(context.Background(), 0, RecipientByPhoneNumber(9001), 50, db)
+		if err != nil {
+			t.Errorf("can't transfer money to default card: %v", err)
+		}
+		if cardBalance(t, db, 1) != 200 || cardBalance(t, db, 3) != 250 || cardBalance(t, db, 2) != 450 {
+			t.Error("card balances not match for transfers with default card")
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package iso8583
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var ErrMessageTooLong = errors.New("message too long")
+
+// maxMessageLength is what the two byte length header of a frame can hold.
+const maxMessageLength = 1<<16 - 1
+
+// ReadMessage reads a message framed by its length as two big-endian bytes.
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return Message{}, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return Message{}, err
+	}
+	return Unpack(data)
+}
+
+// WriteMessage writes the message framed like ReadMessage reads it.
+func WriteMessage(w io.Writer, message Message) error {
+	data, err := message.Pack()
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageLength {
+		return ErrMessageTooLong
+	}
+	frame := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
+
+// Client is the ATM end of a host connection.
+type Client struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Dial connects to the host at address; each exchange has to be answered
+// within timeout, 0 waits forever.
+func Dial(address string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, timeout: timeout}, nil
+}
+
+// Exchange sends the request and waits for the response.
+func (receiver *Client) Exchange(request Message) (Message, error) {
+	if receiver.timeout > 0 {
+		err := receiver.conn.SetDeadline(time.Now().Add(receiver.timeout))
+		if err != nil {
+			return Message{}, err
+		}
+	}
+	err := WriteMessage(receiver.conn, request)
+	if err != nil {
+		return Message{}, err
+	}
+	return ReadMessage(receiver.conn)
+}
+
+func (receiver *Client) Close() error {
+	return receiver.conn.Close()
+}
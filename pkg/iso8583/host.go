@@ -0,0 +1,363 @@
+package iso8583
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jafarsirojov/APM-core/pkg/core"
+)
+
+// Response codes of field 39.
+const (
+	Approved                = "00"
+	DoNotHonor              = "05"
+	InvalidTransaction      = "12"
+	InvalidAmount           = "13"
+	InvalidCardNumber       = "14"
+	OriginalNotFound        = "25"
+	FormatError             = "30"
+	InsufficientFunds       = "51"
+	ExpiredCard             = "54"
+	IncorrectPIN            = "55"
+	TransactionNotPermitted = "58"
+	RestrictedCard          = "62"
+	PINTriesExceeded        = "75"
+	SystemMalfunction       = "96"
+)
+
+// Processing codes, the first two digits of field 3.
+const (
+	ProcessingWithdrawal     = "01"
+	ProcessingBalanceInquiry = "31"
+)
+
+// DefaultReadTimeout is how long NewHost waits for the next message of an
+// ATM before it hangs up.
+const DefaultReadTimeout = 5 * time.Minute
+
+// DefaultRepeatWindow is how long NewHost keeps the answers of withdrawals
+// to answer their repeats.
+const DefaultRepeatWindow = 24 * time.Hour
+
+// Host answers ATMs on behalf of the core. The terminal id of field 41 is
+// the ATM id, and the retrieval reference number of field 37 the id of the
+// operation in the operations log; reversals find the withdrawal by it.
+//
+// Host doesn't authenticate terminals: it trusts field 41, and reversals
+// carry no PIN. Serve it only connections of authenticated ATMs, for
+// example from a tls.Listener requiring client certificates, or a network
+// only the ATMs reach.
+type Host struct {
+	Store core.Store
+	// Currency is the ISO 4217 numeric code of the card balances
+	// returned in field 54.
+	Currency string
+	// ReadTimeout bounds the wait for each message of a connection,
+	// including the idle time before it; 0 waits forever.
+	ReadTimeout time.Duration
+	// RepeatWindow is how long a withdrawal is answered again rather than
+	// withdrawn again when its terminal sends it with the same STAN; 0
+	// keeps no withdrawals. The answers are kept in memory only.
+	RepeatWindow time.Duration
+
+	mu          sync.Mutex
+	withdrawals map[withdrawalKey]*withdrawalAnswer
+	// answered holds the keys of withdrawals oldest first, to forget them
+	// past RepeatWindow.
+	answered []withdrawalKey
+}
+
+// withdrawalKey tells a withdrawal from the others: its terminal and STAN,
+// and against STANs wrapping around, its card and amount.
+type withdrawalKey struct {
+	terminal string
+	stan     string
+	pan      string
+	amount   string
+}
+
+// withdrawalAnswer is the response to a withdrawal, ready once done is
+// closed.
+type withdrawalAnswer struct {
+	done     chan struct{}
+	response Message
+	at       time.Time
+}
+
+func NewHost(store core.Store, currency string) *Host {
+	return &Host{Store: store, Currency: currency, ReadTimeout: DefaultReadTimeout, RepeatWindow: DefaultRepeatWindow}
+}
+
+// Serve answers the connections of listener until it is closed.
+func (receiver *Host) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			_ = receiver.ServeConn(context.Background(), conn)
+		}()
+	}
+}
+
+// ServeConn answers the requests of conn one by one until the ATM hangs up.
+// Messages that can't be read, or don't arrive within ReadTimeout, close
+// the connection.
+func (receiver *Host) ServeConn(ctx context.Context, conn net.Conn) (err error) {
+	defer func() {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for {
+		if receiver.ReadTimeout > 0 {
+			// Some conns refuse deadlines once the ATM hung up; the read
+			// reports the hang up then.
+			_ = conn.SetReadDeadline(time.Now().Add(receiver.ReadTimeout))
+		}
+		request, readErr := ReadMessage(conn)
+		if readErr != nil && request.MTI == "" {
+			if readErr == io.EOF {
+				return nil
+			}
+			return readErr
+		}
+		response := receiver.reply(request, FormatError)
+		if readErr == nil {
+			response = receiver.Handle(ctx, request)
+		}
+		err = WriteMessage(conn, response)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Handle answers a request: 0100 and 0200 with processing code 31 are
+// balance inquiries, 0200 with processing code 01 withdrawals, and 0420
+// reverses a withdrawal.
+func (receiver *Host) Handle(ctx context.Context, request Message) Message {
+	switch request.MTI {
+	case MTIAuthorizationRequest, MTIFinancialRequest:
+		processing := request.Fields[FieldProcessingCode]
+		switch {
+		case strings.HasPrefix(processing, ProcessingBalanceInquiry):
+			return receiver.balanceInquiry(ctx, request)
+		case strings.HasPrefix(processing, ProcessingWithdrawal) && request.MTI == MTIFinancialRequest:
+			return receiver.withdrawal(ctx, request)
+		}
+	case MTIReversalAdvice:
+		return receiver.reversal(ctx, request)
+	}
+	return receiver.reply(request, InvalidTransaction)
+}
+
+func (receiver *Host) balanceInquiry(ctx context.Context, request Message) Message {
+	card, err := receiver.authenticate(ctx, request)
+	if err != nil {
+		return receiver.reply(request, responseCode(err))
+	}
+	response := receiver.reply(request, Approved)
+	response.Fields[FieldAdditionalAmounts] = receiver.balanceAmount(card.Balance)
+	return response
+}
+
+// withdrawal withdraws once for each terminal and STAN: ATMs repeat a 0200
+// they got no answer to, and the repeat gets the answer of the original.
+func (receiver *Host) withdrawal(ctx context.Context, request Message) Message {
+	if receiver.RepeatWindow <= 0 {
+		return receiver.withdraw(ctx, request)
+	}
+	key := withdrawalKey{
+		terminal: request.Fields[FieldTerminalId],
+		stan:     request.Fields[FieldSTAN],
+		pan:      request.Fields[FieldPAN],
+		amount:   request.Fields[FieldAmount],
+	}
+	answer, repeat := receiver.answerOf(key)
+	if repeat {
+		<-answer.done
+		return answer.response
+	}
+	answer.response = receiver.withdraw(ctx, request)
+	close(answer.done)
+	return answer.response
+}
+
+// answerOf returns the answer of the withdrawal key within RepeatWindow,
+// or a new one to give when it isn't a repeat.
+func (receiver *Host) answerOf(key withdrawalKey) (answer *withdrawalAnswer, repeat bool) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	now := time.Now()
+	for len(receiver.answered) > 0 {
+		oldest := receiver.answered[0]
+		if now.Sub(receiver.withdrawals[oldest].at) < receiver.RepeatWindow {
+			break
+		}
+		delete(receiver.withdrawals, oldest)
+		receiver.answered = receiver.answered[1:]
+	}
+	if answer, ok := receiver.withdrawals[key]; ok {
+		return answer, true
+	}
+	if receiver.withdrawals == nil {
+		receiver.withdrawals = make(map[withdrawalKey]*withdrawalAnswer)
+	}
+	answer = &withdrawalAnswer{done: make(chan struct{}), at: now}
+	receiver.withdrawals[key] = answer
+	receiver.answered = append(receiver.answered, key)
+	return answer, false
+}
+
+func (receiver *Host) withdraw(ctx context.Context, request Message) Message {
+	amount, err := requestAmount(request)
+	if err != nil {
+		return receiver.reply(request, responseCode(err))
+	}
+	atmId, err := strconv.ParseInt(strings.TrimSpace(request.Fields[FieldTerminalId]), 10, 64)
+	if err != nil {
+		return receiver.reply(request, TransactionNotPermitted)
+	}
+	card, err := receiver.authenticate(ctx, request)
+	if err != nil {
+		return receiver.reply(request, responseCode(err))
+	}
+	result, err := receiver.Store.Withdraw(ctx, core.Session{UserId: card.User_id}, atmId, card.Id, amount)
+	if err != nil {
+		return receiver.reply(request, responseCode(err))
+	}
+
+	response := receiver.reply(request, Approved)
+	response.Fields[FieldRRN] = fmt.Sprintf("%012d", result.OperationId)
+	response.Fields[FieldAuthorizationCode] = fmt.Sprintf("%06d", result.OperationId%1000000)
+	response.Fields[FieldAdditionalAmounts] = receiver.balanceAmount(result.CardBalance)
+	return response
+}
+
+// reversal reverses the withdrawal of field 37 for the terminal, card and
+// amount of the request. A reversal already done is approved again: ATMs
+// repeat the advice until they get an answer.
+func (receiver *Host) reversal(ctx context.Context, request Message) Message {
+	amount, err := requestAmount(request)
+	if err != nil {
+		return receiver.reply(request, responseCode(err))
+	}
+	atmId, err := strconv.ParseInt(strings.TrimSpace(request.Fields[FieldTerminalId]), 10, 64)
+	if err != nil {
+		return receiver.reply(request, TransactionNotPermitted)
+	}
+	operationId, err := strconv.ParseInt(strings.TrimSpace(request.Fields[FieldRRN]), 10, 64)
+	if err != nil {
+		return receiver.reply(request, OriginalNotFound)
+	}
+	card, err := receiver.Store.CardByNumber(ctx, request.Fields[FieldPAN])
+	if err != nil {
+		return receiver.reply(request, responseCode(err))
+	}
+	result, err := receiver.Store.ReverseAtmWithdrawal(ctx, atmId, operationId, card.Id, amount)
+	if errors.Is(err, core.ErrOperationReversed) {
+		return receiver.reply(request, Approved)
+	}
+	if err != nil {
+		return receiver.reply(request, responseCode(err))
+	}
+	response := receiver.reply(request, Approved)
+	response.Fields[FieldAdditionalAmounts] = receiver.balanceAmount(result.CardBalance)
+	return response
+}
+
+// authenticate finds the card of field 2, refuses it when it can't be used,
+// expired or not active, and checks the PIN block of field 52 against it.
+func (receiver *Host) authenticate(ctx context.Context, request Message) (core.Card, error) {
+	card, err := receiver.Store.CardByNumber(ctx, request.Fields[FieldPAN])
+	if err != nil {
+		return core.Card{}, err
+	}
+	err = core.CheckCardUsable(card)
+	if err != nil {
+		return core.Card{}, err
+	}
+	pin, err := pinFromBlock([]byte(request.Fields[FieldPINBlock]), card.NumberCard)
+	if err != nil {
+		return core.Card{}, err
+	}
+	err = receiver.Store.VerifyPIN(ctx, card.Id, pin)
+	if err != nil {
+		return core.Card{}, err
+	}
+	return card, nil
+}
+
+// reply is the response to request with the fields the ATM matches it by.
+func (receiver *Host) reply(request Message, code string) Message {
+	mti, err := ResponseMTI(request.MTI)
+	if err != nil {
+		mti = request.MTI
+	}
+	response := NewMessage(mti)
+	for _, number := range []int{
+		FieldPAN, FieldProcessingCode, FieldAmount, FieldTransmissionTime, FieldSTAN,
+		FieldLocalTime, FieldLocalDate, FieldRRN, FieldTerminalId, FieldCardAcceptorId, FieldCurrency,
+	} {
+		if value, ok := request.Fields[number]; ok {
+			response.Fields[number] = value
+		}
+	}
+	response.Fields[FieldResponseCode] = code
+	return response
+}
+
+// balanceAmount is the available balance as an additional amount of field
+// 54: account type, amount type, currency, sign and amount.
+func (receiver *Host) balanceAmount(balance int64) string {
+	sign := "C"
+	if balance < 0 {
+		sign, balance = "D", -balance
+	}
+	return fmt.Sprintf("0002%3s%s%012d", receiver.Currency, sign, balance)
+}
+
+func requestAmount(request Message) (int64, error) {
+	amount, err := strconv.ParseInt(request.Fields[FieldAmount], 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, core.ErrInvalidAmount
+	}
+	return amount, nil
+}
+
+func responseCode(err error) string {
+	switch {
+	case errors.Is(err, core.ErrCardNotFound):
+		return InvalidCardNumber
+	case errors.Is(err, ErrInvalidPINBlock), errors.Is(err, core.ErrWrongPIN), errors.Is(err, core.ErrPINNotSet):
+		return IncorrectPIN
+	case errors.Is(err, core.ErrPINAttemptsExceeded):
+		return PINTriesExceeded
+	case errors.Is(err, core.ErrCardExpired):
+		return ExpiredCard
+	case errors.Is(err, core.ErrCardNotActive):
+		return RestrictedCard
+	case errors.Is(err, core.ErrInsufficientFunds):
+		return InsufficientFunds
+	case errors.Is(err, core.ErrInvalidAmount), errors.Is(err, core.ErrAmountNotInDenominations):
+		return InvalidAmount
+	case errors.Is(err, core.ErrNotEnoughCash):
+		return DoNotHonor
+	case errors.Is(err, core.ErrAtmNotFound), errors.Is(err, core.ErrAtmNotOperational):
+		return TransactionNotPermitted
+	case errors.Is(err, core.ErrOperationNotFound):
+		return OriginalNotFound
+	}
+	return SystemMalfunction
+}
@@ -0,0 +1,307 @@
+package iso8583
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jafarsirojov/APM-core/pkg/core"
+)
+
+// simulatedAtm is an ATM talking to the host the way a real one does.
+type simulatedAtm struct {
+	client   *Client
+	terminal string
+	stan     int
+}
+
+func (receiver *simulatedAtm) request(mti, processing, pan, pin string, amount int64) Message {
+	receiver.stan++
+	request := NewMessage(mti)
+	request.Fields[FieldPAN] = pan
+	request.Fields[FieldProcessingCode] = processing
+	request.Fields[FieldAmount] = fmt.Sprintf("%012d", amount)
+	request.Fields[FieldTransmissionTime] = time.Now().UTC().Format("0102150405")
+	request.Fields[FieldSTAN] = fmt.Sprintf("%06d", receiver.stan)
+	request.Fields[FieldTerminalId] = receiver.terminal
+	request.Fields[FieldCurrency] = "972"
+	if pin != "" {
+		block, _ := PINBlock(pin, pan)
+		request.Fields[FieldPINBlock] = string(block)
+	}
+	return request
+}
+
+func (receiver *simulatedAtm) exchange(t *testing.T, request Message) Message {
+	response, err := receiver.client.Exchange(request)
+	if err != nil {
+		t.Fatalf("can't exchange %s: %v", request.MTI, err)
+	}
+	if response.Fields[FieldSTAN] != request.Fields[FieldSTAN] || response.Fields[FieldTerminalId] != request.Fields[FieldTerminalId] {
+		t.Errorf("response doesn't match request: %v", response)
+	}
+	return response
+}
+
+func (receiver *simulatedAtm) balanceInquiry(t *testing.T, pan, pin string) Message {
+	return receiver.exchange(t, receiver.request(MTIAuthorizationRequest, "310000", pan, pin, 0))
+}
+
+func (receiver *simulatedAtm) withdraw(t *testing.T, pan, pin string, amount int64) Message {
+	return receiver.exchange(t, receiver.request(MTIFinancialRequest, "010000", pan, pin, amount))
+}
+
+func (receiver *simulatedAtm) reverse(t *testing.T, pan string, amount int64, rrn string) Message {
+	request := receiver.request(MTIReversalAdvice, "010000", pan, "", amount)
+	request.Fields[FieldRRN] = rrn
+	return receiver.exchange(t, request)
+}
+
+func openHost(t *testing.T) (*simulatedAtm, core.Store, core.IssuedCard, func()) {
+	ctx := context.Background()
+	err := core.SetCardSecretKey([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("can't set card secret key: %v", err)
+	}
+	store := core.NewMemoryStore()
+	err = store.AddUser(ctx, "vasya", "vasya", "secret", "A0001", 900000001)
+	if err != nil {
+		t.Fatalf("can't add user: %v", err)
+	}
+	card, err := store.IssueCard(ctx, "AlifMobi", 500, 1)
+	if err != nil {
+		t.Fatalf("can't issue card: %v", err)
+	}
+	err = store.SetPIN(ctx, core.Session{UserId: 1}, card.Id, "1234")
+	if err != nil {
+		t.Fatalf("can't set PIN: %v", err)
+	}
+	err = store.AddAtm(ctx, "T1", "rudaki 65", 38.5737, 68.7738)
+	if err != nil {
+		t.Fatalf("can't add atm: %v", err)
+	}
+	err = store.SetAtmDenominations(ctx, 1, []int64{50, 20})
+	if err != nil {
+		t.Fatalf("can't set denominations: %v", err)
+	}
+	err = store.ReplenishAtm(ctx, 1, []core.Cassette{{Denomination: 50, Notes: 10}, {Denomination: 20, Notes: 10}})
+	if err != nil {
+		t.Fatalf("can't replenish atm: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	go func() {
+		_ = NewHost(store, "972").Serve(listener)
+	}()
+	client, err := Dial(listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("can't dial host: %v", err)
+	}
+	closeHost := func() {
+		if err := client.Close(); err != nil {
+			t.Errorf("can't close client: %v", err)
+		}
+		if err := listener.Close(); err != nil {
+			t.Errorf("can't close listener: %v", err)
+		}
+	}
+	return &simulatedAtm{client: client, terminal: "00000001"}, store, card, closeHost
+}
+
+func checkCassettes(t *testing.T, store core.Store, want []core.Cassette) {
+	t.Helper()
+	cassettes, err := store.AtmCassettes(context.Background(), 1)
+	if err != nil || !reflect.DeepEqual(cassettes, want) {
+		t.Errorf("cassettes not match: %v, want %v: %v", cassettes, want, err)
+	}
+}
+
+func TestHost(t *testing.T) {
+	atm, store, card, closeHost := openHost(t)
+	defer closeHost()
+	pan := card.NumberCard
+
+	response := atm.balanceInquiry(t, pan, "1234")
+	if response.MTI != MTIAuthorizationResponse || response.Fields[FieldResponseCode] != Approved ||
+		response.Fields[FieldAdditionalAmounts] != "0002972C000000000500" {
+		t.Errorf("balance inquiry not match: %v", response)
+	}
+	response = atm.balanceInquiry(t, pan, "4321")
+	if response.Fields[FieldResponseCode] != IncorrectPIN || response.Fields[FieldAdditionalAmounts] != "" {
+		t.Errorf("balance inquiry with wrong PIN not match: %v", response)
+	}
+	response = atm.balanceInquiry(t, "2021600000000099", "1234")
+	if response.Fields[FieldResponseCode] != InvalidCardNumber {
+		t.Errorf("balance inquiry of unknown card not match: %v", response)
+	}
+
+	withdrawal := atm.withdraw(t, pan, "1234", 120)
+	if withdrawal.MTI != MTIFinancialResponse || withdrawal.Fields[FieldResponseCode] != Approved ||
+		withdrawal.Fields[FieldAdditionalAmounts] != "0002972C000000000380" || len(withdrawal.Fields[FieldRRN]) != 12 {
+		t.Errorf("withdrawal not match: %v", withdrawal)
+	}
+	checkCassettes(t, store, []core.Cassette{{Denomination: 50, Notes: 8}, {Denomination: 20, Notes: 9}})
+	request := atm.request(MTIFinancialRequest, "010000", pan, "1234", 60)
+	first := atm.exchange(t, request)
+	repeat := atm.exchange(t, request)
+	if first.Fields[FieldResponseCode] != Approved || !reflect.DeepEqual(repeat, first) {
+		t.Errorf("repeated withdrawal not answered as the first: %v, %v", repeat, first)
+	}
+	checkCassettes(t, store, []core.Cassette{{Denomination: 50, Notes: 8}, {Denomination: 20, Notes: 6}})
+	response = atm.reverse(t, pan, 60, first.Fields[FieldRRN])
+	if response.Fields[FieldResponseCode] != Approved {
+		t.Fatalf("can't reverse repeated withdrawal: %v", response)
+	}
+	codes := []struct {
+		name   string
+		amount int64
+		want   string
+	}{
+		{"insufficient funds", 400, InsufficientFunds},
+		{"not in denominations", 30, InvalidAmount},
+	}
+	for _, code := range codes {
+		response = atm.withdraw(t, pan, "1234", code.amount)
+		if response.Fields[FieldResponseCode] != code.want {
+			t.Errorf("%s: got %v, want %s", code.name, response, code.want)
+		}
+	}
+	response = atm.exchange(t, atm.request(MTIAuthorizationRequest, "010000", pan, "1234", 50))
+	if response.MTI != MTIAuthorizationResponse || response.Fields[FieldResponseCode] != InvalidTransaction {
+		t.Errorf("authorization of withdrawal not match: %v", response)
+	}
+
+	response = atm.reverse(t, pan, 120, "000000000099")
+	if response.MTI != MTIReversalResponse || response.Fields[FieldResponseCode] != OriginalNotFound {
+		t.Errorf("reversal of unknown operation not match: %v", response)
+	}
+	response = atm.reverse(t, pan, 100, withdrawal.Fields[FieldRRN])
+	if response.Fields[FieldResponseCode] != OriginalNotFound {
+		t.Errorf("reversal of other amount not match: %v", response)
+	}
+	other := &simulatedAtm{client: atm.client, terminal: "00000002"}
+	response = other.reverse(t, pan, 120, withdrawal.Fields[FieldRRN])
+	if response.Fields[FieldResponseCode] != OriginalNotFound {
+		t.Errorf("reversal from other terminal not match: %v", response)
+	}
+	for i := 0; i < 2; i++ {
+		response = atm.reverse(t, pan, 120, withdrawal.Fields[FieldRRN])
+		if response.MTI != MTIReversalResponse || response.Fields[FieldResponseCode] != Approved {
+			t.Errorf("reversal %d not match: %v", i, response)
+		}
+	}
+	cards, err := store.GetAllCards(context.Background())
+	if err != nil || len(cards) != 1 || cards[0].Balance != 500 {
+		t.Errorf("card balance not restored: %v, %v", cards, err)
+	}
+	checkCassettes(t, store, []core.Cassette{{Denomination: 50, Notes: 10}, {Denomination: 20, Notes: 10}})
+
+	err = store.SetAtmStatus(context.Background(), 1, core.AtmOffline, "")
+	if err != nil {
+		t.Fatalf("can't set atm status: %v", err)
+	}
+	response = atm.withdraw(t, pan, "1234", 50)
+	if response.Fields[FieldResponseCode] != TransactionNotPermitted {
+		t.Errorf("withdrawal at offline atm not match: %v", response)
+	}
+}
+
+// expiredCardStore returns the cards as past their expiry.
+type expiredCardStore struct {
+	core.Store
+}
+
+func (receiver expiredCardStore) CardByNumber(ctx context.Context, numberCard string) (core.Card, error) {
+	card, err := receiver.Store.CardByNumber(ctx, numberCard)
+	card.ExpiryMonth, card.ExpiryYear = 12, time.Now().Year()-1
+	return card, err
+}
+
+func TestHostExpiredCard(t *testing.T) {
+	atm, store, card, closeHost := openHost(t)
+	defer closeHost()
+
+	host := NewHost(expiredCardStore{store}, "972")
+	for _, request := range []Message{
+		atm.request(MTIAuthorizationRequest, "310000", card.NumberCard, "1234", 0),
+		atm.request(MTIFinancialRequest, "010000", card.NumberCard, "1234", 50),
+	} {
+		response := host.Handle(context.Background(), request)
+		if response.Fields[FieldResponseCode] != ExpiredCard || response.Fields[FieldAdditionalAmounts] != "" {
+			t.Errorf("%s with expired card not match: %v", request.MTI, response)
+		}
+	}
+}
+
+func TestHostPINTriesExceeded(t *testing.T) {
+	atm, _, card, closeHost := openHost(t)
+	defer closeHost()
+
+	want := []string{IncorrectPIN, IncorrectPIN, PINTriesExceeded, RestrictedCard}
+	for i, code := range want {
+		pin := "0000"
+		if i == len(want)-1 {
+			pin = "1234"
+		}
+		response := atm.withdraw(t, card.NumberCard, pin, 50)
+		if response.Fields[FieldResponseCode] != code {
+			t.Errorf("attempt %d: got %v, want %s", i, response, code)
+		}
+	}
+}
+
+func TestHostFormatError(t *testing.T) {
+	host, atm := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- NewHost(core.NewMemoryStore(), "972").ServeConn(context.Background(), host)
+	}()
+
+	frame := []byte("\x00\x120200\x20\x20\x00\x00\x00\x00\x00\x00a10000000001")
+	frame[1] = byte(len(frame) - 2)
+	_, err := atm.Write(frame)
+	if err != nil {
+		t.Fatalf("can't write message: %v", err)
+	}
+	response, err := ReadMessage(atm)
+	if err != nil || response.MTI != MTIFinancialResponse || response.Fields[FieldResponseCode] != FormatError {
+		t.Errorf("response to invalid message not match: %v, %v", response, err)
+	}
+	err = atm.Close()
+	if err != nil {
+		t.Errorf("can't close atm end: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Errorf("host didn't stop on hang up: %v", err)
+	}
+}
+
+func TestHostReadTimeout(t *testing.T) {
+	host, atm := net.Pipe()
+	defer atm.Close()
+	server := NewHost(core.NewMemoryStore(), "972")
+	server.ReadTimeout = 50 * time.Millisecond
+	done := make(chan error)
+	go func() {
+		done <- server.ServeConn(context.Background(), host)
+	}()
+
+	_, err := atm.Write([]byte{0x00})
+	if err != nil {
+		t.Fatalf("can't write message: %v", err)
+	}
+	select {
+	case err = <-done:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("Not timeout error for stalled message: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("host kept waiting for stalled message")
+	}
+}
@@ -0,0 +1,227 @@
+// Package iso8583 connects ATMs speaking ISO 8583 to the core: it packs and
+// unpacks the messages and maps authorization, financial and reversal
+// requests onto balance inquiry, withdrawal and reversal.
+package iso8583
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var ErrInvalidMTI = errors.New("invalid message type indicator")
+var ErrUnknownField = errors.New("unknown field")
+var ErrInvalidField = errors.New("invalid field")
+var ErrShortMessage = errors.New("message too short")
+
+const (
+	MTIAuthorizationRequest  = "0100"
+	MTIAuthorizationResponse = "0110"
+	MTIFinancialRequest      = "0200"
+	MTIFinancialResponse     = "0210"
+	MTIReversalAdvice        = "0420"
+	MTIReversalResponse      = "0430"
+)
+
+// The fields the adapter knows.
+const (
+	FieldPAN                 = 2
+	FieldProcessingCode      = 3
+	FieldAmount              = 4
+	FieldTransmissionTime    = 7
+	FieldSTAN                = 11
+	FieldLocalTime           = 12
+	FieldLocalDate           = 13
+	FieldExpiry              = 14
+	FieldAcquirerId          = 32
+	FieldRRN                 = 37
+	FieldAuthorizationCode   = 38
+	FieldResponseCode        = 39
+	FieldTerminalId          = 41
+	FieldCardAcceptorId      = 42
+	FieldCurrency            = 49
+	FieldPINBlock            = 52
+	FieldAdditionalAmounts   = 54
+	FieldOriginalDataElement = 90
+)
+
+type fieldKind int
+
+const (
+	numeric fieldKind = iota
+	text
+	binaryData
+)
+
+// fieldSpec is the format of a field: fixed length, or up to length with
+// a prefix of prefix ASCII digits holding the actual one.
+type fieldSpec struct {
+	kind   fieldKind
+	length int
+	prefix int
+}
+
+var fieldSpecs = map[int]fieldSpec{
+	FieldPAN:                 {numeric, 19, 2},
+	FieldProcessingCode:      {numeric, 6, 0},
+	FieldAmount:              {numeric, 12, 0},
+	FieldTransmissionTime:    {numeric, 10, 0},
+	FieldSTAN:                {numeric, 6, 0},
+	FieldLocalTime:           {numeric, 6, 0},
+	FieldLocalDate:           {numeric, 4, 0},
+	FieldExpiry:              {numeric, 4, 0},
+	FieldAcquirerId:          {numeric, 11, 2},
+	FieldRRN:                 {text, 12, 0},
+	FieldAuthorizationCode:   {text, 6, 0},
+	FieldResponseCode:        {text, 2, 0},
+	FieldTerminalId:          {text, 8, 0},
+	FieldCardAcceptorId:      {text, 15, 0},
+	FieldCurrency:            {numeric, 3, 0},
+	FieldPINBlock:            {binaryData, 8, 0},
+	FieldAdditionalAmounts:   {text, 120, 3},
+	FieldOriginalDataElement: {numeric, 42, 0},
+}
+
+// Message is an ISO 8583 message. Fields hold the values by field number;
+// binary fields hold their raw bytes.
+type Message struct {
+	MTI    string
+	Fields map[int]string
+}
+
+func NewMessage(mti string) Message {
+	return Message{MTI: mti, Fields: make(map[int]string)}
+}
+
+// Pack encodes the message with an ASCII MTI, a binary bitmap, secondary
+// when a field above 64 is set, and ASCII fields.
+func (receiver Message) Pack() ([]byte, error) {
+	if !validMTI(receiver.MTI) {
+		return nil, ErrInvalidMTI
+	}
+	numbers := make([]int, 0, len(receiver.Fields))
+	for number := range receiver.Fields {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	bitmap := make([]byte, 8)
+	if len(numbers) > 0 && numbers[len(numbers)-1] > 64 {
+		bitmap = make([]byte, 16)
+		bitmap[0] |= 0x80
+	}
+	var data []byte
+	for _, number := range numbers {
+		spec, ok := fieldSpecs[number]
+		if !ok {
+			return nil, fmt.Errorf("field %d: %w", number, ErrUnknownField)
+		}
+		value := receiver.Fields[number]
+		if !spec.valid(value) {
+			return nil, fmt.Errorf("field %d: %w", number, ErrInvalidField)
+		}
+		if spec.prefix > 0 {
+			data = append(data, fmt.Sprintf("%0*d", spec.prefix, len(value))...)
+		}
+		data = append(data, value...)
+		bitmap[(number-1)/8] |= 0x80 >> uint((number-1)%8)
+	}
+
+	packed := append([]byte(receiver.MTI), bitmap...)
+	return append(packed, data...), nil
+}
+
+// Unpack decodes a message packed like Pack does. The MTI of a message with
+// invalid fields is still returned, so that it can be answered.
+func Unpack(data []byte) (Message, error) {
+	if len(data) < 4+8 {
+		return Message{}, ErrShortMessage
+	}
+	message := NewMessage(string(data[:4]))
+	if !validMTI(message.MTI) {
+		return Message{}, ErrInvalidMTI
+	}
+	bitmap := data[4:12]
+	data = data[12:]
+	if bitmap[0]&0x80 != 0 {
+		if len(data) < 8 {
+			return message, ErrShortMessage
+		}
+		bitmap = append(bitmap[:8:8], data[:8]...)
+		data = data[8:]
+	}
+
+	for number := 2; number <= len(bitmap)*8; number++ {
+		if bitmap[(number-1)/8]&(0x80>>uint((number-1)%8)) == 0 {
+			continue
+		}
+		spec, ok := fieldSpecs[number]
+		if !ok {
+			return message, fmt.Errorf("field %d: %w", number, ErrUnknownField)
+		}
+		length := spec.length
+		if spec.prefix > 0 {
+			if len(data) < spec.prefix {
+				return message, ErrShortMessage
+			}
+			var err error
+			length, err = strconv.Atoi(string(data[:spec.prefix]))
+			if err != nil || length > spec.length {
+				return message, fmt.Errorf("field %d: %w", number, ErrInvalidField)
+			}
+			data = data[spec.prefix:]
+		}
+		if len(data) < length {
+			return message, ErrShortMessage
+		}
+		value := string(data[:length])
+		if !spec.valid(value) {
+			return message, fmt.Errorf("field %d: %w", number, ErrInvalidField)
+		}
+		message.Fields[number] = value
+		data = data[length:]
+	}
+	if len(data) > 0 {
+		return message, fmt.Errorf("%d bytes after the last field: %w", len(data), ErrInvalidField)
+	}
+	return message, nil
+}
+
+func (receiver fieldSpec) valid(value string) bool {
+	if receiver.prefix == 0 && len(value) != receiver.length || len(value) > receiver.length {
+		return false
+	}
+	switch receiver.kind {
+	case numeric:
+		return isDigits(value)
+	case text:
+		for _, c := range []byte(value) {
+			if c < 0x20 || c > 0x7e {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validMTI(mti string) bool {
+	return len(mti) == 4 && isDigits(mti)
+}
+
+// ResponseMTI is the MTI answering mti: 0100 is answered by 0110.
+func ResponseMTI(mti string) (string, error) {
+	if !validMTI(mti) || (mti[2]-'0')%2 != 0 {
+		return "", ErrInvalidMTI
+	}
+	return mti[:2] + string(mti[2]+1) + mti[3:], nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package iso8583
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPackUnpack(t *testing.T) {
+	message := NewMessage(MTIReversalAdvice)
+	message.Fields[FieldPAN] = "2021600000000016"
+	message.Fields[FieldProcessingCode] = "010000"
+	message.Fields[FieldAmount] = "000000000120"
+	message.Fields[FieldSTAN] = "000042"
+	message.Fields[FieldRRN] = "000000000007"
+	message.Fields[FieldTerminalId] = "00000001"
+	message.Fields[FieldPINBlock] = "\x04\x12\x25\xee\xee\xee\xee\xee"
+	message.Fields[FieldAdditionalAmounts] = "0002972C000000000500"
+	message.Fields[FieldOriginalDataElement] = "020000004210171200000000000000000000000000"
+
+	data, err := message.Pack()
+	if err != nil {
+		t.Fatalf("can't pack message: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("0420\xf0\x20\x00\x00\x08\x80\x14\x00\x00\x00\x00\x40\x00\x00\x00\x00162021600000000016")) {
+		t.Errorf("packed message not match: %q", data)
+	}
+	unpacked, err := Unpack(data)
+	if err != nil {
+		t.Fatalf("can't unpack message: %v", err)
+	}
+	if !reflect.DeepEqual(unpacked, message) {
+		t.Errorf("unpacked message not match: %v, want %v", unpacked, message)
+	}
+
+	message = NewMessage(MTIAuthorizationRequest)
+	message.Fields[FieldSTAN] = "000001"
+	data, err = message.Pack()
+	if err != nil || len(data) != 4+8+6 {
+		t.Errorf("message without secondary bitmap not match: %q, %v", data, err)
+	}
+}
+
+func TestPackInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		want    error
+	}{
+		{"mti", Message{MTI: "01a0"}, ErrInvalidMTI},
+		{"unknown field", Message{MTI: "0100", Fields: map[int]string{5: "000000000001"}}, ErrUnknownField},
+		{"fixed length", Message{MTI: "0100", Fields: map[int]string{FieldSTAN: "42"}}, ErrInvalidField},
+		{"variable length", Message{MTI: "0100", Fields: map[int]string{FieldPAN: "20216000000000160000"}}, ErrInvalidField},
+		{"numeric", Message{MTI: "0100", Fields: map[int]string{FieldAmount: "00000000012a"}}, ErrInvalidField},
+		{"text", Message{MTI: "0100", Fields: map[int]string{FieldResponseCode: "0\n"}}, ErrInvalidField},
+	}
+	for _, test := range tests {
+		_, err := test.message.Pack()
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestUnpackInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"short", "0100\x00\x20", ErrShortMessage},
+		{"mti", "01a0\x00\x20\x00\x00\x00\x00\x00\x00000001", ErrInvalidMTI},
+		{"unknown field", "0100\x08\x00\x00\x00\x00\x00\x00\x00000000000001", ErrUnknownField},
+		{"short field", "0100\x00\x20\x00\x00\x00\x00\x00\x0000001", ErrShortMessage},
+		{"numeric", "0100\x00\x20\x00\x00\x00\x00\x00\x00a00001", ErrInvalidField},
+		{"length", "0100\x40\x00\x00\x00\x00\x00\x00\x0020", ErrInvalidField},
+		{"trailing", "0100\x00\x20\x00\x00\x00\x00\x00\x00000001x", ErrInvalidField},
+	}
+	for _, test := range tests {
+		message, err := Unpack([]byte(test.data))
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+		if test.want != ErrInvalidMTI && test.want != ErrShortMessage && message.MTI != "0100" {
+			t.Errorf("%s: MTI not returned: %v", test.name, message)
+		}
+	}
+}
+
+func TestResponseMTI(t *testing.T) {
+	tests := []struct {
+		mti  string
+		want string
+	}{
+		{MTIAuthorizationRequest, MTIAuthorizationResponse},
+		{MTIFinancialRequest, MTIFinancialResponse},
+		{MTIReversalAdvice, MTIReversalResponse},
+		{"0421", "0431"},
+		{MTIFinancialResponse, ""},
+		{"abc", ""},
+	}
+	for _, test := range tests {
+		got, err := ResponseMTI(test.mti)
+		if got != test.want || (err != nil) != (test.want == "") {
+			t.Errorf("%s: got %q, %v, want %q", test.mti, got, err, test.want)
+		}
+	}
+}
+
+func TestPINBlock(t *testing.T) {
+	block, err := PINBlock("1234", "4111111111111111")
+	if err != nil || !bytes.Equal(block, []byte{0x04, 0x12, 0x25, 0xee, 0xee, 0xee, 0xee, 0xee}) {
+		t.Errorf("PIN block not match: %x, %v", block, err)
+	}
+	pin, err := pinFromBlock(block, "4111111111111111")
+	if err != nil || pin != "1234" {
+		t.Errorf("PIN not match: %q, %v", pin, err)
+	}
+	pin, err = pinFromBlock(block, "4111111111111129")
+	if !errors.Is(err, ErrInvalidPINBlock) {
+		t.Errorf("Not ErrInvalidPINBlock error for other card: %q, %v", pin, err)
+	}
+	_, err = PINBlock("12a4", "4111111111111111")
+	if !errors.Is(err, ErrInvalidPINBlock) {
+		t.Errorf("Not ErrInvalidPINBlock error: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package iso8583
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidPINBlock = errors.New("invalid PIN block")
+
+// PINBlock returns the ISO 9564 format 0 PIN block of pin for the card pan.
+// The block travels in the clear: encrypting it under the terminal PIN key
+// is left to the link between the ATMs and the host.
+func PINBlock(pin, pan string) ([]byte, error) {
+	if len(pin) < 4 || len(pin) > 12 || !isDigits(pin) || len(pan) < 13 || !isDigits(pan) {
+		return nil, ErrInvalidPINBlock
+	}
+	pinField, err := hex.DecodeString(fmt.Sprintf("0%X%s%s", len(pin), pin, strings.Repeat("F", 14-len(pin))))
+	if err != nil {
+		return nil, ErrInvalidPINBlock
+	}
+	panField := panBlockField(pan)
+	block := make([]byte, 8)
+	for i := range block {
+		block[i] = pinField[i] ^ panField[i]
+	}
+	return block, nil
+}
+
+// pinFromBlock recovers the PIN of a PINBlock.
+func pinFromBlock(block []byte, pan string) (string, error) {
+	if len(block) != 8 || len(pan) < 13 || !isDigits(pan) {
+		return "", ErrInvalidPINBlock
+	}
+	panField := panBlockField(pan)
+	pinField := make([]byte, 8)
+	for i := range pinField {
+		pinField[i] = block[i] ^ panField[i]
+	}
+	digits := strings.ToUpper(hex.EncodeToString(pinField))
+	length := int(pinField[0] & 0x0f)
+	if digits[0] != '0' || length < 4 || length > 12 || !isDigits(digits[2:2+length]) || strings.Trim(digits[2+length:], "F") != "" {
+		return "", ErrInvalidPINBlock
+	}
+	return digits[2 : 2+length], nil
+}
+
+// panBlockField is 0000 followed by the 12 rightmost digits of the PAN
+// without its check digit.
+func panBlockField(pan string) []byte {
+	digits := pan[len(pan)-13 : len(pan)-1]
+	field, _ := hex.DecodeString("0000" + digits)
+	return field
+}